@@ -10,6 +10,8 @@ import (
 
 	"github.com/beeper/babbleserv/internal/config"
 	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/federator"
+	"github.com/beeper/babbleserv/internal/media"
 	"github.com/beeper/babbleserv/internal/notifier"
 	"github.com/beeper/babbleserv/internal/routes"
 	"github.com/beeper/babbleserv/internal/util"
@@ -39,32 +41,40 @@ func NewBabbleserv(cfg config.BabbleConfig) *Babbleserv {
 	// Overwrite default Go HTTP client user agent
 	http.DefaultClient.Transport = &UserAgentTransport{http.DefaultTransport, cfg.UserAgent}
 
-	// Create a global federation client
+	// Create the notifier instance
+	notif := notifier.NewNotifier(cfg, log)
+
+	db := databases.NewDatabases(cfg, log, notif)
+
+	// Create a global federation client, wrapped to fast-fail requests to any
+	// servers we've marked as down.
 	keyID, key := cfg.MustGetActiveSigningKey()
-	fclient := fclient.NewFederationClient([]*fclient.SigningIdentity{{
+	fclient := util.NewBackoffFederationClient(fclient.NewFederationClient([]*fclient.SigningIdentity{{
 		ServerName: spec.ServerName(cfg.ServerName),
 		KeyID:      gomatrixserverlib.KeyID(keyID),
 		PrivateKey: key,
-	}}, fclient.WithUserAgent(cfg.UserAgent), fclient.WithSkipVerify(true))
+	}}, fclient.WithUserAgent(cfg.UserAgent), fclient.WithSkipVerify(true)), db.Rooms)
 
 	// Create a global key store to cache server signing keys
 	keyStore := util.NewKeyStore(fclient)
 
-	// Create the notifier instance
-	notif := notifier.NewNotifier(cfg, log)
+	// Create the federator, shared by routes & workers to ingest federated events
+	fedr := federator.NewFederator(cfg, log, db, fclient, keyStore)
 
-	db := databases.NewDatabases(cfg, log, notif)
+	// Create the media repository, shared by routes & workers to serve local
+	// media and cache remote media
+	mediaRepo := media.NewMediaRepo(cfg, log, db, fclient)
 
 	var rts *routes.Routes
 	if cfg.RoutesEnabled {
-		rts = routes.NewRoutes(cfg, log, db, notif, fclient, keyStore)
+		rts = routes.NewRoutes(cfg, log, db, notif, fclient, keyStore, fedr, mediaRepo)
 	} else {
 		log.Info().Msg("Routes disabled")
 	}
 
 	var wrks *workers.Workers
 	if cfg.WorkersEnabled {
-		wrks = workers.NewWorkers(cfg, log, db, notif, fclient)
+		wrks = workers.NewWorkers(cfg, log, db, notif, fclient, fedr, mediaRepo)
 	} else {
 		log.Info().Msg("Workers disabled")
 	}
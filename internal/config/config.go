@@ -3,6 +3,7 @@ package config
 import (
 	"crypto/ed25519"
 	"os"
+	"runtime"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -24,6 +25,41 @@ type keyConfig struct {
 	ExpiredTimestamp int64  `yaml:"expiredTimestamp"`
 }
 
+// IP ranges outbound requests to user supplied URLs may connect to, addresses
+// in an allowed range are always allowed, otherwise any in a denied range are
+// denied.
+type ipRangesConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// Private, loopback, link-local and other non-public ranges denied by default
+var DefaultDeniedIPRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+type mediaThumbnailSize struct {
+	Width  int    `yaml:"width"`
+	Height int    `yaml:"height"`
+	Method string `yaml:"method"`
+}
+
 type BabbleConfig struct {
 	ServerName string `yaml:"serverName"`
 
@@ -51,8 +87,98 @@ type BabbleConfig struct {
 
 	Federation struct {
 		MaxFetchMissingEvents int `yaml:"maxFetchMissingEvents"`
+
+		// Durably store inbound transaction PDUs in the inbox and acknowledge
+		// them immediately, the federation inbox worker then processes them.
+		AsyncTransactions bool `yaml:"asyncTransactions"`
+		// How long to keep inbound transaction responses to dedupe retries
+		TransactionRetention time.Duration `yaml:"transactionRetention"`
+
+		// Exponential backoff applied per destination server after failed
+		// transactions, once a server has failed DownAfterFailures times in a
+		// row other outbound requests (make_join, keys, etc) fast-fail until
+		// the backoff expires.
+		Backoff struct {
+			Initial           time.Duration `yaml:"initial"`
+			Max               time.Duration `yaml:"max"`
+			DownAfterFailures int           `yaml:"downAfterFailures"`
+		} `yaml:"backoff"`
 	} `yaml:"federation"`
 
+	Push struct {
+		// How long to keep notifications in user notification logs
+		NotificationRetention time.Duration `yaml:"notificationRetention"`
+
+		// Exponential backoff applied per pusher after failed requests to its
+		// push gateway, a notification is dropped once it has failed to send
+		// DropAfterFailures times in a row.
+		Backoff struct {
+			Initial           time.Duration `yaml:"initial"`
+			Max               time.Duration `yaml:"max"`
+			DropAfterFailures int           `yaml:"dropAfterFailures"`
+		} `yaml:"backoff"`
+
+		// IP ranges pusher gateway URLs may resolve to, denies
+		// DefaultDeniedIPRanges unless set.
+		GatewayIPRanges ipRangesConfig `yaml:"gatewayIPRanges"`
+	} `yaml:"push"`
+
+	Media struct {
+		// Maximum size of a single upload in bytes
+		MaxUploadSize int64 `yaml:"maxUploadSize"`
+		// Maximum total size of media each local user may upload in bytes,
+		// unlimited if zero.
+		UserQuota int64 `yaml:"userQuota"`
+		// Media IDs created via /create awaiting upload, per user, and how long
+		// they remain valid for.
+		MaxPendingUploads   int           `yaml:"maxPendingUploads"`
+		PendingUploadExpiry time.Duration `yaml:"pendingUploadExpiry"`
+
+		// Thumbnail sizes generated on request, clients asking for other sizes
+		// receive the closest size at least as large as requested.
+		ThumbnailSizes []mediaThumbnailSize `yaml:"thumbnailSizes"`
+		// Images with more pixels than this are not thumbnailed
+		MaxThumbnailPixels int64 `yaml:"maxThumbnailPixels"`
+		// Thumbnails generated at once, others wait for a slot
+		MaxConcurrentThumbnails int `yaml:"maxConcurrentThumbnails"`
+
+		// Media fetched from other servers is cached in media storage, least
+		// recently used media is removed once the cache is over MaxSize bytes
+		// or when it has not been used for MaxAge.
+		RemoteCache struct {
+			MaxSize int64         `yaml:"maxSize"`
+			MaxAge  time.Duration `yaml:"maxAge"`
+		} `yaml:"remoteCache"`
+		// IP ranges remote media redirect locations may resolve to, denies
+		// DefaultDeniedIPRanges unless set.
+		RemoteLocationIPRanges ipRangesConfig `yaml:"remoteLocationIPRanges"`
+
+		Storage struct {
+			// Either "file" (default) or "s3"
+			Type string `yaml:"type"`
+			Path string `yaml:"path"`
+			S3   struct {
+				Endpoint        string `yaml:"endpoint"`
+				Region          string `yaml:"region"`
+				Bucket          string `yaml:"bucket"`
+				AccessKeyID     string `yaml:"accessKeyID"`
+				SecretAccessKey string `yaml:"secretAccessKey"`
+				PathStyle       bool   `yaml:"pathStyle"`
+			} `yaml:"s3"`
+		} `yaml:"storage"`
+	} `yaml:"media"`
+
+	// Identity servers users may send third party (email, etc) invites via,
+	// mapping the id_server clients provide to its base URL. Third party
+	// invites are rejected if empty.
+	IdentityServers map[string]string `yaml:"identityServers"`
+
+	UserDirectory struct {
+		// Search all local users, otherwise only users who share a room with
+		// the searcher or are in public rooms are returned.
+		SearchAllUsers bool `yaml:"searchAllUsers"`
+	} `yaml:"userDirectory"`
+
 	// For development usage - serve the .well-known client/server endpoints
 	WellKnown struct {
 		Server string `yaml:"server"`
@@ -106,6 +232,75 @@ func NewBabbleConfig(filename string, commitHash string) BabbleConfig {
 		cfg.SigningKeyRefreshInterval = time.Hour
 	}
 
+	if cfg.Federation.TransactionRetention == 0 {
+		cfg.Federation.TransactionRetention = time.Hour * 24
+	}
+	if cfg.Federation.Backoff.Initial == 0 {
+		cfg.Federation.Backoff.Initial = time.Second * 30
+	}
+	if cfg.Federation.Backoff.Max == 0 {
+		cfg.Federation.Backoff.Max = time.Hour * 24
+	}
+	if cfg.Federation.Backoff.DownAfterFailures == 0 {
+		cfg.Federation.Backoff.DownAfterFailures = 3
+	}
+
+	if cfg.Push.NotificationRetention == 0 {
+		cfg.Push.NotificationRetention = time.Hour * 24 * 30
+	}
+	if cfg.Push.Backoff.Initial == 0 {
+		cfg.Push.Backoff.Initial = time.Second * 10
+	}
+	if cfg.Push.Backoff.Max == 0 {
+		cfg.Push.Backoff.Max = time.Hour
+	}
+	if cfg.Push.Backoff.DropAfterFailures == 0 {
+		cfg.Push.Backoff.DropAfterFailures = 10
+	}
+	if cfg.Push.GatewayIPRanges.Deny == nil {
+		cfg.Push.GatewayIPRanges.Deny = DefaultDeniedIPRanges
+	}
+
+	if cfg.Media.MaxUploadSize == 0 {
+		cfg.Media.MaxUploadSize = 50 * 1024 * 1024
+	}
+	if cfg.Media.MaxPendingUploads == 0 {
+		cfg.Media.MaxPendingUploads = 10
+	}
+	if cfg.Media.PendingUploadExpiry == 0 {
+		cfg.Media.PendingUploadExpiry = time.Hour * 24
+	}
+	if len(cfg.Media.ThumbnailSizes) == 0 {
+		cfg.Media.ThumbnailSizes = []mediaThumbnailSize{
+			{32, 32, "crop"},
+			{96, 96, "crop"},
+			{320, 240, "scale"},
+			{640, 480, "scale"},
+			{800, 600, "scale"},
+		}
+	}
+	if cfg.Media.MaxThumbnailPixels == 0 {
+		cfg.Media.MaxThumbnailPixels = 32 * 1000 * 1000
+	}
+	if cfg.Media.MaxConcurrentThumbnails == 0 {
+		cfg.Media.MaxConcurrentThumbnails = runtime.NumCPU()
+	}
+	if cfg.Media.RemoteCache.MaxSize == 0 {
+		cfg.Media.RemoteCache.MaxSize = 10 * 1024 * 1024 * 1024
+	}
+	if cfg.Media.RemoteCache.MaxAge == 0 {
+		cfg.Media.RemoteCache.MaxAge = time.Hour * 24 * 30
+	}
+	if cfg.Media.RemoteLocationIPRanges.Deny == nil {
+		cfg.Media.RemoteLocationIPRanges.Deny = DefaultDeniedIPRanges
+	}
+	if cfg.Media.Storage.Type == "" {
+		cfg.Media.Storage.Type = "file"
+	}
+	if cfg.Media.Storage.Path == "" {
+		cfg.Media.Storage.Path = "media"
+	}
+
 	return cfg
 }
 
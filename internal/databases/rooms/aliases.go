@@ -0,0 +1,149 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Local room aliases (alias) -> room_id, set by local users through the room
+// directory and moved to the replacement room when a room is upgraded.
+//
+
+func (r *RoomsDatabase) KeyForRoomAlias(alias id.RoomAlias) fdb.Key {
+	return r.byAlias.Pack(tuple.Tuple{alias.String()})
+}
+
+// Local room aliases by room (room_id, alias) -> user_id of the creator
+//
+
+func (r *RoomsDatabase) KeyForRoomAliasByRoom(roomID id.RoomID, alias id.RoomAlias) fdb.Key {
+	return r.roomAliases.Pack(tuple.Tuple{roomID.String(), alias.String()})
+}
+
+func (r *RoomsDatabase) RangeForRoomAliases(roomID id.RoomID) fdb.ExactRange {
+	return r.roomAliases.Sub(roomID.String())
+}
+
+// Lookup the room for a local alias, returns an empty room ID if not found
+func (r *RoomsDatabase) LookupRoomAlias(ctx context.Context, alias id.RoomAlias) (id.RoomID, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (id.RoomID, error) {
+		b, err := txn.Get(r.KeyForRoomAlias(alias)).Get()
+		return id.RoomID(b), err
+	})
+}
+
+// Point a local alias at a room, the user must be a local user joined to the
+// room with the power to change its canonical alias.
+func (r *RoomsDatabase) SetRoomAlias(
+	ctx context.Context,
+	alias id.RoomAlias,
+	roomID id.RoomID,
+	userID id.UserID,
+) error {
+	if aliasServerName(alias) != r.config.ServerName || userID.Homeserver() != r.config.ServerName {
+		return types.ErrRoomAliasNotAllowed
+	}
+
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		if txn.Get(r.KeyForRoomAlias(alias)).MustGet() != nil {
+			return nil, types.ErrRoomAliasInUse
+		}
+		if allowed, err := r.txnCanUserChangeRoomAliases(ctx, txn, roomID, userID); err != nil {
+			return nil, err
+		} else if !allowed {
+			return nil, types.ErrRoomAliasNotAllowed
+		}
+		txn.Set(r.KeyForRoomAlias(alias), []byte(roomID))
+		txn.Set(r.KeyForRoomAliasByRoom(roomID, alias), []byte(userID))
+		return nil, nil
+	})
+	return err
+}
+
+// Remove a local alias, allowed for the user who created it or any user with
+// the power to change the canonical alias of the room it points at.
+func (r *RoomsDatabase) DeleteRoomAlias(ctx context.Context, alias id.RoomAlias, userID id.UserID) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		roomID := id.RoomID(txn.Get(r.KeyForRoomAlias(alias)).MustGet())
+		if roomID == "" {
+			return nil, types.ErrRoomAliasNotFound
+		}
+		byRoomKey := r.KeyForRoomAliasByRoom(roomID, alias)
+		if id.UserID(txn.Get(byRoomKey).MustGet()) != userID {
+			if allowed, err := r.txnCanUserChangeRoomAliases(ctx, txn, roomID, userID); err != nil {
+				return nil, err
+			} else if !allowed {
+				return nil, types.ErrRoomAliasNotAllowed
+			}
+		}
+		txn.Clear(r.KeyForRoomAlias(alias))
+		txn.Clear(byRoomKey)
+		return nil, nil
+	})
+	return err
+}
+
+// Point all local aliases of a room at another, used when upgrading rooms.
+func (r *RoomsDatabase) txnMoveRoomAliases(txn fdb.Transaction, roomID, newRoomID id.RoomID) error {
+	kvs, err := txn.GetRange(r.RangeForRoomAliases(roomID), fdb.RangeOptions{
+		Mode: fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		tup, err := r.roomAliases.Unpack(kv.Key)
+		if err != nil {
+			return err
+		}
+		alias := id.RoomAlias(tup[1].(string))
+		txn.Set(r.KeyForRoomAlias(alias), []byte(newRoomID))
+		txn.Set(r.KeyForRoomAliasByRoom(newRoomID, alias), kv.Value)
+		txn.Clear(kv.Key)
+	}
+	return nil
+}
+
+func (r *RoomsDatabase) txnCanUserChangeRoomAliases(
+	ctx context.Context,
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	userID id.UserID,
+) (bool, error) {
+	if inRoom, err := r.users.TxnIsUserInRoom(txn, userID, roomID); err != nil || !inRoom {
+		return false, err
+	}
+
+	powerLevelsEventID, err := r.events.TxnLookupCurrentRoomStateEventID(txn, roomID, event.StatePowerLevels, "")
+	if err != nil {
+		return false, err
+	} else if powerLevelsEventID == "" {
+		// Without power levels any member may send state
+		return true, nil
+	}
+	eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+	eventsProvider.WillGet(powerLevelsEventID)
+	powerLevelsEv, err := eventsProvider.Get(powerLevelsEventID)
+	if err != nil {
+		return false, err
+	}
+	var powerLevels event.PowerLevelsEventContent
+	if err := json.Unmarshal(powerLevelsEv.Content, &powerLevels); err != nil {
+		return false, err
+	}
+	return powerLevels.GetUserLevel(userID) >= powerLevels.GetEventLevel(event.StateCanonicalAlias), nil
+}
+
+func aliasServerName(alias id.RoomAlias) string {
+	_, serverName, _ := strings.Cut(alias.String(), ":")
+	return serverName
+}
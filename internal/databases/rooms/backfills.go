@@ -0,0 +1,373 @@
+package rooms
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Backfills populate data for rooms and users that existed before the code that
+// maintains it was added. Each runs once, in batches, with the progress stored
+// alongside each batch so the backfiller worker can resume after a restart.
+
+const (
+	BackfillRoomStateFields        = "room_state_fields"
+	BackfillUserDirectoryProfiles  = "user_directory_profiles"
+	BackfillUserDirectoryMembers   = "user_directory_members"
+	BackfillProfileUpdates         = "profile_updates"
+	BackfillRoomAliases            = "room_aliases"
+	BackfillNotificationsByVersion = "notifications_by_version"
+)
+
+// State types that set room fields (see updateRoomForStateEvent) added after
+// rooms were first created.
+var backfillRoomStateTypes = []event.Type{
+	event.StateCanonicalAlias,
+	event.StateJoinRules,
+	event.StateHistoryVisibility,
+	event.StateGuestAccess,
+	event.StateEncryption,
+}
+
+type BackfillProgress struct {
+	Cursor string `msgpack:"cur"`
+	Done   bool   `msgpack:"don"`
+}
+
+type txnBackfillBatchFunc func(ctx context.Context, txn fdb.Transaction, cursor string, limit int) (string, error)
+
+func (r *RoomsDatabase) backfillBatchFuncs() map[string]txnBackfillBatchFunc {
+	return map[string]txnBackfillBatchFunc{
+		BackfillRoomStateFields:        r.txnBackfillRoomStateFields,
+		BackfillUserDirectoryProfiles:  r.txnBackfillUserDirectoryProfiles,
+		BackfillUserDirectoryMembers:   r.txnBackfillUserDirectoryMembers,
+		BackfillProfileUpdates:         r.txnBackfillProfileUpdates,
+		BackfillRoomAliases:            r.txnBackfillRoomAliases,
+		BackfillNotificationsByVersion: r.txnBackfillNotificationsByVersion,
+	}
+}
+
+// Names of all backfills, in the order they should be run
+func (r *RoomsDatabase) GetBackfillNames() []string {
+	return []string{
+		BackfillRoomStateFields,
+		BackfillUserDirectoryProfiles,
+		BackfillUserDirectoryMembers,
+		BackfillProfileUpdates,
+		BackfillRoomAliases,
+		BackfillNotificationsByVersion,
+	}
+}
+
+// Backfills (name) -> BackfillProgress msgpack
+//
+
+func (r *RoomsDatabase) KeyForBackfill(name string) fdb.Key {
+	return r.backfills.Pack(tuple.Tuple{name})
+}
+
+func (r *RoomsDatabase) txnLookupBackfillProgress(txn fdb.ReadTransaction, name string) (BackfillProgress, error) {
+	var progress BackfillProgress
+	b := txn.Get(r.KeyForBackfill(name)).MustGet()
+	if b == nil {
+		return progress, nil
+	}
+	err := msgpack.Unmarshal(b, &progress)
+	return progress, err
+}
+
+// Run the next batch of a backfill, returns true once the backfill is complete.
+func (r *RoomsDatabase) RunBackfillBatch(ctx context.Context, name string, limit int) (bool, error) {
+	batchFunc, found := r.backfillBatchFuncs()[name]
+	if !found {
+		return false, fmt.Errorf("unknown backfill: %s", name)
+	}
+
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (bool, error) {
+		progress, err := r.txnLookupBackfillProgress(txn, name)
+		if err != nil {
+			return false, err
+		} else if progress.Done {
+			return true, nil
+		}
+
+		nextCursor, err := batchFunc(ctx, txn, progress.Cursor, limit)
+		if err != nil {
+			return false, err
+		}
+		progress.Cursor = nextCursor
+		progress.Done = nextCursor == ""
+
+		b, err := msgpack.Marshal(progress)
+		if err != nil {
+			return false, err
+		}
+		txn.Set(r.KeyForBackfill(name), b)
+		return progress.Done, nil
+	})
+}
+
+// Range over rooms after (exclusive) a cursor room ID, or all rooms if empty
+func (r *RoomsDatabase) rangeForRoomsAfter(cursor string) fdb.Range {
+	if cursor == "" {
+		return r.byID
+	}
+	_, end := r.byID.FDBRangeKeys()
+	return fdb.KeyRange{
+		Begin: fdb.Key(append(r.KeyForRoom(id.RoomID(cursor)), 0x00)),
+		End:   end,
+	}
+}
+
+// Range over keys after (exclusive) a cursor key, or the whole range if empty
+func rangeForKeysAfter(keyRange fdb.ExactRange, cursor string) fdb.Range {
+	if cursor == "" {
+		return keyRange
+	}
+	_, end := keyRange.FDBRangeKeys()
+	return fdb.KeyRange{
+		Begin: fdb.Key(append([]byte(cursor), 0x00)),
+		End:   end,
+	}
+}
+
+// Set the room fields derived from state that rooms created before those fields
+// existed are missing, ie join rule and history visibility.
+func (r *RoomsDatabase) txnBackfillRoomStateFields(
+	ctx context.Context,
+	txn fdb.Transaction,
+	cursor string,
+	limit int,
+) (string, error) {
+	kvs, err := txn.GetRange(r.rangeForRoomsAfter(cursor), fdb.RangeOptions{
+		Limit: limit,
+		Mode:  fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return "", err
+	} else if len(kvs) == 0 {
+		return "", nil
+	}
+
+	eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+
+	rooms := make([]*types.Room, 0, len(kvs))
+	stateIDs := make([]map[event.Type]id.EventID, 0, len(kvs))
+	for _, kv := range kvs {
+		room := types.MustNewRoomFromBytes(kv.Value)
+		roomStateIDs := make(map[event.Type]id.EventID, len(backfillRoomStateTypes))
+		for _, evType := range backfillRoomStateTypes {
+			eventID, err := r.events.TxnLookupCurrentRoomStateEventID(txn, room.ID, evType, "")
+			if err != nil {
+				return "", err
+			} else if eventID != "" {
+				roomStateIDs[evType] = eventID
+				eventsProvider.WillGet(eventID)
+			}
+		}
+		rooms = append(rooms, room)
+		stateIDs = append(stateIDs, roomStateIDs)
+	}
+
+	for i, room := range rooms {
+		for _, evType := range backfillRoomStateTypes {
+			eventID, found := stateIDs[i][evType]
+			if !found {
+				continue
+			}
+			ev, err := eventsProvider.Get(eventID)
+			if err != nil {
+				return "", err
+			}
+			r.updateRoomForStateEvent(txn, room.ID, room, ev)
+		}
+		txn.Set(r.KeyForRoom(room.ID), room.ToMsgpack())
+	}
+
+	if len(kvs) < limit {
+		return "", nil
+	}
+	return rooms[len(rooms)-1].ID.String(), nil
+}
+
+// Add local users to the user directory from their profiles, users created
+// before the directory existed are otherwise only added when they next change
+// their profile.
+func (r *RoomsDatabase) txnBackfillUserDirectoryProfiles(
+	ctx context.Context,
+	txn fdb.Transaction,
+	cursor string,
+	limit int,
+) (string, error) {
+	kvs, err := txn.GetRange(rangeForKeysAfter(r.users.RangeForAllUserProfiles(), cursor), fdb.RangeOptions{
+		Limit: limit,
+		Mode:  fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return "", err
+	} else if len(kvs) == 0 {
+		return "", nil
+	}
+
+	for _, kv := range kvs {
+		userID := r.users.KeyToUserProfile(kv.Key)
+		profile := types.MustNewUserProfileFromBytes(kv.Value)
+		if err := r.users.TxnUpdateUserDirectoryEntry(txn, userID, profile.DisplayName, profile.AvatarURL); err != nil {
+			return "", err
+		}
+	}
+
+	if len(kvs) < limit {
+		return "", nil
+	}
+	return string(kvs[len(kvs)-1].Key), nil
+}
+
+// Add joined users to the user directory from their current member events,
+// users who joined before the directory existed are otherwise only added when
+// they next join a room.
+func (r *RoomsDatabase) txnBackfillUserDirectoryMembers(
+	ctx context.Context,
+	txn fdb.Transaction,
+	cursor string,
+	limit int,
+) (string, error) {
+	kvs, err := txn.GetRange(rangeForKeysAfter(r.users.RangeForAllUserMemberships(), cursor), fdb.RangeOptions{
+		Limit: limit,
+		Mode:  fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return "", err
+	} else if len(kvs) == 0 {
+		return "", nil
+	}
+
+	eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+
+	eventIDs := make([]id.EventID, 0, len(kvs))
+	for _, kv := range kvs {
+		membershipTup := types.ValueToMembershipTup(kv.Value)
+		if membershipTup.Membership != event.MembershipJoin {
+			continue
+		}
+		eventIDs = append(eventIDs, membershipTup.EventID)
+		eventsProvider.WillGet(membershipTup.EventID)
+	}
+
+	for _, eventID := range eventIDs {
+		ev, err := eventsProvider.Get(eventID)
+		if err != nil {
+			return "", err
+		}
+		r.txnUpdateUserDirectoryForMemberEvent(txn, ev)
+	}
+
+	if len(kvs) < limit {
+		return "", nil
+	}
+	return string(kvs[len(kvs)-1].Key), nil
+}
+
+// Re-store profile update jobs stored before the pending index existed, which
+// indexes incomplete jobs and drops the room lists jobs used to store.
+func (r *RoomsDatabase) txnBackfillProfileUpdates(
+	ctx context.Context,
+	txn fdb.Transaction,
+	cursor string,
+	limit int,
+) (string, error) {
+	kvs, err := txn.GetRange(rangeForKeysAfter(r.profileUpdates, cursor), fdb.RangeOptions{
+		Limit: limit,
+		Mode:  fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return "", err
+	} else if len(kvs) == 0 {
+		return "", nil
+	}
+
+	for _, kv := range kvs {
+		update, err := types.NewProfileUpdateFromBytes(kv.Value)
+		if err != nil {
+			return "", err
+		}
+		r.txnStoreProfileUpdate(txn, update)
+	}
+
+	if len(kvs) < limit {
+		return "", nil
+	}
+	return string(kvs[len(kvs)-1].Key), nil
+}
+
+// Index local aliases by room, aliases set before the index existed otherwise
+// stay pointing at the old room when it is upgraded.
+func (r *RoomsDatabase) txnBackfillRoomAliases(
+	ctx context.Context,
+	txn fdb.Transaction,
+	cursor string,
+	limit int,
+) (string, error) {
+	kvs, err := txn.GetRange(rangeForKeysAfter(r.byAlias, cursor), fdb.RangeOptions{
+		Limit: limit,
+		Mode:  fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return "", err
+	} else if len(kvs) == 0 {
+		return "", nil
+	}
+
+	for _, kv := range kvs {
+		tup, err := r.byAlias.Unpack(kv.Key)
+		if err != nil {
+			return "", err
+		}
+		key := r.KeyForRoomAliasByRoom(id.RoomID(kv.Value), id.RoomAlias(tup[0].(string)))
+		if txn.Get(key).MustGet() == nil {
+			txn.Set(key, []byte{})
+		}
+	}
+
+	if len(kvs) < limit {
+		return "", nil
+	}
+	return string(kvs[len(kvs)-1].Key), nil
+}
+
+// Index user notifications by version, notifications stored before the index
+// existed are otherwise never pruned.
+func (r *RoomsDatabase) txnBackfillNotificationsByVersion(
+	ctx context.Context,
+	txn fdb.Transaction,
+	cursor string,
+	limit int,
+) (string, error) {
+	kvs, err := txn.GetRange(rangeForKeysAfter(r.users.RangeForAllUserNotifications(), cursor), fdb.RangeOptions{
+		Limit: limit,
+		Mode:  fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return "", err
+	} else if len(kvs) == 0 {
+		return "", nil
+	}
+
+	for _, kv := range kvs {
+		userID, version := r.users.KeyToUserNotification(kv.Key)
+		txn.Set(r.users.KeyForNotificationByVersion(version, userID), nil)
+	}
+
+	if len(kvs) < limit {
+		return "", nil
+	}
+	return string(kvs[len(kvs)-1].Key), nil
+}
@@ -78,17 +78,27 @@ func (e *EventsDirectory) KeyForIDToVersion(eventID id.EventID) fdb.Key {
 	return e.idToVersion.Pack(tuple.Tuple{eventID.String()})
 }
 
-// Room version indices
-//
-
-func (e *EventsDirectory) KeyForVersion(version tuple.Versionstamp) fdb.Key {
-	if key, err := e.byVersion.PackWithVersionstamp(tuple.Tuple{version}); err != nil {
+// Pack a key containing a version, keys for incomplete versions are packed with
+// the versionstamp offset for writing while complete versions (existing keys
+// being cleared) are packed as-is.
+func packVersionKey(sub subspace.Subspace, tup tuple.Tuple) fdb.Key {
+	if incomplete, _ := tup.HasIncompleteVersionstamp(); !incomplete {
+		return sub.Pack(tup)
+	}
+	if key, err := sub.PackWithVersionstamp(tup); err != nil {
 		panic(err)
 	} else {
 		return key
 	}
 }
 
+// Room version indices
+//
+
+func (e *EventsDirectory) KeyForVersion(version tuple.Versionstamp) fdb.Key {
+	return packVersionKey(e.byVersion, tuple.Tuple{version})
+}
+
 func (e *EventsDirectory) KeyToVersion(key fdb.Key) tuple.Versionstamp {
 	tup, _ := e.byVersion.Unpack(key)
 	return tup[0].(tuple.Versionstamp)
@@ -100,13 +110,9 @@ func (e *EventsDirectory) RangeForVersion(fromVersion, toVersion tuple.Versionst
 }
 
 func (e *EventsDirectory) KeyForRoomVersion(roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
-	if key, err := e.byRoomVersion.PackWithVersionstamp(tuple.Tuple{
+	return packVersionKey(e.byRoomVersion, tuple.Tuple{
 		roomID.String(), version,
-	}); err != nil {
-		panic(err)
-	} else {
-		return key
-	}
+	})
 }
 
 func (e *EventsDirectory) KeyToRoomVersion(key fdb.Key) tuple.Versionstamp {
@@ -122,13 +128,9 @@ func (e *EventsDirectory) RangeForRoomVersion(
 }
 
 func (e *EventsDirectory) KeyForRoomLocalVersion(roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
-	if key, err := e.byRoomLocalVersion.PackWithVersionstamp(tuple.Tuple{
+	return packVersionKey(e.byRoomLocalVersion, tuple.Tuple{
 		roomID.String(), version,
-	}); err != nil {
-		panic(err)
-	} else {
-		return key
-	}
+	})
 }
 
 func (e *EventsDirectory) KeyToRoomLocalVersion(key fdb.Key) tuple.Versionstamp {
@@ -147,13 +149,9 @@ func (e *EventsDirectory) RangeForRoomLocalVersion(
 //
 
 func (e *EventsDirectory) KeyForRoomStateVersion(roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
-	if key, err := e.byRoomStateVersion.PackWithVersionstamp(tuple.Tuple{
+	return packVersionKey(e.byRoomStateVersion, tuple.Tuple{
 		roomID.String(), version,
-	}); err != nil {
-		panic(err)
-	} else {
-		return key
-	}
+	})
 }
 
 func (e *EventsDirectory) KeyToRoomStateVersion(key fdb.Key) (id.RoomID, tuple.Versionstamp) {
@@ -249,14 +247,25 @@ func (e *EventsDirectory) RangeForRoomVersionStateTup(roomID id.RoomID, evType e
 	}
 }
 
+// Range of every version of a state tuple in a room
+func (e *EventsDirectory) RangeForRoomStateTupVersions(roomID id.RoomID, evType event.Type, stateKey string) fdb.Range {
+	return types.GetVersionRange(
+		e.byRoomVersionStateTup,
+		types.ZeroVersionstamp,
+		types.ZeroVersionstamp,
+		roomID.String(), evType.String(), stateKey,
+	)
+}
+
+func (e *EventsDirectory) KeyToRoomVersionStateTup(key fdb.Key) tuple.Versionstamp {
+	tup, _ := e.byRoomVersionStateTup.Unpack(key)
+	return tup[3].(tuple.Versionstamp)
+}
+
 func (e *EventsDirectory) KeyForRoomVersionStateTup(roomID id.RoomID, evType event.Type, stateKey string, version tuple.Versionstamp) fdb.Key {
-	if key, err := e.byRoomVersionStateTup.PackWithVersionstamp(tuple.Tuple{
+	return packVersionKey(e.byRoomVersionStateTup, tuple.Tuple{
 		roomID.String(), evType.String(), stateKey, version,
-	}); err != nil {
-		panic(err)
-	} else {
-		return key
-	}
+	})
 }
 
 // Room relations/reactions/threads
@@ -204,11 +204,8 @@ func (ap *TxnAuthEventsProvider) IsEventAllowed(ev *types.Event) error {
 		ap.stateMap[types.StateTup{Type: event.StateJoinRules}] = ev.ID
 	case event.StatePowerLevels:
 		ap.stateMap[types.StateTup{Type: event.StatePowerLevels}] = ev.ID
-	case event.StateMember:
-		ap.stateMap[types.StateTup{
-			Type:     event.StateMember,
-			StateKey: *ev.StateKey,
-		}] = ev.ID
+	case event.StateMember, types.StateThirdPartyInvite:
+		ap.stateMap[ev.StateTup()] = ev.ID
 	}
 	return nil
 }
@@ -218,6 +215,19 @@ func (ap *TxnAuthEventsProvider) GetAuthEventIDsForEvent(ev *types.Event) []id.E
 	if ev.Type == event.StateCreate {
 		return nil
 	}
+	var membership event.Membership
+	var authoriser id.UserID
+	var thirdPartyInviteToken string
+	if ev.Type == event.StateMember {
+		membership = ev.Membership()
+		if membership == event.MembershipInvite {
+			thirdPartyInviteToken = ev.ThirdPartyInviteToken()
+		}
+		if ev.MustGetRoomSpec().CheckRestrictedJoinsAllowed() == nil {
+			authoriser = ev.JoinAuthorisedViaUsersServer()
+		}
+	}
+
 	authEventIDs := make([]id.EventID, 0, len(ap.stateMap))
 	for stateTup, eventID := range ap.stateMap {
 		var include bool
@@ -236,8 +246,19 @@ func (ap *TxnAuthEventsProvider) GetAuthEventIDsForEvent(ev *types.Event) []id.E
 				// The target’s current m.room.member event, if any.
 				include = true
 			}
-			// TODO: If membership is invite and content contains a third_party_invite property, the current m.room.third_party_invite event with state_key matching content.third_party_invite.signed.token, if any.
-			// TODO: If content.join_authorised_via_users_server is present, and the room version supports restricted rooms, then the m.room.member event with state_key matching content.join_authorised_via_users_server.
+			// If membership is join, invite or knock, the current m.room.join_rules event, if any.
+			if stateTup.Type == event.StateJoinRules &&
+				(membership == event.MembershipJoin || membership == event.MembershipInvite || membership == event.MembershipKnock) {
+				include = true
+			}
+			// If membership is invite and content contains a third_party_invite property, the current m.room.third_party_invite event with state_key matching content.third_party_invite.signed.token, if any.
+			if thirdPartyInviteToken != "" && stateTup.Type == types.StateThirdPartyInvite && stateTup.StateKey == thirdPartyInviteToken {
+				include = true
+			}
+			// If content.join_authorised_via_users_server is present, and the room version supports restricted rooms, then the m.room.member event with state_key matching content.join_authorised_via_users_server.
+			if authoriser != "" && stateTup.Type == event.StateMember && stateTup.StateKey == authoriser.String() {
+				include = true
+			}
 		}
 		if include {
 			authEventIDs = append(authEventIDs, eventID)
@@ -272,9 +293,16 @@ func (ap *TxnAuthEventsProvider) PowerLevels() (gomatrixserverlib.PDU, error) {
 	return ap.getByType(event.StatePowerLevels)
 }
 
-func (ap *TxnAuthEventsProvider) ThirdPartyInvite(s string) (gomatrixserverlib.PDU, error) {
-	// TODO: implement
-	return nil, nil
+func (ap *TxnAuthEventsProvider) ThirdPartyInvite(token string) (gomatrixserverlib.PDU, error) {
+	eventID, found := ap.stateMap[types.StateTup{
+		Type:     types.StateThirdPartyInvite,
+		StateKey: token,
+	}]
+	if !found {
+		ap.log.Trace().Str("token", token).Msg("Missed third party invite state event")
+		return nil, nil
+	}
+	return ap.get(eventID)
 }
 
 func (ap *TxnAuthEventsProvider) Valid() bool {
@@ -13,7 +13,7 @@ var authStateTypes = []event.Type{
 	event.StateCreate,
 	event.StateJoinRules,
 	event.StatePowerLevels,
-	// Third party?
+	// Third party invites are looked up by token where needed
 }
 
 // Types of state event used for stripped state on invites
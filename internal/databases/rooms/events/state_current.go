@@ -54,17 +54,34 @@ func (e *EventsDirectory) TxnLookupCurrentRoomStateMap(
 		if err != nil {
 			return nil, err
 		}
-		_, evType, _ := e.KeyToRoomCurrentStateTup(kv.Key)
+		_, evType, stateKey := e.KeyToRoomCurrentStateTup(kv.Key)
 		if eventsProvider != nil {
 			eventsProvider.WillGet(id.EventID(kv.Value))
 		}
-		ids[types.StateTup{
-			Type: evType,
-		}] = id.EventID(kv.Value)
+		stateTup := types.StateTup{Type: evType}
+		if stateKey != nil {
+			stateTup.StateKey = *stateKey
+		}
+		ids[stateTup] = id.EventID(kv.Value)
 	}
 	return ids, nil
 }
 
+// Lookup a single current (non member) state event ID, returns an empty event
+// ID if there is no such state.
+func (e *EventsDirectory) TxnLookupCurrentRoomStateEventID(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	evType event.Type,
+	stateKey string,
+) (id.EventID, error) {
+	b, err := txn.Get(e.KeyForRoomCurrentStateTup(roomID, evType, &stateKey)).Get()
+	if err != nil {
+		return "", err
+	}
+	return id.EventID(b), nil
+}
+
 func (e *EventsDirectory) TxnLookupCurrentRoomAuthStateMap(
 	txn fdb.ReadTransaction,
 	roomID id.RoomID,
@@ -177,11 +194,43 @@ func (e *EventsDirectory) TxnLookupCurrentSpecificRoomMemberStateMap(
 	return idToEventID, nil
 }
 
+// Lookup current third party invite event IDs by token and start fetching events
+func (e *EventsDirectory) TxnLookupCurrentSpecificRoomThirdPartyInviteStateMap(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	tokens []string,
+	eventsProvider *TxnEventsProvider,
+) (types.StateMap, error) {
+	tokenToFut := make(map[string]fdb.FutureByteSlice, len(tokens))
+	for _, token := range tokens {
+		tokenToFut[token] = txn.Get(e.KeyForRoomCurrentStateTup(roomID, types.StateThirdPartyInvite, &token))
+	}
+	stateMap := make(types.StateMap, len(tokens))
+
+	for token, fut := range tokenToFut {
+		b, err := fut.Get()
+		if err != nil {
+			return nil, err
+		} else if b == nil {
+			continue
+		}
+		if eventsProvider != nil {
+			eventsProvider.WillGet(id.EventID(b))
+		}
+		stateMap[types.StateTup{
+			Type:     types.StateThirdPartyInvite,
+			StateKey: token,
+		}] = id.EventID(b)
+	}
+	return stateMap, nil
+}
+
 func (e *EventsDirectory) TxnLookupCurrentRoomAuthAndSpecificMemberStateMap(
 	ctx context.Context,
 	txn fdb.ReadTransaction,
 	roomID id.RoomID,
 	userIDs []id.UserID,
+	thirdPartyInviteTokens []string,
 	eventsProvider *TxnEventsProvider,
 ) (types.StateMap, error) {
 	stateMap, err := e.TxnLookupCurrentRoomAuthStateMap(txn, roomID, eventsProvider)
@@ -195,5 +244,14 @@ func (e *EventsDirectory) TxnLookupCurrentRoomAuthAndSpecificMemberStateMap(
 	for k, v := range memberMap {
 		stateMap[k] = v
 	}
+	if len(thirdPartyInviteTokens) > 0 {
+		inviteMap, err := e.TxnLookupCurrentSpecificRoomThirdPartyInviteStateMap(txn, roomID, thirdPartyInviteTokens, eventsProvider)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range inviteMap {
+			stateMap[k] = v
+		}
+	}
 	return stateMap, nil
 }
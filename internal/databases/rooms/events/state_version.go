@@ -191,11 +191,63 @@ func (e *EventsDirectory) TxnLookupSpecificRoomMemberStateMapAtEvent(
 	return stateMap, nil
 }
 
+// Return a future to lookup specific third party invite state at or before an event
+func (e *EventsDirectory) TxnLookupSpecificRoomThirdPartyInviteStateMapAtEvent(
+	ctx context.Context,
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	tokens []string,
+	eventID id.EventID,
+	eventsProvider *TxnEventsProvider,
+) (types.StateMap, error) {
+	version, err := e.TxnLookupVersionForEventID(txn, eventID)
+	if err != nil {
+		return nil, err
+	}
+	version.UserVersion += 1 // FDB range ends are exclusive
+
+	futs := make(map[string]fdb.RangeResult, len(tokens))
+	for _, token := range tokens {
+		futs[token] = txn.GetRange(
+			e.RangeForRoomVersionStateTup(roomID, types.StateThirdPartyInvite, token, version),
+			fdb.RangeOptions{
+				Reverse: true,
+				Limit:   1,
+			},
+		)
+	}
+
+	stateMap := make(types.StateMap, len(tokens))
+	for _, token := range tokens {
+		results, err := futs[token].GetSliceWithError()
+		if err != nil {
+			return nil, err
+		} else if len(results) > 1 {
+			panic("more than one key returned for versioned third party invite state request")
+		} else if results == nil {
+			continue
+		}
+		stateMap[types.StateTup{
+			Type:     types.StateThirdPartyInvite,
+			StateKey: token,
+		}] = id.EventID(results[0].Value)
+	}
+
+	if eventsProvider != nil {
+		for _, evID := range stateMap {
+			eventsProvider.WillGet(evID)
+		}
+	}
+
+	return stateMap, nil
+}
+
 func (e *EventsDirectory) TxnLookupRoomAuthAndSpecificMemberStateMapAtEvent(
 	ctx context.Context,
 	txn fdb.ReadTransaction,
 	roomID id.RoomID,
 	userIDs []id.UserID,
+	thirdPartyInviteTokens []string,
 	eventID id.EventID,
 	eventsProvider *TxnEventsProvider,
 ) (types.StateMap, error) {
@@ -210,5 +262,16 @@ func (e *EventsDirectory) TxnLookupRoomAuthAndSpecificMemberStateMapAtEvent(
 	for k, v := range memberMap {
 		stateMap[k] = v
 	}
+	if len(thirdPartyInviteTokens) > 0 {
+		inviteMap, err := e.TxnLookupSpecificRoomThirdPartyInviteStateMapAtEvent(
+			ctx, txn, roomID, thirdPartyInviteTokens, eventID, eventsProvider,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range inviteMap {
+			stateMap[k] = v
+		}
+	}
 	return stateMap, nil
 }
@@ -3,10 +3,12 @@ package rooms
 import (
 	"context"
 
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 
+	"github.com/beeper/babbleserv/internal/databases/rooms/events"
 	"github.com/beeper/babbleserv/internal/types"
 	"github.com/beeper/babbleserv/internal/util"
 )
@@ -150,6 +152,26 @@ func (r *RoomsDatabase) GetCurrentRoomInviteStateEvents(ctx context.Context, roo
 	})
 }
 
+// Get a single current (non member) state event, returns nil if not found
+func (r *RoomsDatabase) GetCurrentRoomStateEvent(
+	ctx context.Context,
+	roomID id.RoomID,
+	evType event.Type,
+	stateKey string,
+) (*types.Event, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.Event, error) {
+		eventID, err := r.events.TxnLookupCurrentRoomStateEventID(txn, roomID, evType, stateKey)
+		if err != nil {
+			return nil, err
+		} else if eventID == "" {
+			return nil, nil
+		}
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		eventsProvider.WillGet(eventID)
+		return eventsProvider.Get(eventID)
+	})
+}
+
 type roomStateAtEvent struct {
 	StateEvents []*types.Event
 	AuthChain   []*types.Event
@@ -162,12 +184,35 @@ func (r *RoomsDatabase) GetRoomStateWithAuthChainAtEvent(
 	ctx context.Context,
 	roomID id.RoomID,
 	eventID id.EventID,
+) (roomStateAtEvent, error) {
+	return r.getRoomStateWithAuthChain(ctx, func(txn fdb.ReadTransaction, eventsProvider *events.TxnEventsProvider) (types.StateMap, error) {
+		return r.events.TxnLookupRoomStateEventIDsAtEvent(txn, roomID, eventID, eventsProvider)
+	})
+}
+
+// Get room state (state events + their auth chain) before a given event, as
+// resolved from the state at each of its prev events.
+func (r *RoomsDatabase) GetRoomStateWithAuthChainBeforeEvent(
+	ctx context.Context,
+	roomVersion string,
+	ev *types.Event,
+) (roomStateAtEvent, error) {
+	return r.getRoomStateWithAuthChain(ctx, func(txn fdb.ReadTransaction, eventsProvider *events.TxnEventsProvider) (types.StateMap, error) {
+		return r.txnResolveStateBeforeEvent(txn, roomVersion, ev, eventsProvider, func(evID id.EventID) (types.StateMap, error) {
+			return r.events.TxnLookupRoomStateEventIDsAtEvent(txn, ev.RoomID, evID, eventsProvider)
+		})
+	})
+}
+
+func (r *RoomsDatabase) getRoomStateWithAuthChain(
+	ctx context.Context,
+	getStateMap func(fdb.ReadTransaction, *events.TxnEventsProvider) (types.StateMap, error),
 ) (roomStateAtEvent, error) {
 	var res roomStateAtEvent
 
 	if _, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*struct{}, error) {
 		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
-		stateMap, err := r.events.TxnLookupRoomStateEventIDsAtEvent(txn, roomID, eventID, eventsProvider)
+		stateMap, err := getStateMap(txn, eventsProvider)
 		if err != nil {
 			return nil, err
 		}
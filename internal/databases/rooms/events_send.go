@@ -59,6 +59,9 @@ func getUserIDList(evs []*types.PartialEvent) []id.UserID {
 		userIDMap[ev.Sender] = struct{}{}
 		if ev.Type == event.StateMember {
 			userIDMap[id.UserID(*ev.StateKey)] = struct{}{}
+			if authoriser := ev.JoinAuthorisedViaUsersServer(); authoriser != "" {
+				userIDMap[authoriser] = struct{}{}
+			}
 		}
 	}
 	userIDs := make([]id.UserID, 0, len(userIDMap))
@@ -68,6 +71,23 @@ func getUserIDList(evs []*types.PartialEvent) []id.UserID {
 	return userIDs
 }
 
+// Users whose membership the auth check for a single event depends on
+func getEventUserIDs(ev *types.Event) []id.UserID {
+	return getUserIDList([]*types.PartialEvent{&ev.PartialEvent})
+}
+
+func getThirdPartyInviteTokenList(evs []*types.PartialEvent) []string {
+	tokens := make([]string, 0)
+	for _, ev := range evs {
+		if ev.Type == event.StateMember {
+			if token := ev.ThirdPartyInviteToken(); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
 func partialEvents(evs []*types.Event) []*types.PartialEvent {
 	partialEvs := make([]*types.PartialEvent, 0, len(evs))
 	for _, ev := range evs {
@@ -196,6 +216,7 @@ func (r *RoomsDatabase) txnPrepareLocalEvents(
 		txn,
 		roomID,
 		getUserIDList(partialEvs),
+		getThirdPartyInviteTokenList(partialEvs),
 		eventsProvider,
 	)
 
@@ -300,6 +321,9 @@ func (r *RoomsDatabase) txnPrepareLocalEvents(
 type SendFederatedEventsOptions struct {
 	SendLocalEventsOptions
 	SkipPrevStateCheck bool
+	// Set when storing a join made with members omitted, the room is flagged
+	// as partial state after storing the events (the last must be the join).
+	PartialState *PartialStateRoom
 }
 
 // Send federated events to a room after passing through all the required
@@ -322,11 +346,13 @@ func (r *RoomsDatabase) SendFederatedEvents(
 
 	ctx = log.WithContext(ctx)
 	userIDs := getUserIDList(partialEvents(evs))
+	thirdPartyInviteTokens := getThirdPartyInviteTokenList(partialEvents(evs))
 
 	rejectedEvs := make([]RejectedEvent, 0)
 
 	var eventsProvider *events.TxnEventsProvider
 	var roomVersion string
+	var partialState bool
 	var err error
 
 	// First read only transaction - pre-check room can federated, reject dupes
@@ -343,6 +369,7 @@ func (r *RoomsDatabase) SendFederatedEvents(
 				return nil, errors.New("this room is not federated")
 			}
 			roomVersion = room.Version
+			partialState = room.PartialState
 		} else {
 			// If roomBytes is nil we must be creating the room, which means the first input event
 			// *must* be the create event.
@@ -419,23 +446,9 @@ func (r *RoomsDatabase) SendFederatedEvents(
 				continue
 			}
 
-			authEvStateMap := make(types.StateMap)
-			for _, authID := range ev.AuthEventIDs {
-				authEv, err := eventsProvider.Get(authID)
-				if err != nil {
-					return nil, err
-				}
-				if authEv.StateKey == nil {
-					// Should we reject this event if the auth events contain non-state events?
-					// The spec language is "should be the following subset of the room state"
-					// https://spec.matrix.org/v1.11/server-server-api/#auth-events-selection
-					evLog.Warn().Msg("Ignoring non-state auth event")
-					continue
-				}
-				authEvStateMap[types.StateTup{
-					Type:     authEv.Type,
-					StateKey: *authEv.StateKey,
-				}] = authEv.ID
+			authEvStateMap, err := getAuthEventsStateMap(evLog, ev, eventsProvider)
+			if err != nil {
+				return nil, err
 			}
 
 			authEvAuthProvider := events.NewTxnAuthEventsProvider(ctx, eventsProvider, authEvStateMap)
@@ -505,6 +518,7 @@ func (r *RoomsDatabase) SendFederatedEvents(
 				txn,
 				roomID,
 				userIDs,
+				thirdPartyInviteTokens,
 				evID,
 				eventsProvider,
 			)
@@ -518,73 +532,15 @@ func (r *RoomsDatabase) SendFederatedEvents(
 				Str("type", ev.Type.String()).
 				Logger()
 
-			var prevEvStateMap types.StateMap
-
-			if len(ev.PrevEventIDs) == 1 {
-				prevEvStateMap, err = getStateAtEventID(ev.PrevEventIDs[0])
-				if err == types.ErrEventNotFound {
-					rejectedEvs = append(rejectedEvs, RejectedEvent{
-						ev,
-						errors.New("failed to auth event (step 5): prev event not found"),
-					})
-					continue
-				} else if err != nil {
-					return nil, fmt.Errorf("failed to get state at prev event: %w", err)
-				}
-			} else {
-				// We have multiple states to resolve, we need all the state events
-				// (both conflicted + unconflicted).
-				allStateEvents := make([]*types.Event, 0)
-
-				for _, prevID := range ev.PrevEventIDs {
-					prevStateMap, err := getStateAtEventID(prevID)
-					if err == types.ErrEventNotFound {
-						rejectedEvs = append(rejectedEvs, RejectedEvent{
-							ev,
-							fmt.Errorf("failed to auth event (step 5): %w", err),
-						})
-						continue
-					} else if err != nil {
-						return nil, fmt.Errorf("failed to get state at prev event: %w", err)
-					}
-					for _, stateID := range prevStateMap {
-						stateEv := eventsProvider.MustGet(stateID)
-						allStateEvents = append(allStateEvents, stateEv)
-					}
-				}
-
-				// Finally, grab all the auth chains for all the state events we
-				// need to resolve.
-				allAuthEvents, err := r.events.TxnGetAuthChainForEvents(txn, allStateEvents, eventsProvider)
-				if err != nil {
-					return nil, err
-				}
-
-				evMap := util.MergeEventsMap(allStateEvents, allAuthEvents)
-				resolvedPDUs, err := gomatrixserverlib.ResolveConflicts(
-					gomatrixserverlib.RoomVersion(roomVersion),
-					util.EventsToPDUs(allStateEvents),
-					util.EventsToPDUs(allAuthEvents),
-					func(_ spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
-						return senderID.ToUserID(), nil
-					},
-					func(eventID string) bool {
-						return evMap[id.EventID(eventID)].SoftFailed || evMap[id.EventID(eventID)].Outlier
-					},
-				)
-				if err != nil {
-					return nil, err
-				}
-
-				// Turn the resolved state back into our stateMap/memberMap
-				prevEvStateMap = make(types.StateMap, len(resolvedPDUs))
-				for _, pdu := range resolvedPDUs {
-					pduEv := pdu.(types.EventPDU).Event()
-					prevEvStateMap[types.StateTup{
-						Type:     pduEv.Type,
-						StateKey: *pduEv.StateKey,
-					}] = pduEv.ID
-				}
+			prevEvStateMap, err := r.txnResolveStateBeforeEvent(txn, roomVersion, ev, eventsProvider, getStateAtEventID)
+			if err == types.ErrEventNotFound {
+				rejectedEvs = append(rejectedEvs, RejectedEvent{
+					ev,
+					errors.New("failed to auth event (step 5): prev event not found"),
+				})
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to get state before event: %w", err)
 			}
 
 			// Store the state map for the event now, before we finish authorizing
@@ -592,7 +548,17 @@ func (r *RoomsDatabase) SendFederatedEvents(
 			evIDToStateMap[ev.ID] = prevEvStateMap
 
 			prevStateAuthProvider := events.NewTxnAuthEventsProvider(ctx, eventsProvider, prevEvStateMap)
-			if err := prevStateAuthProvider.IsEventAllowed(ev); err != nil {
+			if err := prevStateAuthProvider.IsEventAllowed(ev); err != nil &&
+				partialState && len(prevEvStateMap.MissingMembers(getEventUserIDs(ev))) > 0 {
+				// The state before the event is missing members the auth check
+				// depends on, the event is re-checked once we have the full room
+				// state. Any other failure is rejected as normal.
+				evLog.Warn().Err(err).Msg("Allowing event that failed to auth against partial state (step 5)")
+				if ev.StateKey != nil {
+					evIDToStateMap[ev.ID][ev.StateTup()] = ev.ID
+				}
+				allowedEvs = append(allowedEvs, ev)
+			} else if err != nil {
 				log.Err(err).
 					Any("event", ev).
 					Str("event_id", ev.ID.String()).
@@ -629,12 +595,16 @@ func (r *RoomsDatabase) SendFederatedEvents(
 			txn,
 			roomID,
 			userIDs,
+			thirdPartyInviteTokens,
 			eventsProvider,
 		)
 		if err != nil {
 			return nil, err
 		}
 
+		// Re-read the partial state flag, the resync may have completed since
+		partialState = r.txnIsRoomPartialState(txn, roomID)
+
 		// Use this auth provider throughout as we accept events after step 6
 		currentStateAuthProvider := events.NewTxnAuthEventsProvider(ctx, eventsProvider, currentStateMap)
 
@@ -646,7 +616,11 @@ func (r *RoomsDatabase) SendFederatedEvents(
 				Str("type", ev.Type.String()).
 				Logger()
 
-			if err := currentStateAuthProvider.IsEventAllowed(ev); err != nil {
+			if err := currentStateAuthProvider.IsEventAllowed(ev); err != nil &&
+				partialState && len(currentStateMap.MissingMembers(getEventUserIDs(ev))) > 0 {
+				// As above, this is re-checked once we have the full room state
+				evLog.Warn().Err(err).Msg("Allowing event that failed to auth against partial state (step 6)")
+			} else if err != nil {
 				log.Err(err).
 					Any("event", ev).
 					Str("event_id", ev.ID.String()).
@@ -665,8 +639,16 @@ func (r *RoomsDatabase) SendFederatedEvents(
 			evLog.Debug().Msg("Event authorized for storage")
 		}
 
+		change := r.txnStoreEvents(ctx, txn, roomID, allowedEvs)
+		if options.PartialState != nil && len(allowedEvs) > 0 {
+			change.Servers = append(
+				change.Servers,
+				r.txnMarkRoomPartialState(txn, *options.PartialState, allowedEvs[len(allowedEvs)-1])...,
+			)
+		}
+
 		return newResults(
-			r.txnStoreEvents(ctx, txn, roomID, allowedEvs),
+			change,
 			txn.GetVersionstamp(),
 			allowedEvs,
 			rejectedEvs,
@@ -679,6 +661,9 @@ func (r *RoomsDatabase) SendFederatedEvents(
 	}
 }
 
+// Store a membership event for a room this server is not in, ie invites received
+// over federation or the leave event rejecting one. Leaves clear the outlier
+// membership for the user rather than replacing it.
 func (r *RoomsDatabase) SendFederatedOutlierMembershipEvent(ctx context.Context, ev *types.Event) error {
 	if ev.Type != event.StateMember {
 		panic("outlier event is not a member event")
@@ -690,11 +675,13 @@ func (r *RoomsDatabase) SendFederatedOutlierMembershipEvent(ctx context.Context,
 	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
 		r.txnStoreEvents(ctx, txn, ev.RoomID, []*types.Event{ev})
 
-		// Store user/room -> MembershipTup
-		txn.Set(
-			r.users.KeyForUserOutlierMembership(id.UserID(*ev.StateKey), ev.RoomID),
-			types.ValueForMembershipTup(ev.MembershipTup()),
-		)
+		outlierKey := r.users.KeyForUserOutlierMembership(id.UserID(*ev.StateKey), ev.RoomID)
+		if ev.Membership() == event.MembershipLeave {
+			txn.Clear(outlierKey)
+		} else {
+			// Store user/room -> MembershipTup
+			txn.Set(outlierKey, types.ValueForMembershipTup(ev.MembershipTup()))
+		}
 
 		return nil, nil
 	})
@@ -726,6 +713,103 @@ func (r *RoomsDatabase) txnCheckEventBeforeStore(
 	return nil
 }
 
+// Get the state map of an event's auth events, to authorise the event against
+// its auth events (step 4 of the checks on receipt of a PDU).
+// https://spec.matrix.org/v1.11/server-server-api/#checks-performed-on-receipt-of-a-pdu
+func getAuthEventsStateMap(
+	log zerolog.Logger,
+	ev *types.Event,
+	eventsProvider *events.TxnEventsProvider,
+) (types.StateMap, error) {
+	authEvStateMap := make(types.StateMap, len(ev.AuthEventIDs))
+	for _, authID := range ev.AuthEventIDs {
+		authEv, err := eventsProvider.Get(authID)
+		if err != nil {
+			return nil, err
+		}
+		if authEv.StateKey == nil {
+			// Should we reject this event if the auth events contain non-state events?
+			// The spec language is "should be the following subset of the room state"
+			// https://spec.matrix.org/v1.11/server-server-api/#auth-events-selection
+			log.Warn().Msg("Ignoring non-state auth event")
+			continue
+		}
+		authEvStateMap[types.StateTup{
+			Type:     authEv.Type,
+			StateKey: *authEv.StateKey,
+		}] = authEv.ID
+	}
+	return authEvStateMap, nil
+}
+
+// Get the state before an event from the state at each of its prev events,
+// resolving the states if there is more than one. Returns ErrEventNotFound if
+// any of the prev events are missing.
+func (r *RoomsDatabase) txnResolveStateBeforeEvent(
+	txn fdb.ReadTransaction,
+	roomVersion string,
+	ev *types.Event,
+	eventsProvider *events.TxnEventsProvider,
+	getStateAtEventID func(id.EventID) (types.StateMap, error),
+) (types.StateMap, error) {
+	if len(ev.PrevEventIDs) == 1 {
+		return getStateAtEventID(ev.PrevEventIDs[0])
+	}
+
+	// We have multiple states to resolve, we need all the state events
+	// (both conflicted + unconflicted).
+	allStateEvents := make([]*types.Event, 0)
+	seenStateIDs := make(map[id.EventID]struct{})
+
+	for _, prevID := range ev.PrevEventIDs {
+		prevStateMap, err := getStateAtEventID(prevID)
+		if err != nil {
+			return nil, err
+		}
+		for _, stateID := range prevStateMap {
+			if _, found := seenStateIDs[stateID]; found {
+				continue
+			}
+			seenStateIDs[stateID] = struct{}{}
+			allStateEvents = append(allStateEvents, eventsProvider.MustGet(stateID))
+		}
+	}
+
+	// Finally, grab all the auth chains for all the state events we
+	// need to resolve.
+	allAuthEvents, err := r.events.TxnGetAuthChainForEvents(txn, allStateEvents, eventsProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	evMap := util.MergeEventsMap(allStateEvents, allAuthEvents)
+	resolvedPDUs, err := gomatrixserverlib.ResolveConflicts(
+		gomatrixserverlib.RoomVersion(roomVersion),
+		util.EventsToPDUs(allStateEvents),
+		util.EventsToPDUs(allAuthEvents),
+		func(_ spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return senderID.ToUserID(), nil
+		},
+		func(eventID string) bool {
+			return evMap[id.EventID(eventID)].SoftFailed || evMap[id.EventID(eventID)].Outlier
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Turn the resolved state back into our stateMap/memberMap
+	stateMap := make(types.StateMap, len(resolvedPDUs))
+	for _, pdu := range resolvedPDUs {
+		pduEv := pdu.(types.EventPDU).Event()
+		stateMap[types.StateTup{
+			Type:     pduEv.Type,
+			StateKey: *pduEv.StateKey,
+		}] = pduEv.ID
+	}
+	return stateMap, nil
+}
+
 // Store events handles writing out all the relevant event data into FoundationDB
 // assuming that all events passed in are already authenticated.
 func (r *RoomsDatabase) txnStoreEvents(
@@ -798,6 +882,12 @@ func (r *RoomsDatabase) txnStoreEvents(
 		// Store event_id -> version
 		txn.SetVersionstampedValue(r.events.KeyForIDToVersion(ev.ID), types.ValueForVersionstamp(version))
 
+		if room.PartialState {
+			// Record events stored while the room is partial state, these are
+			// re-checked once the full state has been fetched.
+			txn.SetVersionstampedKey(r.KeyForRoomPartialStateEvent(roomID, version), eventIDBytes)
+		}
+
 		// Room indices
 		// room/version -> event_id, used to sync room events to clients
 		txn.SetVersionstampedKey(r.events.KeyForRoomVersion(ev.RoomID, version), eventIDBytes)
@@ -829,72 +919,8 @@ func (r *RoomsDatabase) txnStoreEvents(
 				// Current (non member) room/type/state_key -> event_id
 				txn.Set(r.events.KeyForRoomCurrentStateTup(ev.RoomID, ev.Type, ev.StateKey), eventIDBytes)
 			} else {
-				// Member event handling involves a bunch more steps, we need to
-				// keep track of which users, and servers, are in the room.
-				memberID := id.UserID(*ev.StateKey)
-				changedUsers[memberID] = struct{}{}
-
-				membershipTupValue := types.ValueForMembershipTup(ev.MembershipTup())
-
-				// Current room/member -> MembershipTup
-				txn.Set(r.events.KeyForCurrentRoomMember(ev.RoomID, memberID), membershipTupValue)
-
-				// Current user/room_id -> MembershipTup
-				txn.Set(r.users.KeyForUserMembership(memberID, ev.RoomID), membershipTupValue)
-
-				// User user/member_changes/version -> MembershipTup
-				txn.Set(r.users.KeyForUserMembershipChange(memberID, version), membershipTupValue)
-
-				// If this event was an outlier membership clear that for the user
-				outlierKey := r.users.KeyForUserOutlierMembership(id.UserID(*ev.StateKey), ev.RoomID)
-				txn.Clear(outlierKey)
-
-				// Handle server room memberships (including local!)
-				username, serverName, _ := memberID.Parse()
-				serverJoinedMemberKey := r.servers.KeyForServerJoinedMember(ev.RoomID, serverName, username)
-
-				if ev.Membership() == event.MembershipJoin {
-					// If we're joining, first check if the server is currently
-					// a member of this room.
-					wasServerJoined := r.servers.TxnMustIsServerInRoom(txn, serverName, ev.RoomID)
-					// Set the joined member key and the server membership
-					txn.Set(serverJoinedMemberKey, []byte{})
-					if !wasServerJoined {
-						changedServers[serverName] = struct{}{}
-						// Current room/server -> MembershipTup
-						txn.Set(r.events.KeyForCurrentRoomServer(ev.RoomID, serverName), membershipTupValue)
-						// Server name/room_id -> MembershipTup
-						txn.Set(r.servers.KeyForServerMembership(serverName, ev.RoomID), membershipTupValue)
-						// Server name/member_changes/version -> MembershipTup
-						txn.Set(r.servers.KeyForServerMembershipChange(serverName, version), membershipTupValue)
-					}
-				} else {
-					txn.Clear(serverJoinedMemberKey)
-					// If leaving, now we've cleared the specific member key
-					// we check if the server has any other joined members.
-					stillJoined := len(txn.GetRange(
-						r.servers.RangeForServerJoinedMembers(ev.RoomID, serverName),
-						fdb.RangeOptions{
-							Limit: 1,
-						},
-					).GetSliceOrPanic()) > 0
-					if !stillJoined {
-						changedServers[serverName] = struct{}{}
-						// Clear current room/server, server membership and set change
-						txn.Clear(r.events.KeyForCurrentRoomServer(ev.RoomID, serverName))
-						txn.Clear(r.servers.KeyForServerMembership(serverName, ev.RoomID))
-						txn.Set(
-							r.servers.KeyForServerMembershipChange(serverName, version),
-							// Note any non-join membership is handled here so we
-							// create a new leave MembershipTup.
-							types.ValueForMembershipTup(types.MembershipTup{
-								EventID:    ev.ID,
-								RoomID:     ev.RoomID,
-								Membership: event.MembershipLeave,
-							}),
-						)
-					}
-				}
+				r.txnUpdateCurrentMembership(txn, ev, version, changedUsers, changedServers)
+				r.txnUpdateUserDirectoryForMemberEvent(txn, ev)
 			}
 		}
 
@@ -960,6 +986,81 @@ func (r *RoomsDatabase) txnStoreEvents(
 	}
 }
 
+// Member event handling involves a bunch more steps, we need to keep track of
+// which users, and servers, are in the room.
+func (r *RoomsDatabase) txnUpdateCurrentMembership(
+	txn fdb.Transaction,
+	ev *types.Event,
+	version tuple.Versionstamp,
+	changedUsers map[id.UserID]struct{},
+	changedServers map[string]struct{},
+) {
+	memberID := id.UserID(*ev.StateKey)
+	changedUsers[memberID] = struct{}{}
+
+	membershipTupValue := types.ValueForMembershipTup(ev.MembershipTup())
+
+	// Current room/member -> MembershipTup
+	txn.Set(r.events.KeyForCurrentRoomMember(ev.RoomID, memberID), membershipTupValue)
+
+	// Current user/room_id -> MembershipTup
+	txn.Set(r.users.KeyForUserMembership(memberID, ev.RoomID), membershipTupValue)
+
+	// User user/member_changes/version -> MembershipTup
+	txn.Set(r.users.KeyForUserMembershipChange(memberID, version), membershipTupValue)
+
+	// If this event was an outlier membership clear that for the user
+	outlierKey := r.users.KeyForUserOutlierMembership(id.UserID(*ev.StateKey), ev.RoomID)
+	txn.Clear(outlierKey)
+
+	// Handle server room memberships (including local!)
+	username, serverName, _ := memberID.Parse()
+	serverJoinedMemberKey := r.servers.KeyForServerJoinedMember(ev.RoomID, serverName, username)
+
+	if ev.Membership() == event.MembershipJoin {
+		// If we're joining, first check if the server is currently
+		// a member of this room.
+		wasServerJoined := r.servers.TxnMustIsServerInRoom(txn, serverName, ev.RoomID)
+		// Set the joined member key and the server membership
+		txn.Set(serverJoinedMemberKey, []byte{})
+		if !wasServerJoined {
+			changedServers[serverName] = struct{}{}
+			// Current room/server -> MembershipTup
+			txn.Set(r.events.KeyForCurrentRoomServer(ev.RoomID, serverName), membershipTupValue)
+			// Server name/room_id -> MembershipTup
+			txn.Set(r.servers.KeyForServerMembership(serverName, ev.RoomID), membershipTupValue)
+			// Server name/member_changes/version -> MembershipTup
+			txn.Set(r.servers.KeyForServerMembershipChange(serverName, version), membershipTupValue)
+		}
+	} else {
+		txn.Clear(serverJoinedMemberKey)
+		// If leaving, now we've cleared the specific member key
+		// we check if the server has any other joined members.
+		stillJoined := len(txn.GetRange(
+			r.servers.RangeForServerJoinedMembers(ev.RoomID, serverName),
+			fdb.RangeOptions{
+				Limit: 1,
+			},
+		).GetSliceOrPanic()) > 0
+		if !stillJoined {
+			changedServers[serverName] = struct{}{}
+			// Clear current room/server, server membership and set change
+			txn.Clear(r.events.KeyForCurrentRoomServer(ev.RoomID, serverName))
+			txn.Clear(r.servers.KeyForServerMembership(serverName, ev.RoomID))
+			txn.Set(
+				r.servers.KeyForServerMembershipChange(serverName, version),
+				// Note any non-join membership is handled here so we
+				// create a new leave MembershipTup.
+				types.ValueForMembershipTup(types.MembershipTup{
+					EventID:    ev.ID,
+					RoomID:     ev.RoomID,
+					Membership: event.MembershipLeave,
+				}),
+			)
+		}
+	}
+}
+
 func (r *RoomsDatabase) updateRoomForStateEvent(
 	txn fdb.Transaction,
 	roomID id.RoomID,
@@ -1010,6 +1111,28 @@ func (r *RoomsDatabase) updateRoomForStateEvent(
 	case event.StateRoomAvatar:
 		room.AvatarURL = gjson.GetBytes(ev.Content, "url").String()
 		changed = true
+	case event.StateCanonicalAlias:
+		alias := gjson.GetBytes(ev.Content, "alias").String()
+		room.CanonicalAlias = alias
+		changed = true
+	case event.StateJoinRules:
+		room.JoinRule = gjson.GetBytes(ev.Content, "join_rule").String()
+		room.AllowedRoomIDs = nil
+		for _, allow := range gjson.GetBytes(ev.Content, "allow").Array() {
+			if allow.Get("type").String() == string(event.JoinRuleAllowRoomMembership) {
+				room.AllowedRoomIDs = append(room.AllowedRoomIDs, id.RoomID(allow.Get("room_id").String()))
+			}
+		}
+		changed = true
+	case event.StateHistoryVisibility:
+		room.HistoryVisibility = gjson.GetBytes(ev.Content, "history_visibility").String()
+		changed = true
+	case event.StateGuestAccess:
+		room.GuestAccess = gjson.GetBytes(ev.Content, "guest_access").String()
+		changed = true
+	case event.StateEncryption:
+		room.Encryption = gjson.GetBytes(ev.Content, "algorithm").String()
+		changed = true
 	case event.StateMember:
 		membership := ev.Membership()
 		wasJoined := r.users.TxnMustIsUserInRoom(txn, id.UserID(*ev.StateKey), roomID)
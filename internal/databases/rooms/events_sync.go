@@ -1,6 +1,7 @@
 package rooms
 
 import (
+	"bytes"
 	"context"
 	"sync"
 	"time"
@@ -27,7 +28,7 @@ func (r *RoomsDatabase) SyncRoomEventsForUser(
 	userID id.UserID,
 	options SyncOptions,
 ) (tuple.Versionstamp, map[types.MembershipTup][]*types.Event, error) {
-	return r.syncRoomEvents(
+	nextVersion, eventsByRoom, err := r.syncRoomEvents(
 		ctx,
 		options,
 		func(txn fdb.ReadTransaction) (types.Memberships, error) {
@@ -36,10 +37,24 @@ func (r *RoomsDatabase) SyncRoomEventsForUser(
 		func(txn fdb.ReadTransaction, fromVersion, toVersion tuple.Versionstamp) (types.MembershipChanges, error) {
 			return r.users.TxnLookupUserMembershipChanges(txn, userID, fromVersion, toVersion)
 		},
+		nil,
 		func(txn fdb.ReadTransaction, roomID id.RoomID, fromVersion, toVersion tuple.Versionstamp, eventsProvider *events.TxnEventsProvider) ([]types.EventIDTupWithVersion, error) {
 			return r.events.TxnPaginateRoomEventIDTups(txn, roomID, fromVersion, toVersion, options.Limit, eventsProvider)
 		},
 	)
+	if err != nil {
+		return nextVersion, nil, err
+	}
+
+	// Drop any timeline events the user may not see, the next version is left
+	// as-is so these are skipped rather than returned in a later batch.
+	checker := r.newUserVisibilityChecker(userID)
+	for membershipTup, evs := range eventsByRoom {
+		if eventsByRoom[membershipTup], err = checker.filterEvents(ctx, evs); err != nil {
+			return nextVersion, nil, err
+		}
+	}
+	return nextVersion, eventsByRoom, nil
 }
 
 func (r *RoomsDatabase) SyncRoomEventsForServer(
@@ -56,6 +71,9 @@ func (r *RoomsDatabase) SyncRoomEventsForServer(
 		func(txn fdb.ReadTransaction, fromVersion, toVersion tuple.Versionstamp) (types.MembershipChanges, error) {
 			return r.servers.TxnLookupServerMembershipChanges(txn, serverName, fromVersion, types.ZeroVersionstamp)
 		},
+		func(txn fdb.ReadTransaction) (map[id.RoomID]tuple.Versionstamp, error) {
+			return r.txnLookupServerPeekedRooms(txn, serverName)
+		},
 		func(txn fdb.ReadTransaction, roomID id.RoomID, fromVersion, toVersion tuple.Versionstamp, eventsProvider *events.TxnEventsProvider) ([]types.EventIDTupWithVersion, error) {
 			return r.events.TxnPaginateLocalRoomEventIDTups(txn, roomID, fromVersion, toVersion, options.Limit, eventsProvider)
 		},
@@ -67,6 +85,8 @@ func (r *RoomsDatabase) syncRoomEvents(
 	options SyncOptions,
 	getCurrentMembershipsFunc func(fdb.ReadTransaction) (types.Memberships, error),
 	getMembershipChanges func(fdb.ReadTransaction, tuple.Versionstamp, tuple.Versionstamp) (types.MembershipChanges, error),
+	// Optional, rooms being peeked (not joined) with the version to get events from
+	getPeekedRoomsFunc func(fdb.ReadTransaction) (map[id.RoomID]tuple.Versionstamp, error),
 	paginateRoomEventIDs func(fdb.ReadTransaction, id.RoomID, tuple.Versionstamp, tuple.Versionstamp, *events.TxnEventsProvider) ([]types.EventIDTupWithVersion, error),
 ) (tuple.Versionstamp, map[types.MembershipTup][]*types.Event, error) {
 	// Bump the from version, FDB ranges are inclusive but we want events *after* the from version
@@ -75,9 +95,16 @@ func (r *RoomsDatabase) syncRoomEvents(
 	// Get current memberships and latest event version in transaction, this means the memberships
 	// are validate at that version and we can thus fetch events up to that version for each room.
 	var latestVersion tuple.Versionstamp
+	var peekedRooms map[id.RoomID]tuple.Versionstamp
 	memberships, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (types.Memberships, error) {
 		latestVersion = r.events.TxnGetLatestEventVersion(txn)
 		latestVersion.UserVersion += 1 // FDB range ends are exclusive
+		if getPeekedRoomsFunc != nil {
+			var err error
+			if peekedRooms, err = getPeekedRoomsFunc(txn); err != nil {
+				return nil, err
+			}
+		}
 		return getCurrentMembershipsFunc(txn)
 	})
 	if err != nil {
@@ -115,6 +142,29 @@ func (r *RoomsDatabase) syncRoomEvents(
 		}
 	}
 
+	// Add any peeked rooms we don't have a membership range for already, only
+	// getting events after the peek started.
+	if len(peekedRooms) > 0 {
+		rangeRoomIDs := make(map[id.RoomID]struct{}, len(membershipsWithRanges))
+		for membershipTup := range membershipsWithRanges {
+			rangeRoomIDs[membershipTup.RoomID] = struct{}{}
+		}
+		for roomID, peekVersion := range peekedRooms {
+			if _, found := rangeRoomIDs[roomID]; found {
+				continue
+			}
+			peekVersion.UserVersion += 1 // we want events *after* the peek version
+			fromVersion := options.From
+			if bytes.Compare(peekVersion.Bytes(), fromVersion.Bytes()) > 0 {
+				fromVersion = peekVersion
+			}
+			membershipsWithRanges[types.MembershipTup{
+				RoomID:     roomID,
+				Membership: membershipPeek,
+			}] = &versionRange{fromVersion, latestVersion}
+		}
+	}
+
 	// Now we're going to fetch up to the limit event ID/version tups in each room
 	type membershipAndEvents struct {
 		membership  types.MembershipTup
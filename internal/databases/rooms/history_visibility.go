@@ -0,0 +1,290 @@
+package rooms
+
+import (
+	"context"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Events checked per read transaction
+const visibilityCheckBatchSize = 100
+
+// Checks event visibility against the history visibility and membership at
+// each event. The history visibility changes of each room are loaded once and
+// cached, as are the membership changes for user checks and the memberships at
+// each state version for server checks, so most events need only their version
+// looked up. Events are immutable so the cache is safe across transactions.
+// https://spec.matrix.org/v1.11/client-server-api/#history-visibility
+type visibilityChecker struct {
+	r      *RoomsDatabase
+	events map[id.EventID]*types.Event
+	// History visibility changes by room, ordered by version
+	visibilityChanges map[id.RoomID][]types.HistoryVisibilityChange
+
+	// Returns whether an event is visible given the history visibility at it
+	isVisible func(
+		txn fdb.ReadTransaction,
+		ev *types.Event,
+		version tuple.Versionstamp,
+		visibility event.HistoryVisibility,
+	) (bool, error)
+}
+
+func (c *visibilityChecker) txnGetEvent(txn fdb.ReadTransaction, eventID id.EventID) (*types.Event, error) {
+	if ev, found := c.events[eventID]; found {
+		return ev, nil
+	}
+	b, err := txn.Get(c.r.events.KeyForEvent(eventID)).Get()
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, types.ErrEventNotFound
+	}
+	ev := types.MustNewEventFromBytes(b, eventID)
+	c.events[eventID] = ev
+	return ev, nil
+}
+
+// Get every version of a state tuple in a room along with the events, ordered
+// by version.
+func (c *visibilityChecker) txnGetStateTupVersions(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	evType event.Type,
+	stateKey string,
+) ([]tuple.Versionstamp, []*types.Event, error) {
+	kvs, err := txn.GetRange(c.r.events.RangeForRoomStateTupVersions(roomID, evType, stateKey), fdb.RangeOptions{
+		Mode: fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return nil, nil, err
+	}
+	versions := make([]tuple.Versionstamp, 0, len(kvs))
+	evs := make([]*types.Event, 0, len(kvs))
+	for _, kv := range kvs {
+		ev, err := c.txnGetEvent(txn, id.EventID(kv.Value))
+		if err != nil {
+			return nil, nil, err
+		}
+		versions = append(versions, c.r.events.KeyToRoomVersionStateTup(kv.Key))
+		evs = append(evs, ev)
+	}
+	return versions, evs, nil
+}
+
+func (c *visibilityChecker) txnGetVisibilityAtVersion(
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	version tuple.Versionstamp,
+) (event.HistoryVisibility, error) {
+	changes, found := c.visibilityChanges[roomID]
+	if !found {
+		versions, evs, err := c.txnGetStateTupVersions(txn, roomID, event.StateHistoryVisibility, "")
+		if err != nil {
+			return "", err
+		}
+		changes = make([]types.HistoryVisibilityChange, 0, len(evs))
+		for i, ev := range evs {
+			changes = append(changes, types.HistoryVisibilityChange{
+				Version:    versions[i],
+				Visibility: event.HistoryVisibility(gjson.GetBytes(ev.Content, "history_visibility").String()),
+			})
+		}
+		c.visibilityChanges[roomID] = changes
+	}
+	return types.HistoryVisibilityAtVersion(changes, version), nil
+}
+
+func (c *visibilityChecker) txnIsEventVisible(txn fdb.ReadTransaction, ev *types.Event) (bool, error) {
+	version, err := c.r.events.TxnLookupVersionForEventID(txn, ev.ID)
+	if err != nil {
+		return false, err
+	}
+	visibility, err := c.txnGetVisibilityAtVersion(txn, ev.RoomID, version)
+	if err != nil {
+		return false, err
+	} else if visibility == event.HistoryVisibilityWorldReadable {
+		return true, nil
+	}
+	return c.isVisible(txn, ev, version, visibility)
+}
+
+func (c *visibilityChecker) isEventVisible(ctx context.Context, ev *types.Event) (bool, error) {
+	return util.DoReadTransaction(ctx, c.r.db, func(txn fdb.ReadTransaction) (bool, error) {
+		return c.txnIsEventVisible(txn, ev)
+	})
+}
+
+func (c *visibilityChecker) filterEvents(ctx context.Context, evs []*types.Event) ([]*types.Event, error) {
+	visibleEvs := make([]*types.Event, 0, len(evs))
+	for start := 0; start < len(evs); start += visibilityCheckBatchSize {
+		batch := evs[start:min(start+visibilityCheckBatchSize, len(evs))]
+		visibleBatch, err := util.DoReadTransaction(ctx, c.r.db, func(txn fdb.ReadTransaction) ([]*types.Event, error) {
+			visibleBatch := make([]*types.Event, 0, len(batch))
+			for _, ev := range batch {
+				if visible, err := c.txnIsEventVisible(txn, ev); err != nil {
+					return nil, err
+				} else if visible {
+					visibleBatch = append(visibleBatch, ev)
+				}
+			}
+			return visibleBatch, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		visibleEvs = append(visibleEvs, visibleBatch...)
+	}
+	return visibleEvs, nil
+}
+
+func getMembership(ev *types.Event) event.Membership {
+	return event.Membership(gjson.GetBytes(ev.Content, "membership").String())
+}
+
+func (r *RoomsDatabase) newUserVisibilityChecker(userID id.UserID) *visibilityChecker {
+	c := &visibilityChecker{
+		r:                 r,
+		events:            make(map[id.EventID]*types.Event),
+		visibilityChanges: make(map[id.RoomID][]types.HistoryVisibilityChange),
+	}
+	// The user's membership changes by room, ordered by version
+	membershipChanges := make(map[id.RoomID]types.MembershipChanges)
+
+	c.isVisible = func(
+		txn fdb.ReadTransaction,
+		ev *types.Event,
+		version tuple.Versionstamp,
+		visibility event.HistoryVisibility,
+	) (bool, error) {
+		// Users can always see their own membership events, including leaves
+		if ev.Type == event.StateMember && ev.StateKey != nil && *ev.StateKey == userID.String() {
+			return true, nil
+		}
+
+		changes, found := membershipChanges[ev.RoomID]
+		if !found {
+			versions, memberEvs, err := c.txnGetStateTupVersions(txn, ev.RoomID, event.StateMember, userID.String())
+			if err != nil {
+				return false, err
+			}
+			changes = make(types.MembershipChanges, 0, len(memberEvs))
+			for i, memberEv := range memberEvs {
+				changes = append(changes, types.MembershipTupWithVersion{
+					MembershipTup: memberEv.MembershipTup(),
+					Version:       versions[i],
+				})
+			}
+			membershipChanges[ev.RoomID] = changes
+		}
+
+		return types.IsEventVisibleToMember(
+			visibility,
+			types.MembershipAtVersion(changes, version),
+			types.JoinedSinceVersion(changes, version),
+		), nil
+	}
+	return c
+}
+
+func (r *RoomsDatabase) newServerVisibilityChecker(serverName string) *visibilityChecker {
+	c := &visibilityChecker{
+		r:                 r,
+		events:            make(map[id.EventID]*types.Event),
+		visibilityChanges: make(map[id.RoomID][]types.HistoryVisibilityChange),
+	}
+	// Whether the server is currently in each room, for shared visibility
+	inRoom := make(map[id.RoomID]bool)
+	// Memberships of the server's users by room state version, events between
+	// state changes share the same state.
+	stateMemberships := make(map[string][]event.Membership)
+
+	c.isVisible = func(
+		txn fdb.ReadTransaction,
+		ev *types.Event,
+		version tuple.Versionstamp,
+		visibility event.HistoryVisibility,
+	) (bool, error) {
+		endVersion := version
+		endVersion.UserVersion += 1 // FDB range ends are exclusive
+		stateKvs, err := txn.GetRange(r.events.RangeForRoomStateVersion(ev.RoomID, endVersion), fdb.RangeOptions{
+			Reverse: true,
+			Limit:   1,
+		}).GetSliceWithError()
+		if err != nil {
+			return false, err
+		}
+		var stateVersion tuple.Versionstamp
+		if len(stateKvs) > 0 {
+			_, stateVersion = r.events.KeyToRoomStateVersion(stateKvs[0].Key)
+		}
+		cacheKey := ev.RoomID.String() + string(stateVersion.Bytes())
+
+		memberships, found := stateMemberships[cacheKey]
+		if !found {
+			stateMap, err := r.events.TxnLookupRoomStateEventIDsAtEvent(txn, ev.RoomID, ev.ID, nil)
+			if err != nil {
+				return false, err
+			}
+			memberships = make([]event.Membership, 0)
+			for stateTup, evID := range stateMap {
+				if stateTup.Type != event.StateMember || !strings.HasSuffix(stateTup.StateKey, ":"+serverName) {
+					continue
+				}
+				memberEv, err := c.txnGetEvent(txn, evID)
+				if err != nil {
+					return false, err
+				}
+				memberships = append(memberships, getMembership(memberEv))
+			}
+			stateMemberships[cacheKey] = memberships
+		}
+
+		serverInRoom, found := inRoom[ev.RoomID]
+		if !found {
+			serverInRoom = r.servers.TxnMustIsServerInRoom(txn, serverName, ev.RoomID)
+			inRoom[ev.RoomID] = serverInRoom
+		}
+
+		if len(memberships) == 0 {
+			memberships = []event.Membership{event.MembershipLeave}
+		}
+		for _, membership := range memberships {
+			if types.IsEventVisibleToMember(visibility, membership, serverInRoom) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return c
+}
+
+// Filter events to those the user may see according to the history visibility
+// and their membership at each event.
+// https://spec.matrix.org/v1.11/client-server-api/#history-visibility
+func (r *RoomsDatabase) FilterEventsForUser(ctx context.Context, userID id.UserID, evs []*types.Event) ([]*types.Event, error) {
+	return r.newUserVisibilityChecker(userID).filterEvents(ctx, evs)
+}
+
+func (r *RoomsDatabase) IsEventVisibleToUser(ctx context.Context, userID id.UserID, ev *types.Event) (bool, error) {
+	return r.newUserVisibilityChecker(userID).isEventVisible(ctx, ev)
+}
+
+// Filter events to those a server may see, where any user from the server
+// was joined (or invited, for invited visibility) at each event.
+// https://spec.matrix.org/v1.11/server-server-api/#restricting-server-access
+func (r *RoomsDatabase) FilterEventsForServer(ctx context.Context, serverName string, evs []*types.Event) ([]*types.Event, error) {
+	return r.newServerVisibilityChecker(serverName).filterEvents(ctx, evs)
+}
+
+func (r *RoomsDatabase) IsEventVisibleToServer(ctx context.Context, serverName string, ev *types.Event) (bool, error) {
+	return r.newServerVisibilityChecker(serverName).isEventVisible(ctx, ev)
+}
@@ -0,0 +1,269 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// The federation inbox durably stores PDUs received over federation so they
+// can be acknowledged immediately and processed, in order per room, by the
+// federation inbox worker.
+
+type InboxEvent struct {
+	Origin  string
+	Event   *types.Event
+	Version tuple.Versionstamp
+	// Number of previous attempts to process this event that failed with an
+	// unexpected error.
+	Attempts int
+}
+
+// Inbox events given up on after too many failed attempts
+type FailedInboxEvent struct {
+	InboxEvent
+	Error string
+}
+
+func packInboxEventValue(origin string, ev *types.Event, attempts int) ([]byte, error) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	return tuple.Tuple{origin, b, int64(attempts)}.Pack(), nil
+}
+
+func unpackInboxEventValue(value []byte) (InboxEvent, error) {
+	tup, err := tuple.Unpack(value)
+	if err != nil {
+		return InboxEvent{}, err
+	}
+	var ev types.Event
+	if err := json.Unmarshal(tup[1].([]byte), &ev); err != nil {
+		return InboxEvent{}, err
+	}
+	inboxEv := InboxEvent{
+		Origin: tup[0].(string),
+		Event:  &ev,
+	}
+	// Events queued before attempts were tracked have no attempts
+	if len(tup) > 2 {
+		inboxEv.Attempts = int(tup[2].(int64))
+	}
+	return inboxEv, nil
+}
+
+// Inbox (room_id, version) -> (origin, event JSON, attempts)
+//
+
+func (r *RoomsDatabase) KeyForRoomInboxEvent(roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
+	if key, err := r.inbox.PackWithVersionstamp(tuple.Tuple{
+		roomID.String(), version,
+	}); err != nil {
+		panic(err)
+	} else {
+		return key
+	}
+}
+
+// Key for an existing inbox event, as opposed to one being queued
+func (r *RoomsDatabase) KeyForExistingRoomInboxEvent(roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
+	return r.inbox.Pack(tuple.Tuple{roomID.String(), version})
+}
+
+func (r *RoomsDatabase) KeyToRoomInboxEvent(key fdb.Key) tuple.Versionstamp {
+	tup, _ := r.inbox.Unpack(key)
+	return tup[1].(tuple.Versionstamp)
+}
+
+func (r *RoomsDatabase) RangeForRoomInbox(roomID id.RoomID) fdb.Range {
+	return types.GetVersionRange(r.inbox, types.ZeroVersionstamp, types.ZeroVersionstamp, roomID.String())
+}
+
+// Inbox rooms (room_id) -> '' (rooms with pending inbox events)
+//
+
+func (r *RoomsDatabase) KeyForInboxRoom(roomID id.RoomID) fdb.Key {
+	return r.inboxRooms.Pack(tuple.Tuple{roomID.String()})
+}
+
+func (r *RoomsDatabase) KeyToInboxRoom(key fdb.Key) id.RoomID {
+	tup, _ := r.inboxRooms.Unpack(key)
+	return id.RoomID(tup[0].(string))
+}
+
+// Failed inbox (room_id, version) -> (origin, event JSON, attempts, error)
+//
+
+func (r *RoomsDatabase) KeyForFailedInboxEvent(roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
+	return r.inboxFailed.Pack(tuple.Tuple{roomID.String(), version})
+}
+
+func (r *RoomsDatabase) QueueInboxEvents(ctx context.Context, origin string, evs []*types.Event) error {
+	if len(evs) == 0 {
+		return nil
+	}
+
+	values := make([][]byte, 0, len(evs))
+	for _, ev := range evs {
+		value, err := packInboxEventValue(origin, ev, 0)
+		if err != nil {
+			return err
+		}
+		values = append(values, value)
+	}
+
+	roomIDs := make([]id.RoomID, 0, 1)
+	seenRoomIDs := make(map[id.RoomID]struct{}, 1)
+
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		for i, ev := range evs {
+			key := r.KeyForRoomInboxEvent(ev.RoomID, tuple.IncompleteVersionstamp(uint16(i)))
+			txn.SetVersionstampedKey(key, values[i])
+
+			if _, found := seenRoomIDs[ev.RoomID]; !found {
+				txn.Set(r.KeyForInboxRoom(ev.RoomID), nil)
+				seenRoomIDs[ev.RoomID] = struct{}{}
+				roomIDs = append(roomIDs, ev.RoomID)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.notifier.SendChange(notifier.Change{RoomIDs: roomIDs})
+	return nil
+}
+
+func (r *RoomsDatabase) GetInboxRoomIDs(ctx context.Context) ([]id.RoomID, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]id.RoomID, error) {
+		iter := txn.GetRange(r.inboxRooms, fdb.RangeOptions{
+			Mode: fdb.StreamingModeWantAll,
+		}).Iterator()
+
+		roomIDs := make([]id.RoomID, 0)
+		for iter.Advance() {
+			kv, err := iter.Get()
+			if err != nil {
+				return nil, err
+			}
+			roomIDs = append(roomIDs, r.KeyToInboxRoom(kv.Key))
+		}
+		return roomIDs, nil
+	})
+}
+
+func (r *RoomsDatabase) IsInboxRoom(ctx context.Context, roomID id.RoomID) (bool, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (bool, error) {
+		value, err := txn.Get(r.KeyForInboxRoom(roomID)).Get()
+		return value != nil, err
+	})
+}
+
+func (r *RoomsDatabase) GetRoomInboxEvents(ctx context.Context, roomID id.RoomID, limit int) ([]InboxEvent, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]InboxEvent, error) {
+		iter := txn.GetRange(r.RangeForRoomInbox(roomID), fdb.RangeOptions{
+			Limit: limit,
+			Mode:  fdb.StreamingModeWantAll,
+		}).Iterator()
+
+		inboxEvs := make([]InboxEvent, 0, limit)
+		for iter.Advance() {
+			kv, err := iter.Get()
+			if err != nil {
+				return nil, err
+			}
+			inboxEv, err := unpackInboxEventValue(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			inboxEv.Version = r.KeyToRoomInboxEvent(kv.Key)
+			inboxEvs = append(inboxEvs, inboxEv)
+		}
+		return inboxEvs, nil
+	})
+}
+
+// Increment the attempts of inbox events that failed to process, leaving them
+// in the inbox to be retried.
+func (r *RoomsDatabase) RetryRoomInboxEvents(
+	ctx context.Context,
+	roomID id.RoomID,
+	inboxEvs []InboxEvent,
+	checkUpdateLock func(fdb.Transaction),
+) error {
+	values := make([][]byte, 0, len(inboxEvs))
+	for _, inboxEv := range inboxEvs {
+		value, err := packInboxEventValue(inboxEv.Origin, inboxEv.Event, inboxEv.Attempts+1)
+		if err != nil {
+			return err
+		}
+		values = append(values, value)
+	}
+
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		// Ensure that our lock is still valid before writing data
+		checkUpdateLock(txn)
+
+		for i, inboxEv := range inboxEvs {
+			txn.Set(r.KeyForExistingRoomInboxEvent(roomID, inboxEv.Version), values[i])
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// Clear processed inbox events up to and including toVersion, recording any
+// failed events given up on, also clearing the room from the inbox rooms set
+// if nothing else is waiting.
+func (r *RoomsDatabase) ClearRoomInboxEvents(
+	ctx context.Context,
+	roomID id.RoomID,
+	toVersion tuple.Versionstamp,
+	failed []FailedInboxEvent,
+	checkUpdateLock func(fdb.Transaction),
+) error {
+	failedValues := make([][]byte, 0, len(failed))
+	for _, failedEv := range failed {
+		b, err := json.Marshal(failedEv.Event)
+		if err != nil {
+			return err
+		}
+		failedValues = append(failedValues, tuple.Tuple{
+			failedEv.Origin, b, int64(failedEv.Attempts), failedEv.Error,
+		}.Pack())
+	}
+
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		// Ensure that our lock is still valid before writing data
+		checkUpdateLock(txn)
+
+		for i, failedEv := range failed {
+			txn.Set(r.KeyForFailedInboxEvent(roomID, failedEv.Version), failedValues[i])
+		}
+
+		txn.ClearRange(fdb.KeyRange{
+			Begin: r.inbox.Pack(tuple.Tuple{roomID.String()}),
+			// Range end is exclusive so append a null byte to include toVersion
+			End: fdb.Key(append(r.inbox.Pack(tuple.Tuple{roomID.String(), toVersion}), 0x00)),
+		})
+
+		// If events were added concurrently this read will conflict and the
+		// transaction retry, so we never drop a room with pending events.
+		remaining := txn.GetRange(r.RangeForRoomInbox(roomID), fdb.RangeOptions{Limit: 1}).GetSliceOrPanic()
+		if len(remaining) == 0 {
+			txn.Clear(r.KeyForInboxRoom(roomID))
+		}
+		return nil, nil
+	})
+	return err
+}
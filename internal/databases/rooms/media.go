@@ -0,0 +1,346 @@
+package rooms
+
+import (
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Media metadata, content is kept in media storage by hash and reference
+// counted here so identical content is only stored once.
+// https://spec.matrix.org/v1.11/client-server-api/#content-repository
+
+func (r *RoomsDatabase) GetMedia(ctx context.Context, serverName, mediaID string) (*types.Media, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.Media, error) {
+		return r.media.TxnLookupMedia(txn, serverName, mediaID)
+	})
+}
+
+// Get the number of media referencing content by hash, zero if the content
+// is not in media storage.
+func (r *RoomsDatabase) GetMediaHashRefs(ctx context.Context, sha256 string) (int64, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (int64, error) {
+		return r.media.TxnLookupMediaHashRefs(txn, sha256)
+	})
+}
+
+func (r *RoomsDatabase) GetUserMediaUsage(ctx context.Context, userID id.UserID) (int64, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (int64, error) {
+		return r.media.TxnLookupUserMediaUsage(txn, userID)
+	})
+}
+
+// Create media without content for a user to upload later, expired pending
+// media are removed before checking the user's pending limit.
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixmediav1create
+func (r *RoomsDatabase) CreatePendingMedia(ctx context.Context, media *types.Media) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		mediaIDs, err := r.media.TxnLookupUserPendingMediaIDs(txn, media.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		var pending int
+		for _, mediaID := range mediaIDs {
+			existing, err := r.media.TxnLookupMedia(txn, media.ServerName, mediaID)
+			if err != nil {
+				return nil, err
+			} else if existing == nil || !existing.IsPending() {
+				r.media.TxnClearUserPendingMedia(txn, media.UserID, mediaID)
+			} else if existing.IsPendingExpired() {
+				r.media.TxnClearUserPendingMedia(txn, media.UserID, mediaID)
+				r.media.TxnClearMedia(txn, media.ServerName, mediaID)
+			} else {
+				pending++
+			}
+		}
+		if pending >= r.config.Media.MaxPendingUploads {
+			return nil, types.ErrMediaTooManyPending
+		}
+
+		r.media.TxnStoreMedia(txn, media)
+		r.media.TxnSetUserPendingMedia(txn, media.UserID, media.MediaID)
+		return nil, nil
+	})
+	return err
+}
+
+// Check content the caller skipped writing to media storage is still there,
+// the last media referencing it may have been removed since the caller checked.
+// Returns types.ErrMediaContentNotStored if not, the caller must write the
+// content and retry.
+func (r *RoomsDatabase) txnCheckMediaContentStored(txn fdb.Transaction, sha256 string, contentStored bool) error {
+	if contentStored {
+		return nil
+	}
+	if refs, err := r.media.TxnLookupMediaHashRefs(txn, sha256); err != nil {
+		return err
+	} else if refs <= 0 {
+		return types.ErrMediaContentNotStored
+	}
+	return nil
+}
+
+// Store metadata for uploaded media whose content is in media storage, either
+// new media or, if completePending is set, pending media created by the same
+// user. Local uploads count towards the uploader's quota. If contentStored is
+// false the content was already stored for other media, see
+// txnCheckMediaContentStored.
+func (r *RoomsDatabase) StoreMedia(ctx context.Context, media *types.Media, completePending, contentStored bool) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		existing, err := r.media.TxnLookupMedia(txn, media.ServerName, media.MediaID)
+		if err != nil {
+			return nil, err
+		} else if err := r.txnCheckMediaContentStored(txn, media.SHA256, contentStored); err != nil {
+			return nil, err
+		} else if completePending {
+			if existing == nil || existing.IsPendingExpired() {
+				return nil, types.ErrMediaNotFound
+			} else if existing.UserID != media.UserID {
+				return nil, types.ErrMediaNotOwner
+			} else if !existing.IsPending() {
+				return nil, types.ErrMediaAlreadyUploaded
+			}
+			media.CreatedTS = existing.CreatedTS
+			media.PendingExpiresTS = 0
+			r.media.TxnClearUserPendingMedia(txn, media.UserID, media.MediaID)
+		} else if existing != nil {
+			return nil, types.ErrMediaAlreadyUploaded
+		}
+
+		if media.UserID != "" {
+			if quota := r.config.Media.UserQuota; quota > 0 {
+				usage, err := r.media.TxnLookupUserMediaUsage(txn, media.UserID)
+				if err != nil {
+					return nil, err
+				} else if usage+media.Size > quota {
+					return nil, types.ErrMediaQuotaExceeded
+				}
+			}
+			r.media.TxnAddUserMediaUsage(txn, media.UserID, media.Size)
+		}
+
+		r.media.TxnStoreMedia(txn, media)
+		r.media.TxnAddMediaHashRefs(txn, media.SHA256, 1)
+		return nil, nil
+	})
+	return err
+}
+
+// Get a thumbnail of media content at exactly the given size and method, or
+// nil if it has not been generated.
+func (r *RoomsDatabase) GetMediaThumbnail(
+	ctx context.Context,
+	sha256 string,
+	width, height int,
+	method string,
+) (*types.MediaThumbnail, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.MediaThumbnail, error) {
+		return r.media.TxnLookupMediaThumbnail(txn, sha256, width, height, method)
+	})
+}
+
+func (r *RoomsDatabase) StoreMediaThumbnail(ctx context.Context, thumbnail *types.MediaThumbnail) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		r.media.TxnStoreMediaThumbnail(txn, thumbnail)
+		return nil, nil
+	})
+	return err
+}
+
+// Time to wait between checks for pending media content to be uploaded
+const pendingMediaPollInterval = time.Millisecond * 500
+
+// Wait for pending media to be uploaded, up to the given timeout. Returns the
+// media as last seen, which is still pending if the timeout was reached.
+func (r *RoomsDatabase) WaitForPendingMedia(
+	ctx context.Context,
+	media *types.Media,
+	timeout time.Duration,
+) (*types.Media, error) {
+	deadline := time.After(timeout)
+	for media.IsPending() && !media.IsPendingExpired() {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			return media, nil
+		case <-time.After(pendingMediaPollInterval):
+		}
+
+		latest, err := r.GetMedia(ctx, media.ServerName, media.MediaID)
+		if err != nil {
+			return nil, err
+		} else if latest == nil {
+			return nil, types.ErrMediaNotFound
+		}
+		media = latest
+	}
+	return media, nil
+}
+
+// Store metadata for media fetched from another server whose content is in
+// media storage, tracking it in the remote media cache. If contentStored is
+// false the content was already stored for other media, see
+// txnCheckMediaContentStored.
+func (r *RoomsDatabase) StoreRemoteMedia(ctx context.Context, media *types.Media, contentStored bool) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		if existing, err := r.media.TxnLookupMedia(txn, media.ServerName, media.MediaID); err != nil {
+			return nil, err
+		} else if existing != nil {
+			return nil, types.ErrMediaAlreadyUploaded
+		} else if err := r.txnCheckMediaContentStored(txn, media.SHA256, contentStored); err != nil {
+			return nil, err
+		}
+
+		media.LastAccessTS = time.Now().UnixMilli()
+		r.media.TxnStoreMedia(txn, media)
+		r.media.TxnAddMediaHashRefs(txn, media.SHA256, 1)
+		txn.Set(r.media.KeyForRemoteMediaAccess(media), []byte{})
+		r.media.TxnAddRemoteMediaCacheSize(txn, media.Size)
+		return nil, nil
+	})
+	return err
+}
+
+// Update the last access time of cached remote media
+func (r *RoomsDatabase) TouchRemoteMedia(ctx context.Context, serverName, mediaID string) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		media, err := r.media.TxnLookupMedia(txn, serverName, mediaID)
+		if err != nil || media == nil || media.LastAccessTS == 0 {
+			return nil, err
+		}
+		txn.Clear(r.media.KeyForRemoteMediaAccess(media))
+		media.LastAccessTS = time.Now().UnixMilli()
+		txn.Set(r.media.KeyForRemoteMediaAccess(media), []byte{})
+		r.media.TxnStoreMedia(txn, media)
+		return nil, nil
+	})
+	return err
+}
+
+// Remove cached remote media, returning the content (and its thumbnails) if no
+// longer referenced by other media.
+func (r *RoomsDatabase) txnEvictRemoteMedia(txn fdb.Transaction, media *types.Media) (*EvictedContent, error) {
+	r.media.TxnClearMedia(txn, media.ServerName, media.MediaID)
+	txn.Clear(r.media.KeyForRemoteMediaAccess(media))
+	r.media.TxnAddRemoteMediaCacheSize(txn, -media.Size)
+
+	refs, err := r.media.TxnLookupMediaHashRefs(txn, media.SHA256)
+	if err != nil {
+		return nil, err
+	} else if refs > 1 {
+		r.media.TxnAddMediaHashRefs(txn, media.SHA256, -1)
+		return nil, nil
+	}
+
+	thumbnails, err := r.media.TxnLookupMediaThumbnails(txn, media.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	r.media.TxnClearMediaHashRefs(txn, media.SHA256)
+	r.media.TxnClearMediaThumbnails(txn, media.SHA256)
+
+	storageKeys := make([]string, 0, len(thumbnails)+1)
+	storageKeys = append(storageKeys, media.StorageKey())
+	for _, thumbnail := range thumbnails {
+		storageKeys = append(storageKeys, thumbnail.StorageKey())
+	}
+	return &EvictedContent{SHA256: media.SHA256, StorageKeys: storageKeys}, nil
+}
+
+// Content no longer referenced to remove from media storage
+type EvictedContent struct {
+	SHA256      string
+	StorageKeys []string
+}
+
+type EvictedMedia struct {
+	Evicted int
+	Content []*EvictedContent
+}
+
+// Evict up to limit cached remote media, least recently accessed first, that
+// is older than maxAge or while the cache is larger than maxSize.
+func (r *RoomsDatabase) ExpireRemoteMedia(
+	ctx context.Context,
+	maxAge time.Duration,
+	maxSize int64,
+	limit int,
+) (*EvictedMedia, error) {
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*EvictedMedia, error) {
+		size, err := r.media.TxnLookupRemoteMediaCacheSize(txn)
+		if err != nil {
+			return nil, err
+		}
+		cutoffTS := time.Now().Add(-maxAge).UnixMilli()
+
+		kvs, err := txn.GetRange(r.media.RangeForRemoteMediaAccess(), fdb.RangeOptions{
+			Limit: limit,
+		}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+
+		res := &EvictedMedia{Content: make([]*EvictedContent, 0)}
+		for _, kv := range kvs {
+			accessTS, serverName, mediaID, err := r.media.KeyToRemoteMediaAccess(kv.Key)
+			if err != nil {
+				return nil, err
+			} else if accessTS >= cutoffTS && size <= maxSize {
+				break
+			}
+
+			media, err := r.media.TxnLookupMedia(txn, serverName, mediaID)
+			if err != nil {
+				return nil, err
+			} else if media == nil {
+				txn.Clear(kv.Key)
+				continue
+			}
+
+			content, err := r.txnEvictRemoteMedia(txn, media)
+			if err != nil {
+				return nil, err
+			} else if content != nil {
+				res.Content = append(res.Content, content)
+			}
+			res.Evicted++
+			size -= media.Size
+		}
+		return res, nil
+	})
+}
+
+// Evict up to limit cached media from a remote server
+func (r *RoomsDatabase) PurgeRemoteServerMedia(ctx context.Context, serverName string, limit int) (*EvictedMedia, error) {
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*EvictedMedia, error) {
+		kvs, err := txn.GetRange(r.media.RangeForServerMedia(serverName), fdb.RangeOptions{
+			Limit: limit,
+		}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+
+		res := &EvictedMedia{Content: make([]*EvictedContent, 0)}
+		for _, kv := range kvs {
+			media, err := types.NewMediaFromBytes(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			content, err := r.txnEvictRemoteMedia(txn, media)
+			if err != nil {
+				return nil, err
+			} else if content != nil {
+				res.Content = append(res.Content, content)
+			}
+			res.Evicted++
+		}
+		return res, nil
+	})
+}
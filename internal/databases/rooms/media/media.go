@@ -0,0 +1,256 @@
+package media
+
+import (
+	"encoding/binary"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+type MediaDirectory struct {
+	log zerolog.Logger
+
+	byID,
+	thumbnails,
+	hashRefs,
+	userUsage,
+	userPending,
+	remoteAccess,
+	remoteCacheSize subspace.Subspace
+}
+
+func NewMediaDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *MediaDirectory {
+	mediaDir, err := parentDir.CreateOrOpen(db, []string{"media"}, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return &MediaDirectory{
+		log: logger.With().Str("directory", "media").Logger(),
+
+		byID:       mediaDir.Sub("id"),
+		thumbnails: mediaDir.Sub("thm"),
+		hashRefs:   mediaDir.Sub("ref"),
+
+		userUsage:   mediaDir.Sub("usg"),
+		userPending: mediaDir.Sub("pnd"),
+
+		remoteAccess:    mediaDir.Sub("rac"),
+		remoteCacheSize: mediaDir.Sub("rcs"),
+	}
+}
+
+func countToValue(count int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(count))
+	return b
+}
+
+func valueToCount(b []byte) int64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+// Media (server_name, media_id) -> msgpack(types.Media)
+//
+
+func (m *MediaDirectory) KeyForMedia(serverName, mediaID string) fdb.Key {
+	return m.byID.Pack(tuple.Tuple{serverName, mediaID})
+}
+
+func (m *MediaDirectory) TxnLookupMedia(txn fdb.ReadTransaction, serverName, mediaID string) (*types.Media, error) {
+	b, err := txn.Get(m.KeyForMedia(serverName, mediaID)).Get()
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, nil
+	}
+	return types.NewMediaFromBytes(b)
+}
+
+func (m *MediaDirectory) RangeForServerMedia(serverName string) fdb.Range {
+	return m.byID.Sub(serverName)
+}
+
+func (m *MediaDirectory) TxnStoreMedia(txn fdb.Transaction, media *types.Media) {
+	txn.Set(m.KeyForMedia(media.ServerName, media.MediaID), media.ToMsgpack())
+}
+
+func (m *MediaDirectory) TxnClearMedia(txn fdb.Transaction, serverName, mediaID string) {
+	txn.Clear(m.KeyForMedia(serverName, mediaID))
+}
+
+// Media thumbnails (sha256, width, height, method) -> msgpack(types.MediaThumbnail)
+//
+
+func (m *MediaDirectory) KeyForMediaThumbnail(sha256 string, width, height int, method string) fdb.Key {
+	return m.thumbnails.Pack(tuple.Tuple{sha256, width, height, method})
+}
+
+func (m *MediaDirectory) TxnLookupMediaThumbnail(
+	txn fdb.ReadTransaction,
+	sha256 string,
+	width, height int,
+	method string,
+) (*types.MediaThumbnail, error) {
+	b, err := txn.Get(m.KeyForMediaThumbnail(sha256, width, height, method)).Get()
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, nil
+	}
+	return types.NewMediaThumbnailFromBytes(b)
+}
+
+func (m *MediaDirectory) TxnLookupMediaThumbnails(txn fdb.ReadTransaction, sha256 string) ([]*types.MediaThumbnail, error) {
+	kvs, err := txn.GetRange(m.thumbnails.Sub(sha256), fdb.RangeOptions{
+		Mode: fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+	thumbnails := make([]*types.MediaThumbnail, 0, len(kvs))
+	for _, kv := range kvs {
+		thumbnail, err := types.NewMediaThumbnailFromBytes(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		thumbnails = append(thumbnails, thumbnail)
+	}
+	return thumbnails, nil
+}
+
+func (m *MediaDirectory) TxnStoreMediaThumbnail(txn fdb.Transaction, thumbnail *types.MediaThumbnail) {
+	txn.Set(
+		m.KeyForMediaThumbnail(thumbnail.SHA256, thumbnail.Width, thumbnail.Height, thumbnail.Method),
+		thumbnail.ToMsgpack(),
+	)
+}
+
+func (m *MediaDirectory) TxnClearMediaThumbnails(txn fdb.Transaction, sha256 string) {
+	txn.ClearRange(m.thumbnails.Sub(sha256))
+}
+
+// Content hash references (sha256) -> int64 (little endian, atomic)
+//
+// Counts the media referencing each stored file, content can be removed from
+// storage once nothing references it.
+
+func (m *MediaDirectory) KeyForMediaHashRefs(sha256 string) fdb.Key {
+	return m.hashRefs.Pack(tuple.Tuple{sha256})
+}
+
+func (m *MediaDirectory) TxnLookupMediaHashRefs(txn fdb.ReadTransaction, sha256 string) (int64, error) {
+	b, err := txn.Get(m.KeyForMediaHashRefs(sha256)).Get()
+	if err != nil {
+		return 0, err
+	}
+	return valueToCount(b), nil
+}
+
+func (m *MediaDirectory) TxnAddMediaHashRefs(txn fdb.Transaction, sha256 string, count int64) {
+	txn.Add(m.KeyForMediaHashRefs(sha256), countToValue(count))
+}
+
+func (m *MediaDirectory) TxnClearMediaHashRefs(txn fdb.Transaction, sha256 string) {
+	txn.Clear(m.KeyForMediaHashRefs(sha256))
+}
+
+// User media usage (user_id) -> int64 bytes (little endian, atomic)
+//
+
+func (m *MediaDirectory) KeyForUserMediaUsage(userID id.UserID) fdb.Key {
+	return m.userUsage.Pack(tuple.Tuple{userID.String()})
+}
+
+func (m *MediaDirectory) TxnLookupUserMediaUsage(txn fdb.ReadTransaction, userID id.UserID) (int64, error) {
+	b, err := txn.Get(m.KeyForUserMediaUsage(userID)).Get()
+	if err != nil {
+		return 0, err
+	}
+	return valueToCount(b), nil
+}
+
+func (m *MediaDirectory) TxnAddUserMediaUsage(txn fdb.Transaction, userID id.UserID, size int64) {
+	txn.Add(m.KeyForUserMediaUsage(userID), countToValue(size))
+}
+
+// User pending uploads (user_id, media_id) -> ''
+//
+
+func (m *MediaDirectory) KeyForUserPendingMedia(userID id.UserID, mediaID string) fdb.Key {
+	return m.userPending.Pack(tuple.Tuple{userID.String(), mediaID})
+}
+
+func (m *MediaDirectory) TxnLookupUserPendingMediaIDs(txn fdb.ReadTransaction, userID id.UserID) ([]string, error) {
+	kvs, err := txn.GetRange(m.userPending.Sub(userID.String()), fdb.RangeOptions{
+		Mode: fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+	mediaIDs := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		tup, err := m.userPending.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		mediaIDs = append(mediaIDs, tup[1].(string))
+	}
+	return mediaIDs, nil
+}
+
+func (m *MediaDirectory) TxnSetUserPendingMedia(txn fdb.Transaction, userID id.UserID, mediaID string) {
+	txn.Set(m.KeyForUserPendingMedia(userID, mediaID), []byte{})
+}
+
+func (m *MediaDirectory) TxnClearUserPendingMedia(txn fdb.Transaction, userID id.UserID, mediaID string) {
+	txn.Clear(m.KeyForUserPendingMedia(userID, mediaID))
+}
+
+// Remote media access (last_access_ts, server_name, media_id) -> ''
+//
+// Orders cached remote media by last access for LRU expiry.
+
+func (m *MediaDirectory) KeyForRemoteMediaAccess(media *types.Media) fdb.Key {
+	return m.remoteAccess.Pack(tuple.Tuple{media.LastAccessTS, media.ServerName, media.MediaID})
+}
+
+func (m *MediaDirectory) RangeForRemoteMediaAccess() fdb.Range {
+	return m.remoteAccess
+}
+
+func (m *MediaDirectory) KeyToRemoteMediaAccess(key fdb.Key) (int64, string, string, error) {
+	tup, err := m.remoteAccess.Unpack(key)
+	if err != nil {
+		return 0, "", "", err
+	}
+	return tup[0].(int64), tup[1].(string), tup[2].(string), nil
+}
+
+// Remote media cache size () -> int64 bytes (little endian, atomic)
+//
+
+func (m *MediaDirectory) KeyForRemoteMediaCacheSize() fdb.Key {
+	return m.remoteCacheSize.Pack(tuple.Tuple{})
+}
+
+func (m *MediaDirectory) TxnLookupRemoteMediaCacheSize(txn fdb.ReadTransaction) (int64, error) {
+	b, err := txn.Get(m.KeyForRemoteMediaCacheSize()).Get()
+	if err != nil {
+		return 0, err
+	}
+	return valueToCount(b), nil
+}
+
+func (m *MediaDirectory) TxnAddRemoteMediaCacheSize(txn fdb.Transaction, size int64) {
+	txn.Add(m.KeyForRemoteMediaCacheSize(), countToValue(size))
+}
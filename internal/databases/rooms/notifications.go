@@ -0,0 +1,97 @@
+package rooms
+
+import (
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Maximum number of log entries scanned for a single page of notifications, so
+// highlight only requests over mostly non-highlight logs stay within the
+// transaction time limit.
+const maxNotificationsScan = 1000
+
+type NotificationResult struct {
+	Notification *types.UserNotification
+	Event        *types.Event
+}
+
+// Get a user's notifications, most recent first, starting before the given
+// version (or the latest if zero). Returns the version to continue from, or
+// the zero version if there are no more notifications.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3notifications
+func (r *RoomsDatabase) GetUserNotifications(
+	ctx context.Context,
+	userID id.UserID,
+	beforeVersion tuple.Versionstamp,
+	limit int,
+	onlyHighlight bool,
+) ([]NotificationResult, tuple.Versionstamp, error) {
+	type result struct {
+		results     []NotificationResult
+		nextVersion tuple.Versionstamp
+	}
+	res, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*result, error) {
+		iter := txn.GetRange(
+			r.users.RangeForUserNotifications(userID, types.ZeroVersionstamp, beforeVersion),
+			fdb.RangeOptions{Limit: maxNotificationsScan, Reverse: true},
+		).Iterator()
+
+		page := types.NewNotificationsPage(limit, maxNotificationsScan, onlyHighlight)
+		for iter.Advance() {
+			kv, err := iter.Get()
+			if err != nil {
+				return nil, err
+			}
+			notification, err := r.users.KeyValueToUserNotification(kv)
+			if err != nil {
+				return nil, err
+			} else if !page.Add(notification) {
+				break
+			}
+		}
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		for _, notification := range page.Notifications {
+			eventsProvider.WillGet(notification.EventID)
+		}
+		res := &result{
+			results:     make([]NotificationResult, 0, len(page.Notifications)),
+			nextVersion: page.NextVersion,
+		}
+		for _, notification := range page.Notifications {
+			ev, err := eventsProvider.Get(notification.EventID)
+			if err != nil {
+				return nil, err
+			}
+			res.results = append(res.results, NotificationResult{
+				Notification: notification,
+				Event:        ev,
+			})
+		}
+		return res, nil
+	})
+	if err != nil {
+		return nil, types.ZeroVersionstamp, err
+	}
+	return res.results, res.nextVersion, nil
+}
+
+// Prune notifications stored before the given time from user notification
+// logs, up to limit. Returns the number of notifications pruned.
+func (r *RoomsDatabase) PruneUserNotifications(ctx context.Context, before time.Time, limit int) (int, error) {
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (int, error) {
+		version, err := util.TxnLookupVersionForTime(txn, before, false)
+		if err != nil || version == types.ZeroVersionstamp {
+			return 0, err
+		}
+		version.UserVersion += 1 // FDB range ends are exclusive
+		return r.users.TxnPruneUserNotifications(txn, version, limit)
+	})
+}
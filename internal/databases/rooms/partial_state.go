@@ -0,0 +1,560 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms/events"
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Partial state rooms are those we joined over federation with members omitted
+// (MSC3706 "faster joins"), we have the non-member state and members needed to
+// auth it but not the full member list. Users can read and send in these rooms
+// immediately while the partial state resync worker fetches the full state.
+// Events stored in the meantime are recorded so they can be re-checked against
+// the full state once it's been fetched.
+
+var ErrPartialStateEventsPending = errors.New("new events were stored against partial state")
+
+type PartialStateRoom struct {
+	RoomID      id.RoomID  `msgpack:"rid"`
+	JoinEventID id.EventID `msgpack:"jev"`
+	// Servers in the room at the time of the join, used to fetch the full
+	// state and to send events to until we know the full member list.
+	Servers []string `msgpack:"srv"`
+}
+
+// Partial state rooms (room_id) -> PartialStateRoom msgpack
+//
+
+func (r *RoomsDatabase) KeyForPartialStateRoom(roomID id.RoomID) fdb.Key {
+	return r.partialStateRooms.Pack(tuple.Tuple{roomID.String()})
+}
+
+// Partial state events (room_id, version) -> event_id
+//
+
+func (r *RoomsDatabase) KeyForRoomPartialStateEvent(roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
+	tup := tuple.Tuple{roomID.String(), version}
+	if incomplete, _ := tup.HasIncompleteVersionstamp(); !incomplete {
+		return r.partialStateEvents.Pack(tup)
+	}
+	if key, err := r.partialStateEvents.PackWithVersionstamp(tup); err != nil {
+		panic(err)
+	} else {
+		return key
+	}
+}
+
+func (r *RoomsDatabase) KeyToRoomPartialStateEvent(key fdb.Key) tuple.Versionstamp {
+	tup, _ := r.partialStateEvents.Unpack(key)
+	return tup[1].(tuple.Versionstamp)
+}
+
+// Range of partial state events for a room after (exclusive) afterVersion, or
+// all of them if afterVersion is zero.
+func (r *RoomsDatabase) RangeForRoomPartialStateEventsAfter(roomID id.RoomID, afterVersion tuple.Versionstamp) fdb.Range {
+	if afterVersion == types.ZeroVersionstamp {
+		return types.GetVersionRange(r.partialStateEvents, types.ZeroVersionstamp, types.ZeroVersionstamp, roomID.String())
+	}
+	return fdb.KeyRange{
+		Begin: fdb.Key(append(r.partialStateEvents.Pack(tuple.Tuple{roomID.String(), afterVersion}), 0x00)),
+		End:   fdb.Key(append(r.partialStateEvents.Pack(tuple.Tuple{roomID.String()}), 0xff)),
+	}
+}
+
+func (r *RoomsDatabase) txnIsRoomPartialState(txn fdb.ReadTransaction, roomID id.RoomID) bool {
+	roomBytes := txn.Get(r.KeyForRoom(roomID)).MustGet()
+	if roomBytes == nil {
+		return false
+	}
+	return types.MustNewRoomFromBytes(roomBytes).PartialState
+}
+
+// Flag a room as partial state after storing the join events, we also mark the
+// servers from the join response as in the room so the federation sender sends
+// our events to them until the full member list is known.
+func (r *RoomsDatabase) txnMarkRoomPartialState(
+	txn fdb.Transaction,
+	partialStateRoom PartialStateRoom,
+	joinEv *types.Event,
+) []string {
+	roomKey := r.KeyForRoom(partialStateRoom.RoomID)
+	room := types.MustNewRoomFromBytes(txn.Get(roomKey).MustGet())
+	room.PartialState = true
+	txn.Set(roomKey, room.ToMsgpack())
+
+	b, err := msgpack.Marshal(partialStateRoom)
+	if err != nil {
+		panic(err)
+	}
+	txn.Set(r.KeyForPartialStateRoom(partialStateRoom.RoomID), b)
+
+	membershipTupValue := types.ValueForMembershipTup(joinEv.MembershipTup())
+	addedServers := make([]string, 0, len(partialStateRoom.Servers))
+	for _, serverName := range partialStateRoom.Servers {
+		if serverName == r.config.ServerName ||
+			r.servers.TxnMustIsServerInRoom(txn, serverName, partialStateRoom.RoomID) {
+			continue
+		}
+		txn.Set(r.events.KeyForCurrentRoomServer(partialStateRoom.RoomID, serverName), membershipTupValue)
+		txn.Set(r.servers.KeyForServerMembership(serverName, partialStateRoom.RoomID), membershipTupValue)
+		addedServers = append(addedServers, serverName)
+	}
+	return addedServers
+}
+
+func (r *RoomsDatabase) GetPartialStateRooms(ctx context.Context) ([]PartialStateRoom, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]PartialStateRoom, error) {
+		iter := txn.GetRange(r.partialStateRooms, fdb.RangeOptions{
+			Mode: fdb.StreamingModeWantAll,
+		}).Iterator()
+
+		partialStateRooms := make([]PartialStateRoom, 0)
+		for iter.Advance() {
+			kv, err := iter.Get()
+			if err != nil {
+				return nil, err
+			}
+			var partialStateRoom PartialStateRoom
+			if err := msgpack.Unmarshal(kv.Value, &partialStateRoom); err != nil {
+				return nil, err
+			}
+			partialStateRooms = append(partialStateRooms, partialStateRoom)
+		}
+		return partialStateRooms, nil
+	})
+}
+
+// Store member events from the full room state fetched for a partial state room,
+// only members we don't already have current state for are stored (anything
+// else we've received since the join is newer). Returns the user -> event ID
+// for each member stored. Like outliers these are not added to the timeline or
+// room extremities, we have them for state only. Each event must pass auth
+// against its auth events, which are looked up in authEvs (the auth chain from
+// the state response) or the database, those that don't are skipped.
+func (r *RoomsDatabase) StorePartialStateRoomMembers(
+	ctx context.Context,
+	roomID id.RoomID,
+	evs []*types.Event,
+	authEvs []*types.Event,
+) (map[id.UserID]id.EventID, error) {
+	log := r.getTxnLogContext(ctx, "StorePartialStateRoomMembers").
+		Str("room_id", roomID.String()).
+		Int("events", len(evs)).
+		Logger()
+
+	ctx = log.WithContext(ctx)
+	storedMembers := make(map[id.UserID]id.EventID, len(evs))
+
+	res, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*SendEventsResult, error) {
+		clear(storedMembers)
+
+		currentMemberFuts := make([]fdb.FutureByteSlice, 0, len(evs))
+		for _, ev := range evs {
+			currentMemberFuts = append(currentMemberFuts, txn.Get(
+				r.events.KeyForCurrentRoomMember(roomID, id.UserID(*ev.StateKey)),
+			))
+		}
+
+		roomKey := r.KeyForRoom(roomID)
+		room := types.MustNewRoomFromBytes(txn.Get(roomKey).MustGet())
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn).WithEvents(authEvs...)
+		changedUsers := make(map[id.UserID]struct{}, len(evs))
+		changedServers := make(map[string]struct{}, 0)
+		storedEvs := make([]*types.Event, 0, len(evs))
+
+		for i, ev := range evs {
+			if ev.Type != event.StateMember || ev.RoomID != roomID {
+				panic("partial state room member event is not a member of this room")
+			} else if currentMemberFuts[i].MustGet() != nil {
+				continue
+			}
+
+			// Same check as PDUs against their auth events, a resident server
+			// could otherwise inject any membership.
+			evLog := log.With().Str("event_id", ev.ID.String()).Logger()
+			authEvStateMap, err := getAuthEventsStateMap(evLog, ev, eventsProvider)
+			if errors.Is(err, types.ErrEventNotFound) {
+				evLog.Warn().Msg("Skipping partial state member event with missing auth events")
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			authProvider := events.NewTxnAuthEventsProvider(ctx, eventsProvider, authEvStateMap)
+			if err := authProvider.IsEventAllowed(ev); err != nil {
+				evLog.Warn().Err(err).Msg("Skipping partial state member event that fails auth")
+				continue
+			}
+
+			version := tuple.IncompleteVersionstamp(uint16(i))
+			txn.Set(r.events.KeyForEvent(ev.ID), ev.ToMsgpack())
+			txn.SetVersionstampedKey(
+				r.events.KeyForVersion(version),
+				types.ValueForEventIDTup(ev.EventIDTup()),
+			)
+			txn.SetVersionstampedValue(r.events.KeyForIDToVersion(ev.ID), types.ValueForVersionstamp(version))
+			txn.SetVersionstampedKey(
+				r.events.KeyForRoomStateVersion(roomID, version),
+				types.ValueForStateTupWithID(ev.StateTupWithID()),
+			)
+			txn.SetVersionstampedKey(
+				r.events.KeyForRoomVersionStateTup(roomID, ev.Type, *ev.StateKey, version),
+				[]byte(ev.ID),
+			)
+			r.updateRoomForStateEvent(txn, roomID, room, ev)
+			r.txnUpdateCurrentMembership(txn, ev, version, changedUsers, changedServers)
+
+			storedMembers[id.UserID(*ev.StateKey)] = ev.ID
+			storedEvs = append(storedEvs, ev)
+		}
+
+		if len(storedEvs) == 0 {
+			return newResults(notifier.Change{}, txn.GetVersionstamp(), nil, nil), nil
+		}
+
+		txn.Set(roomKey, room.ToMsgpack())
+
+		changedUserIDs := make([]id.UserID, 0, len(changedUsers))
+		for userID := range changedUsers {
+			changedUserIDs = append(changedUserIDs, userID)
+		}
+		changedServerNames := make([]string, 0, len(changedServers))
+		for serverName := range changedServers {
+			changedServerNames = append(changedServerNames, serverName)
+		}
+		return newResults(
+			notifier.Change{
+				RoomIDs:  []id.RoomID{roomID},
+				UserIDs:  changedUserIDs,
+				Servers:  changedServerNames,
+				EventIDs: []id.EventID{storedEvs[len(storedEvs)-1].ID},
+			},
+			txn.GetVersionstamp(),
+			storedEvs,
+			nil,
+		), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.handleSendEventsResults(res, log)
+	return storedMembers, nil
+}
+
+// Re-check events stored while the room was partial state, in order, against
+// the state before each event with any members missing from it filled in from
+// the full state. Returns the events that fail auth and the version of the last
+// event checked to continue after, a zero version means there were no events.
+// Checking stops at the first state event that fails so it can be rolled back
+// before the events after it are checked.
+func (r *RoomsDatabase) RecheckPartialStateEvents(
+	ctx context.Context,
+	roomID id.RoomID,
+	afterVersion tuple.Versionstamp,
+	members map[id.UserID]id.EventID,
+	limit int,
+) ([]RejectedEvent, tuple.Versionstamp, error) {
+	type recheckResult struct {
+		rejected    []RejectedEvent
+		lastVersion tuple.Versionstamp
+	}
+
+	res, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*recheckResult, error) {
+		kvs, err := txn.GetRange(r.RangeForRoomPartialStateEventsAfter(roomID, afterVersion), fdb.RangeOptions{
+			Limit: limit,
+			Mode:  fdb.StreamingModeWantAll,
+		}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+
+		room := types.MustNewRoomFromBytes(txn.Get(r.KeyForRoom(roomID)).MustGet())
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		for _, kv := range kvs {
+			eventsProvider.WillGet(id.EventID(kv.Value))
+		}
+
+		res := &recheckResult{rejected: make([]RejectedEvent, 0)}
+		for _, kv := range kvs {
+			res.lastVersion = r.KeyToRoomPartialStateEvent(kv.Key)
+
+			ev, err := eventsProvider.Get(id.EventID(kv.Value))
+			if err != nil {
+				return nil, err
+			} else if ev.SoftFailed {
+				// Already soft failed against the current state at the time, this
+				// is not in the timeline or state so there's nothing to undo.
+				continue
+			}
+
+			partialEvs := []*types.PartialEvent{&ev.PartialEvent}
+			userIDs := getUserIDList(partialEvs)
+			thirdPartyInviteTokens := getThirdPartyInviteTokenList(partialEvs)
+
+			stateMap, err := r.txnResolveStateBeforeEvent(txn, room.Version, ev, eventsProvider,
+				func(evID id.EventID) (types.StateMap, error) {
+					return r.events.TxnLookupRoomAuthAndSpecificMemberStateMapAtEvent(
+						ctx,
+						txn,
+						roomID,
+						userIDs,
+						thirdPartyInviteTokens,
+						evID,
+						eventsProvider,
+					)
+				},
+			)
+			if err != nil {
+				return nil, err
+			}
+			for _, userID := range stateMap.MissingMembers(userIDs) {
+				if memberEventID, found := members[userID]; found {
+					stateMap[types.StateTup{Type: event.StateMember, StateKey: userID.String()}] = memberEventID
+					eventsProvider.WillGet(memberEventID)
+				}
+			}
+
+			authProvider := events.NewTxnAuthEventsProvider(ctx, eventsProvider, stateMap)
+			if err := authProvider.IsEventAllowed(ev); err != nil {
+				res.rejected = append(res.rejected, RejectedEvent{ev, err})
+				if ev.StateKey != nil {
+					break
+				}
+			}
+		}
+		return res, nil
+	})
+	if err != nil {
+		return nil, types.ZeroVersionstamp, err
+	}
+	return res.rejected, res.lastVersion, nil
+}
+
+// Roll back events stored against partial state that failed the re-check. The
+// events are soft failed, removing them from the room timeline, and any state
+// events are removed from the room state with the current state for each
+// restored to the previous event. Returns any users whose membership was
+// cleared because the rejected event was their first, the caller should store
+// their member event from the full state.
+func (r *RoomsDatabase) RollbackPartialStateEvents(
+	ctx context.Context,
+	roomID id.RoomID,
+	evs []*types.Event,
+) ([]id.UserID, error) {
+	type rollbackResult struct {
+		clearedMembers []id.UserID
+		change         notifier.Change
+	}
+
+	res, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*rollbackResult, error) {
+		roomKey := r.KeyForRoom(roomID)
+		room := types.MustNewRoomFromBytes(txn.Get(roomKey).MustGet())
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+
+		// Servers from the join remain in the room until the resync completes
+		var partialStateRoom PartialStateRoom
+		if b := txn.Get(r.KeyForPartialStateRoom(roomID)).MustGet(); b != nil {
+			if err := msgpack.Unmarshal(b, &partialStateRoom); err != nil {
+				return nil, err
+			}
+		}
+
+		res := &rollbackResult{clearedMembers: make([]id.UserID, 0)}
+		changedUsers := make(map[id.UserID]struct{})
+		changedServers := make(map[string]struct{})
+
+		for i, ev := range evs {
+			version := r.events.TxnMustLookupVersionForEventID(txn, ev.ID)
+			ev.SoftFailed = true
+			txn.Set(r.events.KeyForEvent(ev.ID), ev.ToMsgpack())
+			txn.Clear(r.events.KeyForRoomVersion(roomID, version))
+			txn.Clear(r.events.KeyForRoomLocalVersion(roomID, version))
+
+			if ev.StateKey == nil {
+				continue
+			}
+
+			txn.Clear(r.events.KeyForRoomStateVersion(roomID, version))
+			txn.Clear(r.events.KeyForRoomVersionStateTup(roomID, ev.Type, *ev.StateKey, version))
+
+			// Find the state event this replaced, rejected events before it have
+			// already been removed from the versioned state.
+			var prevEv *types.Event
+			var err error
+			prevKvs := txn.GetRange(
+				r.events.RangeForRoomVersionStateTup(roomID, ev.Type, *ev.StateKey, version),
+				fdb.RangeOptions{Reverse: true, Limit: 1},
+			).GetSliceOrPanic()
+			if len(prevKvs) > 0 {
+				if prevEv, err = eventsProvider.Get(id.EventID(prevKvs[0].Value)); err != nil {
+					return nil, err
+				}
+			}
+
+			if ev.Type != event.StateMember {
+				currentKey := r.events.KeyForRoomCurrentStateTup(roomID, ev.Type, ev.StateKey)
+				if id.EventID(txn.Get(currentKey).MustGet()) != ev.ID {
+					continue
+				}
+				if prevEv != nil {
+					txn.Set(currentKey, []byte(prevEv.ID))
+					r.updateRoomForStateEvent(txn, roomID, room, prevEv)
+				} else {
+					txn.Clear(currentKey)
+					// Reset any room fields derived from the state
+					r.updateRoomForStateEvent(txn, roomID, room, &types.Event{PartialEvent: types.PartialEvent{
+						Type:     ev.Type,
+						StateKey: ev.StateKey,
+						Content:  []byte("{}"),
+					}})
+				}
+				continue
+			}
+
+			memberID := id.UserID(*ev.StateKey)
+			currentMember := txn.Get(r.events.KeyForCurrentRoomMember(roomID, memberID)).MustGet()
+			if currentMember == nil || types.ValueToMembershipTup(currentMember).EventID != ev.ID {
+				continue
+			}
+			if prevEv != nil {
+				r.updateRoomForStateEvent(txn, roomID, room, prevEv)
+				r.txnUpdateCurrentMembership(txn, prevEv, tuple.IncompleteVersionstamp(uint16(i)), changedUsers, changedServers)
+				r.txnUpdateUserDirectoryForMemberEvent(txn, prevEv)
+			} else {
+				if ev.Membership() == event.MembershipJoin {
+					room.MemberCount -= 1
+				}
+				r.txnClearCurrentMembership(txn, roomID, memberID, partialStateRoom.Servers, changedServers)
+				changedUsers[memberID] = struct{}{}
+				res.clearedMembers = append(res.clearedMembers, memberID)
+			}
+		}
+
+		txn.Set(roomKey, room.ToMsgpack())
+
+		changedUserIDs := make([]id.UserID, 0, len(changedUsers))
+		for userID := range changedUsers {
+			changedUserIDs = append(changedUserIDs, userID)
+		}
+		changedServerNames := make([]string, 0, len(changedServers))
+		for serverName := range changedServers {
+			if serverName != r.config.ServerName {
+				changedServerNames = append(changedServerNames, serverName)
+			}
+		}
+		res.change = notifier.Change{
+			RoomIDs: []id.RoomID{roomID},
+			UserIDs: changedUserIDs,
+			Servers: changedServerNames,
+		}
+		return res, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.notifier.SendChange(res.change)
+	return res.clearedMembers, nil
+}
+
+// Clear the current membership of a user in a room that has no previous member
+// event to restore, the user's server is kept in the room if it has other joined
+// members or is one of keepServers.
+func (r *RoomsDatabase) txnClearCurrentMembership(
+	txn fdb.Transaction,
+	roomID id.RoomID,
+	memberID id.UserID,
+	keepServers []string,
+	changedServers map[string]struct{},
+) {
+	txn.Clear(r.events.KeyForCurrentRoomMember(roomID, memberID))
+	txn.Clear(r.users.KeyForUserMembership(memberID, roomID))
+
+	username, serverName, _ := memberID.Parse()
+	txn.Clear(r.servers.KeyForServerJoinedMember(roomID, serverName, username))
+	stillJoined := len(txn.GetRange(
+		r.servers.RangeForServerJoinedMembers(roomID, serverName),
+		fdb.RangeOptions{
+			Limit: 1,
+		},
+	).GetSliceOrPanic()) > 0
+	if !stillJoined && !slices.Contains(keepServers, serverName) &&
+		r.servers.TxnMustIsServerInRoom(txn, serverName, roomID) {
+		changedServers[serverName] = struct{}{}
+		txn.Clear(r.events.KeyForCurrentRoomServer(roomID, serverName))
+		txn.Clear(r.servers.KeyForServerMembership(serverName, roomID))
+	}
+}
+
+// Complete the partial state resync for a room, clearing the partial state flag
+// and any servers marked as in the room at join that have no joined members. If
+// any events were stored against partial state after afterVersion this returns
+// ErrPartialStateEventsPending and the room remains partial state.
+func (r *RoomsDatabase) CompleteRoomPartialState(
+	ctx context.Context,
+	roomID id.RoomID,
+	afterVersion tuple.Versionstamp,
+) error {
+	change, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*notifier.Change, error) {
+		pending := txn.GetRange(r.RangeForRoomPartialStateEventsAfter(roomID, afterVersion), fdb.RangeOptions{
+			Limit: 1,
+		}).GetSliceOrPanic()
+		if len(pending) > 0 {
+			return nil, ErrPartialStateEventsPending
+		}
+
+		b := txn.Get(r.KeyForPartialStateRoom(roomID)).MustGet()
+		if b == nil {
+			return nil, errors.New("room is not partial state")
+		}
+		var partialStateRoom PartialStateRoom
+		if err := msgpack.Unmarshal(b, &partialStateRoom); err != nil {
+			return nil, err
+		}
+
+		removedServers := make([]string, 0)
+		for _, serverName := range partialStateRoom.Servers {
+			stillJoined := len(txn.GetRange(
+				r.servers.RangeForServerJoinedMembers(roomID, serverName),
+				fdb.RangeOptions{
+					Limit: 1,
+				},
+			).GetSliceOrPanic()) > 0
+			if !stillJoined {
+				txn.Clear(r.events.KeyForCurrentRoomServer(roomID, serverName))
+				txn.Clear(r.servers.KeyForServerMembership(serverName, roomID))
+				removedServers = append(removedServers, serverName)
+			}
+		}
+
+		roomKey := r.KeyForRoom(roomID)
+		room := types.MustNewRoomFromBytes(txn.Get(roomKey).MustGet())
+		room.PartialState = false
+		txn.Set(roomKey, room.ToMsgpack())
+
+		txn.Clear(r.KeyForPartialStateRoom(roomID))
+		txn.ClearRange(r.partialStateEvents.Sub(roomID.String()))
+
+		return &notifier.Change{
+			RoomIDs: []id.RoomID{roomID},
+			Servers: removedServers,
+		}, nil
+	})
+	if err != nil {
+		return err
+	}
+	r.notifier.SendChange(*change)
+	return nil
+}
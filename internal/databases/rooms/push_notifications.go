@@ -0,0 +1,369 @@
+package rooms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms/events"
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// The push evaluator worker iterates all events and evaluates the push rules
+// of local users in the room for each, storing notifications and maintaining
+// per room unread notification & highlight counts which read receipts reset.
+// Rules are evaluated against the current room state rather than the state at
+// each event.
+// https://spec.matrix.org/v1.11/client-server-api/#push-notifications
+
+const (
+	pushEvaluatorPositionKey = "PushEvaluatorPosition"
+
+	// Maximum push rule evaluations (events x local members) per transaction,
+	// at least one event is always evaluated.
+	maxPushEvaluationsPerTxn = 5000
+)
+
+// Get the push evaluator position, on first run this starts after the latest
+// event so existing history doesn't generate notifications.
+func (r *RoomsDatabase) GetPushEvaluatorPosition(ctx context.Context) (tuple.Versionstamp, error) {
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (tuple.Versionstamp, error) {
+		positionKey := r.root.Pack(tuple.Tuple{pushEvaluatorPositionKey})
+		val, err := txn.Get(positionKey).Get()
+		if err != nil {
+			return types.ZeroVersionstamp, err
+		} else if val != nil {
+			return types.ValueToVersionstamp(val)
+		}
+
+		kvs, err := txn.GetRange(
+			r.events.RangeForVersion(types.ZeroVersionstamp, types.ZeroVersionstamp),
+			fdb.RangeOptions{Reverse: true, Limit: 1},
+		).GetSliceWithError()
+		if err != nil || len(kvs) == 0 {
+			return types.ZeroVersionstamp, err
+		}
+		position := r.events.KeyToVersion(kvs[0].Key)
+		position.UserVersion += 1
+		txn.Set(positionKey, types.ValueForVersionstamp(position))
+		return position, nil
+	})
+}
+
+// Room state needed to evaluate push rules, loaded once per room per batch
+type pushRoomState struct {
+	memberCount int
+	// Local joined users and their display names
+	localMembers map[id.UserID]string
+	powerLevels  event.PowerLevelsEventContent
+	notification map[string]int
+}
+
+// Evaluate push rules for a batch of events from the events iterator, storing
+// notifications and incrementing counts, and move the evaluator position past
+// them. Evaluation stops early once the transaction has evaluated the max
+// rules, returns the number of events evaluated. Pushers of any notified users
+// are woken up via the notifier.
+func (r *RoomsDatabase) EvaluateEventsForPush(
+	ctx context.Context,
+	tups []types.EventIDTupWithVersion,
+	checkUpdateLock func(fdb.Transaction),
+) (int, error) {
+	type evaluateResult struct {
+		evaluated int
+		pushers   []types.PusherKey
+	}
+	res, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (evaluateResult, error) {
+		var res evaluateResult
+		// Ensure that our lock is still valid before writing data
+		checkUpdateLock(txn)
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		for _, tup := range tups {
+			eventsProvider.WillGet(tup.EventID)
+		}
+
+		roomStates := make(map[id.RoomID]*pushRoomState)
+		userRules := make(map[id.UserID]*pushrules.PushRuleset)
+		notifiedUserIDs := make(map[id.UserID]struct{})
+
+		var evaluations int
+		for _, tup := range tups {
+			if res.evaluated > 0 && evaluations >= maxPushEvaluationsPerTxn {
+				break
+			}
+			res.evaluated++
+
+			ev, err := eventsProvider.Get(tup.EventID)
+			if err != nil {
+				return res, err
+			} else if ev.SoftFailed || ev.Outlier || ev.Redacted {
+				continue
+			}
+
+			roomState, found := roomStates[ev.RoomID]
+			if !found {
+				roomState, err = r.txnLoadPushRoomState(ctx, txn, ev.RoomID, eventsProvider)
+				if err != nil {
+					return res, err
+				}
+				roomStates[ev.RoomID] = roomState
+			}
+
+			pushEv, err := types.NewPushEvent(ev)
+			if err != nil {
+				return res, err
+			}
+
+			userIDs := make(map[id.UserID]string, len(roomState.localMembers)+1)
+			for userID, displayName := range roomState.localMembers {
+				userIDs[userID] = displayName
+			}
+			// Invited users aren't members yet but should be notified of the invite
+			if ev.Type == event.StateMember && ev.Membership() == event.MembershipInvite {
+				if invitee := id.UserID(*ev.StateKey); invitee.Homeserver() == r.config.ServerName {
+					userIDs[invitee] = ""
+				}
+			}
+
+			room := &types.PushRuleRoom{
+				MemberCount:             roomState.memberCount,
+				SenderPowerLevel:        roomState.powerLevels.GetUserLevel(ev.Sender),
+				NotificationPowerLevels: roomState.notification,
+			}
+
+			evaluations += len(userIDs)
+			for userID, displayName := range userIDs {
+				if userID == ev.Sender {
+					continue
+				}
+
+				// Skip anything the user has already read
+				if receiptVersion, err := r.users.TxnLookupUserReadReceiptVersion(txn, userID, ev.RoomID); err != nil {
+					return res, err
+				} else if bytes.Compare(receiptVersion.Bytes(), tup.Version.Bytes()) >= 0 {
+					continue
+				}
+
+				rules, found := userRules[userID]
+				if !found {
+					if rules, err = r.users.TxnLookupUserPushRules(txn, userID); err != nil {
+						return res, err
+					}
+					userRules[userID] = rules
+				}
+
+				room.DisplayName = displayName
+				actions := types.EvaluatePushRules(rules, pushEv, room)
+				notify, highlight := types.PushActionsNotifyHighlight(actions)
+				if !notify {
+					continue
+				}
+
+				actionsJSON, err := json.Marshal(actions)
+				if err != nil {
+					return res, err
+				}
+				r.users.TxnStoreUserNotification(txn, userID, ev.RoomID, ev.ID, tup.Version, highlight, actionsJSON)
+				notifiedUserIDs[userID] = struct{}{}
+				var highlights int64
+				if highlight {
+					highlights = 1
+				}
+				r.users.TxnAddUserNotificationCounts(txn, userID, ev.RoomID, 1, highlights)
+			}
+		}
+
+		position := tups[res.evaluated-1].Version
+		position.UserVersion += 1
+		txn.Set(r.root.Pack(tuple.Tuple{pushEvaluatorPositionKey}), types.ValueForVersionstamp(position))
+
+		res.pushers = make([]types.PusherKey, 0)
+		for userID := range notifiedUserIDs {
+			userPushers, err := r.users.TxnLookupUserPushers(txn, userID)
+			if err != nil {
+				return res, err
+			}
+			for _, pusher := range userPushers {
+				res.pushers = append(res.pushers, pusher.Key())
+			}
+		}
+		return res, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(res.pushers) > 0 {
+		r.notifier.SendChange(notifier.Change{Pushers: res.pushers})
+	}
+	return res.evaluated, nil
+}
+
+func (r *RoomsDatabase) txnLoadPushRoomState(
+	ctx context.Context,
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	eventsProvider *events.TxnEventsProvider,
+) (*pushRoomState, error) {
+	roomState := &pushRoomState{
+		localMembers: make(map[id.UserID]string),
+		notification: make(map[string]int),
+	}
+
+	kvs, err := txn.GetRange(r.events.RangeForCurrentRoomMembers(roomID), fdb.RangeOptions{
+		Mode: fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+	localMemberEventIDs := make(map[id.UserID]id.EventID)
+	for _, kv := range kvs {
+		membershipTup := types.ValueToMembershipTup(kv.Value)
+		if membershipTup.Membership != event.MembershipJoin {
+			continue
+		}
+		roomState.memberCount++
+		_, userID := r.events.KeyToCurrentRoomMember(kv.Key)
+		if userID.Homeserver() == r.config.ServerName {
+			localMemberEventIDs[userID] = membershipTup.EventID
+			eventsProvider.WillGet(membershipTup.EventID)
+		}
+	}
+
+	powerLevelsEventID, err := r.events.TxnLookupCurrentRoomStateEventID(txn, roomID, event.StatePowerLevels, "")
+	if err != nil {
+		return nil, err
+	} else if powerLevelsEventID != "" {
+		eventsProvider.WillGet(powerLevelsEventID)
+		powerLevelsEv, err := eventsProvider.Get(powerLevelsEventID)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(powerLevelsEv.Content, &roomState.powerLevels); err != nil {
+			return nil, err
+		}
+		gjson.GetBytes(powerLevelsEv.Content, "notifications").ForEach(func(key, value gjson.Result) bool {
+			roomState.notification[key.String()] = int(value.Int())
+			return true
+		})
+	}
+
+	for userID, eventID := range localMemberEventIDs {
+		memberEv, err := eventsProvider.Get(eventID)
+		if err != nil {
+			return nil, err
+		}
+		roomState.localMembers[userID] = gjson.GetBytes(memberEv.Content, "displayname").String()
+	}
+
+	return roomState, nil
+}
+
+// Get a user's unread notification counts for rooms
+func (r *RoomsDatabase) GetUserNotificationCounts(
+	ctx context.Context,
+	userID id.UserID,
+	roomIDs []id.RoomID,
+) (map[id.RoomID]types.NotificationCounts, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (map[id.RoomID]types.NotificationCounts, error) {
+		counts := make(map[id.RoomID]types.NotificationCounts, len(roomIDs))
+		for _, roomID := range roomIDs {
+			roomCounts, err := r.users.TxnLookupUserNotificationCounts(txn, userID, roomID)
+			if err != nil {
+				return nil, err
+			}
+			counts[roomID] = roomCounts
+		}
+		return counts, nil
+	})
+}
+
+// Store a user's read receipt for an event in a room, removing notifications
+// up to and including the event from the unread counts. Receipts for events
+// before the user's current receipt are ignored. Returns types.ErrRoomNotAccessible
+// if the user isn't joined to the room.
+// https://spec.matrix.org/v1.11/client-server-api/#receipts
+func (r *RoomsDatabase) SetUserReadReceipt(
+	ctx context.Context,
+	userID id.UserID,
+	roomID id.RoomID,
+	eventID id.EventID,
+) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		if inRoom, err := r.users.TxnIsUserInRoom(txn, userID, roomID); err != nil {
+			return nil, err
+		} else if !inRoom {
+			return nil, types.ErrRoomNotAccessible
+		}
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		eventsProvider.WillGet(eventID)
+		ev, err := eventsProvider.Get(eventID)
+		if err != nil {
+			return nil, err
+		} else if ev.RoomID != roomID {
+			return nil, types.ErrEventNotFound
+		}
+
+		version, err := r.events.TxnLookupVersionForEventID(txn, eventID)
+		if err != nil {
+			return nil, err
+		}
+
+		currentVersion, err := r.users.TxnLookupUserReadReceiptVersion(txn, userID, roomID)
+		if err != nil {
+			return nil, err
+		} else if bytes.Compare(currentVersion.Bytes(), version.Bytes()) >= 0 {
+			return nil, nil
+		}
+
+		txn.Set(
+			r.users.KeyForUserReadReceipt(userID, roomID),
+			tuple.Tuple{eventID.String(), version}.Pack(),
+		)
+
+		// Subtract notifications between the previous receipt and this one
+		// from the counts, clear them from the room and mark them read in the
+		// user's notification log, which is kept until pruned.
+		fromVersion := currentVersion
+		if fromVersion != types.ZeroVersionstamp {
+			fromVersion.UserVersion += 1
+		}
+		toVersion := version
+		toVersion.UserVersion += 1 // FDB range ends are exclusive
+		kvs, err := txn.GetRange(
+			r.users.RangeForUserRoomNotifications(userID, roomID, fromVersion, toVersion),
+			fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+		).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+		var notifications, highlights int64
+		versions := make([]tuple.Versionstamp, 0, len(kvs))
+		for _, kv := range kvs {
+			tup, err := tuple.Unpack(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			notifications++
+			if tup[1].(bool) {
+				highlights++
+			}
+			versions = append(versions, r.users.KeyToUserRoomNotificationVersion(kv.Key))
+			txn.Clear(kv.Key)
+		}
+		r.users.TxnAddUserNotificationCounts(txn, userID, roomID, -notifications, -highlights)
+		return nil, r.users.TxnMarkUserNotificationsRead(txn, userID, versions)
+	})
+	return err
+}
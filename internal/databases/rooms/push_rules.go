@@ -0,0 +1,38 @@
+package rooms
+
+import (
+	"context"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Get a user's push rules, the spec default rules if they've not changed any
+// https://spec.matrix.org/v1.11/client-server-api/#push-rules-api
+func (r *RoomsDatabase) GetUserPushRules(ctx context.Context, userID id.UserID) (*pushrules.PushRuleset, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*pushrules.PushRuleset, error) {
+		return r.users.TxnLookupUserPushRules(txn, userID)
+	})
+}
+
+// Modify a user's push rules in a transaction, any error returned by update
+// aborts the change.
+func (r *RoomsDatabase) UpdateUserPushRules(
+	ctx context.Context,
+	userID id.UserID,
+	update func(rs *pushrules.PushRuleset) error,
+) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		rs, err := r.users.TxnLookupUserPushRules(txn, userID)
+		if err != nil {
+			return nil, err
+		} else if err := update(rs); err != nil {
+			return nil, err
+		}
+		return nil, r.users.TxnStoreUserPushRules(txn, userID, rs)
+	})
+	return err
+}
@@ -0,0 +1,322 @@
+package rooms
+
+import (
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms/events"
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Pushers send notifications stored by the push evaluator to push gateways,
+// each pusher tracks its own position in the user's notifications.
+// https://spec.matrix.org/v1.11/client-server-api/#push-notifications
+
+func (r *RoomsDatabase) GetUserPushers(ctx context.Context, userID id.UserID) ([]*types.Pusher, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*types.Pusher, error) {
+		return r.users.TxnLookupUserPushers(txn, userID)
+	})
+}
+
+// Create or update a pusher, unless appendPusher is set any pushers for the same
+// app ID and pushkey belonging to other users are removed. New pushers start
+// from the user's latest notification.
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3pushersset
+func (r *RoomsDatabase) SetUserPusher(ctx context.Context, pusher *types.Pusher, appendPusher bool) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		key := pusher.Key()
+
+		if !appendPusher {
+			userIDs, err := r.users.TxnLookupPusherUserIDs(txn, pusher.AppID, pusher.PushKey)
+			if err != nil {
+				return nil, err
+			}
+			for _, userID := range userIDs {
+				if userID != pusher.UserID {
+					r.users.TxnDeleteUserPusher(txn, types.PusherKey{
+						UserID:  userID,
+						AppID:   pusher.AppID,
+						PushKey: pusher.PushKey,
+					})
+				}
+			}
+		}
+
+		existing, err := r.users.TxnLookupUserPusher(txn, key)
+		if err != nil {
+			return nil, err
+		} else if existing != nil {
+			pusher.PushKeyTS = existing.PushKeyTS
+		} else {
+			pusher.PushKeyTS = time.Now().Unix()
+
+			kvs, err := txn.GetRange(
+				r.users.RangeForUserNotifications(pusher.UserID, types.ZeroVersionstamp, types.ZeroVersionstamp),
+				fdb.RangeOptions{Limit: 1, Reverse: true},
+			).GetSliceWithError()
+			if err != nil {
+				return nil, err
+			} else if len(kvs) > 0 {
+				notification, err := r.users.KeyValueToUserNotification(kvs[0])
+				if err != nil {
+					return nil, err
+				}
+				position := notification.Version
+				position.UserVersion += 1
+				r.users.TxnSetPusherPosition(txn, key, position)
+			}
+		}
+
+		r.users.TxnStoreUserPusher(txn, pusher)
+		return nil, nil
+	})
+	return err
+}
+
+// Delete a pusher, does nothing if the pusher doesn't exist
+func (r *RoomsDatabase) DeleteUserPusher(ctx context.Context, key types.PusherKey) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		r.users.TxnDeleteUserPusher(txn, key)
+		return nil, nil
+	})
+	return err
+}
+
+type PusherNotification struct {
+	Version      tuple.Versionstamp
+	Notification *types.PushGatewayNotification
+}
+
+type PusherNotifications struct {
+	Pusher        *types.Pusher
+	Notifications []PusherNotification
+	// The pusher's current position
+	Position tuple.Versionstamp
+	// Version after the last notification checked, which may be later than the
+	// last notification returned when notifications have already been read.
+	NextVersion tuple.Versionstamp
+}
+
+// Get the next notifications to send to a pusher after its current position,
+// skipping any the user has since read. Returns nil if the pusher doesn't exist.
+func (r *RoomsDatabase) GetPusherNotifications(
+	ctx context.Context,
+	key types.PusherKey,
+	limit int,
+) (*PusherNotifications, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*PusherNotifications, error) {
+		pusher, err := r.users.TxnLookupUserPusher(txn, key)
+		if err != nil || pusher == nil {
+			return nil, err
+		}
+		position, err := r.users.TxnLookupPusherPosition(txn, key)
+		if err != nil {
+			return nil, err
+		}
+
+		kvs, err := txn.GetRange(
+			r.users.RangeForUserNotifications(key.UserID, position, types.ZeroVersionstamp),
+			fdb.RangeOptions{Mode: fdb.StreamingModeWantAll, Limit: limit},
+		).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+
+		res := &PusherNotifications{
+			Pusher:        pusher,
+			Notifications: make([]PusherNotification, 0, len(kvs)),
+			Position:      position,
+			NextVersion:   position,
+		}
+		if len(kvs) == 0 {
+			return res, nil
+		}
+
+		unread, err := r.users.TxnLookupUserTotalNotificationCount(txn, key.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		userNotifications := make([]*types.UserNotification, 0, len(kvs))
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		for _, kv := range kvs {
+			notification, err := r.users.KeyValueToUserNotification(kv)
+			if err != nil {
+				return nil, err
+			}
+			res.NextVersion = notification.Version
+			res.NextVersion.UserVersion += 1
+
+			if notification.Read {
+				continue
+			}
+			userNotifications = append(userNotifications, notification)
+			eventsProvider.WillGet(notification.EventID)
+		}
+
+		roomNames := make(map[id.RoomID]string)
+		for _, notification := range userNotifications {
+			ev, err := eventsProvider.Get(notification.EventID)
+			if err != nil {
+				return nil, err
+			}
+
+			var roomName, senderDisplayName string
+			if pusher.Format() != types.PusherFormatEventIDOnly {
+				var found bool
+				if roomName, found = roomNames[ev.RoomID]; !found {
+					if roomName, err = r.txnLookupCurrentRoomStateContentField(
+						txn, eventsProvider, ev.RoomID, event.StateRoomName, "", "name",
+					); err != nil {
+						return nil, err
+					}
+					roomNames[ev.RoomID] = roomName
+				}
+				if senderDisplayName, err = r.txnLookupCurrentRoomMemberDisplayName(
+					txn, eventsProvider, ev.RoomID, ev.Sender,
+				); err != nil {
+					return nil, err
+				}
+			}
+
+			res.Notifications = append(res.Notifications, PusherNotification{
+				Version: notification.Version,
+				Notification: types.NewPushGatewayNotification(
+					pusher, ev, notification.Actions, roomName, senderDisplayName, unread,
+				),
+			})
+		}
+
+		return res, nil
+	})
+}
+
+func (r *RoomsDatabase) txnLookupCurrentRoomStateContentField(
+	txn fdb.ReadTransaction,
+	eventsProvider *events.TxnEventsProvider,
+	roomID id.RoomID,
+	evType event.Type,
+	stateKey, field string,
+) (string, error) {
+	eventID, err := r.events.TxnLookupCurrentRoomStateEventID(txn, roomID, evType, stateKey)
+	if err != nil || eventID == "" {
+		return "", err
+	}
+	eventsProvider.WillGet(eventID)
+	ev, err := eventsProvider.Get(eventID)
+	if err != nil {
+		return "", err
+	}
+	return gjson.GetBytes(ev.Content, field).String(), nil
+}
+
+func (r *RoomsDatabase) txnLookupCurrentRoomMemberDisplayName(
+	txn fdb.ReadTransaction,
+	eventsProvider *events.TxnEventsProvider,
+	roomID id.RoomID,
+	userID id.UserID,
+) (string, error) {
+	b, err := txn.Get(r.events.KeyForCurrentRoomMember(roomID, userID)).Get()
+	if err != nil || b == nil {
+		return "", err
+	}
+	membershipTup := types.ValueToMembershipTup(b)
+	eventsProvider.WillGet(membershipTup.EventID)
+	memberEv, err := eventsProvider.Get(membershipTup.EventID)
+	if err != nil {
+		return "", err
+	}
+	return gjson.GetBytes(memberEv.Content, "displayname").String(), nil
+}
+
+// Update a pusher's position, unless the pusher has since been deleted
+func (r *RoomsDatabase) UpdatePusherPosition(
+	ctx context.Context,
+	key types.PusherKey,
+	version tuple.Versionstamp,
+	checkUpdateLock func(fdb.Transaction),
+) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		// Ensure lock is still valid before writing data
+		checkUpdateLock(txn)
+
+		if pusher, err := r.users.TxnLookupUserPusher(txn, key); err != nil || pusher == nil {
+			return nil, err
+		}
+		r.users.TxnSetPusherPosition(txn, key, version)
+		return nil, nil
+	})
+	return err
+}
+
+func (r *RoomsDatabase) GetPusherBackoff(ctx context.Context, key types.PusherKey) (*types.PusherBackoff, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.PusherBackoff, error) {
+		return r.users.TxnLookupPusherBackoff(txn, key)
+	})
+}
+
+func (r *RoomsDatabase) GetPusherBackoffs(ctx context.Context) ([]*types.PusherBackoff, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*types.PusherBackoff, error) {
+		return r.users.TxnLookupPusherBackoffs(txn)
+	})
+}
+
+// Record a failed request to a pusher's gateway, incrementing the failure count
+// and calculating the next retry time.
+func (r *RoomsDatabase) RecordPusherFailure(
+	ctx context.Context,
+	key types.PusherKey,
+	failErr error,
+) (*types.PusherBackoff, error) {
+	backoffCfg := r.config.Push.Backoff
+
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*types.PusherBackoff, error) {
+		backoff, err := r.users.TxnLookupPusherBackoff(txn, key)
+		if err != nil {
+			return nil, err
+		} else if backoff == nil {
+			backoff = &types.PusherBackoff{PusherKey: key}
+		}
+
+		now := time.Now()
+		backoff.Failures++
+		backoff.LastError = failErr.Error()
+		backoff.LastFailureTS = now.UnixMilli()
+		backoff.RetryAfterTS = now.Add(
+			util.GetBackoffDuration(backoff.Failures, backoffCfg.Initial, backoffCfg.Max),
+		).UnixMilli()
+
+		r.users.TxnSetPusherBackoff(txn, backoff)
+		return backoff, nil
+	})
+}
+
+// Reset any backoff for the pusher, returns true if there was one. Most calls
+// will not find a backoff so we check with a read transaction first to avoid
+// a write on every request.
+func (r *RoomsDatabase) ResetPusherBackoff(ctx context.Context, key types.PusherKey) (bool, error) {
+	if backoff, err := r.GetPusherBackoff(ctx, key); err != nil {
+		return false, err
+	} else if backoff == nil {
+		return false, nil
+	}
+
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		r.users.TxnClearPusherBackoff(txn, key)
+		return nil, nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	r.notifier.SendChange(notifier.Change{Pushers: []types.PusherKey{key}})
+	return true, nil
+}
@@ -0,0 +1,113 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Knock restricted join rule isn't defined by mautrix
+// https://spec.matrix.org/v1.11/client-server-api/#knock_restricted-rooms
+const joinRuleKnockRestricted event.JoinRule = "knock_restricted"
+
+// Get the local user that should authorise a user joining a restricted room,
+// returns an empty user ID if no authorisation is needed - the room is not
+// restricted or the user is already joined or invited. Returns one of the
+// restricted join errors if the user may not join.
+// https://spec.matrix.org/v1.11/client-server-api/#restricted-rooms
+func (r *RoomsDatabase) GetRestrictedJoinAuthoriser(
+	ctx context.Context,
+	roomID id.RoomID,
+	userID id.UserID,
+) (id.UserID, error) {
+	room, err := r.GetRoom(ctx, roomID)
+	if err != nil || room == nil {
+		return "", err
+	}
+	roomSpec, err := gomatrixserverlib.GetRoomVersion(gomatrixserverlib.RoomVersion(room.Version))
+	if err != nil {
+		return "", err
+	} else if roomSpec.CheckRestrictedJoinsAllowed() != nil {
+		return "", nil
+	}
+
+	joinRulesEv, err := r.GetCurrentRoomStateEvent(ctx, roomID, event.StateJoinRules, "")
+	if err != nil || joinRulesEv == nil {
+		return "", err
+	}
+	var joinRules event.JoinRulesEventContent
+	if err := json.Unmarshal(joinRulesEv.Content, &joinRules); err != nil {
+		return "", err
+	} else if joinRules.JoinRule != event.JoinRuleRestricted && joinRules.JoinRule != joinRuleKnockRestricted {
+		return "", nil
+	}
+
+	memberships, err := r.GetUserMemberships(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if membership, found := memberships[roomID]; found &&
+		(membership.Membership == event.MembershipJoin || membership.Membership == event.MembershipInvite) {
+		return "", nil
+	}
+
+	// Check the allow conditions, we can only know the user's membership of
+	// rooms this server is in.
+	var allowed, unknown bool
+	for _, allow := range joinRules.Allow {
+		if allow.Type != event.JoinRuleAllowRoomMembership {
+			continue
+		}
+		if membership, found := memberships[allow.RoomID]; found && membership.Membership == event.MembershipJoin {
+			allowed = true
+			break
+		}
+		if inRoom, err := r.IsServerInRoom(ctx, r.config.ServerName, allow.RoomID); err != nil {
+			return "", err
+		} else if !inRoom {
+			unknown = true
+		}
+	}
+	if !allowed {
+		if unknown {
+			return "", types.ErrUnableToAuthoriseJoin
+		}
+		return "", types.ErrJoinNotAuthorised
+	}
+
+	// Now pick a local user currently joined to the room with invite power
+	var powerLevels event.PowerLevelsEventContent
+	if powerLevelsEv, err := r.GetCurrentRoomStateEvent(ctx, roomID, event.StatePowerLevels, ""); err != nil {
+		return "", err
+	} else if powerLevelsEv != nil {
+		if err := json.Unmarshal(powerLevelsEv.Content, &powerLevels); err != nil {
+			return "", err
+		}
+	}
+	// Note: spec default invite level is 0, mautrix defaults to 50
+	inviteLevel := 0
+	if powerLevels.InvitePtr != nil {
+		inviteLevel = *powerLevels.InvitePtr
+	}
+
+	memberEvs, err := r.GetCurrentRoomMemberEvents(ctx, roomID)
+	if err != nil {
+		return "", err
+	}
+	for _, memberEv := range memberEvs {
+		memberID := id.UserID(*memberEv.StateKey)
+		if memberEv.Membership() != event.MembershipJoin || memberID.Homeserver() != r.config.ServerName {
+			continue
+		}
+		if powerLevels.GetUserLevel(memberID) >= inviteLevel {
+			return memberID, nil
+		}
+	}
+
+	return "", types.ErrUnableToGrantJoin
+}
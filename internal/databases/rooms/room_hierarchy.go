@@ -0,0 +1,128 @@
+package rooms
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Get the summary of a room used in the space hierarchy, including the space
+// children state. Returns nil if we don't know the room.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidhierarchy
+func (r *RoomsDatabase) GetRoomHierarchyRoom(ctx context.Context, roomID id.RoomID) (*fclient.RoomHierarchyRoom, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*fclient.RoomHierarchyRoom, error) {
+		roomBytes := txn.Get(r.KeyForRoom(roomID)).MustGet()
+		if roomBytes == nil {
+			return nil, nil
+		}
+		room := types.MustNewRoomFromBytes(roomBytes)
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		stateMap, err := r.events.TxnLookupCurrentRoomStateMap(txn, roomID, eventsProvider)
+		if err != nil {
+			return nil, err
+		}
+
+		hierarchyRoom := &fclient.RoomHierarchyRoom{
+			PublicRoom: fclient.PublicRoom{
+				RoomID:             roomID.String(),
+				JoinedMembersCount: room.MemberCount,
+				JoinRule:           string(event.JoinRuleInvite),
+			},
+			RoomType:      room.Type,
+			ChildrenState: make([]fclient.RoomHierarchyStrippedEvent, 0),
+		}
+
+		for stateTup, evID := range stateMap {
+			ev, err := eventsProvider.Get(evID)
+			if err != nil {
+				return nil, err
+			}
+			content := gjson.ParseBytes(ev.Content)
+
+			switch stateTup.Type {
+			case event.StateRoomName:
+				hierarchyRoom.Name = content.Get("name").String()
+			case event.StateTopic:
+				hierarchyRoom.Topic = content.Get("topic").String()
+			case event.StateRoomAvatar:
+				hierarchyRoom.AvatarURL = content.Get("url").String()
+			case event.StateCanonicalAlias:
+				hierarchyRoom.CanonicalAlias = content.Get("alias").String()
+			case event.StateJoinRules:
+				hierarchyRoom.JoinRule = content.Get("join_rule").String()
+				for _, allow := range content.Get("allow").Array() {
+					if allow.Get("type").String() == string(event.JoinRuleAllowRoomMembership) {
+						hierarchyRoom.AllowedRoomIDs = append(hierarchyRoom.AllowedRoomIDs, allow.Get("room_id").String())
+					}
+				}
+			case event.StateHistoryVisibility:
+				hierarchyRoom.WorldReadable = content.Get("history_visibility").String() == string(event.HistoryVisibilityWorldReadable)
+			case event.StateGuestAccess:
+				hierarchyRoom.GuestCanJoin = content.Get("guest_access").String() == string(event.GuestAccessCanJoin)
+			case event.StateSpaceChild:
+				// Children without any via servers are not valid (ie removed)
+				if len(content.Get("via").Array()) == 0 {
+					continue
+				}
+				hierarchyRoom.ChildrenState = append(hierarchyRoom.ChildrenState, fclient.RoomHierarchyStrippedEvent{
+					Type:           ev.Type.Type,
+					StateKey:       *ev.StateKey,
+					Content:        ev.Content,
+					Sender:         ev.Sender.String(),
+					OriginServerTS: spec.Timestamp(ev.Timestamp),
+				})
+			}
+		}
+
+		SortSpaceChildren(hierarchyRoom.ChildrenState)
+		return hierarchyRoom, nil
+	})
+}
+
+// Sort space children in place: those with a valid order first (by order), then
+// by the timestamp of the child event and finally the room ID.
+// https://spec.matrix.org/v1.11/client-server-api/#ordering-of-children-within-a-space
+func SortSpaceChildren(children []fclient.RoomHierarchyStrippedEvent) {
+	getOrder := func(child fclient.RoomHierarchyStrippedEvent) string {
+		order := gjson.GetBytes(child.Content, "order")
+		if order.Type != gjson.String || len(order.Str) > 50 {
+			return ""
+		}
+		for _, c := range order.Str {
+			if c < 0x20 || c > 0x7E {
+				return ""
+			}
+		}
+		return order.Str
+	}
+
+	slices.SortStableFunc(children, func(a, b fclient.RoomHierarchyStrippedEvent) int {
+		aOrder, bOrder := getOrder(a), getOrder(b)
+		if aOrder != bOrder {
+			if aOrder == "" {
+				return 1
+			} else if bOrder == "" {
+				return -1
+			}
+			return strings.Compare(aOrder, bOrder)
+		}
+		if a.OriginServerTS != b.OriginServerTS {
+			if a.OriginServerTS < b.OriginServerTS {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.StateKey, b.StateKey)
+	})
+}
@@ -0,0 +1,212 @@
+package rooms
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Remote servers may peek world readable rooms we're in without joining them
+// (MSC2444). While a peek is active the federation sender includes the room's
+// events for the peeking server as if it were in the room. Peeks expire unless
+// renewed by the peeking server.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2444
+
+// Pseudo membership used for peeked rooms in server syncs
+const membershipPeek event.Membership = "peek"
+
+// Room peeks (room_id, server_name, peek_id) -> RoomPeek msgpack
+//
+
+func (r *RoomsDatabase) KeyForRoomPeek(roomID id.RoomID, serverName, peekID string) fdb.Key {
+	return r.roomPeeks.Pack(tuple.Tuple{roomID.String(), serverName, peekID})
+}
+
+// Server peeks (server_name, room_id, peek_id) -> nil
+//
+
+func (r *RoomsDatabase) KeyForServerPeek(serverName string, roomID id.RoomID, peekID string) fdb.Key {
+	return r.serverPeeks.Pack(tuple.Tuple{serverName, roomID.String(), peekID})
+}
+
+func (r *RoomsDatabase) KeyToServerPeek(key fdb.Key) (id.RoomID, string) {
+	tup, _ := r.serverPeeks.Unpack(key)
+	return id.RoomID(tup[1].(string)), tup[2].(string)
+}
+
+func (r *RoomsDatabase) txnClearRoomPeek(txn fdb.Transaction, peek *types.RoomPeek) {
+	txn.Clear(r.KeyForRoomPeek(peek.RoomID, peek.ServerName, peek.PeekID))
+	txn.Clear(r.KeyForServerPeek(peek.ServerName, peek.RoomID, peek.PeekID))
+}
+
+// Start or renew a peek, renewing keeps the original start version. Any other
+// expired peeks by the same server on the room are cleared.
+func (r *RoomsDatabase) StartRoomPeek(
+	ctx context.Context,
+	roomID id.RoomID,
+	serverName, peekID string,
+	renewalInterval time.Duration,
+) (*types.RoomPeek, error) {
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*types.RoomPeek, error) {
+		var peek *types.RoomPeek
+
+		iter := txn.GetRange(
+			r.roomPeeks.Sub(roomID.String(), serverName),
+			fdb.RangeOptions{},
+		).Iterator()
+		for iter.Advance() {
+			kv := iter.MustGet()
+			existing := types.MustNewRoomPeekFromBytes(kv.Value)
+			if existing.PeekID == peekID {
+				peek = existing
+			} else if existing.IsExpired() {
+				r.txnClearRoomPeek(txn, existing)
+			}
+		}
+
+		if peek == nil {
+			peek = &types.RoomPeek{
+				RoomID:      roomID,
+				ServerName:  serverName,
+				PeekID:      peekID,
+				FromVersion: types.ValueForVersionstamp(r.events.TxnGetLatestEventVersion(txn)),
+			}
+		}
+		peek.Renew(time.Now(), renewalInterval)
+
+		txn.Set(r.KeyForRoomPeek(roomID, serverName, peekID), peek.ToMsgpack())
+		txn.Set(r.KeyForServerPeek(serverName, roomID, peekID), nil)
+		return peek, nil
+	})
+}
+
+func (r *RoomsDatabase) DeleteRoomPeek(ctx context.Context, roomID id.RoomID, serverName, peekID string) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		r.txnClearRoomPeek(txn, &types.RoomPeek{RoomID: roomID, ServerName: serverName, PeekID: peekID})
+		return nil, nil
+	})
+	return err
+}
+
+// Get servers with an active peek on a room
+func (r *RoomsDatabase) GetRoomPeekingServers(ctx context.Context, roomID id.RoomID) ([]string, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]string, error) {
+		kvs, err := txn.GetRange(r.roomPeeks.Sub(roomID.String()), fdb.RangeOptions{}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+		serverNames := make([]string, 0, len(kvs))
+		for _, kv := range kvs {
+			peek := types.MustNewRoomPeekFromBytes(kv.Value)
+			if peek.IsExpired() {
+				continue
+			}
+			if len(serverNames) == 0 || serverNames[len(serverNames)-1] != peek.ServerName {
+				serverNames = append(serverNames, peek.ServerName)
+			}
+		}
+		return serverNames, nil
+	})
+}
+
+// Lookup rooms a server is actively peeking, with the version to send events
+// from. Peeks on rooms that are no longer world readable are ignored.
+func (r *RoomsDatabase) txnLookupServerPeekedRooms(
+	txn fdb.ReadTransaction,
+	serverName string,
+) (map[id.RoomID]tuple.Versionstamp, error) {
+	kvs, err := txn.GetRange(r.serverPeeks.Sub(serverName), fdb.RangeOptions{}).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+
+	peekedRooms := make(map[id.RoomID]tuple.Versionstamp, len(kvs))
+	worldReadableRooms := make(map[id.RoomID]bool)
+
+	for _, kv := range kvs {
+		roomID, peekID := r.KeyToServerPeek(kv.Key)
+		peekBytes, err := txn.Get(r.KeyForRoomPeek(roomID, serverName, peekID)).Get()
+		if err != nil {
+			return nil, err
+		} else if peekBytes == nil {
+			continue
+		}
+		peek := types.MustNewRoomPeekFromBytes(peekBytes)
+		if peek.IsExpired() {
+			continue
+		}
+
+		worldReadable, found := worldReadableRooms[roomID]
+		if !found {
+			roomBytes, err := txn.Get(r.KeyForRoom(roomID)).Get()
+			if err != nil {
+				return nil, err
+			}
+			worldReadable = roomBytes != nil &&
+				types.MustNewRoomFromBytes(roomBytes).HistoryVisibility == string(event.HistoryVisibilityWorldReadable)
+			worldReadableRooms[roomID] = worldReadable
+		}
+		if !worldReadable {
+			continue
+		}
+
+		fromVersion, err := types.ValueToVersionstamp(peek.FromVersion)
+		if err != nil {
+			return nil, err
+		}
+		// Where a server has multiple peeks on a room use the earliest
+		if existing, found := peekedRooms[roomID]; !found || bytes.Compare(fromVersion.Bytes(), existing.Bytes()) < 0 {
+			peekedRooms[roomID] = fromVersion
+		}
+	}
+
+	return peekedRooms, nil
+}
+
+// Clear expired peeks, scanning up to limit peeks after (exclusive) a cursor
+// key, or from the start if nil. Returns the number of peeks cleared and the
+// cursor for the next batch, nil once all peeks have been scanned.
+func (r *RoomsDatabase) PruneExpiredRoomPeeks(ctx context.Context, cursor fdb.Key, limit int) (int, fdb.Key, error) {
+	type result struct {
+		pruned int
+		cursor fdb.Key
+	}
+	res, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (result, error) {
+		var res result
+
+		var rng fdb.Range = r.roomPeeks
+		if cursor != nil {
+			_, end := r.roomPeeks.FDBRangeKeys()
+			rng = fdb.KeyRange{Begin: fdb.Key(append(append([]byte{}, cursor...), 0x00)), End: end}
+		}
+		kvs, err := txn.GetRange(rng, fdb.RangeOptions{
+			Limit: limit,
+			Mode:  fdb.StreamingModeWantAll,
+		}).GetSliceWithError()
+		if err != nil {
+			return res, err
+		}
+
+		now := time.Now()
+		for _, kv := range kvs {
+			peek := types.MustNewRoomPeekFromBytes(kv.Value)
+			if peek.IsExpiredAt(now) {
+				r.txnClearRoomPeek(txn, peek)
+				res.pruned++
+			}
+		}
+		if len(kvs) == limit {
+			res.cursor = kvs[len(kvs)-1].Key
+		}
+		return res, nil
+	})
+	return res.pruned, res.cursor, err
+}
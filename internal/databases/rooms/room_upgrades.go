@@ -0,0 +1,394 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/zerolog"
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+// Room upgrades replace a room with a new one (usually to move to a newer room
+// version), each upgrade is stored and run step by step so it can be resumed by
+// the room upgrader worker if interrupted.
+// https://spec.matrix.org/v1.11/client-server-api/#room-upgrades
+
+const (
+	roomUpgradeLockNamePrefix = "RoomUpgradeLock:"
+	roomUpgradeLockRefresh    = time.Second * 5
+	roomUpgradeLockTimeout    = time.Second * 30
+)
+
+type RoomUpgradeStep int
+
+const (
+	RoomUpgradeStepCreateRoom RoomUpgradeStep = iota
+	RoomUpgradeStepTombstone
+	RoomUpgradeStepRestrictOldRoom
+	RoomUpgradeStepComplete
+)
+
+// State copied from the old room to the new, power levels are handled separately
+var roomUpgradeTransferableState = []event.Type{
+	event.StateJoinRules,
+	event.StateHistoryVisibility,
+	event.StateGuestAccess,
+	event.StateRoomName,
+	event.StateTopic,
+	event.StateRoomAvatar,
+	event.StateServerACL,
+	event.StateEncryption,
+	event.StateCanonicalAlias,
+}
+
+type RoomUpgrade struct {
+	RoomID     id.RoomID       `msgpack:"rid"`
+	NewRoomID  id.RoomID       `msgpack:"nid"`
+	NewVersion string          `msgpack:"ver"`
+	Sender     id.UserID       `msgpack:"snd"`
+	Step       RoomUpgradeStep `msgpack:"stp"`
+}
+
+// Room upgrades (room_id) -> RoomUpgrade msgpack
+//
+
+func (r *RoomsDatabase) KeyForRoomUpgrade(roomID id.RoomID) fdb.Key {
+	return r.roomUpgrades.Pack(tuple.Tuple{roomID.String()})
+}
+
+func (r *RoomsDatabase) txnLookupRoomUpgrade(txn fdb.ReadTransaction, roomID id.RoomID) (*RoomUpgrade, error) {
+	b := txn.Get(r.KeyForRoomUpgrade(roomID)).MustGet()
+	if b == nil {
+		return nil, nil
+	}
+	var upgrade RoomUpgrade
+	if err := msgpack.Unmarshal(b, &upgrade); err != nil {
+		return nil, err
+	}
+	return &upgrade, nil
+}
+
+func (r *RoomsDatabase) txnStoreRoomUpgrade(txn fdb.Transaction, upgrade *RoomUpgrade) {
+	b, err := msgpack.Marshal(upgrade)
+	if err != nil {
+		panic(err)
+	}
+	txn.Set(r.KeyForRoomUpgrade(upgrade.RoomID), b)
+}
+
+// Store a new upgrade for a room, returns types.ErrRoomUpgradeInProgress if the
+// room is already being upgraded or types.ErrRoomAlreadyUpgraded if the room has
+// a tombstone.
+func (r *RoomsDatabase) StartRoomUpgrade(
+	ctx context.Context,
+	roomID id.RoomID,
+	sender id.UserID,
+	newVersion string,
+) (*RoomUpgrade, error) {
+	newRoomID, err := r.GenerateRoomID()
+	if err != nil {
+		return nil, err
+	}
+
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*RoomUpgrade, error) {
+		if existing, err := r.txnLookupRoomUpgrade(txn, roomID); err != nil {
+			return nil, err
+		} else if existing != nil {
+			return nil, types.ErrRoomUpgradeInProgress
+		}
+		if tombstoneID, err := r.events.TxnLookupCurrentRoomStateEventID(txn, roomID, event.StateTombstone, ""); err != nil {
+			return nil, err
+		} else if tombstoneID != "" {
+			return nil, types.ErrRoomAlreadyUpgraded
+		}
+
+		upgrade := &RoomUpgrade{
+			RoomID:     roomID,
+			NewRoomID:  newRoomID,
+			NewVersion: newVersion,
+			Sender:     sender,
+			Step:       RoomUpgradeStepCreateRoom,
+		}
+		r.txnStoreRoomUpgrade(txn, upgrade)
+		return upgrade, nil
+	})
+}
+
+func (r *RoomsDatabase) GetPendingRoomUpgrades(ctx context.Context) ([]*RoomUpgrade, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*RoomUpgrade, error) {
+		kvs, err := txn.GetRange(r.roomUpgrades, fdb.RangeOptions{
+			Mode: fdb.StreamingModeWantAll,
+		}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+		upgrades := make([]*RoomUpgrade, 0, len(kvs))
+		for _, kv := range kvs {
+			var upgrade RoomUpgrade
+			if err := msgpack.Unmarshal(kv.Value, &upgrade); err != nil {
+				return nil, err
+			}
+			upgrades = append(upgrades, &upgrade)
+		}
+		return upgrades, nil
+	})
+}
+
+// Run any remaining steps of a room upgrade under the room upgrade lock, if
+// the lock is held elsewhere the upgrade is already running and this returns
+// immediately.
+func (r *RoomsDatabase) RunRoomUpgrade(ctx context.Context, upgrade *RoomUpgrade) error {
+	var upgradeErr error
+	if err := lock.WithLockIfAvailable(ctx, r, roomUpgradeLockNamePrefix+upgrade.RoomID.String(), lock.LockOptions{
+		RefreshInterval: roomUpgradeLockRefresh,
+		Timeout:         roomUpgradeLockTimeout,
+	}, func(lock lock.Lock) {
+		defer lock.Release()
+		upgradeErr = r.runRoomUpgradeSteps(ctx, upgrade, lock)
+	}); err != nil {
+		return err
+	}
+	return upgradeErr
+}
+
+func (r *RoomsDatabase) runRoomUpgradeSteps(ctx context.Context, upgrade *RoomUpgrade, lock lock.Lock) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("room_id", upgrade.RoomID.String()).
+		Str("new_room_id", upgrade.NewRoomID.String()).
+		Logger()
+
+	// Re-read the upgrade now we hold the lock, another process may have
+	// progressed (or completed) it.
+	upgrade, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*RoomUpgrade, error) {
+		return r.txnLookupRoomUpgrade(txn, upgrade.RoomID)
+	})
+	if err != nil {
+		return err
+	} else if upgrade == nil {
+		return nil
+	}
+
+	for upgrade.Step != RoomUpgradeStepComplete {
+		lock.Refresh()
+
+		var evErr, err error
+		switch upgrade.Step {
+		case RoomUpgradeStepCreateRoom:
+			evErr, err = r.upgradeCreateRoom(ctx, upgrade)
+		case RoomUpgradeStepTombstone:
+			evErr, err = r.upgradeSendTombstone(ctx, upgrade)
+		case RoomUpgradeStepRestrictOldRoom:
+			evErr, err = r.upgradeRestrictOldRoom(ctx, upgrade)
+		}
+		if err != nil {
+			return fmt.Errorf("room upgrade step %d failed: %w", upgrade.Step, err)
+		} else if evErr != nil {
+			// The sender can't send the events (ie they've lost power since
+			// starting the upgrade), retrying won't help so abandon it.
+			log.Err(evErr).Int("step", int(upgrade.Step)).Msg("Abandoning room upgrade")
+			upgrade.Step = RoomUpgradeStepComplete
+		} else {
+			upgrade.Step += 1
+			log.Debug().Int("step", int(upgrade.Step)).Msg("Completed room upgrade step")
+		}
+
+		if _, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+			lock.TxnRefresh(txn)
+			if upgrade.Step == RoomUpgradeStepComplete {
+				txn.Clear(r.KeyForRoomUpgrade(upgrade.RoomID))
+			} else {
+				r.txnStoreRoomUpgrade(txn, upgrade)
+			}
+			return nil, nil
+		}); err != nil {
+			return err
+		} else if evErr != nil {
+			return evErr
+		}
+	}
+
+	log.Info().Msg("Completed room upgrade")
+	return nil
+}
+
+func (r *RoomsDatabase) getCurrentRoomStateContent(
+	ctx context.Context,
+	roomID id.RoomID,
+	evType event.Type,
+) (map[string]any, error) {
+	ev, err := r.GetCurrentRoomStateEvent(ctx, roomID, evType, "")
+	if err != nil || ev == nil {
+		return nil, err
+	}
+	var content map[string]any
+	if err := json.Unmarshal(ev.Content, &content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Returns (evErr, err) where evErr is the first event rejection
+func (r *RoomsDatabase) sendRoomUpgradeEvents(
+	ctx context.Context,
+	roomID id.RoomID,
+	evs []*types.PartialEvent,
+) (error, error) {
+	res, err := r.SendLocalEvents(ctx, roomID, evs, SendLocalEventsOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, rEv := range res.Rejected {
+		return rEv.Error, nil
+	}
+	return nil, nil
+}
+
+// Create the replacement room with the transferable state of the old room,
+// including bans.
+func (r *RoomsDatabase) upgradeCreateRoom(ctx context.Context, upgrade *RoomUpgrade) (error, error) {
+	// If we crashed after creating the room, nothing to do
+	if room, err := r.GetRoom(ctx, upgrade.NewRoomID); err != nil {
+		return nil, err
+	} else if room != nil {
+		return nil, nil
+	}
+
+	oldCreateContent, err := r.getCurrentRoomStateContent(ctx, upgrade.RoomID, event.StateCreate)
+	if err != nil {
+		return nil, err
+	} else if oldCreateContent == nil {
+		return nil, errors.New("old room create event not found")
+	}
+	extremIDs, err := r.GetRoomCurrentExtremEventIDs(ctx, upgrade.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	sKey := ""
+	sender := upgrade.Sender
+	senderStr := sender.String()
+
+	createContent := util.RoomUpgradeCreateContent(
+		oldCreateContent, sender, upgrade.NewVersion, upgrade.RoomID, extremIDs[0],
+	)
+
+	evs := []*types.PartialEvent{
+		types.NewPartialEvent(upgrade.NewRoomID, event.StateCreate, &sKey, sender, createContent),
+		types.NewPartialEvent(upgrade.NewRoomID, event.StateMember, &senderStr, sender, map[string]any{
+			"membership": event.MembershipJoin,
+		}),
+	}
+
+	powerLevelsContent, err := r.getCurrentRoomStateContent(ctx, upgrade.RoomID, event.StatePowerLevels)
+	if err != nil {
+		return nil, err
+	} else if powerLevelsContent == nil {
+		powerLevelsContent = map[string]any{}
+	}
+
+	// The sender may not have the power to send all the state we're copying,
+	// so start with them raised to the highest level and restore after.
+	raisedContent, err := util.RoomUpgradeRaisedPowerLevels(powerLevelsContent, sender)
+	if err != nil {
+		return nil, err
+	} else if raisedContent != nil {
+		evs = append(evs, types.NewPartialEvent(upgrade.NewRoomID, event.StatePowerLevels, &sKey, sender, raisedContent))
+	} else {
+		evs = append(evs, types.NewPartialEvent(upgrade.NewRoomID, event.StatePowerLevels, &sKey, sender, powerLevelsContent))
+	}
+
+	for _, evType := range roomUpgradeTransferableState {
+		content, err := r.getCurrentRoomStateContent(ctx, upgrade.RoomID, evType)
+		if err != nil {
+			return nil, err
+		} else if content == nil {
+			continue
+		}
+		evs = append(evs, types.NewPartialEvent(upgrade.NewRoomID, evType, &sKey, sender, content))
+	}
+
+	// Copy bans so banned users can't join the new room
+	memberEvs, err := r.GetCurrentRoomMemberEvents(ctx, upgrade.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, memberEv := range memberEvs {
+		if memberEv.Membership() != event.MembershipBan {
+			continue
+		}
+		var content map[string]any
+		if err := json.Unmarshal(memberEv.Content, &content); err != nil {
+			return nil, err
+		}
+		evs = append(evs, types.NewPartialEvent(upgrade.NewRoomID, event.StateMember, memberEv.StateKey, sender, content))
+	}
+
+	if raisedContent != nil {
+		evs = append(evs, types.NewPartialEvent(upgrade.NewRoomID, event.StatePowerLevels, &sKey, sender, powerLevelsContent))
+	}
+
+	return r.sendRoomUpgradeEvents(ctx, upgrade.NewRoomID, evs)
+}
+
+// Send the tombstone pointing the old room at the new one
+func (r *RoomsDatabase) upgradeSendTombstone(ctx context.Context, upgrade *RoomUpgrade) (error, error) {
+	tombstoneContent, err := r.getCurrentRoomStateContent(ctx, upgrade.RoomID, event.StateTombstone)
+	if err != nil {
+		return nil, err
+	} else if tombstoneContent != nil && tombstoneContent["replacement_room"] == upgrade.NewRoomID.String() {
+		return nil, nil
+	}
+
+	sKey := ""
+	return r.sendRoomUpgradeEvents(ctx, upgrade.RoomID, []*types.PartialEvent{
+		types.NewPartialEvent(upgrade.RoomID, event.StateTombstone, &sKey, upgrade.Sender, map[string]any{
+			"body":             "This room has been replaced",
+			"replacement_room": upgrade.NewRoomID,
+		}),
+	})
+}
+
+// Restrict the old room so only moderators can talk or invite, and move the
+// canonical alias and local aliases to the new room.
+func (r *RoomsDatabase) upgradeRestrictOldRoom(ctx context.Context, upgrade *RoomUpgrade) (error, error) {
+	if _, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		return nil, r.txnMoveRoomAliases(txn, upgrade.RoomID, upgrade.NewRoomID)
+	}); err != nil {
+		return nil, err
+	}
+
+	sKey := ""
+	evs := make([]*types.PartialEvent, 0, 2)
+
+	powerLevelsContent, err := r.getCurrentRoomStateContent(ctx, upgrade.RoomID, event.StatePowerLevels)
+	if err != nil {
+		return nil, err
+	} else if powerLevelsContent != nil {
+		evs = append(evs, types.NewPartialEvent(
+			upgrade.RoomID, event.StatePowerLevels, &sKey, upgrade.Sender,
+			util.RoomUpgradeRestrictedPowerLevels(powerLevelsContent),
+		))
+	}
+
+	if aliasContent, err := r.getCurrentRoomStateContent(ctx, upgrade.RoomID, event.StateCanonicalAlias); err != nil {
+		return nil, err
+	} else if len(aliasContent) > 0 {
+		evs = append(evs, types.NewPartialEvent(upgrade.RoomID, event.StateCanonicalAlias, &sKey, upgrade.Sender, map[string]any{}))
+	}
+
+	if len(evs) == 0 {
+		return nil, nil
+	}
+	return r.sendRoomUpgradeEvents(ctx, upgrade.RoomID, evs)
+}
@@ -17,6 +17,7 @@ import (
 
 	"github.com/beeper/babbleserv/internal/config"
 	"github.com/beeper/babbleserv/internal/databases/rooms/events"
+	"github.com/beeper/babbleserv/internal/databases/rooms/media"
 	"github.com/beeper/babbleserv/internal/databases/rooms/servers"
 	"github.com/beeper/babbleserv/internal/databases/rooms/users"
 	"github.com/beeper/babbleserv/internal/notifier"
@@ -40,13 +41,45 @@ type RoomsDatabase struct {
 	events  *events.EventsDirectory
 	users   *users.UsersDirectory
 	servers *servers.ServersDirectory
+	media   *media.MediaDirectory
 
 	byID,
 	byAlias,
 	byPublic subspace.Subspace
 
+	// Local aliases by room, so they can be moved when the room is upgraded
+	roomAliases subspace.Subspace
+
 	// The super stream combines, by room, events and receipts
 	superStream subspace.Subspace
+
+	// Federated events waiting to be processed, by room, and events given up
+	// on after repeated processing failures
+	inbox,
+	inboxRooms,
+	inboxFailed subspace.Subspace
+
+	// Rooms joined with partial state and events stored against it, by room
+	partialStateRooms,
+	partialStateEvents subspace.Subspace
+
+	// Pending room upgrades, by old room
+	roomUpgrades subspace.Subspace
+
+	// Remote servers peeking rooms, by room and by server
+	roomPeeks,
+	serverPeeks subspace.Subspace
+
+	// Pending and completed profile update jobs by user, and pending jobs
+	profileUpdates,
+	pendingProfileUpdates subspace.Subspace
+
+	// Full text search index by term and the indexed terms by event
+	searchTerms,
+	searchEvents subspace.Subspace
+
+	// Progress of each backfill, by name
+	backfills subspace.Subspace
 }
 
 func NewRoomsDatabase(
@@ -88,12 +121,35 @@ func NewRoomsDatabase(
 		events:  events.NewEventsDirectory(log, db, roomsDir),
 		users:   users.NewUsersDirectory(log, db, roomsDir),
 		servers: servers.NewServersDirectory(log, db, roomsDir),
+		media:   media.NewMediaDirectory(log, db, roomsDir),
 
 		byID:     roomsDir.Sub("id"),
 		byAlias:  roomsDir.Sub("as"),
 		byPublic: roomsDir.Sub("pb"),
 
+		roomAliases: roomsDir.Sub("ras"),
+
 		superStream: roomsDir.Sub("ss"),
+
+		inbox:       roomsDir.Sub("ibx"),
+		inboxRooms:  roomsDir.Sub("ibr"),
+		inboxFailed: roomsDir.Sub("ibf"),
+
+		partialStateRooms:  roomsDir.Sub("psr"),
+		partialStateEvents: roomsDir.Sub("pse"),
+
+		roomUpgrades: roomsDir.Sub("upg"),
+
+		roomPeeks:   roomsDir.Sub("rpk"),
+		serverPeeks: roomsDir.Sub("spk"),
+
+		profileUpdates:        roomsDir.Sub("pfu"),
+		pendingProfileUpdates: roomsDir.Sub("pfp"),
+
+		searchTerms:  roomsDir.Sub("stm"),
+		searchEvents: roomsDir.Sub("sev"),
+
+		backfills: roomsDir.Sub("bkf"),
 	}
 }
 
@@ -0,0 +1,455 @@
+package rooms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms/events"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Full text search over message bodies and room names & topics. The search
+// indexer worker iterates all events and adds their terms to an inverted index
+// by (term, room, version) so searches can be restricted to rooms and walk
+// matches newest first. The terms of each indexed event are also stored so
+// they can be removed when the event is redacted.
+// https://spec.matrix.org/v1.11/client-server-api/#server-side-search
+
+const (
+	searchIndexerPositionKey = "SearchIndexerPosition"
+
+	// Maximum index entries scanned per room for one search, this bounds the
+	// transaction time when searching for common terms.
+	maxSearchScanPerRoom = 1000
+	searchScanBatchSize  = 100
+)
+
+// Event types indexed for search and the content key that is indexed
+var searchIndexKeys = map[string]string{
+	event.EventMessage.Type:  "content.body",
+	event.StateRoomName.Type: "content.name",
+	event.StateTopic.Type:    "content.topic",
+}
+
+type SearchOptions struct {
+	// Tokenized search terms, events must match all of them
+	Terms []string
+	// Content keys to search, all indexed keys if empty
+	Keys []string
+	// Only return events before this version, for pagination
+	BeforeVersion tuple.Versionstamp
+	// Maximum results per room
+	Limit int
+	// Optional extra filter applied to matching events
+	Filter func(ev *types.Event) bool
+}
+
+type SearchResult struct {
+	Event   *types.Event
+	Version tuple.Versionstamp
+	// Proportion of the event's terms that matched the search
+	Rank float64
+}
+
+// Search terms (term, room_id, version) -> (event_id, key, term count)
+//
+
+func (r *RoomsDatabase) KeyForSearchTerm(term string, roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
+	return r.searchTerms.Pack(tuple.Tuple{term, roomID.String(), version})
+}
+
+func (r *RoomsDatabase) KeyToSearchTermVersion(key fdb.Key) tuple.Versionstamp {
+	tup, _ := r.searchTerms.Unpack(key)
+	return tup[2].(tuple.Versionstamp)
+}
+
+func (r *RoomsDatabase) RangeForSearchTerm(
+	term string,
+	roomID id.RoomID,
+	fromVersion, toVersion tuple.Versionstamp,
+) fdb.Range {
+	return types.GetVersionRange(r.searchTerms, fromVersion, toVersion, term, roomID.String())
+}
+
+// Search events (event_id) -> (room_id, version, terms...)
+//
+
+func (r *RoomsDatabase) KeyForSearchEvent(eventID id.EventID) fdb.Key {
+	return r.searchEvents.Pack(tuple.Tuple{eventID.String()})
+}
+
+func (r *RoomsDatabase) GetSearchIndexerPosition(ctx context.Context) (tuple.Versionstamp, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (tuple.Versionstamp, error) {
+		val, err := txn.Get(r.root.Pack(tuple.Tuple{searchIndexerPositionKey})).Get()
+		if err != nil {
+			return types.ZeroVersionstamp, err
+		} else if val == nil {
+			return types.ZeroVersionstamp, nil
+		}
+		return types.ValueToVersionstamp(val)
+	})
+}
+
+// Add a batch of events from the events iterator to the search index, removing
+// any events redacted in the batch, and move the indexer position past them.
+func (r *RoomsDatabase) IndexEventsForSearch(
+	ctx context.Context,
+	tups []types.EventIDTupWithVersion,
+	checkUpdateLock func(fdb.Transaction),
+) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		// Ensure that our lock is still valid before writing data
+		checkUpdateLock(txn)
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		for _, tup := range tups {
+			eventsProvider.WillGet(tup.EventID)
+		}
+
+		for _, tup := range tups {
+			ev, err := eventsProvider.Get(tup.EventID)
+			if err != nil {
+				return nil, err
+			} else if ev.SoftFailed || ev.Outlier || ev.Redacted {
+				continue
+			}
+
+			if ev.Type == event.EventRedaction {
+				if err := r.txnRemoveSearchEvent(txn, eventsProvider, ev, tup.Version); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			r.txnIndexSearchEvent(txn, ev, tup.Version)
+		}
+
+		r.txnSetSearchIndexerPositionAfter(txn, tups[len(tups)-1].Version)
+		return nil, nil
+	})
+	return err
+}
+
+// Move the indexer position past an event without indexing it, for events that
+// repeatedly fail to index so they don't block the indexer.
+func (r *RoomsDatabase) SkipEventForSearch(
+	ctx context.Context,
+	tup types.EventIDTupWithVersion,
+	checkUpdateLock func(fdb.Transaction),
+) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		checkUpdateLock(txn)
+		r.txnSetSearchIndexerPositionAfter(txn, tup.Version)
+		return nil, nil
+	})
+	return err
+}
+
+func (r *RoomsDatabase) txnSetSearchIndexerPositionAfter(txn fdb.Transaction, version tuple.Versionstamp) {
+	version.UserVersion += 1
+	txn.Set(r.root.Pack(tuple.Tuple{searchIndexerPositionKey}), types.ValueForVersionstamp(version))
+}
+
+func getRedactsEventID(ev *types.Event) id.EventID {
+	if ev.Redacts != "" {
+		return ev.Redacts
+	}
+	// Room v11+ moved redacts into the content
+	return id.EventID(gjson.GetBytes(ev.Content, "redacts").String())
+}
+
+func (r *RoomsDatabase) txnIndexSearchEvent(txn fdb.Transaction, ev *types.Event, version tuple.Versionstamp) {
+	key, found := searchIndexKeys[ev.Type.Type]
+	if !found || (ev.StateKey != nil && *ev.StateKey != "") {
+		return
+	}
+	terms := util.TokenizeSearchText(gjson.GetBytes(ev.Content, key).String())
+	if len(terms) == 0 {
+		return
+	}
+
+	termValue := tuple.Tuple{ev.ID.String(), key, int64(len(terms))}.Pack()
+	eventTup := tuple.Tuple{ev.RoomID.String(), version}
+	for _, term := range terms {
+		txn.Set(r.KeyForSearchTerm(term, ev.RoomID, version), termValue)
+		eventTup = append(eventTup, term)
+	}
+	txn.Set(r.KeyForSearchEvent(ev.ID), eventTup.Pack())
+}
+
+// Remove a redacted event from the search index, if the redaction is allowed
+// to redact it.
+func (r *RoomsDatabase) txnRemoveSearchEvent(
+	txn fdb.Transaction,
+	eventsProvider *events.TxnEventsProvider,
+	redactionEv *types.Event,
+	version tuple.Versionstamp,
+) error {
+	eventID := getRedactsEventID(redactionEv)
+	if eventID == "" {
+		return nil
+	}
+	b, err := txn.Get(r.KeyForSearchEvent(eventID)).Get()
+	if err != nil || b == nil {
+		return err
+	}
+	tup, err := tuple.Unpack(b)
+	if err != nil {
+		return err
+	}
+	roomID := id.RoomID(tup[0].(string))
+	if roomID != redactionEv.RoomID {
+		// Redactions can only apply to events in the same room
+		return nil
+	}
+
+	if allowed, err := r.txnIsRedactionAllowed(txn, eventsProvider, redactionEv, eventID, version); err != nil {
+		return err
+	} else if !allowed {
+		return nil
+	}
+
+	eventVersion := tup[1].(tuple.Versionstamp)
+	for _, term := range tup[2:] {
+		txn.Clear(r.KeyForSearchTerm(term.(string), roomID, eventVersion))
+	}
+	txn.Clear(r.KeyForSearchEvent(eventID))
+	return nil
+}
+
+// Check a redaction is by the redacted event's sender or a user with the redact
+// power level at the redaction.
+func (r *RoomsDatabase) txnIsRedactionAllowed(
+	txn fdb.ReadTransaction,
+	eventsProvider *events.TxnEventsProvider,
+	redactionEv *types.Event,
+	redactedEventID id.EventID,
+	version tuple.Versionstamp,
+) (bool, error) {
+	eventsProvider.WillGet(redactedEventID)
+	redactedEv, err := eventsProvider.Get(redactedEventID)
+	if err != nil {
+		return false, err
+	} else if redactionEv.CanRedact(redactedEv, nil) {
+		return true, nil
+	}
+
+	version.UserVersion += 1 // FDB range ends are exclusive
+	kvs, err := txn.GetRange(
+		r.events.RangeForRoomVersionStateTup(redactionEv.RoomID, event.StatePowerLevels, "", version),
+		fdb.RangeOptions{
+			Reverse: true,
+			Limit:   1,
+		},
+	).GetSliceWithError()
+	if err != nil {
+		return false, err
+	} else if len(kvs) == 0 {
+		return false, nil
+	}
+
+	powerLevelsEventID := id.EventID(kvs[0].Value)
+	eventsProvider.WillGet(powerLevelsEventID)
+	powerLevelsEv, err := eventsProvider.Get(powerLevelsEventID)
+	if err != nil {
+		return false, err
+	}
+	var powerLevels event.PowerLevelsEventContent
+	if err := json.Unmarshal(powerLevelsEv.Content, &powerLevels); err != nil {
+		return false, err
+	}
+	return redactionEv.CanRedact(redactedEv, &powerLevels), nil
+}
+
+// Search the given rooms for events matching all the terms, returning the most
+// recent matches in each room. Note this does not check history visibility.
+func (r *RoomsDatabase) SearchRoomEvents(
+	ctx context.Context,
+	roomIDs []id.RoomID,
+	options SearchOptions,
+) ([]SearchResult, error) {
+	if len(options.Terms) == 0 {
+		return nil, nil
+	}
+
+	results := make([]SearchResult, 0)
+	for _, roomID := range roomIDs {
+		roomResults, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]SearchResult, error) {
+			return r.txnSearchRoomEvents(ctx, txn, roomID, options)
+		})
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, roomResults...)
+	}
+
+	// Most recent first across all rooms
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		return bytes.Compare(b.Version.Bytes(), a.Version.Bytes())
+	})
+	return results, nil
+}
+
+func (r *RoomsDatabase) txnSearchRoomEvents(
+	ctx context.Context,
+	txn fdb.ReadTransaction,
+	roomID id.RoomID,
+	options SearchOptions,
+) ([]SearchResult, error) {
+	results := make([]SearchResult, 0, options.Limit)
+	eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+
+	// Walk the first term newest first and check the other terms exist for
+	// each candidate.
+	toVersion := options.BeforeVersion
+	scanned := 0
+	for scanned < maxSearchScanPerRoom && len(results) < options.Limit {
+		kvs, err := txn.GetRange(
+			r.RangeForSearchTerm(options.Terms[0], roomID, types.ZeroVersionstamp, toVersion),
+			fdb.RangeOptions{
+				Limit:   searchScanBatchSize,
+				Reverse: true,
+			},
+		).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		} else if len(kvs) == 0 {
+			break
+		}
+		scanned += len(kvs)
+
+		type candidate struct {
+			eventID   id.EventID
+			version   tuple.Versionstamp
+			termCount int64
+			others    []fdb.FutureByteSlice
+		}
+		candidates := make([]candidate, 0, len(kvs))
+		for _, kv := range kvs {
+			tup, err := tuple.Unpack(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			if len(options.Keys) > 0 && !slices.Contains(options.Keys, tup[1].(string)) {
+				continue
+			}
+			c := candidate{
+				eventID:   id.EventID(tup[0].(string)),
+				version:   r.KeyToSearchTermVersion(kv.Key),
+				termCount: tup[2].(int64),
+			}
+			for _, term := range options.Terms[1:] {
+				c.others = append(c.others, txn.Get(r.KeyForSearchTerm(term, roomID, c.version)))
+			}
+			candidates = append(candidates, c)
+		}
+
+		for _, c := range candidates {
+			matched := true
+			for _, other := range c.others {
+				if b, err := other.Get(); err != nil {
+					return nil, err
+				} else if b == nil {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+
+			eventsProvider.WillGet(c.eventID)
+			ev, err := eventsProvider.Get(c.eventID)
+			if err != nil {
+				return nil, err
+			} else if options.Filter != nil && !options.Filter(ev) {
+				continue
+			}
+			results = append(results, SearchResult{
+				Event:   ev,
+				Version: c.version,
+				Rank:    float64(len(options.Terms)) / float64(max(c.termCount, 1)),
+			})
+			if len(results) >= options.Limit {
+				break
+			}
+		}
+
+		toVersion = r.KeyToSearchTermVersion(kvs[len(kvs)-1].Key)
+		if len(kvs) < searchScanBatchSize {
+			break
+		}
+	}
+
+	return results, nil
+}
+
+// Get up to the given number of events either side of an event in a room, in
+// topological (stream) order. Note this does not check history visibility.
+func (r *RoomsDatabase) GetRoomEventContext(
+	ctx context.Context,
+	roomID id.RoomID,
+	eventID id.EventID,
+	beforeLimit, afterLimit int,
+) ([]*types.Event, []*types.Event, error) {
+	type eventContext struct {
+		before, after []*types.Event
+	}
+	evContext, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*eventContext, error) {
+		version, err := r.events.TxnLookupVersionForEventID(txn, eventID)
+		if err != nil {
+			return nil, err
+		}
+		afterVersion := version
+		afterVersion.UserVersion += 1 // FDB range starts are inclusive
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		getEvents := func(keyRange fdb.Range, limit int, reverse bool) ([]*types.Event, error) {
+			if limit <= 0 {
+				return []*types.Event{}, nil
+			}
+			kvs, err := txn.GetRange(keyRange, fdb.RangeOptions{
+				Limit:   limit,
+				Reverse: reverse,
+			}).GetSliceWithError()
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range kvs {
+				eventsProvider.WillGet(id.EventID(kv.Value))
+			}
+			evs := make([]*types.Event, 0, len(kvs))
+			for _, kv := range kvs {
+				ev, err := eventsProvider.Get(id.EventID(kv.Value))
+				if err != nil {
+					return nil, err
+				}
+				evs = append(evs, ev)
+			}
+			return evs, nil
+		}
+
+		before, err := getEvents(r.events.RangeForRoomVersion(roomID, types.ZeroVersionstamp, version), beforeLimit, true)
+		if err != nil {
+			return nil, err
+		}
+		after, err := getEvents(r.events.RangeForRoomVersion(roomID, afterVersion, types.ZeroVersionstamp), afterLimit, false)
+		if err != nil {
+			return nil, err
+		}
+		return &eventContext{before, after}, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return evContext.before, evContext.after, nil
+}
@@ -0,0 +1,35 @@
+package rooms
+
+import (
+	"context"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Get the current server ACL for a room, returns nil if the room has none
+func (r *RoomsDatabase) GetRoomServerACL(ctx context.Context, roomID id.RoomID) (*types.ServerACL, error) {
+	ev, err := r.GetCurrentRoomStateEvent(ctx, roomID, event.StateServerACL, "")
+	if err != nil || ev == nil {
+		return nil, err
+	}
+	return types.NewServerACLFromContent(ev.Content)
+}
+
+// Check whether the room's current server ACL allows a server, rooms with no
+// ACL allow all servers.
+func (r *RoomsDatabase) IsServerAllowedByRoomACL(
+	ctx context.Context,
+	roomID id.RoomID,
+	serverName string,
+) (bool, error) {
+	acl, err := r.GetRoomServerACL(ctx, roomID)
+	if err != nil {
+		return false, err
+	} else if acl == nil {
+		return true, nil
+	}
+	return acl.IsServerAllowed(serverName), nil
+}
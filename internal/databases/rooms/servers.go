@@ -2,11 +2,15 @@ package rooms
 
 import (
 	"context"
+	"slices"
+	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"github.com/vmihailenco/msgpack/v5"
 	"maunium.net/go/mautrix/id"
 
+	"github.com/beeper/babbleserv/internal/notifier"
 	"github.com/beeper/babbleserv/internal/types"
 	"github.com/beeper/babbleserv/internal/util"
 )
@@ -40,10 +44,80 @@ func (r *RoomsDatabase) GetServerPositions(ctx context.Context, serverName strin
 	})
 }
 
+// Queue EDUs to be sent to each of the given servers and wake up any federation
+// senders via the notifier.
+func (r *RoomsDatabase) QueueEDUsForServers(ctx context.Context, serverNames []string, edus []*types.EDU) error {
+	serverNames = slices.DeleteFunc(slices.Clone(serverNames), func(serverName string) bool {
+		return serverName == r.config.ServerName
+	})
+	if len(serverNames) == 0 || len(edus) == 0 {
+		return nil
+	}
+
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		for _, serverName := range serverNames {
+			r.servers.TxnQueueServerEDUs(txn, serverName, edus)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.notifier.SendChange(notifier.Change{Servers: serverNames})
+	return nil
+}
+
+// Queue EDUs to be sent to all servers currently in a room.
+func (r *RoomsDatabase) QueueEDUsForRoom(ctx context.Context, roomID id.RoomID, edus []*types.EDU) error {
+	serverNames, err := r.GetCurrentRoomServers(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	acl, err := r.GetRoomServerACL(ctx, roomID)
+	if err != nil {
+		return err
+	} else if acl != nil {
+		allowed := make([]string, 0, len(serverNames))
+		for _, serverName := range serverNames {
+			if acl.IsServerAllowed(serverName) {
+				allowed = append(allowed, serverName)
+			}
+		}
+		serverNames = allowed
+	}
+	return r.QueueEDUsForServers(ctx, serverNames, edus)
+}
+
+func (r *RoomsDatabase) GetServerEDUs(
+	ctx context.Context,
+	serverName string,
+	limit int,
+) ([]*types.EDU, tuple.Versionstamp, error) {
+	type result struct {
+		edus    []*types.EDU
+		version tuple.Versionstamp
+	}
+	res, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*result, error) {
+		edus, version, err := r.servers.TxnLookupServerEDUs(txn, serverName, limit)
+		if err != nil {
+			return nil, err
+		}
+		return &result{edus, version}, nil
+	})
+	if err != nil {
+		return nil, types.ZeroVersionstamp, err
+	}
+	return res.edus, res.version, nil
+}
+
+// Update server positions and clear any sent EDUs in a single transaction, such
+// that a sender never re-sends PDUs or EDUs that have been acknowledged.
 func (r *RoomsDatabase) UpdateServerPositions(
 	ctx context.Context,
 	serverName string,
 	versions types.VersionMap,
+	edusVersion tuple.Versionstamp,
 	checkUpdateLock func(fdb.Transaction),
 ) error {
 	data, err := msgpack.Marshal(versions)
@@ -54,9 +128,110 @@ func (r *RoomsDatabase) UpdateServerPositions(
 		// Ensure lock is still valid before writing data
 		checkUpdateLock(txn)
 
-		key := r.servers.KeyForServerPosition(serverName)
-		txn.Set(key, data)
+		txn.Set(r.servers.KeyForServerPosition(serverName), data)
+		if edusVersion != types.ZeroVersionstamp {
+			r.servers.TxnClearServerEDUs(txn, serverName, edusVersion)
+		}
 		return nil, nil
 	})
 	return err
 }
+
+func (r *RoomsDatabase) GetServerBackoff(ctx context.Context, serverName string) (*types.ServerBackoff, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.ServerBackoff, error) {
+		return r.servers.TxnLookupServerBackoff(txn, serverName)
+	})
+}
+
+func (r *RoomsDatabase) GetServerBackoffs(ctx context.Context) ([]*types.ServerBackoff, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*types.ServerBackoff, error) {
+		return r.servers.TxnLookupServerBackoffs(txn)
+	})
+}
+
+func (r *RoomsDatabase) IsServerDown(ctx context.Context, serverName string) (bool, error) {
+	backoff, err := r.GetServerBackoff(ctx, serverName)
+	if err != nil {
+		return false, err
+	}
+	return backoff != nil && backoff.IsDown(), nil
+}
+
+// Record a failed request to a server, incrementing the failure count and
+// calculating the next retry time.
+func (r *RoomsDatabase) RecordServerFailure(
+	ctx context.Context,
+	serverName string,
+	failErr error,
+) (*types.ServerBackoff, error) {
+	backoffCfg := r.config.Federation.Backoff
+
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*types.ServerBackoff, error) {
+		backoff, err := r.servers.TxnLookupServerBackoff(txn, serverName)
+		if err != nil {
+			return nil, err
+		} else if backoff == nil {
+			backoff = &types.ServerBackoff{ServerName: serverName}
+		}
+
+		now := time.Now()
+		backoff.Failures++
+		backoff.LastError = failErr.Error()
+		backoff.LastFailureTS = now.UnixMilli()
+		backoff.RetryAfterTS = now.Add(
+			util.GetBackoffDuration(backoff.Failures, backoffCfg.Initial, backoffCfg.Max),
+		).UnixMilli()
+		backoff.Down = backoff.Failures >= backoffCfg.DownAfterFailures
+
+		r.servers.TxnSetServerBackoff(txn, backoff)
+		return backoff, nil
+	})
+}
+
+// Reset any backoff for the server, returns true if there was one. Most calls
+// will not find a backoff so we check with a read transaction first to avoid
+// a write on every request.
+func (r *RoomsDatabase) ResetServerBackoff(ctx context.Context, serverName string) (bool, error) {
+	if backoff, err := r.GetServerBackoff(ctx, serverName); err != nil {
+		return false, err
+	} else if backoff == nil {
+		return false, nil
+	}
+
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		r.servers.TxnClearServerBackoff(txn, serverName)
+		return nil, nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Wake up the federation sender for this server so anything queued while
+	// we were backing off is sent immediately.
+	r.notifier.SendChange(notifier.Change{Servers: []string{serverName}})
+	return true, nil
+}
+
+func (r *RoomsDatabase) GetServerTransactionResponse(ctx context.Context, serverName, txnID string) ([]byte, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]byte, error) {
+		return r.servers.TxnLookupServerTransactionResponse(txn, serverName, txnID)
+	})
+}
+
+func (r *RoomsDatabase) StoreServerTransactionResponse(
+	ctx context.Context,
+	serverName, txnID string,
+	response []byte,
+) error {
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		r.servers.TxnStoreServerTransactionResponse(txn, serverName, txnID, response)
+		return nil, nil
+	})
+	return err
+}
+
+func (r *RoomsDatabase) PruneServerTransactions(ctx context.Context, before time.Time, limit int) (int, error) {
+	return util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (int, error) {
+		return r.servers.TxnPruneServerTransactions(txn, before, limit)
+	})
+}
@@ -0,0 +1,50 @@
+package servers
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func (s *ServersDirectory) TxnLookupServerBackoff(
+	txn fdb.ReadTransaction,
+	serverName string,
+) (*types.ServerBackoff, error) {
+	b, err := txn.Get(s.KeyForServerBackoff(serverName)).Get()
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, nil
+	}
+	return types.NewServerBackoffFromBytes(b)
+}
+
+func (s *ServersDirectory) TxnLookupServerBackoffs(txn fdb.ReadTransaction) ([]*types.ServerBackoff, error) {
+	iter := txn.GetRange(
+		s.RangeForServerBackoffs(),
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll},
+	).Iterator()
+
+	backoffs := make([]*types.ServerBackoff, 0)
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		backoff, err := types.NewServerBackoffFromBytes(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		backoffs = append(backoffs, backoff)
+	}
+
+	return backoffs, nil
+}
+
+func (s *ServersDirectory) TxnSetServerBackoff(txn fdb.Transaction, backoff *types.ServerBackoff) {
+	txn.Set(s.KeyForServerBackoff(backoff.ServerName), backoff.ToMsgpack())
+}
+
+func (s *ServersDirectory) TxnClearServerBackoff(txn fdb.Transaction, serverName string) {
+	txn.Clear(s.KeyForServerBackoff(serverName))
+}
@@ -0,0 +1,68 @@
+package servers
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func (s *ServersDirectory) TxnQueueServerEDUs(
+	txn fdb.Transaction,
+	serverName string,
+	edus []*types.EDU,
+) {
+	for i, edu := range edus {
+		// Use the user version to keep multiple EDUs in the same transaction
+		// unique and in the order given.
+		key := s.KeyForServerEDU(serverName, tuple.IncompleteVersionstamp(uint16(i)))
+		txn.SetVersionstampedKey(key, edu.ToMsgpack())
+	}
+}
+
+// Returns up to limit queued EDUs for the server, in order, along with the
+// version of the last EDU returned (ZeroVersionstamp if nothing queued).
+func (s *ServersDirectory) TxnLookupServerEDUs(
+	txn fdb.ReadTransaction,
+	serverName string,
+	limit int,
+) ([]*types.EDU, tuple.Versionstamp, error) {
+	iter := txn.GetRange(
+		s.RangeForServerEDUs(serverName, types.ZeroVersionstamp, types.ZeroVersionstamp),
+		fdb.RangeOptions{
+			Limit: limit,
+			Mode:  fdb.StreamingModeWantAll,
+		},
+	).Iterator()
+
+	edus := make([]*types.EDU, 0, limit)
+	lastVersion := types.ZeroVersionstamp
+
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, lastVersion, err
+		}
+		edu, err := types.NewEDUFromBytes(kv.Value)
+		if err != nil {
+			return nil, lastVersion, err
+		}
+		edus = append(edus, edu)
+		_, lastVersion = s.KeyToServerEDU(kv.Key)
+	}
+
+	return edus, lastVersion, nil
+}
+
+// Clears all queued EDUs for the server up to and including toVersion.
+func (s *ServersDirectory) TxnClearServerEDUs(
+	txn fdb.Transaction,
+	serverName string,
+	toVersion tuple.Versionstamp,
+) {
+	txn.ClearRange(fdb.KeyRange{
+		Begin: s.edus.Pack(tuple.Tuple{serverName}),
+		// Range end is exclusive so append a null byte to include toVersion
+		End: fdb.Key(append(s.edus.Pack(tuple.Tuple{serverName, toVersion}), 0x00)),
+	})
+}
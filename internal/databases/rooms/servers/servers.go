@@ -7,6 +7,8 @@ import (
 	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
 )
 
 type ServersDirectory struct {
@@ -16,7 +18,11 @@ type ServersDirectory struct {
 	joinedMembers,
 	memberships,
 	membershipChanges,
-	idToPosition subspace.Subspace
+	idToPosition,
+	edus,
+	backoffs,
+	transactions,
+	transactionTimes subspace.Subspace
 }
 
 func NewServersDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *ServersDirectory {
@@ -38,6 +44,12 @@ func NewServersDirectory(logger zerolog.Logger, db fdb.Database, parentDir direc
 		membershipChanges: serversDir.Sub("mch"),
 
 		idToPosition: serversDir.Sub("itt"),
+
+		edus:     serversDir.Sub("edu"),
+		backoffs: serversDir.Sub("bof"),
+
+		transactions:     serversDir.Sub("txn"),
+		transactionTimes: serversDir.Sub("txt"),
 	}
 }
 
@@ -49,6 +61,14 @@ func (s *ServersDirectory) KeyForServerPosition(serverName string) fdb.Key {
 	return s.idToPosition.Pack(tuple.Tuple{serverName})
 }
 
+func (s *ServersDirectory) KeyForServerBackoff(serverName string) fdb.Key {
+	return s.backoffs.Pack(tuple.Tuple{serverName})
+}
+
+func (s *ServersDirectory) RangeForServerBackoffs() fdb.Range {
+	return s.backoffs
+}
+
 // Server joined members (room_id, server_name, username) -> ''
 //
 
@@ -83,3 +103,50 @@ func (s *ServersDirectory) KeyForServerMembershipChange(serverName string, versi
 	}
 	return key
 }
+
+// Server EDU queue (server_name, version) -> EDU msgpack
+//
+
+func (s *ServersDirectory) KeyForServerEDU(serverName string, version tuple.Versionstamp) fdb.Key {
+	key, err := s.edus.PackWithVersionstamp(tuple.Tuple{
+		serverName, version,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func (s *ServersDirectory) KeyToServerEDU(key fdb.Key) (string, tuple.Versionstamp) {
+	tup, _ := s.edus.Unpack(key)
+	return tup[0].(string), tup[1].(tuple.Versionstamp)
+}
+
+func (s *ServersDirectory) RangeForServerEDUs(serverName string, fromVersion, toVersion tuple.Versionstamp) fdb.Range {
+	return types.GetVersionRange(s.edus, fromVersion, toVersion, serverName)
+}
+
+// Server inbound transactions (server_name, txn_id) -> (ts, response JSON)
+// Transaction times (ts, server_name, txn_id) -> ''
+//
+
+func (s *ServersDirectory) KeyForServerTransaction(serverName, txnID string) fdb.Key {
+	return s.transactions.Pack(tuple.Tuple{serverName, txnID})
+}
+
+func (s *ServersDirectory) KeyForServerTransactionTime(ts int64, serverName, txnID string) fdb.Key {
+	return s.transactionTimes.Pack(tuple.Tuple{ts, serverName, txnID})
+}
+
+func (s *ServersDirectory) KeyToServerTransactionTime(key fdb.Key) (int64, string, string) {
+	tup, _ := s.transactionTimes.Unpack(key)
+	return tup[0].(int64), tup[1].(string), tup[2].(string)
+}
+
+func (s *ServersDirectory) RangeForServerTransactionTimesBefore(ts int64) fdb.Range {
+	begin, _ := s.transactionTimes.FDBRangeKeys()
+	return fdb.KeyRange{
+		Begin: begin,
+		End:   s.transactionTimes.Pack(tuple.Tuple{ts}),
+	}
+}
@@ -0,0 +1,62 @@
+package servers
+
+import (
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+func (s *ServersDirectory) TxnLookupServerTransactionResponse(
+	txn fdb.ReadTransaction,
+	serverName, txnID string,
+) ([]byte, error) {
+	b, err := txn.Get(s.KeyForServerTransaction(serverName, txnID)).Get()
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, nil
+	}
+	tup, err := tuple.Unpack(b)
+	if err != nil {
+		return nil, err
+	}
+	return tup[1].([]byte), nil
+}
+
+func (s *ServersDirectory) TxnStoreServerTransactionResponse(
+	txn fdb.Transaction,
+	serverName, txnID string,
+	response []byte,
+) {
+	ts := time.Now().UnixMilli()
+	txn.Set(s.KeyForServerTransaction(serverName, txnID), tuple.Tuple{ts, response}.Pack())
+	txn.Set(s.KeyForServerTransactionTime(ts, serverName, txnID), nil)
+}
+
+// Remove up to limit stored transaction responses from before ts, returning the
+// number removed.
+func (s *ServersDirectory) TxnPruneServerTransactions(
+	txn fdb.Transaction,
+	before time.Time,
+	limit int,
+) (int, error) {
+	iter := txn.GetRange(
+		s.RangeForServerTransactionTimesBefore(before.UnixMilli()),
+		fdb.RangeOptions{Limit: limit},
+	).Iterator()
+
+	var pruned int
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return pruned, err
+		}
+		_, serverName, txnID := s.KeyToServerTransactionTime(kv.Key)
+		txn.Clear(kv.Key)
+		txn.Clear(s.KeyForServerTransaction(serverName, txnID))
+		pruned++
+	}
+
+	return pruned, nil
+}
@@ -0,0 +1,87 @@
+package rooms
+
+import (
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Find the closest room event to a time in the given direction, mapping the time
+// to a version using the time to version index and then finding the nearest
+// event in the room by version. Note this is by the time we stored events, not
+// their origin server timestamp. Returns nil if there is no event.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidtimestamp_to_event
+func (r *RoomsDatabase) GetRoomEventForTime(
+	ctx context.Context,
+	roomID id.RoomID,
+	t time.Time,
+	forward bool,
+) (*types.Event, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.Event, error) {
+		version, err := util.TxnLookupVersionForTime(txn, t, forward)
+		if err != nil {
+			return nil, err
+		} else if version == types.ZeroVersionstamp {
+			return nil, nil
+		}
+
+		var keyRange fdb.Range
+		if forward {
+			keyRange = r.events.RangeForRoomVersion(roomID, version, types.ZeroVersionstamp)
+		} else {
+			version.UserVersion += 1 // FDB range ends are exclusive
+			keyRange = r.events.RangeForRoomVersion(roomID, types.ZeroVersionstamp, version)
+		}
+
+		kvs, err := txn.GetRange(keyRange, fdb.RangeOptions{
+			Limit:   1,
+			Reverse: !forward,
+		}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		} else if len(kvs) == 0 {
+			return nil, nil
+		}
+
+		eventID := id.EventID(kvs[0].Value)
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		eventsProvider.WillGet(eventID)
+		return eventsProvider.Get(eventID)
+	})
+}
+
+// Get the first event we have in a room, which is only the create event if we
+// have the room's full history.
+func (r *RoomsDatabase) GetRoomFirstEvent(ctx context.Context, roomID id.RoomID) (*types.Event, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.Event, error) {
+		kvs, err := txn.GetRange(
+			r.events.RangeForRoomVersion(roomID, types.ZeroVersionstamp, types.ZeroVersionstamp),
+			fdb.RangeOptions{Limit: 1},
+		).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		} else if len(kvs) == 0 {
+			return nil, nil
+		}
+
+		eventID := id.EventID(kvs[0].Value)
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		eventsProvider.WillGet(eventID)
+		return eventsProvider.Get(eventID)
+	})
+}
+
+// Prune the time to version index in the rooms database, see util.PruneTimeToVersion
+func (r *RoomsDatabase) PruneTimeToVersion(
+	ctx context.Context,
+	before time.Time,
+	granularity time.Duration,
+	afterBatch func(),
+) (int, error) {
+	return util.PruneTimeToVersion(ctx, r.db, before, granularity, afterBatch)
+}
@@ -0,0 +1,141 @@
+package rooms
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	// Maximum directory term keys scanned for a single search
+	maxUserDirectoryScan = 1000
+	// Candidates checked for visibility per read transaction
+	userDirectoryVisibilityBatchSize = 50
+)
+
+// Update the user directory for a join event. Local users are always listed
+// with their global profile, remote users with the profile from their latest
+// join event in any room we're in.
+func (r *RoomsDatabase) txnUpdateUserDirectoryForMemberEvent(txn fdb.Transaction, ev *types.Event) {
+	if ev.Membership() != event.MembershipJoin {
+		return
+	}
+	userID := id.UserID(*ev.StateKey)
+
+	displayName := gjson.GetBytes(ev.Content, "displayname").String()
+	avatarURL := gjson.GetBytes(ev.Content, "avatar_url").String()
+	if userID.Homeserver() == r.config.ServerName {
+		if b := txn.Get(r.users.KeyForUserProfile(userID)).MustGet(); b != nil {
+			profile := types.MustNewUserProfileFromBytes(b)
+			displayName, avatarURL = profile.DisplayName, profile.AvatarURL
+		}
+	}
+
+	if err := r.users.TxnUpdateUserDirectoryEntry(txn, userID, displayName, avatarURL); err != nil {
+		panic(err)
+	}
+}
+
+// Search the user directory for users visible to the searcher, depending on
+// configuration this is either all local users or only those who share a room
+// with the searcher. Users in public rooms are always visible. Candidates are
+// checked in sorted order over multiple transactions, stopping once there are
+// enough visible users. Returns whether the results were limited.
+// https://spec.matrix.org/v1.11/client-server-api/#user-directory
+func (r *RoomsDatabase) SearchUserDirectory(
+	ctx context.Context,
+	searcherID id.UserID,
+	searchTerm string,
+	limit int,
+) ([]*types.UserDirectoryEntry, bool, error) {
+	terms := util.TokenizeSearchText(searchTerm)
+
+	type searchResult struct {
+		entries             []*types.UserDirectoryEntry
+		limited             bool
+		searcherMemberships types.Memberships
+	}
+	res, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (searchResult, error) {
+		entries, limited, err := r.users.TxnSearchUserDirectory(txn, terms, maxUserDirectoryScan)
+		if err != nil || len(entries) == 0 {
+			return searchResult{entries: entries, limited: limited}, err
+		}
+		searcherMemberships, err := r.users.TxnLookupUserMemberships(txn, searcherID)
+		return searchResult{entries, limited, searcherMemberships}, err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	entries := res.entries
+	slices.SortFunc(entries, func(a, b *types.UserDirectoryEntry) int {
+		return cmp.Or(
+			cmp.Compare(strings.ToLower(a.DisplayName), strings.ToLower(b.DisplayName)),
+			cmp.Compare(a.UserID, b.UserID),
+		)
+	})
+
+	publicRooms := make(map[id.RoomID]bool)
+	visibleEntries := make([]*types.UserDirectoryEntry, 0, min(len(entries), limit+1))
+	for start := 0; start < len(entries) && len(visibleEntries) <= limit; start += userDirectoryVisibilityBatchSize {
+		batch := entries[start:min(start+userDirectoryVisibilityBatchSize, len(entries))]
+		visibleBatch, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]*types.UserDirectoryEntry, error) {
+			isPublicRoom := func(roomID id.RoomID) (bool, error) {
+				if public, found := publicRooms[roomID]; found {
+					return public, nil
+				}
+				b, err := txn.Get(r.KeyForRoom(roomID)).Get()
+				if err != nil {
+					return false, err
+				}
+				public := b != nil && types.MustNewRoomFromBytes(b).JoinRule == string(event.JoinRulePublic)
+				publicRooms[roomID] = public
+				return public, nil
+			}
+
+			visibleBatch := make([]*types.UserDirectoryEntry, 0, len(batch))
+			for _, entry := range batch {
+				if len(visibleEntries)+len(visibleBatch) > limit {
+					break
+				}
+				if r.config.UserDirectory.SearchAllUsers && entry.UserID.Homeserver() == r.config.ServerName {
+					visibleBatch = append(visibleBatch, entry)
+					continue
+				}
+				var memberships types.Memberships
+				if entry.UserID != searcherID {
+					var err error
+					if memberships, err = r.users.TxnLookupUserMemberships(txn, entry.UserID); err != nil {
+						return nil, err
+					}
+				}
+				if visible, err := types.IsUserVisibleInDirectory(
+					searcherID, res.searcherMemberships, entry.UserID, memberships, isPublicRoom,
+				); err != nil {
+					return nil, err
+				} else if visible {
+					visibleBatch = append(visibleBatch, entry)
+				}
+			}
+			return visibleBatch, nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		visibleEntries = append(visibleEntries, visibleBatch...)
+	}
+
+	if len(visibleEntries) > limit {
+		return visibleEntries[:limit], true, nil
+	}
+	return visibleEntries, res.limited, nil
+}
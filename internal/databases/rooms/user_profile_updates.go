@@ -0,0 +1,330 @@
+package rooms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+// Per the (somewhat ridiculous) profiles spec, when a user changes their profile
+// we must send an updated member event to *every room the user is joined to*:
+// https://spec.matrix.org/v1.10/client-server-api/#events-on-change-of-profile-information
+//
+// This is stored as a job alongside the profile change and run in batches of
+// rooms, paging through the user's memberships, so it resumes (via the profile
+// updater worker) if interrupted. Rooms where the member event already matches
+// the profile are skipped, which makes re-running a batch safe. A newer profile change replaces any running job.
+
+const (
+	profileUpdateLockNamePrefix = "ProfileUpdateLock:"
+	profileUpdateLockRefresh    = time.Second * 5
+	profileUpdateLockTimeout    = time.Second * 30
+	profileUpdateBatchSize      = 10
+)
+
+// Profile updates (user_id) -> ProfileUpdate msgpack
+//
+
+func (r *RoomsDatabase) KeyForProfileUpdate(userID id.UserID) fdb.Key {
+	return r.profileUpdates.Pack(tuple.Tuple{userID.String()})
+}
+
+// Pending profile updates (user_id) -> nil
+//
+
+func (r *RoomsDatabase) KeyForPendingProfileUpdate(userID id.UserID) fdb.Key {
+	return r.pendingProfileUpdates.Pack(tuple.Tuple{userID.String()})
+}
+
+func (r *RoomsDatabase) KeyToPendingProfileUpdate(key fdb.Key) id.UserID {
+	tup, _ := r.pendingProfileUpdates.Unpack(key)
+	return id.UserID(tup[0].(string))
+}
+
+func (r *RoomsDatabase) txnLookupProfileUpdate(txn fdb.ReadTransaction, userID id.UserID) (*types.ProfileUpdate, error) {
+	b, err := txn.Get(r.KeyForProfileUpdate(userID)).Get()
+	if err != nil || b == nil {
+		return nil, err
+	}
+	return types.NewProfileUpdateFromBytes(b)
+}
+
+// Store a profile update, keeping the pending index in sync so the profile
+// updater worker only scans jobs that still need running.
+func (r *RoomsDatabase) txnStoreProfileUpdate(txn fdb.Transaction, update *types.ProfileUpdate) {
+	txn.Set(r.KeyForProfileUpdate(update.UserID), update.ToMsgpack())
+	if update.Complete {
+		txn.Clear(r.KeyForPendingProfileUpdate(update.UserID))
+	} else {
+		txn.Set(r.KeyForPendingProfileUpdate(update.UserID), nil)
+	}
+}
+
+// Start a new profile update job for the user's current joined rooms,
+// replacing any existing job. Only the count of rooms is stored, the job pages
+// through the user's memberships as it runs.
+func (r *RoomsDatabase) txnStartProfileUpdate(txn fdb.Transaction, userID id.UserID) error {
+	memberships, err := r.users.TxnLookupUserMemberships(txn, userID)
+	if err != nil {
+		return err
+	}
+	totalRooms := 0
+	for _, membershipTup := range memberships {
+		if membershipTup.Membership == event.MembershipJoin {
+			totalRooms++
+		}
+	}
+
+	r.txnStoreProfileUpdate(txn, types.NewProfileUpdate(userID, xid.New().String(), totalRooms, time.Now()))
+	return nil
+}
+
+// Get up to limit rooms the user is joined to after the cursor room, and the
+// cursor to continue from which is empty once there are no more rooms.
+func (r *RoomsDatabase) txnLookupProfileUpdateBatch(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	cursor id.RoomID,
+	limit int,
+) ([]id.RoomID, id.RoomID, error) {
+	var cursorKey string
+	if cursor != "" {
+		cursorKey = string(r.users.KeyForUserMembership(userID, cursor))
+	}
+	iter := txn.GetRange(
+		rangeForKeysAfter(r.users.RangeForUserMemberships(userID), cursorKey),
+		fdb.RangeOptions{
+			Mode: fdb.StreamingModeIterator,
+		},
+	).Iterator()
+
+	roomIDs := make([]id.RoomID, 0, limit)
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, "", err
+		}
+		membershipTup := types.ValueToMembershipTup(kv.Value)
+		if membershipTup.Membership != event.MembershipJoin {
+			continue
+		}
+		roomIDs = append(roomIDs, membershipTup.RoomID)
+		if len(roomIDs) == limit {
+			return roomIDs, membershipTup.RoomID, nil
+		}
+	}
+	return roomIDs, "", nil
+}
+
+// Get the latest profile update job for a user, including completed ones
+func (r *RoomsDatabase) GetProfileUpdate(ctx context.Context, userID id.UserID) (*types.ProfileUpdate, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.ProfileUpdate, error) {
+		return r.txnLookupProfileUpdate(txn, userID)
+	})
+}
+
+// Get up to limit users with incomplete profile update jobs
+func (r *RoomsDatabase) GetPendingProfileUpdateUserIDs(ctx context.Context, limit int) ([]id.UserID, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) ([]id.UserID, error) {
+		kvs, err := txn.GetRange(r.pendingProfileUpdates, fdb.RangeOptions{
+			Limit: limit,
+			Mode:  fdb.StreamingModeWantAll,
+		}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+		userIDs := make([]id.UserID, 0, len(kvs))
+		for _, kv := range kvs {
+			userIDs = append(userIDs, r.KeyToPendingProfileUpdate(kv.Key))
+		}
+		return userIDs, nil
+	})
+}
+
+// Run the remaining batches of a user's profile update under the profile update
+// lock, if the lock is held elsewhere the update is already running and this
+// returns immediately.
+func (r *RoomsDatabase) RunProfileUpdate(ctx context.Context, userID id.UserID) error {
+	var updateErr error
+	if err := lock.WithLockIfAvailable(ctx, r, profileUpdateLockNamePrefix+userID.String(), lock.LockOptions{
+		RefreshInterval: profileUpdateLockRefresh,
+		Timeout:         profileUpdateLockTimeout,
+	}, func(lock lock.Lock) {
+		defer lock.Release()
+		updateErr = r.runProfileUpdateBatches(ctx, userID, lock)
+	}); err != nil {
+		return err
+	}
+	return updateErr
+}
+
+func (r *RoomsDatabase) runProfileUpdateBatches(ctx context.Context, userID id.UserID, lock lock.Lock) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("user_id", userID.String()).
+		Logger()
+
+	for {
+		lock.Refresh()
+
+		// Re-read the job and profile for each batch, either may be replaced
+		// by a newer profile change while we're running.
+		var profile *types.UserProfile
+		var batch []id.RoomID
+		var nextCursor id.RoomID
+		update, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.ProfileUpdate, error) {
+			if b, err := txn.Get(r.users.KeyForUserProfile(userID)).Get(); err != nil {
+				return nil, err
+			} else if b != nil {
+				profile = types.MustNewUserProfileFromBytes(b)
+			} else {
+				profile = &types.UserProfile{}
+			}
+			update, err := r.txnLookupProfileUpdate(txn, userID)
+			if err != nil || update == nil || update.Complete {
+				return update, err
+			}
+			batch, nextCursor, err = r.txnLookupProfileUpdateBatch(txn, userID, update.Cursor, profileUpdateBatchSize)
+			return update, err
+		})
+		if err != nil {
+			return err
+		} else if update == nil || update.Complete {
+			return nil
+		}
+
+		var updated, skipped, failed int
+		for _, roomID := range batch {
+			sent, evErr, err := r.sendProfileMemberEvent(ctx, userID, roomID, profile)
+			if err != nil {
+				return err
+			} else if evErr != nil {
+				log.Warn().
+					Err(evErr).
+					Str("room_id", roomID.String()).
+					Msg("Updated member event not allowed")
+				failed++
+			} else if sent {
+				updated++
+			} else {
+				skipped++
+			}
+		}
+
+		if _, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+			lock.TxnRefresh(txn)
+
+			current, err := r.txnLookupProfileUpdate(txn, userID)
+			if err != nil {
+				return nil, err
+			} else if current == nil || current.JobID != update.JobID {
+				// Replaced by a newer profile change, the next loop picks it up
+				return nil, nil
+			}
+
+			current.CompleteBatch(nextCursor, updated, skipped, failed, time.Now())
+			r.txnStoreProfileUpdate(txn, current)
+			return nil, nil
+		}); err != nil {
+			return err
+		}
+
+		log.Debug().
+			Int("processed", update.ProcessedRooms+len(batch)).
+			Int("total", update.TotalRooms).
+			Msg("Completed profile update batch")
+	}
+}
+
+// Send an updated member event for the user to the room if they're still joined
+// and the current member event doesn't match their profile. Returns whether an
+// event was sent and (evErr, err) where evErr is the event rejection.
+func (r *RoomsDatabase) sendProfileMemberEvent(
+	ctx context.Context,
+	userID id.UserID,
+	roomID id.RoomID,
+	profile *types.UserProfile,
+) (bool, error, error) {
+	memberEv, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*types.Event, error) {
+		b, err := txn.Get(r.events.KeyForCurrentRoomMember(roomID, userID)).Get()
+		if err != nil || b == nil {
+			return nil, err
+		}
+		membershipTup := types.ValueToMembershipTup(b)
+		if membershipTup.Membership != event.MembershipJoin {
+			return nil, nil
+		}
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		eventsProvider.WillGet(membershipTup.EventID)
+		return eventsProvider.Get(membershipTup.EventID)
+	})
+	if err != nil {
+		return false, nil, err
+	} else if memberEv == nil {
+		return false, nil, nil
+	}
+
+	content := profile.ToMembershipContent()
+	if matches, err := memberContentMatchesProfile(memberEv.Content, content); err != nil {
+		return false, nil, err
+	} else if matches {
+		return false, nil, nil
+	}
+
+	content["membership"] = event.MembershipJoin
+	sKey := userID.String()
+	results, err := r.SendLocalEvents(
+		ctx,
+		roomID,
+		[]*types.PartialEvent{types.NewPartialEvent(roomID, event.StateMember, &sKey, userID, content)},
+		SendLocalEventsOptions{},
+	)
+	if err != nil {
+		return false, nil, err
+	} else if len(results.Rejected) > 0 {
+		return false, results.Rejected[0].Error, nil
+	}
+	return true, nil, nil
+}
+
+// Check the member event content has exactly the profile fields
+func memberContentMatchesProfile(memberContent json.RawMessage, profileContent map[string]any) (bool, error) {
+	var existing map[string]any
+	if err := json.Unmarshal(memberContent, &existing); err != nil {
+		return false, err
+	}
+	for _, key := range []string{"displayname", "avatar_url"} {
+		if _, found := profileContent[key]; !found && existing[key] != nil {
+			return false, nil
+		}
+	}
+	for key, value := range profileContent {
+		existingValue, found := existing[key]
+		if !found {
+			return false, nil
+		}
+		a, err := json.Marshal(existingValue)
+		if err != nil {
+			return false, err
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(a, b) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -2,10 +2,11 @@ package rooms
 
 import (
 	"context"
+	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/rs/zerolog"
-	"maunium.net/go/mautrix/event"
+	"github.com/vmihailenco/msgpack/v5"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/types"
@@ -23,89 +24,164 @@ func (r *RoomsDatabase) GetUserProfile(ctx context.Context, userID id.UserID) (*
 	})
 }
 
+// Set (or, if value is nil, delete) a profile field. If the display name or
+// avatar URL changed a profile update job is started to send updated member
+// events to the user's joined rooms, see user_profile_updates.go. Returns
+// types.ErrProfileTooLarge if the profile would exceed the size limit.
 func (r *RoomsDatabase) UpdateUserProfile(ctx context.Context, userID id.UserID, key string, value any) error {
-	// Per the (somewhat ridiculous) profiles spec, here we must update the
-	// profile and then send an event to *every room the user is joined in* to
-	// update the in-room membership state event:
-	// https://spec.matrix.org/v1.10/client-server-api/#events-on-change-of-profile-information
-
-	// We do the membership event updates in a background goroutine after the
-	// profile update. We grab the memberships *at time of profile update*.
-	var profile *types.UserProfile
-	memberships, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (types.Memberships, error) {
+	var startedUpdate bool
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		startedUpdate = false
+
 		profileKey := r.users.KeyForUserProfile(userID)
 		b := txn.Get(profileKey).MustGet()
+		var profile *types.UserProfile
 		if b == nil {
 			profile = &types.UserProfile{}
 		} else {
 			profile = types.MustNewUserProfileFromBytes(b)
 		}
 
-		switch key {
-		case "displayname":
-			if profile.DisplayName == value {
-				return nil, types.ErrProfileNotChanged
-			}
-			profile.DisplayName = value.(string)
-		case "avatar_url":
-			if profile.AvatarURL == value {
-				return nil, types.ErrProfileNotChanged
-			}
-			profile.AvatarURL = value.(string)
-		default:
-			profile.Custom[key] = value
+		var changed bool
+		if value == nil {
+			changed = profile.Delete(key)
+		} else {
+			changed = profile.Set(key, value)
+		}
+		if !changed {
+			return nil, types.ErrProfileNotChanged
+		} else if profile.Size() > types.MaxUserProfileSize {
+			return nil, types.ErrProfileTooLarge
 		}
 
 		txn.Set(profileKey, profile.ToMsgpack())
 
-		return r.users.TxnLookupUserMemberships(txn, userID)
+		if key != types.UserProfileKeyDisplayName && key != types.UserProfileKeyAvatarURL {
+			// Extended fields don't appear in member events or the directory
+			return nil, nil
+		}
+
+		if err := r.users.TxnUpdateUserDirectoryEntry(txn, userID, profile.DisplayName, profile.AvatarURL); err != nil {
+			return nil, err
+		}
+		startedUpdate = true
+		return nil, r.txnStartProfileUpdate(txn, userID)
 	})
-	if err != nil {
+	if err != nil || !startedUpdate {
 		return err
 	}
 
-	// Now we have our memberships, kick off a background task to generate the
-	// member event updates.
+	// Start running the job now, if we die part way the profile updater worker
+	// will resume it.
 	backgroundCtx := zerolog.Ctx(ctx).With().
-		Str("background_task", "SendMemberEventsAfterProfileUpdate").
+		Str("background_task", "RunProfileUpdate").
 		Logger().
 		WithContext(context.Background())
-	log := zerolog.Ctx(backgroundCtx)
 
 	r.backgroundWg.Add(1)
 	go func() {
 		defer r.backgroundWg.Done()
+		if err := r.RunProfileUpdate(backgroundCtx, userID); err != nil {
+			zerolog.Ctx(backgroundCtx).Err(err).Msg("Failed to run profile update")
+		}
+	}()
 
-		var updated int
-		for roomID, membershipTup := range memberships {
-			if membershipTup.Membership != event.MembershipJoin {
-				continue
-			}
+	return nil
+}
 
-			content := profile.ToMembershipContent()
-			content["membership"] = membershipTup.Membership
-			sKey := string(userID)
-
-			partialEv := types.NewPartialEvent(roomID, event.StateMember, &sKey, userID, content)
-
-			results, err := r.SendLocalEvents(
-				backgroundCtx,
-				roomID,
-				[]*types.PartialEvent{partialEv},
-				SendLocalEventsOptions{},
-			)
-			if err != nil {
-				log.Err(err).Msg("Failed to send updated member event")
-			} else if len(results.Rejected) > 0 {
-				err := results.Rejected[0].Error
-				log.Warn().Err(err).Msg("Updated member event not allowed")
-			} else {
-				updated++
-			}
+// Get a cached remote user profile and whether it is older than maxAge, or nil
+// if we have no cached profile.
+func (r *RoomsDatabase) GetCachedRemoteUserProfile(
+	ctx context.Context,
+	userID id.UserID,
+	maxAge time.Duration,
+) (*types.UserProfile, bool, error) {
+	type cachedProfile struct {
+		profile *types.UserProfile
+		expired bool
+	}
+	cached, err := util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (*cachedProfile, error) {
+		b, err := txn.Get(r.users.KeyForRemoteUserProfile(userID)).Get()
+		if err != nil || b == nil {
+			return nil, err
+		}
+		var remote types.RemoteUserProfile
+		if err := msgpack.Unmarshal(b, &remote); err != nil {
+			return nil, err
 		}
+		return &cachedProfile{
+			profile: remote.Profile,
+			expired: time.Since(time.UnixMilli(remote.FetchedAt)) > maxAge,
+		}, nil
+	})
+	if err != nil || cached == nil {
+		return nil, false, err
+	}
+	return cached.profile, cached.expired, nil
+}
 
-		log.Info().Int("updated", updated).Msg("Send updated member events")
-	}()
+func (r *RoomsDatabase) StoreRemoteUserProfile(ctx context.Context, userID id.UserID, profile *types.UserProfile) error {
+	if profile.Size() > types.MaxUserProfileSize {
+		return types.ErrProfileTooLarge
+	}
+	_, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (*struct{}, error) {
+		b, err := msgpack.Marshal(types.RemoteUserProfile{
+			Profile:   profile,
+			FetchedAt: time.Now().UnixMilli(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		txn.Set(r.users.KeyForRemoteUserProfile(userID), b)
+		return nil, nil
+	})
+	return err
+}
 
-	return nil
+// Clear cached remote user profiles fetched before a time, scanning up to limit
+// profiles after (exclusive) a cursor key, or from the start if nil. Returns the
+// number of profiles cleared and the cursor for the next batch, nil once all
+// profiles have been scanned.
+func (r *RoomsDatabase) PruneRemoteUserProfiles(
+	ctx context.Context,
+	before time.Time,
+	cursor fdb.Key,
+	limit int,
+) (int, fdb.Key, error) {
+	type result struct {
+		pruned int
+		cursor fdb.Key
+	}
+	res, err := util.DoWriteTransaction(ctx, r.db, func(txn fdb.Transaction) (result, error) {
+		var res result
+
+		profilesRange := r.users.RangeForAllRemoteUserProfiles()
+		var rng fdb.Range = profilesRange
+		if cursor != nil {
+			_, end := profilesRange.FDBRangeKeys()
+			rng = fdb.KeyRange{Begin: fdb.Key(append(append([]byte{}, cursor...), 0x00)), End: end}
+		}
+		kvs, err := txn.GetRange(rng, fdb.RangeOptions{
+			Limit: limit,
+			Mode:  fdb.StreamingModeWantAll,
+		}).GetSliceWithError()
+		if err != nil {
+			return res, err
+		}
+
+		for _, kv := range kvs {
+			var remote types.RemoteUserProfile
+			if err := msgpack.Unmarshal(kv.Value, &remote); err != nil {
+				return res, err
+			} else if remote.FetchedBefore(before) {
+				txn.Clear(kv.Key)
+				res.pruned++
+			}
+		}
+		if len(kvs) == limit {
+			res.cursor = kvs[len(kvs)-1].Key
+		}
+		return res, nil
+	})
+	return res.pruned, res.cursor, err
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/types"
@@ -27,3 +28,65 @@ func (r *RoomsDatabase) GetUserOutlierMemberships(ctx context.Context, userID id
 		return r.users.TxnLookupUserOutlierMemberships(txn, userID)
 	})
 }
+
+// Get the rooms a user has knocked on with the stripped state for the sync
+// knock section. Knocks sent over federation use the state returned by the
+// remote server (stored in the outlier knock event's unsigned), otherwise the
+// current room state is used. The knock event itself is always included.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3sync
+func (r *RoomsDatabase) GetUserKnockedRooms(ctx context.Context, userID id.UserID) (map[id.RoomID][]any, error) {
+	return util.DoReadTransaction(ctx, r.db, func(txn fdb.ReadTransaction) (map[id.RoomID][]any, error) {
+		memberships, err := r.users.TxnLookupUserMemberships(txn, userID)
+		if err != nil {
+			return nil, err
+		}
+		outlierMemberships, err := r.users.TxnLookupUserOutlierMemberships(txn, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		eventsProvider := r.events.NewTxnEventsProvider(ctx, txn)
+		knocks := make(map[id.RoomID]types.MembershipTup)
+		for _, allMemberships := range []types.Memberships{outlierMemberships, memberships} {
+			for roomID, membershipTup := range allMemberships {
+				// Room memberships take precedence over outliers
+				if membershipTup.Membership == event.MembershipKnock {
+					knocks[roomID] = membershipTup
+					eventsProvider.WillGet(membershipTup.EventID)
+				} else {
+					delete(knocks, roomID)
+				}
+			}
+		}
+
+		knockedRooms := make(map[id.RoomID][]any, len(knocks))
+		for roomID, membershipTup := range knocks {
+			knockEv, err := eventsProvider.Get(membershipTup.EventID)
+			if err != nil {
+				return nil, err
+			}
+
+			var stateEvs []*types.Event
+			if state, ok := knockEv.Unsigned["knock_room_state"].([]any); ok {
+				knockedRooms[roomID] = state
+			} else {
+				stateMap, err := r.events.TxnLookupCurrentRoomInviteStateMap(txn, roomID, eventsProvider)
+				if err != nil {
+					return nil, err
+				}
+				for _, evID := range stateMap {
+					stateEvs = append(stateEvs, eventsProvider.MustGet(evID))
+				}
+				util.SortEventList(stateEvs)
+			}
+			stateEvs = append(stateEvs, knockEv)
+
+			values, err := util.StrippedStatesToValues(util.EventsToStrippedStates(stateEvs))
+			if err != nil {
+				return nil, err
+			}
+			knockedRooms[roomID] = append(knockedRooms[roomID], values...)
+		}
+		return knockedRooms, nil
+	})
+}
@@ -0,0 +1,150 @@
+package users
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// User directory (user_id) -> UserDirectoryEntry
+//
+
+func (u *UsersDirectory) KeyForUserDirectoryEntry(userID id.UserID) fdb.Key {
+	return u.directory.Pack(tuple.Tuple{userID.String()})
+}
+
+// User directory terms (term, user_id) -> nil
+//
+
+func (u *UsersDirectory) KeyForUserDirectoryTerm(term string, userID id.UserID) fdb.Key {
+	return u.directoryTerms.Pack(tuple.Tuple{term, userID.String()})
+}
+
+func (u *UsersDirectory) KeyToUserDirectoryTerm(key fdb.Key) id.UserID {
+	tup, _ := u.directoryTerms.Unpack(key)
+	return id.UserID(tup[1].(string))
+}
+
+// Range over all terms starting with the prefix
+func (u *UsersDirectory) RangeForUserDirectoryTermPrefix(prefix string) fdb.Range {
+	key := u.directoryTerms.Pack(tuple.Tuple{prefix})
+	// Drop the string terminator so the range includes longer terms
+	keyRange, err := fdb.PrefixRange(key[:len(key)-1])
+	if err != nil {
+		panic(err)
+	}
+	return keyRange
+}
+
+func (u *UsersDirectory) TxnLookupUserDirectoryEntry(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+) (*types.UserDirectoryEntry, error) {
+	b, err := txn.Get(u.KeyForUserDirectoryEntry(userID)).Get()
+	if err != nil || b == nil {
+		return nil, err
+	}
+	return types.NewUserDirectoryEntryFromBytes(b)
+}
+
+// Add or update a user in the directory, replacing any previous terms
+func (u *UsersDirectory) TxnUpdateUserDirectoryEntry(
+	txn fdb.Transaction,
+	userID id.UserID,
+	displayName, avatarURL string,
+) error {
+	entry, err := u.TxnLookupUserDirectoryEntry(txn, userID)
+	if err != nil {
+		return err
+	} else if entry != nil {
+		if entry.DisplayName == displayName && entry.AvatarURL == avatarURL {
+			return nil
+		}
+		for _, term := range entry.Terms {
+			txn.Clear(u.KeyForUserDirectoryTerm(term, userID))
+		}
+	}
+
+	entry = &types.UserDirectoryEntry{
+		UserID:      userID,
+		DisplayName: displayName,
+		AvatarURL:   avatarURL,
+		Terms:       util.TokenizeSearchText(userID.String() + " " + displayName),
+	}
+	for _, term := range entry.Terms {
+		txn.Set(u.KeyForUserDirectoryTerm(term, userID), nil)
+	}
+	txn.Set(u.KeyForUserDirectoryEntry(userID), entry.ToMsgpack())
+	return nil
+}
+
+// Find directory entries where each term prefixes one of the entry's terms.
+// The longest term is scanned for candidates, up to the max scan keys. Returns
+// whether the scan hit the max and there may be more entries.
+func (u *UsersDirectory) TxnSearchUserDirectory(
+	txn fdb.ReadTransaction,
+	terms []string,
+	maxScan int,
+) ([]*types.UserDirectoryEntry, bool, error) {
+	if len(terms) == 0 {
+		return nil, false, nil
+	}
+	scanTerm := slices.MaxFunc(terms, func(a, b string) int {
+		return len(a) - len(b)
+	})
+
+	kvs, err := txn.GetRange(
+		u.RangeForUserDirectoryTermPrefix(scanTerm),
+		fdb.RangeOptions{Limit: maxScan},
+	).GetSliceWithError()
+	if err != nil {
+		return nil, false, err
+	}
+
+	userIDs := make([]id.UserID, 0, len(kvs))
+	futures := make([]fdb.FutureByteSlice, 0, len(kvs))
+	seen := make(map[id.UserID]struct{}, len(kvs))
+	for _, kv := range kvs {
+		userID := u.KeyToUserDirectoryTerm(kv.Key)
+		if _, found := seen[userID]; found {
+			continue
+		}
+		seen[userID] = struct{}{}
+		userIDs = append(userIDs, userID)
+		futures = append(futures, txn.Get(u.KeyForUserDirectoryEntry(userID)))
+	}
+
+	entries := make([]*types.UserDirectoryEntry, 0, len(userIDs))
+	for _, future := range futures {
+		b, err := future.Get()
+		if err != nil {
+			return nil, false, err
+		} else if b == nil {
+			continue
+		}
+		entry, err := types.NewUserDirectoryEntryFromBytes(b)
+		if err != nil {
+			return nil, false, err
+		}
+
+		matched := true
+		for _, term := range terms {
+			if !slices.ContainsFunc(entry.Terms, func(entryTerm string) bool {
+				return strings.HasPrefix(entryTerm, term)
+			}) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, len(kvs) >= maxScan, nil
+}
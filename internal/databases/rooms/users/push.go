@@ -0,0 +1,342 @@
+package users
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+const (
+	notificationCountKey = "n"
+	highlightCountKey    = "h"
+)
+
+// User push rules (user_id) -> PushRuleset JSON
+//
+
+func (u *UsersDirectory) KeyForUserPushRules(userID id.UserID) fdb.Key {
+	return u.pushRules.Pack(tuple.Tuple{userID.String()})
+}
+
+// Lookup a user's push rules, or the default rules if they have none stored
+func (u *UsersDirectory) TxnLookupUserPushRules(txn fdb.ReadTransaction, userID id.UserID) (*pushrules.PushRuleset, error) {
+	b, err := txn.Get(u.KeyForUserPushRules(userID)).Get()
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return types.NewDefaultPushRuleset(userID), nil
+	}
+	var rs pushrules.PushRuleset
+	if err := json.Unmarshal(b, &rs); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+func (u *UsersDirectory) TxnStoreUserPushRules(txn fdb.Transaction, userID id.UserID, rs *pushrules.PushRuleset) error {
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	txn.Set(u.KeyForUserPushRules(userID), b)
+	return nil
+}
+
+// User read receipts (user_id, room_id) -> (event_id, version)
+//
+
+func (u *UsersDirectory) KeyForUserReadReceipt(userID id.UserID, roomID id.RoomID) fdb.Key {
+	return u.readReceipts.Pack(tuple.Tuple{userID.String(), roomID.String()})
+}
+
+// Lookup the version of the event the user has read up to in a room, or the
+// zero version if the user has no read receipt.
+func (u *UsersDirectory) TxnLookupUserReadReceiptVersion(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	roomID id.RoomID,
+) (tuple.Versionstamp, error) {
+	b, err := txn.Get(u.KeyForUserReadReceipt(userID, roomID)).Get()
+	if err != nil || b == nil {
+		return types.ZeroVersionstamp, err
+	}
+	tup, err := tuple.Unpack(b)
+	if err != nil {
+		return types.ZeroVersionstamp, err
+	}
+	return tup[1].(tuple.Versionstamp), nil
+}
+
+// User room notifications (user_id, room_id, version) -> (event_id, highlight, actions JSON)
+//
+
+func (u *UsersDirectory) KeyForUserRoomNotification(userID id.UserID, roomID id.RoomID, version tuple.Versionstamp) fdb.Key {
+	return u.roomNotifications.Pack(tuple.Tuple{userID.String(), roomID.String(), version})
+}
+
+func (u *UsersDirectory) KeyToUserRoomNotificationVersion(key fdb.Key) tuple.Versionstamp {
+	tup, _ := u.roomNotifications.Unpack(key)
+	return tup[2].(tuple.Versionstamp)
+}
+
+func (u *UsersDirectory) RangeForUserRoomNotifications(
+	userID id.UserID,
+	roomID id.RoomID,
+	fromVersion, toVersion tuple.Versionstamp,
+) fdb.Range {
+	return types.GetVersionRange(u.roomNotifications, fromVersion, toVersion, userID.String(), roomID.String())
+}
+
+// User notifications (user_id, version) -> (room_id, event_id, highlight, actions JSON, read)
+//
+
+func (u *UsersDirectory) KeyForUserNotification(userID id.UserID, version tuple.Versionstamp) fdb.Key {
+	return u.userNotifications.Pack(tuple.Tuple{userID.String(), version})
+}
+
+func (u *UsersDirectory) RangeForUserNotifications(userID id.UserID, fromVersion, toVersion tuple.Versionstamp) fdb.Range {
+	return types.GetVersionRange(u.userNotifications, fromVersion, toVersion, userID.String())
+}
+
+func (u *UsersDirectory) RangeForAllUserNotifications() fdb.ExactRange {
+	return u.userNotifications
+}
+
+func (u *UsersDirectory) KeyToUserNotification(key fdb.Key) (id.UserID, tuple.Versionstamp) {
+	tup, _ := u.userNotifications.Unpack(key)
+	return id.UserID(tup[0].(string)), tup[1].(tuple.Versionstamp)
+}
+
+func (u *UsersDirectory) ValueForUserNotification(
+	roomID id.RoomID,
+	eventID id.EventID,
+	highlight bool,
+	actionsJSON []byte,
+	read bool,
+) []byte {
+	return tuple.Tuple{roomID.String(), eventID.String(), highlight, actionsJSON, read}.Pack()
+}
+
+func (u *UsersDirectory) KeyValueToUserNotification(kv fdb.KeyValue) (*types.UserNotification, error) {
+	keyTup, err := u.userNotifications.Unpack(kv.Key)
+	if err != nil {
+		return nil, err
+	}
+	tup, err := tuple.Unpack(kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	notification := &types.UserNotification{
+		Version:   keyTup[1].(tuple.Versionstamp),
+		RoomID:    id.RoomID(tup[0].(string)),
+		EventID:   id.EventID(tup[1].(string)),
+		Highlight: tup[2].(bool),
+	}
+	// Notifications stored before read tracking don't have the read field
+	if len(tup) > 4 {
+		notification.Read = tup[4].(bool)
+	}
+	if err := json.Unmarshal(tup[3].([]byte), &notification.Actions); err != nil {
+		return nil, err
+	}
+	return notification, nil
+}
+
+// Notifications by version (version, user_id) -> ""
+//
+
+func (u *UsersDirectory) KeyForNotificationByVersion(version tuple.Versionstamp, userID id.UserID) fdb.Key {
+	return u.notificationsByVersion.Pack(tuple.Tuple{version, userID.String()})
+}
+
+// Store a new unread notification for a user
+func (u *UsersDirectory) TxnStoreUserNotification(
+	txn fdb.Transaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	eventID id.EventID,
+	version tuple.Versionstamp,
+	highlight bool,
+	actionsJSON []byte,
+) {
+	txn.Set(
+		u.KeyForUserRoomNotification(userID, roomID, version),
+		tuple.Tuple{eventID.String(), highlight, actionsJSON}.Pack(),
+	)
+	txn.Set(
+		u.KeyForUserNotification(userID, version),
+		u.ValueForUserNotification(roomID, eventID, highlight, actionsJSON, false),
+	)
+	txn.Set(u.KeyForNotificationByVersion(version, userID), nil)
+}
+
+// Mark a user's notifications as read, those already pruned are skipped
+func (u *UsersDirectory) TxnMarkUserNotificationsRead(
+	txn fdb.Transaction,
+	userID id.UserID,
+	versions []tuple.Versionstamp,
+) error {
+	futs := make([]fdb.FutureByteSlice, 0, len(versions))
+	for _, version := range versions {
+		futs = append(futs, txn.Get(u.KeyForUserNotification(userID, version)))
+	}
+	for i, fut := range futs {
+		b, err := fut.Get()
+		if err != nil {
+			return err
+		} else if b == nil {
+			continue
+		}
+		tup, err := tuple.Unpack(b)
+		if err != nil {
+			return err
+		}
+		if len(tup) > 4 {
+			tup[4] = true
+		} else {
+			tup = append(tup, true)
+		}
+		txn.Set(u.KeyForUserNotification(userID, versions[i]), tup.Pack())
+	}
+	return nil
+}
+
+// Prune notifications before a version from user notification logs, up to limit.
+// Per room notifications are only needed to subtract unread ones from the counts
+// so those are cleared by read receipts, those read before that are cleared here.
+func (u *UsersDirectory) TxnPruneUserNotifications(
+	txn fdb.Transaction,
+	beforeVersion tuple.Versionstamp,
+	limit int,
+) (int, error) {
+	kvs, err := txn.GetRange(
+		types.GetVersionRange(u.notificationsByVersion, types.ZeroVersionstamp, beforeVersion),
+		fdb.RangeOptions{Limit: limit},
+	).GetSliceWithError()
+	if err != nil {
+		return 0, err
+	}
+
+	type pruneKey struct {
+		userID  id.UserID
+		version tuple.Versionstamp
+		fut     fdb.FutureByteSlice
+	}
+	keys := make([]pruneKey, 0, len(kvs))
+	for _, kv := range kvs {
+		tup, err := u.notificationsByVersion.Unpack(kv.Key)
+		if err != nil {
+			return 0, err
+		}
+		userID := id.UserID(tup[1].(string))
+		version := tup[0].(tuple.Versionstamp)
+		keys = append(keys, pruneKey{userID, version, txn.Get(u.KeyForUserNotification(userID, version))})
+		txn.Clear(kv.Key)
+	}
+
+	for _, key := range keys {
+		b, err := key.fut.Get()
+		if err != nil {
+			return 0, err
+		} else if b == nil {
+			continue
+		}
+		notification, err := u.KeyValueToUserNotification(fdb.KeyValue{
+			Key:   u.KeyForUserNotification(key.userID, key.version),
+			Value: b,
+		})
+		if err != nil {
+			return 0, err
+		}
+		txn.Clear(u.KeyForUserNotification(key.userID, key.version))
+		if notification.Read {
+			txn.Clear(u.KeyForUserRoomNotification(key.userID, notification.RoomID, key.version))
+		}
+	}
+
+	return len(kvs), nil
+}
+
+// User notification counts (user_id, room_id, n|h) -> int64 (little endian, atomic)
+//
+
+func (u *UsersDirectory) KeyForUserNotificationCount(userID id.UserID, roomID id.RoomID, kind string) fdb.Key {
+	return u.notificationCounts.Pack(tuple.Tuple{userID.String(), roomID.String(), kind})
+}
+
+func countToValue(count int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(count))
+	return b
+}
+
+func valueToCount(b []byte) int64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+// Atomically add to (or, with negative values, subtract from) a user's
+// notification counts in a room.
+func (u *UsersDirectory) TxnAddUserNotificationCounts(
+	txn fdb.Transaction,
+	userID id.UserID,
+	roomID id.RoomID,
+	notifications, highlights int64,
+) {
+	if notifications != 0 {
+		txn.Add(u.KeyForUserNotificationCount(userID, roomID, notificationCountKey), countToValue(notifications))
+	}
+	if highlights != 0 {
+		txn.Add(u.KeyForUserNotificationCount(userID, roomID, highlightCountKey), countToValue(highlights))
+	}
+}
+
+// Lookup the total unread notification count for a user across all rooms
+func (u *UsersDirectory) TxnLookupUserTotalNotificationCount(txn fdb.ReadTransaction, userID id.UserID) (int64, error) {
+	kvs, err := txn.GetRange(u.notificationCounts.Sub(userID.String()), fdb.RangeOptions{
+		Mode: fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, kv := range kvs {
+		tup, err := u.notificationCounts.Unpack(kv.Key)
+		if err != nil {
+			return 0, err
+		} else if tup[2].(string) == notificationCountKey {
+			total += valueToCount(kv.Value)
+		}
+	}
+	return total, nil
+}
+
+func (u *UsersDirectory) TxnLookupUserNotificationCounts(
+	txn fdb.ReadTransaction,
+	userID id.UserID,
+	roomID id.RoomID,
+) (types.NotificationCounts, error) {
+	notificationsFut := txn.Get(u.KeyForUserNotificationCount(userID, roomID, notificationCountKey))
+	highlightsFut := txn.Get(u.KeyForUserNotificationCount(userID, roomID, highlightCountKey))
+
+	var counts types.NotificationCounts
+	if b, err := notificationsFut.Get(); err != nil {
+		return counts, err
+	} else {
+		counts.NotificationCount = valueToCount(b)
+	}
+	if b, err := highlightsFut.Get(); err != nil {
+		return counts, err
+	} else {
+		counts.HighlightCount = valueToCount(b)
+	}
+	return counts, nil
+}
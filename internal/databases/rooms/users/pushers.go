@@ -0,0 +1,154 @@
+package users
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// User pushers (user_id, app_id, pushkey) -> Pusher msgpack
+//
+
+func (u *UsersDirectory) KeyForUserPusher(key types.PusherKey) fdb.Key {
+	return u.pushers.Pack(tuple.Tuple{key.UserID.String(), key.AppID, key.PushKey})
+}
+
+func (u *UsersDirectory) RangeForUserPushers(userID id.UserID) fdb.Range {
+	return u.pushers.Sub(userID.String())
+}
+
+// Pushers by key (app_id, pushkey, user_id) -> ""
+//
+
+func (u *UsersDirectory) KeyForPusherByKey(key types.PusherKey) fdb.Key {
+	return u.pushersByKey.Pack(tuple.Tuple{key.AppID, key.PushKey, key.UserID.String()})
+}
+
+func (u *UsersDirectory) RangeForPushersByKey(appID, pushKey string) fdb.Range {
+	return u.pushersByKey.Sub(appID, pushKey)
+}
+
+// Pusher positions (user_id, app_id, pushkey) -> user notifications version
+//
+
+func (u *UsersDirectory) KeyForPusherPosition(key types.PusherKey) fdb.Key {
+	return u.pusherPositions.Pack(tuple.Tuple{key.UserID.String(), key.AppID, key.PushKey})
+}
+
+// Pusher backoffs (user_id, app_id, pushkey) -> PusherBackoff msgpack
+//
+
+func (u *UsersDirectory) KeyForPusherBackoff(key types.PusherKey) fdb.Key {
+	return u.pusherBackoffs.Pack(tuple.Tuple{key.UserID.String(), key.AppID, key.PushKey})
+}
+
+func (u *UsersDirectory) TxnLookupUserPusher(txn fdb.ReadTransaction, key types.PusherKey) (*types.Pusher, error) {
+	b, err := txn.Get(u.KeyForUserPusher(key)).Get()
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, nil
+	}
+	return types.NewPusherFromBytes(b)
+}
+
+func (u *UsersDirectory) TxnLookupUserPushers(txn fdb.ReadTransaction, userID id.UserID) ([]*types.Pusher, error) {
+	kvs, err := txn.GetRange(u.RangeForUserPushers(userID), fdb.RangeOptions{
+		Mode: fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+	pushers := make([]*types.Pusher, 0, len(kvs))
+	for _, kv := range kvs {
+		pusher, err := types.NewPusherFromBytes(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, nil
+}
+
+// Lookup the users with a pusher for the given app ID and pushkey
+func (u *UsersDirectory) TxnLookupPusherUserIDs(txn fdb.ReadTransaction, appID, pushKey string) ([]id.UserID, error) {
+	kvs, err := txn.GetRange(u.RangeForPushersByKey(appID, pushKey), fdb.RangeOptions{
+		Mode: fdb.StreamingModeWantAll,
+	}).GetSliceWithError()
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]id.UserID, 0, len(kvs))
+	for _, kv := range kvs {
+		tup, err := u.pushersByKey.Unpack(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, id.UserID(tup[2].(string)))
+	}
+	return userIDs, nil
+}
+
+func (u *UsersDirectory) TxnStoreUserPusher(txn fdb.Transaction, pusher *types.Pusher) {
+	key := pusher.Key()
+	txn.Set(u.KeyForUserPusher(key), pusher.ToMsgpack())
+	txn.Set(u.KeyForPusherByKey(key), nil)
+}
+
+// Delete a pusher along with its position and any backoff
+func (u *UsersDirectory) TxnDeleteUserPusher(txn fdb.Transaction, key types.PusherKey) {
+	txn.Clear(u.KeyForUserPusher(key))
+	txn.Clear(u.KeyForPusherByKey(key))
+	txn.Clear(u.KeyForPusherPosition(key))
+	txn.Clear(u.KeyForPusherBackoff(key))
+}
+
+func (u *UsersDirectory) TxnLookupPusherPosition(txn fdb.ReadTransaction, key types.PusherKey) (tuple.Versionstamp, error) {
+	b, err := txn.Get(u.KeyForPusherPosition(key)).Get()
+	if err != nil || b == nil {
+		return types.ZeroVersionstamp, err
+	}
+	return types.ValueToVersionstamp(b)
+}
+
+func (u *UsersDirectory) TxnSetPusherPosition(txn fdb.Transaction, key types.PusherKey, version tuple.Versionstamp) {
+	txn.Set(u.KeyForPusherPosition(key), types.ValueForVersionstamp(version))
+}
+
+func (u *UsersDirectory) TxnLookupPusherBackoff(txn fdb.ReadTransaction, key types.PusherKey) (*types.PusherBackoff, error) {
+	b, err := txn.Get(u.KeyForPusherBackoff(key)).Get()
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, nil
+	}
+	return types.NewPusherBackoffFromBytes(b)
+}
+
+func (u *UsersDirectory) TxnLookupPusherBackoffs(txn fdb.ReadTransaction) ([]*types.PusherBackoff, error) {
+	iter := txn.GetRange(u.pusherBackoffs, fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).Iterator()
+
+	backoffs := make([]*types.PusherBackoff, 0)
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return nil, err
+		}
+		backoff, err := types.NewPusherBackoffFromBytes(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		backoffs = append(backoffs, backoff)
+	}
+	return backoffs, nil
+}
+
+func (u *UsersDirectory) TxnSetPusherBackoff(txn fdb.Transaction, backoff *types.PusherBackoff) {
+	txn.Set(u.KeyForPusherBackoff(backoff.PusherKey), backoff.ToMsgpack())
+}
+
+func (u *UsersDirectory) TxnClearPusherBackoff(txn fdb.Transaction, key types.PusherKey) {
+	txn.Clear(u.KeyForPusherBackoff(key))
+}
@@ -14,9 +14,22 @@ type UsersDirectory struct {
 	db  fdb.Database
 
 	profiles,
+	remoteProfiles,
 	memberships,
 	membershipChanges,
-	outlierMemberships subspace.Subspace
+	outlierMemberships,
+	directory,
+	directoryTerms,
+	pushRules,
+	readReceipts,
+	roomNotifications,
+	userNotifications,
+	notificationsByVersion,
+	notificationCounts,
+	pushers,
+	pushersByKey,
+	pusherPositions,
+	pusherBackoffs subspace.Subspace
 }
 
 func NewUsersDirectory(logger zerolog.Logger, db fdb.Database, parentDir directory.Directory) *UsersDirectory {
@@ -37,10 +50,23 @@ func NewUsersDirectory(logger zerolog.Logger, db fdb.Database, parentDir directo
 		// Init data model subspaces, subspace prefixes are intentionally short
 		// "When using the tuple layer to encode keys (as is recommended), select short strings or small integers for tuple elements."
 		// https://apple.github.io/foundationdb/data-modeling.html#key-and-value-sizes
-		profiles:           usersDir.Sub("pro"),
-		memberships:        usersDir.Sub("mem"),
-		membershipChanges:  usersDir.Sub("mch"),
-		outlierMemberships: usersDir.Sub("out"),
+		profiles:               usersDir.Sub("pro"),
+		remoteProfiles:         usersDir.Sub("rpr"),
+		memberships:            usersDir.Sub("mem"),
+		membershipChanges:      usersDir.Sub("mch"),
+		outlierMemberships:     usersDir.Sub("out"),
+		directory:              usersDir.Sub("dir"),
+		directoryTerms:         usersDir.Sub("dit"),
+		pushRules:              usersDir.Sub("psr"),
+		readReceipts:           usersDir.Sub("rrc"),
+		roomNotifications:      usersDir.Sub("rnt"),
+		userNotifications:      usersDir.Sub("unt"),
+		notificationsByVersion: usersDir.Sub("ntv"),
+		notificationCounts:     usersDir.Sub("ntc"),
+		pushers:                usersDir.Sub("pus"),
+		pushersByKey:           usersDir.Sub("pbk"),
+		pusherPositions:        usersDir.Sub("ppo"),
+		pusherBackoffs:         usersDir.Sub("pbo"),
 	}
 }
 
@@ -48,6 +74,26 @@ func (u *UsersDirectory) KeyForUserProfile(userID id.UserID) fdb.Key {
 	return u.profiles.Pack(tuple.Tuple{userID.String()})
 }
 
+func (u *UsersDirectory) KeyToUserProfile(key fdb.Key) id.UserID {
+	tup, _ := u.profiles.Unpack(key)
+	return id.UserID(tup[0].(string))
+}
+
+func (u *UsersDirectory) RangeForAllUserProfiles() fdb.ExactRange {
+	return u.profiles
+}
+
+// Remote user profiles (user_id) -> RemoteUserProfile msgpack
+//
+
+func (u *UsersDirectory) KeyForRemoteUserProfile(userID id.UserID) fdb.Key {
+	return u.remoteProfiles.Pack(tuple.Tuple{userID.String()})
+}
+
+func (u *UsersDirectory) RangeForAllRemoteUserProfiles() fdb.ExactRange {
+	return u.remoteProfiles
+}
+
 // User memberships (user_id, room_id) -> membership
 //
 
@@ -55,10 +101,14 @@ func (u *UsersDirectory) KeyForUserMembership(userID id.UserID, roomID id.RoomID
 	return u.memberships.Pack(tuple.Tuple{userID.String(), roomID.String()})
 }
 
-func (u *UsersDirectory) RangeForUserMemberships(userID id.UserID) fdb.Range {
+func (u *UsersDirectory) RangeForUserMemberships(userID id.UserID) fdb.ExactRange {
 	return u.memberships.Sub(userID.String())
 }
 
+func (u *UsersDirectory) RangeForAllUserMemberships() fdb.ExactRange {
+	return u.memberships
+}
+
 // User membership changes (user_id, version) -> (room_id, membership)
 //
 
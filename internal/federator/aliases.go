@@ -0,0 +1,54 @@
+package federator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Resolve a room alias to the room ID and servers to reach it via, local
+// aliases come from the rooms database and remote ones are queried from the
+// alias server. Returns types.ErrRoomNotAccessible if the alias doesn't exist.
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1querydirectory
+func (f *Federator) ResolveRoomAlias(ctx context.Context, alias id.RoomAlias) (id.RoomID, []string, error) {
+	_, serverName, _ := strings.Cut(alias.String(), ":")
+	if serverName == "" {
+		return "", nil, types.ErrRoomNotAccessible
+	}
+
+	if serverName == f.config.ServerName {
+		roomID, err := f.db.Rooms.LookupRoomAlias(ctx, alias)
+		if err != nil {
+			return "", nil, err
+		} else if roomID == "" {
+			return "", nil, types.ErrRoomNotAccessible
+		}
+		return roomID, []string{f.config.ServerName}, nil
+	}
+
+	resp, err := f.fclient.LookupRoomAlias(
+		ctx,
+		spec.ServerName(f.config.ServerName),
+		spec.ServerName(serverName),
+		alias.String(),
+	)
+	if err != nil {
+		var httpErr gomatrix.HTTPError
+		if errors.As(err, &httpErr) && httpErr.Code == http.StatusNotFound {
+			return "", nil, types.ErrRoomNotAccessible
+		}
+		return "", nil, err
+	}
+	servers := make([]string, 0, len(resp.Servers))
+	for _, server := range resp.Servers {
+		servers = append(servers, string(server))
+	}
+	return id.RoomID(resp.RoomID), servers, nil
+}
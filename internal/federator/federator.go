@@ -0,0 +1,48 @@
+// The federator ingests PDUs received from other servers: verifying them,
+// fetching any missing prev/auth events and passing them to the rooms database
+// for auth & storage. It is shared between the send transaction route and the
+// federation inbox worker. It also handles outbound invites to remote users and
+// third party invite exchanges, which are shared by client & federation routes.
+
+package federator
+
+import (
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type Federator struct {
+	log      zerolog.Logger
+	db       *databases.Databases
+	config   config.BabbleConfig
+	fclient  fclient.FederationClient
+	keyStore *util.KeyStore
+
+	peekedRoomStates *peekedRoomStateCache
+}
+
+func NewFederator(
+	cfg config.BabbleConfig,
+	logger zerolog.Logger,
+	db *databases.Databases,
+	fclient fclient.FederationClient,
+	keyStore *util.KeyStore,
+) *Federator {
+	log := logger.With().
+		Str("component", "federator").
+		Logger()
+
+	return &Federator{
+		log:      log,
+		db:       db,
+		config:   cfg,
+		fclient:  fclient,
+		keyStore: keyStore,
+
+		peekedRoomStates: newPeekedRoomStateCache(),
+	}
+}
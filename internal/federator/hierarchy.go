@@ -0,0 +1,324 @@
+package federator
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Knock restricted join rule isn't defined by mautrix
+const joinRuleKnockRestricted = "knock_restricted"
+
+// Limits per client hierarchy request (like Synapse), so a space with many
+// children can't turn one request into unbounded work or federation requests.
+// The walk stops once either is hit and the rooms so far are returned.
+const (
+	maxHierarchyRoomsVisited   = 1000
+	maxHierarchyRemoteRequests = 50
+)
+
+var errHierarchyRemoteRequestLimit = errors.New("hierarchy remote request limit reached")
+
+type RoomHierarchyOptions struct {
+	// Maximum depth of children to include, negative for no limit
+	MaxDepth      int
+	SuggestedOnly bool
+	// Number of accessible rooms to skip, and to return at most
+	Offset, Limit int
+}
+
+type hierarchyQueueEntry struct {
+	roomID id.RoomID
+	via    []string
+	depth  int
+}
+
+// Rooms anyone may preview: public, knockable or world readable
+func isRoomPreviewable(joinRule string, worldReadable bool) bool {
+	switch joinRule {
+	case string(event.JoinRulePublic), string(event.JoinRuleKnock), joinRuleKnockRestricted:
+		return true
+	}
+	return worldReadable
+}
+
+func isHierarchyRoomPreviewable(room *fclient.RoomHierarchyRoom) bool {
+	return isRoomPreviewable(room.JoinRule, room.WorldReadable)
+}
+
+// Rooms a user may preview: those they're joined or invited to, previewable
+// rooms and restricted rooms where the user is in one of the allowed rooms.
+func isRoomAccessibleToUser(
+	roomID id.RoomID,
+	joinRule string,
+	worldReadable bool,
+	allowedRoomIDs []string,
+	memberships types.Memberships,
+) bool {
+	if membership, found := memberships[roomID]; found &&
+		(membership.Membership == event.MembershipJoin || membership.Membership == event.MembershipInvite) {
+		return true
+	} else if isRoomPreviewable(joinRule, worldReadable) {
+		return true
+	}
+	if joinRule == string(event.JoinRuleRestricted) {
+		for _, allowedRoomID := range allowedRoomIDs {
+			if membership, found := memberships[id.RoomID(allowedRoomID)]; found &&
+				membership.Membership == event.MembershipJoin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getSpaceChildVia(child fclient.RoomHierarchyStrippedEvent) []string {
+	via := gjson.GetBytes(child.Content, "via").Array()
+	servers := make([]string, 0, len(via))
+	for _, server := range via {
+		servers = append(servers, server.String())
+	}
+	return servers
+}
+
+func isSpaceChildSuggested(child fclient.RoomHierarchyStrippedEvent) bool {
+	return gjson.GetBytes(child.Content, "suggested").Bool()
+}
+
+func (f *Federator) isHierarchyRoomAccessibleToUser(
+	room *fclient.RoomHierarchyRoom,
+	memberships types.Memberships,
+) bool {
+	return isRoomAccessibleToUser(id.RoomID(room.RoomID), room.JoinRule, room.WorldReadable, room.AllowedRoomIDs, memberships)
+}
+
+func (f *Federator) isHierarchyRoomAccessibleToServer(
+	ctx context.Context,
+	room *fclient.RoomHierarchyRoom,
+	serverName string,
+) (bool, error) {
+	// Restricted rooms are included along with the allowed room IDs so the
+	// requesting server can check its own users' memberships.
+	if isHierarchyRoomPreviewable(room) || room.JoinRule == string(event.JoinRuleRestricted) {
+		return true, nil
+	}
+	return f.db.Rooms.IsServerInRoom(ctx, serverName, id.RoomID(room.RoomID))
+}
+
+// State of a single hierarchy walk: rooms returned by remote servers and the
+// number of remote requests made.
+type hierarchyWalk struct {
+	remoteRooms         map[id.RoomID]*fclient.RoomHierarchyRoom
+	inaccessibleRoomIDs map[id.RoomID]struct{}
+	remoteRequests      int
+}
+
+// Get a room's hierarchy summary, from our own database if we're in the room
+// or by requesting the hierarchy from one of the via servers if not. Any
+// children returned by remote servers are cached for the rest of the walk.
+// Returns errHierarchyRemoteRequestLimit if the walk has made the maximum
+// number of remote requests.
+func (f *Federator) getHierarchyRoom(
+	ctx context.Context,
+	entry hierarchyQueueEntry,
+	suggestedOnly bool,
+	walk *hierarchyWalk,
+) (*fclient.RoomHierarchyRoom, error) {
+	if room, found := walk.remoteRooms[entry.roomID]; found {
+		return room, nil
+	} else if _, found := walk.inaccessibleRoomIDs[entry.roomID]; found {
+		return nil, nil
+	}
+
+	if inRoom, err := f.db.Rooms.IsServerInRoom(ctx, f.config.ServerName, entry.roomID); err != nil {
+		return nil, err
+	} else if inRoom {
+		return f.db.Rooms.GetRoomHierarchyRoom(ctx, entry.roomID)
+	}
+
+	log := zerolog.Ctx(ctx)
+
+	via := entry.via
+	if len(via) == 0 {
+		roomIDBits := strings.Split(entry.roomID.String(), ":")
+		via = []string{roomIDBits[len(roomIDBits)-1]}
+	}
+	for _, serverName := range via {
+		if serverName == f.config.ServerName {
+			continue
+		} else if walk.remoteRequests >= maxHierarchyRemoteRequests {
+			return nil, errHierarchyRemoteRequestLimit
+		}
+		walk.remoteRequests++
+		resp, err := f.fclient.RoomHierarchy(
+			ctx,
+			spec.ServerName(f.config.ServerName),
+			spec.ServerName(serverName),
+			entry.roomID.String(),
+			suggestedOnly,
+		)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("room_id", entry.roomID.String()).
+				Str("server", serverName).
+				Msg("Failed to fetch room hierarchy from remote server")
+			continue
+		}
+
+		for _, child := range resp.Children {
+			walk.remoteRooms[id.RoomID(child.RoomID)] = &child
+		}
+		for _, roomID := range resp.InaccessibleChildren {
+			walk.inaccessibleRoomIDs[id.RoomID(roomID)] = struct{}{}
+		}
+		return &resp.Room, nil
+	}
+	return nil, nil
+}
+
+// Walk the space hierarchy from a room breadth first, returning the rooms the
+// user may see and whether there may be more (for pagination). Returns
+// types.ErrRoomNotAccessible if the user cannot see the root room.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidhierarchy
+func (f *Federator) GetRoomHierarchyForUser(
+	ctx context.Context,
+	userID id.UserID,
+	roomID id.RoomID,
+	options RoomHierarchyOptions,
+) ([]*fclient.RoomHierarchyRoom, bool, error) {
+	memberships, err := f.db.Rooms.GetUserMemberships(ctx, userID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	queue := []hierarchyQueueEntry{{roomID: roomID}}
+	seenRoomIDs := make(map[id.RoomID]struct{})
+	walk := &hierarchyWalk{
+		remoteRooms:         make(map[id.RoomID]*fclient.RoomHierarchyRoom),
+		inaccessibleRoomIDs: make(map[id.RoomID]struct{}),
+	}
+
+	rooms := make([]*fclient.RoomHierarchyRoom, 0, options.Limit)
+	var skipped int
+
+	for len(queue) > 0 {
+		entry := queue[0]
+		queue = queue[1:]
+
+		if _, found := seenRoomIDs[entry.roomID]; found {
+			continue
+		} else if len(seenRoomIDs) >= maxHierarchyRoomsVisited {
+			// Only paginate if this page got anywhere, the next page would
+			// stop at the same point.
+			return rooms, len(rooms) > 0, nil
+		}
+		seenRoomIDs[entry.roomID] = struct{}{}
+
+		room, err := f.getHierarchyRoom(ctx, entry, options.SuggestedOnly, walk)
+		if errors.Is(err, errHierarchyRemoteRequestLimit) {
+			return rooms, len(rooms) > 0, nil
+		} else if err != nil {
+			return nil, false, err
+		} else if room == nil || !f.isHierarchyRoomAccessibleToUser(room, memberships) {
+			if entry.depth == 0 {
+				return nil, false, types.ErrRoomNotAccessible
+			}
+			continue
+		}
+
+		if skipped < options.Offset {
+			skipped++
+		} else {
+			rooms = append(rooms, room)
+		}
+
+		if options.MaxDepth < 0 || entry.depth < options.MaxDepth {
+			for _, child := range room.ChildrenState {
+				if options.SuggestedOnly && !isSpaceChildSuggested(child) {
+					continue
+				}
+				queue = append(queue, hierarchyQueueEntry{
+					roomID: id.RoomID(child.StateKey),
+					via:    getSpaceChildVia(child),
+					depth:  entry.depth + 1,
+				})
+			}
+		}
+
+		if len(rooms) >= options.Limit {
+			return rooms, len(queue) > 0, nil
+		}
+	}
+
+	return rooms, false, nil
+}
+
+// Get the hierarchy of a room we're in for another server, this includes the
+// room and its direct children that we're also in. Returns
+// types.ErrRoomNotAccessible if the room is not accessible to the server.
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1hierarchyroomid
+func (f *Federator) GetRoomHierarchyForServer(
+	ctx context.Context,
+	serverName string,
+	roomID id.RoomID,
+	suggestedOnly bool,
+) (*fclient.RoomHierarchyResponse, error) {
+	if inRoom, err := f.db.Rooms.IsServerInRoom(ctx, f.config.ServerName, roomID); err != nil {
+		return nil, err
+	} else if !inRoom {
+		return nil, types.ErrRoomNotAccessible
+	}
+
+	room, err := f.db.Rooms.GetRoomHierarchyRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	} else if room == nil {
+		return nil, types.ErrRoomNotAccessible
+	} else if accessible, err := f.isHierarchyRoomAccessibleToServer(ctx, room, serverName); err != nil {
+		return nil, err
+	} else if !accessible {
+		return nil, types.ErrRoomNotAccessible
+	}
+
+	resp := &fclient.RoomHierarchyResponse{
+		Room:                 *room,
+		Children:             make([]fclient.RoomHierarchyRoom, 0),
+		InaccessibleChildren: make([]string, 0),
+	}
+	for _, child := range room.ChildrenState {
+		if suggestedOnly && !isSpaceChildSuggested(child) {
+			continue
+		}
+		childRoomID := id.RoomID(child.StateKey)
+		if inRoom, err := f.db.Rooms.IsServerInRoom(ctx, f.config.ServerName, childRoomID); err != nil {
+			return nil, err
+		} else if !inRoom {
+			continue
+		}
+
+		childRoom, err := f.db.Rooms.GetRoomHierarchyRoom(ctx, childRoomID)
+		if err != nil {
+			return nil, err
+		} else if childRoom == nil {
+			continue
+		}
+		if accessible, err := f.isHierarchyRoomAccessibleToServer(ctx, childRoom, serverName); err != nil {
+			return nil, err
+		} else if accessible {
+			resp.Children = append(resp.Children, *childRoom)
+		} else {
+			resp.InaccessibleChildren = append(resp.InaccessibleChildren, child.StateKey)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,94 @@
+package federator
+
+import (
+	"context"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// https://spec.matrix.org/v1.11/server-server-api/#inviting-to-a-room
+func (f *Federator) PrepareAndSendInviteForRemoteUser(
+	ctx context.Context,
+	roomID id.RoomID,
+	otherUserID id.UserID,
+	partialEv *types.PartialEvent,
+) (*rooms.SendEventsResult, *mautrix.RespError, error) {
+	// Start by preparing the event, this also auths it against local state
+	evs, evErr, err := f.db.Rooms.PrepareLocalEvents(ctx, []*types.PartialEvent{partialEv})
+	if err != nil {
+		return nil, nil, err
+	} else if evErr != nil {
+		return nil, &mautrix.MForbidden, evErr
+	}
+	ev := evs[0]
+
+	inviteStateEvs, err := f.db.Rooms.GetCurrentRoomInviteStateEvents(ctx, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	strippedPDUs := util.EventsToStrippedStates(inviteStateEvs)
+	inviteReq, err := fclient.NewInviteV2Request(ev.PDU(), strippedPDUs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Switch to a background context here - if the client drops the request
+	// we should still send/receive the invite so the state on the remote HS
+	// and local don't end up diverged.
+	backgroundCtx := zerolog.Ctx(ctx).With().
+		Str("background_task", "SendFederatedInvite").
+		Logger().
+		WithContext(context.Background())
+
+	otherHomeserver := otherUserID.Homeserver()
+	inviteResp, err := f.fclient.SendInviteV2(
+		backgroundCtx,
+		spec.ServerName(f.config.ServerName),
+		spec.ServerName(otherHomeserver),
+		inviteReq,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Grab the signature, inject into our event for verification
+	escapedHS := strings.Replace(otherHomeserver, ".", "\\.", -1)
+	signatures := gjson.GetBytes(inviteResp.Event, "signatures."+escapedHS).Value()
+	ev.Signatures[otherHomeserver] = make(map[string]string, 1)
+	for k, v := range signatures.(map[string]any) {
+		ev.Signatures[otherHomeserver][k] = v.(string)
+	}
+
+	verifyErr, err := util.VerifyEvent(backgroundCtx, ev, otherHomeserver, f.keyStore)
+	if err != nil {
+		return nil, nil, err
+	} else if verifyErr != nil {
+		return nil, &mautrix.MInvalidParam, verifyErr
+	}
+
+	// Now that we've prepared, other HS signed and we verified the event we
+	// can send it. We send it as if it's a federated event which triggers
+	// all the authorization checks, accounting for any state changes in
+	// the room during the signing process above.
+	results, err := f.db.Rooms.SendFederatedEvents(backgroundCtx, roomID, []*types.Event{ev}, rooms.SendFederatedEventsOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(results.Rejected) > 0 {
+		err := results.Rejected[0].Error
+		return nil, &mautrix.MForbidden, err
+	}
+
+	return results, nil, nil
+}
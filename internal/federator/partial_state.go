@@ -0,0 +1,218 @@
+package federator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	// Member events stored per transaction during a resync, rooms may have
+	// tens of thousands of members which won't fit in a single FDB txn.
+	partialStateMemberBatchSize = 500
+	// Events re-checked per read transaction
+	partialStateRecheckBatchSize = 100
+)
+
+// Fetch the full state for a room we joined with partial state, store the
+// members we're missing and re-check any events we stored against the partial
+// state before clearing the partial state flag. The refreshLock function is
+// called between each batch, a resync of a large room may take longer than the
+// lock timeout.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3706
+func (f *Federator) ResyncPartialStateRoom(
+	ctx context.Context,
+	partialStateRoom rooms.PartialStateRoom,
+	refreshLock func(),
+) error {
+	roomID := partialStateRoom.RoomID
+	log := zerolog.Ctx(ctx).With().
+		Str("room_id", roomID.String()).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	room, err := f.db.Rooms.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	} else if room == nil {
+		return errors.New("partial state room not found")
+	}
+
+	var stateResp fclient.RespState
+	var lastErr error
+	for _, serverName := range partialStateRoom.Servers {
+		if serverName == f.config.ServerName {
+			continue
+		}
+		stateResp, lastErr = f.fclient.LookupState(
+			ctx,
+			spec.ServerName(f.config.ServerName),
+			spec.ServerName(serverName),
+			roomID.String(),
+			partialStateRoom.JoinEventID.String(),
+			gomatrixserverlib.RoomVersion(room.Version),
+		)
+		if lastErr == nil {
+			break
+		}
+		log.Warn().
+			Err(lastErr).
+			Str("server", serverName).
+			Msg("Failed to fetch room state for partial state resync")
+	}
+	if lastErr != nil {
+		return fmt.Errorf("failed to fetch room state from any server: %w", lastErr)
+	}
+
+	// We only need the member events, everything else we have from the join
+	memberEvs, err := f.parseResyncEvents(ctx, room, stateResp.StateEvents, func(ev *types.Event) bool {
+		return ev.Type == event.StateMember && ev.RoomID == roomID && ev.StateKey != nil
+	})
+	if err != nil {
+		return err
+	}
+	// And the auth chain to check them against
+	authEvs, err := f.parseResyncEvents(ctx, room, stateResp.AuthEvents, func(ev *types.Event) bool {
+		return ev.RoomID == roomID && ev.StateKey != nil
+	})
+	if err != nil {
+		return err
+	}
+
+	members := make(map[id.UserID]id.EventID, len(memberEvs))
+	for start := 0; start < len(memberEvs); start += partialStateMemberBatchSize {
+		end := min(start+partialStateMemberBatchSize, len(memberEvs))
+		storedMembers, err := f.db.Rooms.StorePartialStateRoomMembers(ctx, roomID, memberEvs[start:end], authEvs)
+		if err != nil {
+			return err
+		}
+		for userID, eventID := range storedMembers {
+			members[userID] = eventID
+		}
+		refreshLock()
+	}
+
+	log.Info().
+		Int("state_members", len(memberEvs)).
+		Int("stored_members", len(members)).
+		Msg("Stored partial state room members")
+
+	// Now re-check everything stored against the partial state, new events may
+	// arrive while we do this so keep going until we can complete the resync.
+	lastVersion := types.ZeroVersionstamp
+	for {
+		rejected, nextVersion, err := f.db.Rooms.RecheckPartialStateEvents(
+			ctx, roomID, lastVersion, members, partialStateRecheckBatchSize,
+		)
+		if err != nil {
+			return err
+		}
+
+		if len(rejected) > 0 {
+			rejectedEvs := make([]*types.Event, 0, len(rejected))
+			for _, rEv := range rejected {
+				log.Warn().
+					Err(rEv.Error).
+					Str("event_id", rEv.Event.ID.String()).
+					Msg("Rolling back event that fails auth against full state")
+				rejectedEvs = append(rejectedEvs, rEv.Event)
+			}
+			clearedMembers, err := f.db.Rooms.RollbackPartialStateEvents(ctx, roomID, rejectedEvs)
+			if err != nil {
+				return err
+			}
+			if err := f.restorePartialStateMembers(ctx, roomID, memberEvs, authEvs, clearedMembers, members); err != nil {
+				return err
+			}
+		}
+		refreshLock()
+
+		if nextVersion != types.ZeroVersionstamp {
+			lastVersion = nextVersion
+			continue
+		}
+
+		if err := f.db.Rooms.CompleteRoomPartialState(ctx, roomID, lastVersion); err == rooms.ErrPartialStateEventsPending {
+			continue
+		} else if err != nil {
+			return err
+		}
+		break
+	}
+
+	log.Info().Msg("Completed partial state room resync")
+	return nil
+}
+
+// Store the full state member events for users whose membership was cleared by
+// rolling back a rejected member event.
+func (f *Federator) restorePartialStateMembers(
+	ctx context.Context,
+	roomID id.RoomID,
+	memberEvs []*types.Event,
+	authEvs []*types.Event,
+	clearedMembers []id.UserID,
+	members map[id.UserID]id.EventID,
+) error {
+	restoreEvs := make([]*types.Event, 0, len(clearedMembers))
+	for _, ev := range memberEvs {
+		if slices.Contains(clearedMembers, id.UserID(*ev.StateKey)) {
+			restoreEvs = append(restoreEvs, ev)
+		}
+	}
+	if len(restoreEvs) == 0 {
+		return nil
+	}
+	storedMembers, err := f.db.Rooms.StorePartialStateRoomMembers(ctx, roomID, restoreEvs, authEvs)
+	if err != nil {
+		return err
+	}
+	for userID, eventID := range storedMembers {
+		members[userID] = eventID
+	}
+	return nil
+}
+
+// Parse and verify events from the state response for a resync, skipping those
+// not matching the filter or that fail verification.
+func (f *Federator) parseResyncEvents(
+	ctx context.Context,
+	room *types.Room,
+	pdus gomatrixserverlib.EventJSONs,
+	filter func(*types.Event) bool,
+) ([]*types.Event, error) {
+	evs := make([]*types.Event, 0, len(pdus))
+	for _, b := range pdus {
+		ev := &types.Event{RoomVersion: room.Version}
+		if err := json.Unmarshal(b, ev); err != nil {
+			return nil, err
+		} else if !filter(ev) {
+			continue
+		}
+		verifyErr, err := util.VerifyEvent(ctx, ev, ev.Origin, f.keyStore)
+		if err != nil {
+			return nil, err
+		} else if verifyErr != nil {
+			zerolog.Ctx(ctx).Warn().
+				Err(verifyErr).
+				Str("event_id", ev.ID.String()).
+				Msg("Skipping event that failed verification during resync")
+			continue
+		}
+		evs = append(evs, ev)
+	}
+	return evs, nil
+}
@@ -0,0 +1,64 @@
+package federator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+const remoteProfileCacheTTL = time.Hour
+
+// Get the profile of a remote user, using our cached copy if it's fresh and
+// otherwise querying their server. If the query fails we fall back to any
+// stale cached profile. Returns nil if the user has no profile.
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1queryprofile
+func (f *Federator) GetRemoteUserProfile(ctx context.Context, userID id.UserID) (*types.UserProfile, error) {
+	cached, expired, err := f.db.Rooms.GetCachedRemoteUserProfile(ctx, userID, remoteProfileCacheTTL)
+	if err != nil {
+		return nil, err
+	} else if cached != nil && !expired {
+		return cached, nil
+	}
+
+	path := "/_matrix/federation/v1/query/profile?user_id=" + url.QueryEscape(userID.String())
+
+	var resp map[string]any
+	if err := f.doSignedRequest(ctx, http.MethodGet, userID.Homeserver(), path, nil, &resp); err != nil {
+		var httpErr gomatrix.HTTPError
+		if errors.As(err, &httpErr) && httpErr.Code == http.StatusNotFound {
+			return nil, nil
+		} else if cached != nil {
+			zerolog.Ctx(ctx).Warn().
+				Err(err).
+				Str("user_id", userID.String()).
+				Msg("Failed to fetch remote profile, using stale cached profile")
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	// Fields that fail validation are dropped, the remaining profile must still
+	// be within our size limit before we cache it.
+	profile := types.NewUserProfileFromMap(resp)
+	if err := f.db.Rooms.StoreRemoteUserProfile(ctx, userID, profile); errors.Is(err, types.ErrProfileTooLarge) {
+		zerolog.Ctx(ctx).Warn().
+			Str("user_id", userID.String()).
+			Int("size", profile.Size()).
+			Msg("Remote profile too large, not caching")
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
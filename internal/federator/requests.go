@@ -0,0 +1,41 @@
+package federator
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// Make a signed federation request for endpoints the gomatrixserverlib client
+// doesn't support, content may be nil for requests without a body.
+func (f *Federator) doSignedRequest(
+	ctx context.Context,
+	method string,
+	serverName string,
+	path string,
+	content any,
+	result any,
+) error {
+	req := fclient.NewFederationRequest(
+		method,
+		spec.ServerName(f.config.ServerName),
+		spec.ServerName(serverName),
+		path,
+	)
+	if content != nil {
+		if err := req.SetContent(content); err != nil {
+			return err
+		}
+	}
+	keyID, key := f.config.MustGetActiveSigningKey()
+	if err := req.Sign(spec.ServerName(f.config.ServerName), gomatrixserverlib.KeyID(keyID), key); err != nil {
+		return err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return f.fclient.DoRequestAndParseResponse(ctx, httpReq, result)
+}
@@ -0,0 +1,221 @@
+package federator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// The gomatrixserverlib peek response can't decode the latest event (it's an
+// interface) so we make the requests ourselves.
+type respPeek struct {
+	RenewalInterval int64             `json:"renewal_interval"`
+	RoomVersion     string            `json:"room_version"`
+	State           []json.RawMessage `json:"state"`
+	AuthChain       []json.RawMessage `json:"auth_chain"`
+	LatestEvent     json.RawMessage   `json:"latest_event"`
+}
+
+func (f *Federator) doPeekRequest(
+	ctx context.Context,
+	method string,
+	serverName string,
+	roomID id.RoomID,
+	peekID string,
+	result any,
+) error {
+	path := "/_matrix/federation/v1/peek/" + url.PathEscape(roomID.String()) + "/" + url.PathEscape(peekID)
+	if method == http.MethodPut {
+		vers := make([]string, 0)
+		for roomVersion := range gomatrixserverlib.RoomVersions() {
+			vers = append(vers, "ver="+url.QueryEscape(string(roomVersion)))
+		}
+		path += "?" + strings.Join(vers, "&")
+	}
+	return f.doSignedRequest(ctx, method, serverName, path, struct{}{}, result)
+}
+
+// How long peeked remote room state is reused for before peeking again
+const peekedRoomStateTTL = time.Minute
+
+type peekedRoomState struct {
+	done      chan struct{}
+	stateEvs  []*types.Event
+	err       error
+	expiresAt time.Time
+}
+
+// Peeked remote room state by room, so repeated client requests for the state
+// of the same remote room don't each start and cancel a peek. Concurrent
+// requests for the same room wait on a single peek.
+type peekedRoomStateCache struct {
+	lock  sync.Mutex
+	rooms map[id.RoomID]*peekedRoomState
+}
+
+func newPeekedRoomStateCache() *peekedRoomStateCache {
+	return &peekedRoomStateCache{
+		rooms: make(map[id.RoomID]*peekedRoomState),
+	}
+}
+
+// Returns the cached or in progress peek of a room, or a new one to be
+// completed by the caller if there isn't one.
+func (c *peekedRoomStateCache) getOrStart(roomID id.RoomID) (*peekedRoomState, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for cachedRoomID, peeked := range c.rooms {
+		if !peeked.expiresAt.IsZero() && now.After(peeked.expiresAt) {
+			delete(c.rooms, cachedRoomID)
+		}
+	}
+
+	if peeked, found := c.rooms[roomID]; found {
+		return peeked, true
+	}
+	peeked := &peekedRoomState{done: make(chan struct{})}
+	c.rooms[roomID] = peeked
+	return peeked, false
+}
+
+func (c *peekedRoomStateCache) complete(
+	roomID id.RoomID,
+	peeked *peekedRoomState,
+	stateEvs []*types.Event,
+	err error,
+	cache bool,
+) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	peeked.stateEvs, peeked.err = stateEvs, err
+	if cache {
+		peeked.expiresAt = time.Now().Add(peekedRoomStateTTL)
+	} else {
+		delete(c.rooms, roomID)
+	}
+	close(peeked.done)
+}
+
+// Get the current state of a remote world readable room we're not in by
+// peeking it over federation (MSC2444). We don't store anything, so the peek
+// is cancelled as soon as we have the state, which is then cached briefly in
+// memory. Returns types.ErrRoomNotAccessible if the room is not world readable
+// or no server would let us peek it.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2444
+func (f *Federator) PeekRemoteRoomState(ctx context.Context, roomID id.RoomID, via []string) ([]*types.Event, error) {
+	peeked, found := f.peekedRoomStates.getOrStart(roomID)
+	if found {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-peeked.done:
+			return peeked.stateEvs, peeked.err
+		}
+	}
+
+	stateEvs, err := f.peekRemoteRoomState(ctx, roomID, via)
+	// Don't cache failures caused by the request being cancelled
+	f.peekedRoomStates.complete(roomID, peeked, stateEvs, err, ctx.Err() == nil)
+	return stateEvs, err
+}
+
+func (f *Federator) peekRemoteRoomState(ctx context.Context, roomID id.RoomID, via []string) ([]*types.Event, error) {
+	log := zerolog.Ctx(ctx)
+
+	if len(via) == 0 {
+		roomIDBits := strings.Split(roomID.String(), ":")
+		via = []string{roomIDBits[len(roomIDBits)-1]}
+	}
+
+	for _, serverName := range via {
+		if serverName == f.config.ServerName {
+			continue
+		}
+
+		peekID := xid.New().String()
+		var resp respPeek
+		if err := f.doPeekRequest(ctx, http.MethodPut, serverName, roomID, peekID, &resp); err != nil {
+			log.Warn().
+				Err(err).
+				Str("room_id", roomID.String()).
+				Str("server", serverName).
+				Msg("Failed to peek room on remote server")
+			continue
+		}
+		if err := f.doPeekRequest(ctx, http.MethodDelete, serverName, roomID, peekID, &struct{}{}); err != nil {
+			log.Warn().
+				Err(err).
+				Str("room_id", roomID.String()).
+				Str("server", serverName).
+				Msg("Failed to cancel peek on remote server")
+		}
+
+		stateEvs, err := f.parsePeekStateEvents(ctx, roomID, resp)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("room_id", roomID.String()).
+				Str("server", serverName).
+				Msg("Invalid peek response from remote server")
+			continue
+		}
+		return stateEvs, nil
+	}
+
+	return nil, types.ErrRoomNotAccessible
+}
+
+func (f *Federator) parsePeekStateEvents(ctx context.Context, roomID id.RoomID, resp respPeek) ([]*types.Event, error) {
+	if _, err := gomatrixserverlib.GetRoomVersion(gomatrixserverlib.RoomVersion(resp.RoomVersion)); err != nil {
+		return nil, err
+	}
+
+	var worldReadable bool
+	stateEvs := make([]*types.Event, 0, len(resp.State))
+	for _, b := range resp.State {
+		ev := &types.Event{RoomVersion: resp.RoomVersion}
+		if err := json.Unmarshal(b, ev); err != nil {
+			return nil, err
+		} else if ev.RoomID != roomID || ev.StateKey == nil {
+			return nil, fmt.Errorf("invalid state event %s", ev.ID)
+		}
+		if verifyErr, err := util.VerifyEvent(ctx, ev, ev.Origin, f.keyStore); err != nil {
+			return nil, err
+		} else if verifyErr != nil {
+			return nil, verifyErr
+		}
+		if ev.Type == event.StateHistoryVisibility {
+			var content event.HistoryVisibilityEventContent
+			if err := json.Unmarshal(ev.Content, &content); err != nil {
+				return nil, err
+			}
+			worldReadable = content.HistoryVisibility == event.HistoryVisibilityWorldReadable
+		}
+		stateEvs = append(stateEvs, ev)
+	}
+
+	// Don't trust the remote server to have checked this
+	if !worldReadable {
+		return nil, types.ErrRoomNotAccessible
+	}
+
+	util.SortEventList(stateEvs)
+	return stateEvs, nil
+}
@@ -0,0 +1,153 @@
+package federator
+
+import (
+	"context"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3266
+type RoomSummary struct {
+	RoomID             id.RoomID        `json:"room_id"`
+	Name               string           `json:"name,omitempty"`
+	Topic              string           `json:"topic,omitempty"`
+	AvatarURL          string           `json:"avatar_url,omitempty"`
+	CanonicalAlias     string           `json:"canonical_alias,omitempty"`
+	JoinedMembersCount int              `json:"num_joined_members"`
+	JoinRule           string           `json:"join_rule"`
+	AllowedRoomIDs     []string         `json:"allowed_room_ids,omitempty"`
+	WorldReadable      bool             `json:"world_readable"`
+	GuestCanJoin       bool             `json:"guest_can_join"`
+	RoomType           string           `json:"room_type,omitempty"`
+	RoomVersion        string           `json:"room_version,omitempty"`
+	Encryption         string           `json:"encryption,omitempty"`
+	Membership         event.Membership `json:"membership,omitempty"`
+}
+
+func newRoomSummaryFromRoom(room *types.Room) *RoomSummary {
+	summary := &RoomSummary{
+		RoomID:             room.ID,
+		Name:               room.Name,
+		Topic:              room.Topic,
+		AvatarURL:          room.AvatarURL,
+		CanonicalAlias:     room.CanonicalAlias,
+		JoinedMembersCount: room.MemberCount,
+		JoinRule:           room.JoinRule,
+		WorldReadable:      room.HistoryVisibility == string(event.HistoryVisibilityWorldReadable),
+		GuestCanJoin:       room.GuestAccess == string(event.GuestAccessCanJoin),
+		RoomType:           room.Type,
+		RoomVersion:        room.Version,
+		Encryption:         room.Encryption,
+	}
+	if summary.JoinRule == "" {
+		summary.JoinRule = string(event.JoinRuleInvite)
+	}
+	for _, allowedRoomID := range room.AllowedRoomIDs {
+		summary.AllowedRoomIDs = append(summary.AllowedRoomIDs, allowedRoomID.String())
+	}
+	return summary
+}
+
+// Hierarchy rooms don't include the room version or encryption
+func newRoomSummaryFromHierarchyRoom(room *fclient.RoomHierarchyRoom) *RoomSummary {
+	return &RoomSummary{
+		RoomID:             id.RoomID(room.RoomID),
+		Name:               room.Name,
+		Topic:              room.Topic,
+		AvatarURL:          room.AvatarURL,
+		CanonicalAlias:     room.CanonicalAlias,
+		JoinedMembersCount: room.JoinedMembersCount,
+		JoinRule:           room.JoinRule,
+		AllowedRoomIDs:     room.AllowedRoomIDs,
+		WorldReadable:      room.WorldReadable,
+		GuestCanJoin:       room.GuestCanJoin,
+		RoomType:           room.RoomType,
+	}
+}
+
+// Get the summary of a room for a user, who may be empty for unauthenticated
+// requests. Rooms we're not in are summarised by requesting the hierarchy from
+// one of the via servers. Returns types.ErrRoomNotAccessible if the user may
+// not preview the room or no server could summarise it.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3266
+func (f *Federator) GetRoomSummaryForUser(
+	ctx context.Context,
+	userID id.UserID,
+	roomID id.RoomID,
+	via []string,
+) (*RoomSummary, error) {
+	memberships := make(types.Memberships)
+	if userID != "" {
+		var err error
+		memberships, err = f.db.Rooms.GetUserMemberships(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var summary *RoomSummary
+	if inRoom, err := f.db.Rooms.IsServerInRoom(ctx, f.config.ServerName, roomID); err != nil {
+		return nil, err
+	} else if inRoom {
+		room, err := f.db.Rooms.GetRoom(ctx, roomID)
+		if err != nil {
+			return nil, err
+		} else if room != nil {
+			summary = newRoomSummaryFromRoom(room)
+		}
+	} else {
+		summary = f.getRemoteRoomSummary(ctx, roomID, via)
+	}
+	if summary == nil {
+		return nil, types.ErrRoomNotAccessible
+	}
+
+	membership, found := memberships[roomID]
+	if found {
+		summary.Membership = membership.Membership
+	}
+	// Knocking users may also see the room they knocked on
+	if !(found && membership.Membership == event.MembershipKnock) &&
+		!isRoomAccessibleToUser(roomID, summary.JoinRule, summary.WorldReadable, summary.AllowedRoomIDs, memberships) {
+		return nil, types.ErrRoomNotAccessible
+	}
+	return summary, nil
+}
+
+func (f *Federator) getRemoteRoomSummary(ctx context.Context, roomID id.RoomID, via []string) *RoomSummary {
+	log := zerolog.Ctx(ctx)
+
+	if len(via) == 0 {
+		roomIDBits := strings.Split(roomID.String(), ":")
+		via = []string{roomIDBits[len(roomIDBits)-1]}
+	}
+	for _, serverName := range via {
+		if serverName == f.config.ServerName {
+			continue
+		}
+		resp, err := f.fclient.RoomHierarchy(
+			ctx,
+			spec.ServerName(f.config.ServerName),
+			spec.ServerName(serverName),
+			roomID.String(),
+			false,
+		)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("room_id", roomID.String()).
+				Str("server", serverName).
+				Msg("Failed to fetch room summary from remote server")
+			continue
+		}
+		return newRoomSummaryFromHierarchyRoom(&resp.Room)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package federator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Third party invites are exchanged for a real invite member event once the
+// identity server has bound the 3pid to a Matrix ID. This must be done by the
+// inviting user's server which is in the room and holds their membership.
+// https://spec.matrix.org/v1.11/server-server-api/#third-party-invites
+
+func makeThirdPartyInviteContent(
+	displayName string,
+	signed gomatrixserverlib.MemberThirdPartyInviteSigned,
+) map[string]any {
+	return map[string]any{
+		"membership": event.MembershipInvite,
+		"third_party_invite": gomatrixserverlib.MemberThirdPartyInvite{
+			DisplayName: displayName,
+			Signed:      signed,
+		},
+	}
+}
+
+// Exchange a signed third party invite for an invite member event, sending it
+// ourselves if the inviter is a local user or asking their server to do so.
+func (f *Federator) ExchangeThirdPartyInvite(
+	ctx context.Context,
+	roomID id.RoomID,
+	sender id.UserID,
+	signed gomatrixserverlib.MemberThirdPartyInviteSigned,
+) error {
+	if sender.Homeserver() == f.config.ServerName {
+		_, evErr, err := f.SendThirdPartyInvite(ctx, roomID, sender, signed)
+		if err != nil {
+			return err
+		}
+		return evErr
+	}
+
+	// The inviting server replaces the display name from the original third
+	// party invite event, so we don't need to look it up here.
+	content, err := json.Marshal(makeThirdPartyInviteContent("", signed))
+	if err != nil {
+		return err
+	}
+	stateKey := signed.MXID
+	return f.fclient.ExchangeThirdPartyInvite(
+		ctx,
+		spec.ServerName(f.config.ServerName),
+		spec.ServerName(sender.Homeserver()),
+		gomatrixserverlib.ProtoEvent{
+			SenderID: sender.String(),
+			RoomID:   roomID.String(),
+			Type:     event.StateMember.Type,
+			StateKey: &stateKey,
+			Content:  content,
+		},
+	)
+}
+
+// Send the invite member event for a third party invite made by one of our
+// users. The sender must match the user who made the original invite, and the
+// signed block is checked against its public keys during event auth. Returns
+// the event, any error rejecting it and any other error.
+func (f *Federator) SendThirdPartyInvite(
+	ctx context.Context,
+	roomID id.RoomID,
+	sender id.UserID,
+	signed gomatrixserverlib.MemberThirdPartyInviteSigned,
+) (*types.Event, error, error) {
+	if sender.Homeserver() != f.config.ServerName {
+		return nil, nil, errors.New("third party invite sender is not a local user")
+	}
+
+	thirdPartyInviteEv, err := f.db.Rooms.GetCurrentRoomStateEvent(ctx, roomID, types.StateThirdPartyInvite, signed.Token)
+	if err != nil {
+		return nil, nil, err
+	} else if thirdPartyInviteEv == nil || thirdPartyInviteEv.Sender != sender {
+		return nil, types.ErrThirdPartyInviteNotFound, nil
+	}
+
+	displayName := gjson.GetBytes(thirdPartyInviteEv.Content, "display_name").String()
+	content := makeThirdPartyInviteContent(displayName, signed)
+	stateKey := signed.MXID
+	partialEv := types.NewPartialEvent(roomID, event.StateMember, &stateKey, sender, content)
+
+	if invitee := id.UserID(signed.MXID); invitee.Homeserver() != f.config.ServerName {
+		// Remote invitees must sign the invite as usual
+		results, respErr, err := f.PrepareAndSendInviteForRemoteUser(ctx, roomID, invitee, partialEv)
+		if respErr != nil {
+			return nil, err, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		return results.Allowed[0], nil, nil
+	}
+
+	results, err := f.db.Rooms.SendLocalEvents(ctx, roomID, []*types.PartialEvent{partialEv}, rooms.SendLocalEventsOptions{})
+	if err != nil {
+		return nil, nil, err
+	} else if len(results.Rejected) > 0 {
+		return nil, results.Rejected[0].Error, nil
+	}
+	return results.Allowed[0], nil, nil
+}
@@ -0,0 +1,95 @@
+package federator
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+type TimestampToEventResponse struct {
+	EventID        id.EventID `json:"event_id"`
+	OriginServerTS int64      `json:"origin_server_ts"`
+}
+
+// Find the closest event in a room to a timestamp (unix millis) in the given
+// direction. If our local history doesn't cover the time, because we joined
+// the room after it, other servers in the room are asked. Returns
+// types.ErrEventNotFound if there is no event.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidtimestamp_to_event
+func (f *Federator) GetRoomEventForTimestamp(
+	ctx context.Context,
+	roomID id.RoomID,
+	ts int64,
+	forward bool,
+) (*TimestampToEventResponse, error) {
+	localEv, err := f.db.Rooms.GetRoomEventForTime(ctx, roomID, time.UnixMilli(ts), forward)
+	if err != nil {
+		return nil, err
+	}
+
+	firstEv, err := f.db.Rooms.GetRoomFirstEvent(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	covered := firstEv != nil && (firstEv.Type == event.StateCreate || ts >= firstEv.Timestamp)
+
+	if localEv != nil && covered {
+		return &TimestampToEventResponse{localEv.ID, localEv.Timestamp}, nil
+	}
+
+	if resp := f.getRemoteRoomEventForTimestamp(ctx, roomID, ts, forward); resp != nil {
+		return resp, nil
+	} else if localEv != nil {
+		return &TimestampToEventResponse{localEv.ID, localEv.Timestamp}, nil
+	}
+	return nil, types.ErrEventNotFound
+}
+
+func (f *Federator) getRemoteRoomEventForTimestamp(
+	ctx context.Context,
+	roomID id.RoomID,
+	ts int64,
+	forward bool,
+) *TimestampToEventResponse {
+	log := zerolog.Ctx(ctx)
+
+	servers, err := f.db.Rooms.GetCurrentRoomServers(ctx, roomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get room servers for timestamp to event")
+		return nil
+	}
+
+	dir := "b"
+	if forward {
+		dir = "f"
+	}
+	path := "/_matrix/federation/v1/timestamp_to_event/" + url.PathEscape(roomID.String()) +
+		"?ts=" + strconv.FormatInt(ts, 10) + "&dir=" + dir
+
+	for _, serverName := range servers {
+		if serverName == f.config.ServerName {
+			continue
+		}
+		var resp TimestampToEventResponse
+		if err := f.doSignedRequest(ctx, http.MethodGet, serverName, path, nil, &resp); err != nil {
+			log.Debug().
+				Err(err).
+				Str("room_id", roomID.String()).
+				Str("server", serverName).
+				Msg("Failed to get timestamp to event from remote server")
+			continue
+		} else if resp.EventID == "" {
+			continue
+		}
+		return &resp
+	}
+	return nil
+}
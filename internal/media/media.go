@@ -0,0 +1,501 @@
+// The media repository stores uploaded media content in the configured media
+// storage (local filesystem or S3 compatible), with metadata in the rooms
+// database, and generates thumbnails on request. Media from other servers is
+// fetched over federation and cached in storage, expired by least recent use.
+// It is shared by the client & federation media routes and the remote media
+// expiry worker.
+
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const thumbnailGenerationTimeout = time.Minute * 2
+
+type MediaRepo struct {
+	log     zerolog.Logger
+	db      *databases.Databases
+	config  config.BabbleConfig
+	storage util.MediaStorage
+	fclient util.HTTPFederationClient
+
+	// Client for remote media redirect locations, which may be any URL so
+	// only connects to allowed IP ranges.
+	locationClient *http.Client
+
+	// In progress remote media fetches, so concurrent requests for the same
+	// media share a single download.
+	fetchesLock sync.Mutex
+	fetches     map[string]*remoteMediaFetch
+
+	// Thumbnail generation is CPU and memory heavy, so is limited to a number
+	// at once and concurrent requests for the same thumbnail share one.
+	thumbnailSlots    chan struct{}
+	thumbnailGensLock sync.Mutex
+	thumbnailGens     map[string]*thumbnailGeneration
+}
+
+func NewMediaRepo(
+	cfg config.BabbleConfig,
+	logger zerolog.Logger,
+	db *databases.Databases,
+	fclient util.HTTPFederationClient,
+) *MediaRepo {
+	log := logger.With().
+		Str("component", "media").
+		Logger()
+
+	storage, err := newMediaStorage(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	return &MediaRepo{
+		log:     log,
+		db:      db,
+		config:  cfg,
+		storage: storage,
+		fclient: fclient,
+		fetches: make(map[string]*remoteMediaFetch),
+
+		locationClient: newRemoteMediaLocationClient(cfg),
+		thumbnailSlots: make(chan struct{}, cfg.Media.MaxConcurrentThumbnails),
+		thumbnailGens:  make(map[string]*thumbnailGeneration),
+	}
+}
+
+func newMediaStorage(cfg config.BabbleConfig) (util.MediaStorage, error) {
+	storageCfg := cfg.Media.Storage
+	switch storageCfg.Type {
+	case "file":
+		return util.NewFileMediaStorage(storageCfg.Path)
+	case "s3":
+		return util.NewS3MediaStorage(util.S3MediaStorageOptions{
+			Endpoint:        storageCfg.S3.Endpoint,
+			Region:          storageCfg.S3.Region,
+			Bucket:          storageCfg.S3.Bucket,
+			AccessKeyID:     storageCfg.S3.AccessKeyID,
+			SecretAccessKey: storageCfg.S3.SecretAccessKey,
+			PathStyle:       storageCfg.S3.PathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("invalid media storage type: %s", storageCfg.Type)
+	}
+}
+
+func (m *MediaRepo) generateMediaID() string {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return util.Base64EncodeURLSafe(b)
+}
+
+// Upload new media content for a local user
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixmediav3upload
+func (m *MediaRepo) UploadMedia(
+	ctx context.Context,
+	userID id.UserID,
+	contentType, fileName string,
+	body io.Reader,
+) (*types.Media, error) {
+	media := &types.Media{
+		ServerName:  m.config.ServerName,
+		MediaID:     m.generateMediaID(),
+		UserID:      userID,
+		ContentType: contentType,
+		FileName:    fileName,
+		CreatedTS:   time.Now().UnixMilli(),
+	}
+	if err := m.storeMediaContent(ctx, media, body, false); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+// Create media for a local user to upload content to later
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixmediav1create
+func (m *MediaRepo) CreateMedia(ctx context.Context, userID id.UserID) (*types.Media, error) {
+	now := time.Now()
+	media := &types.Media{
+		ServerName:       m.config.ServerName,
+		MediaID:          m.generateMediaID(),
+		UserID:           userID,
+		CreatedTS:        now.UnixMilli(),
+		PendingExpiresTS: now.Add(m.config.Media.PendingUploadExpiry).UnixMilli(),
+	}
+	if err := m.db.Rooms.CreatePendingMedia(ctx, media); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+// Upload content to media previously created by the same user
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixmediav3uploadservernamemediaid
+func (m *MediaRepo) UploadPendingMedia(
+	ctx context.Context,
+	userID id.UserID,
+	mediaID string,
+	contentType, fileName string,
+	body io.Reader,
+) (*types.Media, error) {
+	// Check before storing any content, the database checks again on commit
+	existing, err := m.db.Rooms.GetMedia(ctx, m.config.ServerName, mediaID)
+	if err != nil {
+		return nil, err
+	} else if existing == nil || existing.IsPendingExpired() {
+		return nil, types.ErrMediaNotFound
+	} else if existing.UserID != userID {
+		return nil, types.ErrMediaNotOwner
+	} else if !existing.IsPending() {
+		return nil, types.ErrMediaAlreadyUploaded
+	}
+
+	media := &types.Media{
+		ServerName:  m.config.ServerName,
+		MediaID:     mediaID,
+		UserID:      userID,
+		ContentType: contentType,
+		FileName:    fileName,
+	}
+	if err := m.storeMediaContent(ctx, media, body, true); err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+// Store uploaded content and the media metadata for a local user
+func (m *MediaRepo) storeMediaContent(ctx context.Context, media *types.Media, body io.Reader, completePending bool) error {
+	if quota := m.config.Media.UserQuota; quota > 0 {
+		// Fail early if the user is already at their quota, before reading
+		// the upload.
+		if usage, err := m.db.Rooms.GetUserMediaUsage(ctx, media.UserID); err != nil {
+			return err
+		} else if usage >= quota {
+			return types.ErrMediaQuotaExceeded
+		}
+	}
+
+	content, err := m.writeMediaContent(ctx, media, body)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	err = m.db.Rooms.StoreMedia(ctx, media, completePending, content.stored)
+	if errors.Is(err, types.ErrMediaContentNotStored) {
+		// The content was removed since checking, store it and retry
+		if err := m.putMediaContent(ctx, media, content); err != nil {
+			return err
+		}
+		err = m.db.Rooms.StoreMedia(ctx, media, completePending, true)
+	}
+	return err
+}
+
+// Media content written to a temporary file, kept until the media metadata is
+// stored in case the content needs writing to media storage again.
+type mediaContent struct {
+	file   *os.File
+	stored bool
+}
+
+func (c *mediaContent) Close() error {
+	c.file.Close()
+	return os.Remove(c.file.Name())
+}
+
+// Write content to a temporary file while hashing it, then store it in media
+// storage unless identical content is already stored. Sets the media size and
+// hash, the caller must then store the media metadata, passing whether the
+// content was stored, and close the returned content.
+func (m *MediaRepo) writeMediaContent(ctx context.Context, media *types.Media, body io.Reader) (*mediaContent, error) {
+	maxSize := m.config.Media.MaxUploadSize
+
+	f, err := os.CreateTemp("", "babbleserv-media-*")
+	if err != nil {
+		return nil, err
+	}
+	content := &mediaContent{file: f}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(body, maxSize+1))
+	if err != nil {
+		content.Close()
+		return nil, err
+	} else if size > maxSize {
+		content.Close()
+		return nil, types.ErrMediaTooLarge
+	}
+	media.Size = size
+	media.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if media.ContentType == "" {
+		media.ContentType = "application/octet-stream"
+	}
+
+	// Content is already stored, skip the write. The last reference may be
+	// removed before the metadata is stored, which is checked again then.
+	if refs, err := m.db.Rooms.GetMediaHashRefs(ctx, media.SHA256); err != nil {
+		content.Close()
+		return nil, err
+	} else if refs > 0 {
+		return content, nil
+	}
+
+	if err := m.putMediaContent(ctx, media, content); err != nil {
+		content.Close()
+		return nil, err
+	}
+	return content, nil
+}
+
+func (m *MediaRepo) putMediaContent(ctx context.Context, media *types.Media, content *mediaContent) error {
+	if _, err := content.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	} else if err := m.storage.Put(ctx, media.StorageKey(), content.file, media.Size, media.ContentType); err != nil {
+		return err
+	}
+	content.stored = true
+	return nil
+}
+
+// Get media and its content, waiting up to maxStall for pending media to be
+// uploaded. The caller must close the returned reader.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1mediadownloadservernamemediaid
+func (m *MediaRepo) GetMedia(
+	ctx context.Context,
+	serverName, mediaID string,
+	maxStall time.Duration,
+) (*types.Media, io.ReadCloser, error) {
+	media, err := m.getMedia(ctx, serverName, mediaID, maxStall)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := m.storage.Get(ctx, media.StorageKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	return media, content, nil
+}
+
+func (m *MediaRepo) getMedia(
+	ctx context.Context,
+	serverName, mediaID string,
+	maxStall time.Duration,
+) (*types.Media, error) {
+	if serverName != m.config.ServerName {
+		return m.getRemoteMedia(ctx, serverName, mediaID, maxStall)
+	}
+
+	media, err := m.db.Rooms.GetMedia(ctx, serverName, mediaID)
+	if err != nil {
+		return nil, err
+	} else if media == nil || media.IsPendingExpired() {
+		return nil, types.ErrMediaNotFound
+	}
+
+	if media.IsPending() {
+		if media, err = m.db.Rooms.WaitForPendingMedia(ctx, media, maxStall); err != nil {
+			return nil, err
+		} else if media.IsPendingExpired() {
+			return nil, types.ErrMediaNotFound
+		} else if media.IsPending() {
+			return nil, types.ErrMediaNotYetUploaded
+		}
+	}
+	return media, nil
+}
+
+// Pick the configured thumbnail size for a request: the smallest with the same
+// method at least as large as requested, otherwise the largest available.
+// Returns types.ErrMediaThumbnailMethodUnavailable if there are no sizes for
+// the method.
+func (m *MediaRepo) pickThumbnailSize(width, height int, method string) (int, int, error) {
+	var bestWidth, bestHeight int
+	var bestLarger bool
+
+	for _, size := range m.config.Media.ThumbnailSizes {
+		if size.Method != method {
+			continue
+		}
+		larger := size.Width >= width && size.Height >= height
+		if bestWidth == 0 ||
+			(larger && (!bestLarger || size.Width*size.Height < bestWidth*bestHeight)) ||
+			(!larger && !bestLarger && size.Width*size.Height > bestWidth*bestHeight) {
+			bestWidth, bestHeight, bestLarger = size.Width, size.Height, larger
+		}
+	}
+
+	if bestWidth == 0 {
+		return 0, 0, fmt.Errorf("%w: %s", types.ErrMediaThumbnailMethodUnavailable, method)
+	}
+	return bestWidth, bestHeight, nil
+}
+
+// Get a thumbnail of media, generating and storing it if needed. The caller
+// must close the returned reader.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1mediathumbnailservernamemediaid
+func (m *MediaRepo) GetThumbnail(
+	ctx context.Context,
+	serverName, mediaID string,
+	width, height int,
+	method string,
+	maxStall time.Duration,
+) (*types.MediaThumbnail, io.ReadCloser, error) {
+	width, height, err := m.pickThumbnailSize(width, height, method)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	media, err := m.getMedia(ctx, serverName, mediaID, maxStall)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	thumbnail, err := m.db.Rooms.GetMediaThumbnail(ctx, media.SHA256, width, height, method)
+	if err != nil {
+		return nil, nil, err
+	} else if thumbnail != nil {
+		content, err := m.storage.Get(ctx, thumbnail.StorageKey())
+		if err == nil {
+			return thumbnail, content, nil
+		} else if !errors.Is(err, types.ErrMediaNotFound) {
+			return nil, nil, err
+		}
+		// Thumbnail content is missing from storage, regenerate it
+	}
+
+	thumbnail, data, err := m.waitForThumbnail(ctx, media, width, height, method)
+	if err != nil {
+		return nil, nil, err
+	}
+	return thumbnail, io.NopCloser(bytes.NewReader(data)), nil
+}
+
+type thumbnailGeneration struct {
+	done      chan struct{}
+	thumbnail *types.MediaThumbnail
+	data      []byte
+	err       error
+}
+
+// Generate a thumbnail, requests for a thumbnail already being generated wait
+// on the existing generation.
+func (m *MediaRepo) waitForThumbnail(
+	ctx context.Context,
+	media *types.Media,
+	width, height int,
+	method string,
+) (*types.MediaThumbnail, []byte, error) {
+	key := fmt.Sprintf("%s/%dx%d/%s", media.SHA256, width, height, method)
+
+	m.thumbnailGensLock.Lock()
+	gen, found := m.thumbnailGens[key]
+	if !found {
+		gen = &thumbnailGeneration{done: make(chan struct{})}
+		m.thumbnailGens[key] = gen
+
+		go func() {
+			// Don't cancel generation with the first request, others may be waiting
+			genCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), thumbnailGenerationTimeout)
+			defer cancel()
+
+			gen.thumbnail, gen.data, gen.err = m.generateThumbnail(genCtx, media, width, height, method)
+
+			m.thumbnailGensLock.Lock()
+			delete(m.thumbnailGens, key)
+			m.thumbnailGensLock.Unlock()
+			close(gen.done)
+		}()
+	}
+	m.thumbnailGensLock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-gen.done:
+		return gen.thumbnail, gen.data, gen.err
+	}
+}
+
+func (m *MediaRepo) generateThumbnail(
+	ctx context.Context,
+	media *types.Media,
+	width, height int,
+	method string,
+) (*types.MediaThumbnail, []byte, error) {
+	// Avoid reading large content we won't be able to decode anyway
+	if !util.IsThumbnailableContentType(media.ContentType) {
+		return nil, nil, types.ErrMediaNotThumbnailable
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case m.thumbnailSlots <- struct{}{}:
+		defer func() { <-m.thumbnailSlots }()
+	}
+
+	content, err := m.storage.Get(ctx, media.StorageKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := io.ReadAll(content)
+	content.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	thumb, err := util.GenerateThumbnail(src, width, height, method, m.config.Media.MaxThumbnailPixels)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Store under the requested size, so lookups for the same request match,
+	// the actual image may be smaller if the source was.
+	thumbnail := &types.MediaThumbnail{
+		SHA256:      media.SHA256,
+		Width:       width,
+		Height:      height,
+		Method:      method,
+		ContentType: thumb.ContentType,
+		Size:        int64(len(thumb.Data)),
+	}
+	if err := m.storage.Put(
+		ctx, thumbnail.StorageKey(), bytes.NewReader(thumb.Data), thumbnail.Size, thumbnail.ContentType,
+	); err != nil {
+		return nil, nil, err
+	}
+	if err := m.db.Rooms.StoreMediaThumbnail(ctx, thumbnail); err != nil {
+		return nil, nil, err
+	}
+
+	m.log.Debug().
+		Str("sha256", media.SHA256).
+		Int("width", width).
+		Int("height", height).
+		Str("method", method).
+		Msg("Generated media thumbnail")
+
+	return thumbnail, thumb.Data, nil
+}
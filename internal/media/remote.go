@@ -0,0 +1,345 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	// Only update the last access time of cached remote media this often, to
+	// avoid a write on every download.
+	remoteMediaTouchInterval = time.Hour
+	remoteMediaFetchTimeout  = time.Minute * 5
+	remoteMediaEvictBatch    = 100
+	remoteMediaMaxRedirects  = 5
+)
+
+func newRemoteMediaLocationClient(cfg config.BabbleConfig) *http.Client {
+	return &http.Client{
+		Timeout: remoteMediaFetchTimeout,
+		Transport: util.NewIPRangeFilteredTransport(types.MustNewIPRangeFilter(
+			cfg.Media.RemoteLocationIPRanges.Allow,
+			cfg.Media.RemoteLocationIPRanges.Deny,
+		)),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= remoteMediaMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", remoteMediaMaxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+type remoteMediaFetch struct {
+	done  chan struct{}
+	media *types.Media
+	err   error
+}
+
+func (m *MediaRepo) getRemoteMedia(
+	ctx context.Context,
+	serverName, mediaID string,
+	maxStall time.Duration,
+) (*types.Media, error) {
+	media, err := m.db.Rooms.GetMedia(ctx, serverName, mediaID)
+	if err != nil {
+		return nil, err
+	} else if media == nil {
+		return m.fetchRemoteMedia(ctx, serverName, mediaID, maxStall)
+	}
+
+	if time.Since(time.UnixMilli(media.LastAccessTS)) > remoteMediaTouchInterval {
+		if err := m.db.Rooms.TouchRemoteMedia(ctx, serverName, mediaID); err != nil {
+			zerolog.Ctx(ctx).Err(err).
+				Str("server_name", serverName).
+				Str("media_id", mediaID).
+				Msg("Failed to update remote media last access")
+		}
+	}
+	return media, nil
+}
+
+// Fetch remote media into the cache, requests for media already being fetched
+// wait on the existing fetch.
+func (m *MediaRepo) fetchRemoteMedia(
+	ctx context.Context,
+	serverName, mediaID string,
+	maxStall time.Duration,
+) (*types.Media, error) {
+	key := serverName + "/" + mediaID
+
+	m.fetchesLock.Lock()
+	fetch, found := m.fetches[key]
+	if !found {
+		fetch = &remoteMediaFetch{done: make(chan struct{})}
+		m.fetches[key] = fetch
+
+		go func() {
+			// Don't cancel the fetch with the first request, others may be waiting
+			fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), remoteMediaFetchTimeout)
+			defer cancel()
+
+			fetch.media, fetch.err = m.downloadRemoteMedia(fetchCtx, serverName, mediaID, maxStall)
+
+			m.fetchesLock.Lock()
+			delete(m.fetches, key)
+			m.fetchesLock.Unlock()
+			close(fetch.done)
+		}()
+	}
+	m.fetchesLock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-fetch.done:
+		return fetch.media, fetch.err
+	}
+}
+
+func (m *MediaRepo) downloadRemoteMedia(
+	ctx context.Context,
+	serverName, mediaID string,
+	maxStall time.Duration,
+) (*types.Media, error) {
+	log := zerolog.Ctx(ctx).With().
+		Str("server_name", serverName).
+		Str("media_id", mediaID).
+		Logger()
+
+	remote, closer, err := m.requestRemoteMedia(ctx, serverName, mediaID, maxStall)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	media := &types.Media{
+		ServerName:  serverName,
+		MediaID:     mediaID,
+		ContentType: remote.ContentType,
+		FileName:    remote.FileName,
+		CreatedTS:   time.Now().UnixMilli(),
+	}
+	content, err := m.writeMediaContent(ctx, media, remote.Content)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	err = m.db.Rooms.StoreRemoteMedia(ctx, media, content.stored)
+	if errors.Is(err, types.ErrMediaContentNotStored) {
+		// The content was removed since checking, store it and retry
+		if err := m.putMediaContent(ctx, media, content); err != nil {
+			return nil, err
+		}
+		err = m.db.Rooms.StoreRemoteMedia(ctx, media, true)
+	}
+	if errors.Is(err, types.ErrMediaAlreadyUploaded) {
+		// Fetched by another process at the same time
+		return m.db.Rooms.GetMedia(ctx, serverName, mediaID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	log.Debug().
+		Int64("size", media.Size).
+		Str("sha256", media.SHA256).
+		Msg("Cached remote media")
+	return media, nil
+}
+
+// Request media content from a remote server via the authenticated federation
+// endpoint, falling back to the legacy unauthenticated media endpoint for
+// servers that don't support it. The caller must close the returned closer
+// once the content has been read.
+func (m *MediaRepo) requestRemoteMedia(
+	ctx context.Context,
+	serverName, mediaID string,
+	maxStall time.Duration,
+) (*util.FederationMedia, io.Closer, error) {
+	path := fmt.Sprintf(
+		"/_matrix/federation/v1/media/download/%s?timeout_ms=%d",
+		url.PathEscape(mediaID), maxStall.Milliseconds(),
+	)
+	req := fclient.NewFederationRequest(
+		http.MethodGet,
+		spec.ServerName(m.config.ServerName),
+		spec.ServerName(serverName),
+		path,
+	)
+	keyID, key := m.config.MustGetActiveSigningKey()
+	if err := req.Sign(spec.ServerName(m.config.ServerName), gomatrixserverlib.KeyID(keyID), key); err != nil {
+		return nil, nil, err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := m.fclient.DoHTTPRequest(ctx, httpReq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		errCode := util.ErrorCodeFromResponse(res)
+		res.Body.Close()
+
+		switch res.StatusCode {
+		case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed:
+			// Servers without authenticated media either don't recognise the
+			// endpoint or return a plain 404.
+			if errCode == "M_UNRECOGNIZED" || errCode == "" {
+				return m.requestRemoteMediaLegacy(ctx, serverName, mediaID, maxStall)
+			}
+		}
+		return nil, nil, remoteMediaError(res.StatusCode, errCode)
+	}
+
+	remote, err := util.ReadFederationMediaResponse(res)
+	if err != nil {
+		res.Body.Close()
+		return nil, nil, err
+	} else if remote.Location == "" {
+		return remote, res.Body, nil
+	}
+
+	// Content is elsewhere, follow the redirect
+	res.Body.Close()
+	locationReq, err := http.NewRequestWithContext(ctx, http.MethodGet, remote.Location, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	locationReq.Header.Set("User-Agent", m.config.UserAgent)
+	locationRes, err := m.locationClient.Do(locationReq)
+	if err != nil {
+		return nil, nil, err
+	} else if locationRes.StatusCode != http.StatusOK {
+		locationRes.Body.Close()
+		return nil, nil, fmt.Errorf("remote media location returned status %d", locationRes.StatusCode)
+	} else if locationRes.ContentLength > m.config.Media.MaxUploadSize {
+		// Content is also limited as it's written, this fails early
+		locationRes.Body.Close()
+		return nil, nil, types.ErrMediaTooLarge
+	}
+	if remote.ContentType == "" {
+		remote.ContentType = locationRes.Header.Get("Content-Type")
+	}
+	remote.Content = locationRes.Body
+	return remote, locationRes.Body, nil
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixmediav3downloadservernamemediaid
+func (m *MediaRepo) requestRemoteMediaLegacy(
+	ctx context.Context,
+	serverName, mediaID string,
+	maxStall time.Duration,
+) (*util.FederationMedia, io.Closer, error) {
+	// Set allow_remote=false to avoid request loops between servers
+	reqURL := fmt.Sprintf(
+		"matrix://%s/_matrix/media/v3/download/%s/%s?allow_remote=false&timeout_ms=%d",
+		serverName, serverName, url.PathEscape(mediaID), maxStall.Milliseconds(),
+	)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := m.fclient.DoHTTPRequest(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	} else if res.StatusCode != http.StatusOK {
+		errCode := util.ErrorCodeFromResponse(res)
+		res.Body.Close()
+		return nil, nil, remoteMediaError(res.StatusCode, errCode)
+	}
+
+	return &util.FederationMedia{
+		ContentType: res.Header.Get("Content-Type"),
+		FileName:    util.MediaFileNameFromContentDisposition(res.Header.Get("Content-Disposition")),
+		Content:     res.Body,
+	}, res.Body, nil
+}
+
+func remoteMediaError(statusCode int, errCode string) error {
+	switch {
+	case statusCode == http.StatusNotFound:
+		return types.ErrMediaNotFound
+	case errCode == util.MNotYetUploaded.ErrCode:
+		return types.ErrMediaNotYetUploaded
+	default:
+		return fmt.Errorf("remote server returned status %d %s", statusCode, errCode)
+	}
+}
+
+// Evict a batch of least recently used remote media from the cache, returns
+// the number of media evicted.
+func (m *MediaRepo) ExpireRemoteMedia(ctx context.Context) (int, error) {
+	cacheCfg := m.config.Media.RemoteCache
+	evicted, err := m.db.Rooms.ExpireRemoteMedia(ctx, cacheCfg.MaxAge, cacheCfg.MaxSize, remoteMediaEvictBatch)
+	if err != nil {
+		return 0, err
+	}
+	m.deleteEvictedContent(ctx, evicted.Content)
+	return evicted.Evicted, nil
+}
+
+// Remove all cached media from a remote server, returns the number of media
+// removed.
+func (m *MediaRepo) PurgeRemoteServerMedia(ctx context.Context, serverName string) (int, error) {
+	if serverName == m.config.ServerName {
+		return 0, errors.New("cannot purge local media")
+	}
+
+	var total int
+	for {
+		evicted, err := m.db.Rooms.PurgeRemoteServerMedia(ctx, serverName, remoteMediaEvictBatch)
+		if err != nil {
+			return total, err
+		}
+		m.deleteEvictedContent(ctx, evicted.Content)
+		total += evicted.Evicted
+		if evicted.Evicted < remoteMediaEvictBatch {
+			return total, nil
+		}
+	}
+}
+
+func (m *MediaRepo) deleteEvictedContent(ctx context.Context, evicted []*rooms.EvictedContent) {
+	log := zerolog.Ctx(ctx)
+	for _, content := range evicted {
+		// The content may have been uploaded again since it was evicted, in
+		// which case the new media references the stored objects.
+		if refs, err := m.db.Rooms.GetMediaHashRefs(ctx, content.SHA256); err != nil {
+			log.Err(err).
+				Str("sha256", content.SHA256).
+				Msg("Failed to check media references before deleting from storage")
+			continue
+		} else if refs > 0 {
+			continue
+		}
+		for _, key := range content.StorageKeys {
+			if err := m.storage.Delete(ctx, key); err != nil {
+				// Orphaned content is harmless, just wasted space
+				log.Err(err).
+					Str("key", key).
+					Msg("Failed to delete media from storage")
+			}
+		}
+	}
+}
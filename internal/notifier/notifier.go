@@ -12,6 +12,7 @@ import (
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/types"
 	"github.com/beeper/babbleserv/internal/util"
 )
 
@@ -24,7 +25,9 @@ type Subscription struct {
 
 	// Subscribe by type
 	AllEvents,
-	AllServers bool
+	AllRooms,
+	AllServers,
+	AllPushers bool
 }
 
 type subscription struct {
@@ -42,6 +45,8 @@ type Change struct {
 	RoomIDs  []id.RoomID  `msgpack:"r,omitempty"`
 	UserIDs  []id.UserID  `msgpack:"u,omitempty"`
 	Servers  []string     `msgpack:"s,omitempty"`
+
+	Pushers []types.PusherKey `msgpack:"p,omitempty"`
 }
 
 // The notifier allows components to subscribe to and receive change notifications
@@ -64,14 +69,17 @@ type Notifier struct {
 	roomChangeCh   chan id.RoomID
 	eventsChangeCh chan id.EventID
 	serverChangeCh chan string
+	pusherChangeCh chan types.PusherKey
 	// Map channels to subscriptions
 	chanToSubscription map[chan any]subscription
 	// Map user/room/event IDs to channels
 	userIDToChan map[id.UserID]map[chan any]struct{}
 	roomIDToChan map[id.RoomID]map[chan any]struct{}
-	// Map channels for all event/server subscribers
+	// Map channels for all event/room/server/pusher subscribers
 	eventChs  map[chan any]struct{}
+	roomChs   map[chan any]struct{}
 	serverChs map[chan any]struct{}
+	pusherChs map[chan any]struct{}
 }
 
 func NewNotifier(cfg config.BabbleConfig, logger zerolog.Logger) *Notifier {
@@ -98,12 +106,15 @@ func NewNotifier(cfg config.BabbleConfig, logger zerolog.Logger) *Notifier {
 		roomChangeCh:   make(chan id.RoomID),
 		eventsChangeCh: make(chan id.EventID),
 		serverChangeCh: make(chan string),
+		pusherChangeCh: make(chan types.PusherKey),
 
 		chanToSubscription: make(map[chan any]subscription),
 		userIDToChan:       make(map[id.UserID]map[chan any]struct{}),
 		roomIDToChan:       make(map[id.RoomID]map[chan any]struct{}),
 		eventChs:           make(map[chan any]struct{}),
+		roomChs:            make(map[chan any]struct{}),
 		serverChs:          make(map[chan any]struct{}),
+		pusherChs:          make(map[chan any]struct{}),
 	}
 }
 
@@ -150,6 +161,9 @@ func (n *Notifier) sendInternalChange(change Change) {
 	for _, server := range change.Servers {
 		n.serverChangeCh <- server
 	}
+	for _, pusher := range change.Pushers {
+		n.pusherChangeCh <- pusher
+	}
 }
 
 func (n *Notifier) sendRedisChange(change Change) {
@@ -196,12 +210,15 @@ func (n *Notifier) internalLoop() {
 			n.unsafeSendChanges(n.eventChs, eventID)
 		case server := <-n.serverChangeCh:
 			n.unsafeSendChanges(n.serverChs, server)
+		case pusher := <-n.pusherChangeCh:
+			n.unsafeSendChanges(n.pusherChs, pusher)
 		// Handle specific subscription changes
 		case userID := <-n.userChangeCh:
 			if chs, found := n.userIDToChan[userID]; found {
 				n.unsafeSendChanges(chs, userID)
 			}
 		case roomID := <-n.roomChangeCh:
+			n.unsafeSendChanges(n.roomChs, roomID)
 			if chs, found := n.roomIDToChan[roomID]; found {
 				n.unsafeSendChanges(chs, roomID)
 			}
@@ -227,9 +244,15 @@ func (n *Notifier) unsafeSubscribe(sub subscription) {
 	if sub.AllEvents {
 		n.eventChs[sub.channel] = struct{}{}
 	}
+	if sub.AllRooms {
+		n.roomChs[sub.channel] = struct{}{}
+	}
 	if sub.AllServers {
 		n.serverChs[sub.channel] = struct{}{}
 	}
+	if sub.AllPushers {
+		n.pusherChs[sub.channel] = struct{}{}
+	}
 
 	// Add specific subscription channels
 	for _, userID := range sub.UserIDs {
@@ -256,9 +279,15 @@ func (n *Notifier) unsafeUnusbscribe(ch chan any) {
 	if sub.AllEvents {
 		delete(n.eventChs, ch)
 	}
+	if sub.AllRooms {
+		delete(n.roomChs, ch)
+	}
 	if sub.AllServers {
 		delete(n.serverChs, ch)
 	}
+	if sub.AllPushers {
+		delete(n.pusherChs, ch)
+	}
 
 	for _, userID := range sub.UserIDs {
 		delete(n.userIDToChan[userID], ch)
@@ -11,18 +11,26 @@ import (
 
 	"github.com/beeper/babbleserv/internal/config"
 	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/federator"
+	"github.com/beeper/babbleserv/internal/media"
 	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
 	"github.com/beeper/babbleserv/internal/util"
 )
 
 type ClientRoutes struct {
 	backgroundWg sync.WaitGroup
 
-	log      zerolog.Logger
-	db       *databases.Databases
-	config   config.BabbleConfig
-	fclient  fclient.FederationClient
-	keyStore *util.KeyStore
+	log       zerolog.Logger
+	db        *databases.Databases
+	config    config.BabbleConfig
+	fclient   fclient.FederationClient
+	keyStore  *util.KeyStore
+	federator *federator.Federator
+	media     *media.MediaRepo
+	identity  *util.IdentityClient
+
+	pushGatewayIPs *types.IPRangeFilter
 }
 
 func NewClientRoutes(
@@ -31,17 +39,24 @@ func NewClientRoutes(
 	db *databases.Databases,
 	fclient fclient.FederationClient,
 	keyStore *util.KeyStore,
+	federator *federator.Federator,
+	media *media.MediaRepo,
 ) *ClientRoutes {
 	log := log.With().
 		Str("routes", "client").
 		Logger()
 
 	return &ClientRoutes{
-		log:      log,
-		db:       db,
-		config:   cfg,
-		fclient:  fclient,
-		keyStore: keyStore,
+		log:       log,
+		db:        db,
+		config:    cfg,
+		fclient:   fclient,
+		keyStore:  keyStore,
+		federator: federator,
+		media:     media,
+		identity:  util.NewIdentityClient(cfg.UserAgent),
+
+		pushGatewayIPs: types.MustNewIPRangeFilter(cfg.Push.GatewayIPRanges.Allow, cfg.Push.GatewayIPRanges.Deny),
 	}
 }
 
@@ -52,10 +67,12 @@ func (c *ClientRoutes) Stop() {
 
 func (c *ClientRoutes) AddClientRoutes(rtr chi.Router) {
 	rtr.MethodFunc(http.MethodGet, "/v3/sync", middleware.RequireUserAuth(c.Sync))
+	rtr.MethodFunc(http.MethodPost, "/v3/search", middleware.RequireUserAuth(c.Search))
 
 	// Rooms
 	//
 	rtr.MethodFunc(http.MethodPost, "/v3/createRoom", middleware.RequireUserAuth(c.CreateRoom))
+	rtr.MethodFunc(http.MethodPost, "/v3/rooms/{roomID}/upgrade", middleware.RequireUserAuth(c.UpgradeRoom))
 	// Send events
 	rtr.MethodFunc(http.MethodPut, "/v3/rooms/{roomID}/state/{eventType}", middleware.RequireUserAuth(c.SendRoomStateEvent))
 	rtr.MethodFunc(http.MethodPut, "/v3/rooms/{roomID}/state/{eventType}/{stateKey}", middleware.RequireUserAuth(c.SendRoomStateEvent))
@@ -75,9 +92,51 @@ func (c *ClientRoutes) AddClientRoutes(rtr chi.Router) {
 	rtr.MethodFunc(http.MethodGet, "/v3/rooms/{roomID}/event/{eventID}", middleware.RequireUserAuth(c.GetRoomEvent))
 	rtr.MethodFunc(http.MethodGet, "/v3/rooms/{roomID}/state", middleware.RequireUserAuth(c.GetRoomState))
 	rtr.MethodFunc(http.MethodGet, "/v3/rooms/{roomID}/members", middleware.RequireUserAuth(c.GetRoomMembers))
+	rtr.MethodFunc(http.MethodGet, "/v1/rooms/{roomID}/hierarchy", middleware.RequireUserAuth(c.GetRoomHierarchy))
+	rtr.MethodFunc(http.MethodGet, "/v1/rooms/{roomID}/timestamp_to_event", middleware.RequireUserAuth(c.GetTimestampToEvent))
+	// Receipts
+	rtr.MethodFunc(http.MethodPost, "/v3/rooms/{roomID}/receipt/{receiptType}/{eventID}", middleware.RequireUserAuth(c.SendReceipt))
+	// Room summary auth is optional
+	rtr.MethodFunc(http.MethodGet, "/v1/room_summary/{roomID}", c.GetRoomSummary)
+
+	// Room alias directory
+	rtr.MethodFunc(http.MethodGet, "/v3/directory/room/{roomAlias}", middleware.RequireUserAuth(c.GetRoomAlias))
+	rtr.MethodFunc(http.MethodPut, "/v3/directory/room/{roomAlias}", middleware.RequireUserAuth(c.PutRoomAlias))
+	rtr.MethodFunc(http.MethodDelete, "/v3/directory/room/{roomAlias}", middleware.RequireUserAuth(c.DeleteRoomAlias))
 
 	// Profile routes (note GET are not authenticated at all)
 	rtr.MethodFunc(http.MethodGet, "/v3/profile/{userID}", c.GetProfile)
 	rtr.MethodFunc(http.MethodGet, "/v3/profile/{userID}/{key}", c.GetProfile)
 	rtr.MethodFunc(http.MethodPut, "/v3/profile/{userID}/{key}", middleware.RequireUserAuth(c.PutProfile))
+	rtr.MethodFunc(http.MethodDelete, "/v3/profile/{userID}/{key}", middleware.RequireUserAuth(c.DeleteProfile))
+	rtr.MethodFunc(http.MethodGet, "/unstable/com.beeper.babbleserv/profile_update", middleware.RequireUserAuth(c.GetProfileUpdateStatus))
+	rtr.MethodFunc(http.MethodPost, "/v3/user_directory/search", middleware.RequireUserAuth(c.SearchUserDirectory))
+
+	// Push rules
+	rtr.MethodFunc(http.MethodGet, "/v3/pushrules/", middleware.RequireUserAuth(c.GetPushRules))
+	rtr.MethodFunc(http.MethodGet, "/v3/pushrules/{scope}/", middleware.RequireUserAuth(c.GetPushRules))
+	rtr.MethodFunc(http.MethodGet, "/v3/pushrules/{scope}/{kind}/{ruleID}", middleware.RequireUserAuth(c.GetPushRule))
+	rtr.MethodFunc(http.MethodPut, "/v3/pushrules/{scope}/{kind}/{ruleID}", middleware.RequireUserAuth(c.PutPushRule))
+	rtr.MethodFunc(http.MethodDelete, "/v3/pushrules/{scope}/{kind}/{ruleID}", middleware.RequireUserAuth(c.DeletePushRule))
+	rtr.MethodFunc(http.MethodGet, "/v3/pushrules/{scope}/{kind}/{ruleID}/{attr}", middleware.RequireUserAuth(c.GetPushRule))
+	rtr.MethodFunc(http.MethodPut, "/v3/pushrules/{scope}/{kind}/{ruleID}/{attr}", middleware.RequireUserAuth(c.PutPushRuleAttr))
+
+	// Pushers
+	rtr.MethodFunc(http.MethodGet, "/v3/pushers", middleware.RequireUserAuth(c.GetPushers))
+	rtr.MethodFunc(http.MethodPost, "/v3/pushers/set", middleware.RequireUserAuth(c.SetPusher))
+
+	rtr.MethodFunc(http.MethodGet, "/v3/notifications", middleware.RequireUserAuth(c.GetNotifications))
+
+	// Media (authenticated downloads)
+	rtr.MethodFunc(http.MethodGet, "/v1/media/config", middleware.RequireUserAuth(c.GetMediaConfig))
+	rtr.MethodFunc(http.MethodGet, "/v1/media/download/{serverName}/{mediaID}", middleware.RequireUserAuth(c.DownloadMedia))
+	rtr.MethodFunc(http.MethodGet, "/v1/media/download/{serverName}/{mediaID}/{fileName}", middleware.RequireUserAuth(c.DownloadMedia))
+	rtr.MethodFunc(http.MethodGet, "/v1/media/thumbnail/{serverName}/{mediaID}", middleware.RequireUserAuth(c.GetMediaThumbnail))
+}
+
+// Media uploads live under /_matrix/media
+func (c *ClientRoutes) AddMediaRoutes(rtr chi.Router) {
+	rtr.MethodFunc(http.MethodPost, "/v3/upload", middleware.RequireUserAuth(c.UploadMedia))
+	rtr.MethodFunc(http.MethodPut, "/v3/upload/{serverName}/{mediaID}", middleware.RequireUserAuth(c.UploadPendingMedia))
+	rtr.MethodFunc(http.MethodPost, "/v1/create", middleware.RequireUserAuth(c.CreateMedia))
 }
@@ -2,33 +2,38 @@ package client
 
 import (
 	"net/http"
+	"slices"
 
 	"github.com/go-chi/chi/v5"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
 	"github.com/beeper/babbleserv/internal/util"
 )
 
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3roomsroomideventeventid
 func (c *ClientRoutes) GetRoomEvent(w http.ResponseWriter, r *http.Request) {
 	roomID := id.RoomID(chi.URLParam(r, "roomID"))
 	eventID := id.EventID(chi.URLParam(r, "eventID"))
 
-	user := middleware.GetRequestUser(r)
-	if inRoom, err := c.db.Rooms.IsUserInRoom(r.Context(), user.UserID(), roomID); err != nil {
+	ev, err := c.db.Rooms.GetEvent(r.Context(), eventID)
+	if err != nil {
 		util.ResponseErrorUnknownJSON(w, r, err)
 		return
-	} else if !inRoom {
-		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
+	} else if ev == nil || ev.RoomID != roomID {
+		util.ResponseErrorJSON(w, r, mautrix.MNotFound)
 		return
 	}
 
-	ev, err := c.db.Rooms.GetEvent(r.Context(), eventID)
-	if err != nil {
+	// Events the user may not see are indistinguishable from missing ones
+	user := middleware.GetRequestUser(r)
+	if visible, err := c.db.Rooms.IsEventVisibleToUser(r.Context(), user.UserID(), ev); err != nil {
 		util.ResponseErrorUnknownJSON(w, r, err)
 		return
-	} else if ev == nil || ev.RoomID != roomID {
+	} else if !visible {
 		util.ResponseErrorJSON(w, r, mautrix.MNotFound)
 		return
 	}
@@ -36,44 +41,90 @@ func (c *ClientRoutes) GetRoomEvent(w http.ResponseWriter, r *http.Request) {
 	util.ResponseJSON(w, r, http.StatusOK, ev.ClientEvent())
 }
 
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3roomsroomidstate
 func (c *ClientRoutes) GetRoomState(w http.ResponseWriter, r *http.Request) {
 	roomID := id.RoomID(chi.URLParam(r, "roomID"))
 
-	user := middleware.GetRequestUser(r)
-	if inRoom, err := c.db.Rooms.IsUserInRoom(r.Context(), user.UserID(), roomID); err != nil {
-		util.ResponseErrorUnknownJSON(w, r, err)
-		return
-	} else if !inRoom {
-		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
-		return
-	}
-
-	stateEvs, err := c.db.Rooms.GetCurrentRoomStateEvents(r.Context(), roomID)
-	if err != nil {
-		util.ResponseErrorUnknownJSON(w, r, err)
+	stateEvs := c.getReadableRoomState(w, r, roomID, false)
+	if stateEvs == nil {
 		return
 	}
 
 	util.ResponseJSON(w, r, http.StatusOK, util.EventsToClientEvents(stateEvs))
 }
 
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3roomsroomidmembers
 func (c *ClientRoutes) GetRoomMembers(w http.ResponseWriter, r *http.Request) {
 	roomID := id.RoomID(chi.URLParam(r, "roomID"))
 
-	user := middleware.GetRequestUser(r)
-	if inRoom, err := c.db.Rooms.IsUserInRoom(r.Context(), user.UserID(), roomID); err != nil {
-		util.ResponseErrorUnknownJSON(w, r, err)
-		return
-	} else if !inRoom {
-		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
+	memberEvs := c.getReadableRoomState(w, r, roomID, true)
+	if memberEvs == nil {
 		return
 	}
 
-	memberEvs, err := c.db.Rooms.GetCurrentRoomMemberEvents(r.Context(), roomID)
+	util.ResponseJSON(w, r, http.StatusOK, util.EventsToClientEvents(memberEvs))
+}
+
+// Get the current state (or just members) of a room the user may read: rooms
+// they're in and world readable rooms. Remote rooms we're not in are peeked
+// over federation. Responds with an error and returns nil if the user may not
+// read the room.
+func (c *ClientRoutes) getReadableRoomState(
+	w http.ResponseWriter,
+	r *http.Request,
+	roomID id.RoomID,
+	membersOnly bool,
+) []*types.Event {
+	user := middleware.GetRequestUser(r)
+	inRoom, err := c.db.Rooms.IsUserInRoom(r.Context(), user.UserID(), roomID)
 	if err != nil {
 		util.ResponseErrorUnknownJSON(w, r, err)
-		return
+		return nil
 	}
 
-	util.ResponseJSON(w, r, http.StatusOK, util.EventsToClientEvents(memberEvs))
+	if !inRoom {
+		serverInRoom, err := c.db.Rooms.IsServerInRoom(r.Context(), c.config.ServerName, roomID)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return nil
+		}
+
+		if !serverInRoom {
+			stateEvs, err := c.federator.PeekRemoteRoomState(r.Context(), roomID, r.URL.Query()["via"])
+			if err == types.ErrRoomNotAccessible {
+				util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
+				return nil
+			} else if err != nil {
+				util.ResponseErrorUnknownJSON(w, r, err)
+				return nil
+			}
+			if membersOnly {
+				stateEvs = slices.DeleteFunc(stateEvs, func(ev *types.Event) bool {
+					return ev.Type != event.StateMember
+				})
+			}
+			return stateEvs
+		}
+
+		room, err := c.db.Rooms.GetRoom(r.Context(), roomID)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return nil
+		} else if room == nil || room.HistoryVisibility != string(event.HistoryVisibilityWorldReadable) {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
+			return nil
+		}
+	}
+
+	var stateEvs []*types.Event
+	if membersOnly {
+		stateEvs, err = c.db.Rooms.GetCurrentRoomMemberEvents(r.Context(), roomID)
+	} else {
+		stateEvs, err = c.db.Rooms.GetCurrentRoomStateEvents(r.Context(), roomID)
+	}
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return nil
+	}
+	return stateEvs
 }
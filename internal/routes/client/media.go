@@ -0,0 +1,154 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1mediaconfig
+func (c *ClientRoutes) GetMediaConfig(w http.ResponseWriter, r *http.Request) {
+	util.ResponseJSON(w, r, http.StatusOK, map[string]any{
+		"m.upload.size": c.config.Media.MaxUploadSize,
+	})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixmediav3upload
+func (c *ClientRoutes) UploadMedia(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	if r.ContentLength > c.config.Media.MaxUploadSize {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MTooLarge, "Media is too large")
+		return
+	}
+
+	media, err := c.media.UploadMedia(
+		r.Context(),
+		userID,
+		r.Header.Get("Content-Type"),
+		r.URL.Query().Get("filename"),
+		r.Body,
+	)
+	if err != nil {
+		util.ResponseMediaErrorJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, map[string]any{
+		"content_uri": media.ContentURI(),
+	})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixmediav1create
+func (c *ClientRoutes) CreateMedia(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	media, err := c.media.CreateMedia(r.Context(), userID)
+	if err != nil {
+		util.ResponseMediaErrorJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, map[string]any{
+		"content_uri":       media.ContentURI(),
+		"unused_expires_at": media.PendingExpiresTS,
+	})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixmediav3uploadservernamemediaid
+func (c *ClientRoutes) UploadPendingMedia(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	if chi.URLParam(r, "serverName") != c.config.ServerName {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Cannot upload media for other servers")
+		return
+	}
+	mediaID := chi.URLParam(r, "mediaID")
+	if !types.IsValidMediaID(mediaID) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Media not found")
+		return
+	}
+	if r.ContentLength > c.config.Media.MaxUploadSize {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MTooLarge, "Media is too large")
+		return
+	}
+
+	if _, err := c.media.UploadPendingMedia(
+		r.Context(),
+		userID,
+		mediaID,
+		r.Header.Get("Content-Type"),
+		r.URL.Query().Get("filename"),
+		r.Body,
+	); err != nil {
+		util.ResponseMediaErrorJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1mediadownloadservernamemediaid
+func (c *ClientRoutes) DownloadMedia(w http.ResponseWriter, r *http.Request) {
+	serverName := chi.URLParam(r, "serverName")
+	mediaID := chi.URLParam(r, "mediaID")
+	if !types.IsValidMediaID(mediaID) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Media not found")
+		return
+	}
+
+	maxStall, err := util.MediaStallTimeoutFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid timeout_ms")
+		return
+	}
+
+	media, content, err := c.media.GetMedia(r.Context(), serverName, mediaID, maxStall)
+	if err != nil {
+		util.ResponseMediaErrorJSON(w, r, err)
+		return
+	}
+	defer content.Close()
+
+	fileName := media.FileName
+	if urlFileName := chi.URLParam(r, "fileName"); urlFileName != "" {
+		fileName = urlFileName
+	}
+
+	util.ResponseMedia(w, r, media.ContentType, fileName, media.Size, content)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1mediathumbnailservernamemediaid
+func (c *ClientRoutes) GetMediaThumbnail(w http.ResponseWriter, r *http.Request) {
+	serverName := chi.URLParam(r, "serverName")
+	mediaID := chi.URLParam(r, "mediaID")
+	if !types.IsValidMediaID(mediaID) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Media not found")
+		return
+	}
+
+	width, height, method, err := util.ThumbnailParamsFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	}
+	maxStall, err := util.MediaStallTimeoutFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid timeout_ms")
+		return
+	}
+
+	thumbnail, content, err := c.media.GetThumbnail(r.Context(), serverName, mediaID, width, height, method, maxStall)
+	if err != nil {
+		util.ResponseMediaErrorJSON(w, r, err)
+		return
+	}
+	defer content.Close()
+
+	util.ResponseMedia(w, r, thumbnail.ContentType, "", thumbnail.Size, content)
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"net/http"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	defaultNotificationsLimit = 20
+	maxNotificationsLimit     = 100
+)
+
+type respNotification struct {
+	Actions pushrules.PushActionArray `json:"actions"`
+	Event   types.ClientEvent         `json:"event"`
+	Read    bool                      `json:"read"`
+	RoomID  id.RoomID                 `json:"room_id"`
+	TS      int64                     `json:"ts"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3notifications
+func (c *ClientRoutes) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	limit, err := util.IntFromRequestQuery(r, "limit", defaultNotificationsLimit)
+	if err != nil || limit < 1 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid limit")
+		return
+	}
+	limit = min(limit, maxNotificationsLimit)
+
+	beforeVersion := types.ZeroVersionstamp
+	if from := r.URL.Query().Get("from"); from != "" {
+		if beforeVersion, err = util.DecodeNotificationsToken(from); err != nil {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid from token")
+			return
+		}
+	}
+
+	onlyHighlight := r.URL.Query().Get("only") == "highlight"
+
+	results, nextVersion, err := c.db.Rooms.GetUserNotifications(r.Context(), userID, beforeVersion, limit, onlyHighlight)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	notifications := make([]respNotification, 0, len(results))
+	for _, result := range results {
+		notifications = append(notifications, respNotification{
+			Actions: result.Notification.Actions,
+			Event:   result.Event.ClientEvent(),
+			Read:    result.Notification.Read,
+			RoomID:  result.Notification.RoomID,
+			TS:      result.Event.Timestamp,
+		})
+	}
+
+	resp := map[string]any{"notifications": notifications}
+	if nextVersion != types.ZeroVersionstamp {
+		resp["next_token"] = util.EncodeNotificationsToken(nextVersion)
+	}
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushrules
+func (c *ClientRoutes) GetPushRules(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	rs, err := c.db.Rooms.GetUserPushRules(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	if chi.URLParam(r, "scope") != "" {
+		if !checkPushRuleScope(w, r) {
+			return
+		}
+		util.ResponseJSON(w, r, http.StatusOK, rs)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, map[string]any{"global": rs})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushrulesscopekindruleid
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushrulesscopekindruleidactions
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushrulesscopekindruleidenabled
+func (c *ClientRoutes) GetPushRule(w http.ResponseWriter, r *http.Request) {
+	if !checkPushRuleScope(w, r) {
+		return
+	}
+	userID := middleware.GetRequestUser(r).UserID()
+
+	rs, err := c.db.Rooms.GetUserPushRules(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	kind := pushrules.PushRuleType(chi.URLParam(r, "kind"))
+	rule, err := types.GetPushRule(rs, kind, chi.URLParam(r, "ruleID"))
+	if err != nil {
+		responsePushRuleError(w, r, err)
+		return
+	}
+
+	switch chi.URLParam(r, "attr") {
+	case "":
+		util.ResponseJSON(w, r, http.StatusOK, rule)
+	case "actions":
+		util.ResponseJSON(w, r, http.StatusOK, map[string]any{"actions": rule.Actions})
+	case "enabled":
+		util.ResponseJSON(w, r, http.StatusOK, map[string]any{"enabled": rule.Enabled})
+	default:
+		util.ResponseErrorJSON(w, r, mautrix.MNotFound)
+	}
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3pushrulesscopekindruleid
+func (c *ClientRoutes) PutPushRule(w http.ResponseWriter, r *http.Request) {
+	if !checkPushRuleScope(w, r) {
+		return
+	}
+	userID := middleware.GetRequestUser(r).UserID()
+
+	var req struct {
+		Actions    pushrules.PushActionArray  `json:"actions"`
+		Conditions []*pushrules.PushCondition `json:"conditions"`
+		Pattern    string                     `json:"pattern"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	kind := pushrules.PushRuleType(chi.URLParam(r, "kind"))
+	rule := &pushrules.PushRule{
+		RuleID:     chi.URLParam(r, "ruleID"),
+		Actions:    req.Actions,
+		Conditions: req.Conditions,
+		Pattern:    req.Pattern,
+	}
+	before := r.URL.Query().Get("before")
+	after := r.URL.Query().Get("after")
+
+	if err := c.db.Rooms.UpdateUserPushRules(r.Context(), userID, func(rs *pushrules.PushRuleset) error {
+		return types.SetPushRule(rs, kind, rule, before, after)
+	}); err != nil {
+		responsePushRuleError(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3pushrulesscopekindruleidactions
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3pushrulesscopekindruleidenabled
+func (c *ClientRoutes) PutPushRuleAttr(w http.ResponseWriter, r *http.Request) {
+	if !checkPushRuleScope(w, r) {
+		return
+	}
+	userID := middleware.GetRequestUser(r).UserID()
+
+	var req struct {
+		Actions pushrules.PushActionArray `json:"actions"`
+		Enabled *bool                     `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	attr := chi.URLParam(r, "attr")
+	switch {
+	case attr == "actions" && req.Actions == nil:
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing actions")
+		return
+	case attr == "enabled" && req.Enabled == nil:
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing enabled")
+		return
+	case attr != "actions" && attr != "enabled":
+		util.ResponseErrorJSON(w, r, mautrix.MNotFound)
+		return
+	}
+
+	kind := pushrules.PushRuleType(chi.URLParam(r, "kind"))
+	ruleID := chi.URLParam(r, "ruleID")
+
+	if err := c.db.Rooms.UpdateUserPushRules(r.Context(), userID, func(rs *pushrules.PushRuleset) error {
+		rule, err := types.GetPushRule(rs, kind, ruleID)
+		if err != nil {
+			return err
+		}
+		if attr == "actions" {
+			rule.Actions = req.Actions
+		} else {
+			rule.Enabled = *req.Enabled
+		}
+		return nil
+	}); err != nil {
+		responsePushRuleError(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#delete_matrixclientv3pushrulesscopekindruleid
+func (c *ClientRoutes) DeletePushRule(w http.ResponseWriter, r *http.Request) {
+	if !checkPushRuleScope(w, r) {
+		return
+	}
+	userID := middleware.GetRequestUser(r).UserID()
+
+	kind := pushrules.PushRuleType(chi.URLParam(r, "kind"))
+	ruleID := chi.URLParam(r, "ruleID")
+
+	if err := c.db.Rooms.UpdateUserPushRules(r.Context(), userID, func(rs *pushrules.PushRuleset) error {
+		return types.DeletePushRule(rs, kind, ruleID)
+	}); err != nil {
+		responsePushRuleError(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+}
+
+// Only the global scope exists
+func checkPushRuleScope(w http.ResponseWriter, r *http.Request) bool {
+	if chi.URLParam(r, "scope") != "global" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Unknown push rule scope")
+		return false
+	}
+	return true
+}
+
+func responsePushRuleError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, types.ErrPushRuleNotFound) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, err.Error())
+	} else if errors.Is(err, types.ErrPushRuleInvalid) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+	} else {
+		util.ResponseErrorUnknownJSON(w, r, err)
+	}
+}
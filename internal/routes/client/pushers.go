@@ -0,0 +1,74 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushers
+func (c *ClientRoutes) GetPushers(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	pushers, err := c.db.Rooms.GetUserPushers(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, map[string]any{"pushers": pushers})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3pushersset
+func (c *ClientRoutes) SetPusher(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	var req struct {
+		types.Pusher
+		// Kind is a pointer as null deletes the pusher
+		Kind   *string `json:"kind"`
+		Append bool    `json:"append"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	pusher := &req.Pusher
+	pusher.UserID = userID
+
+	if req.Kind == nil {
+		if pusher.AppID == "" || pusher.PushKey == "" {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing app_id or pushkey")
+			return
+		}
+		if err := c.db.Rooms.DeleteUserPusher(r.Context(), pusher.Key()); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+		util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+		return
+	}
+
+	pusher.Kind = *req.Kind
+	if err := types.ValidatePusher(r.Context(), pusher, c.pushGatewayIPs); errors.Is(err, types.ErrPusherInvalid) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	if err := c.db.Rooms.SetUserPusher(r.Context(), pusher, req.Append); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+}
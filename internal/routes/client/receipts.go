@@ -0,0 +1,64 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Read receipts are currently only used to reset unread notification counts and
+// mark notifications read, they're not yet sent to other users or servers.
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3roomsroomidreceiptreceipttypeeventid
+func (c *ClientRoutes) SendReceipt(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+	roomID := id.RoomID(chi.URLParam(r, "roomID"))
+	eventID := id.EventID(chi.URLParam(r, "eventID"))
+
+	var req struct {
+		ThreadID string `json:"thread_id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+			return
+		}
+	}
+
+	switch event.ReceiptType(chi.URLParam(r, "receiptType")) {
+	case event.ReceiptTypeRead, event.ReceiptTypeReadPrivate:
+	case "m.fully_read":
+		// Fully read markers are room account data and don't affect counts
+		util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+		return
+	default:
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Unknown receipt type")
+		return
+	}
+
+	// Counts are per room so only unthreaded or main timeline receipts reset them
+	if req.ThreadID != "" && req.ThreadID != "main" {
+		util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+		return
+	}
+
+	if err := c.db.Rooms.SetUserReadReceipt(r.Context(), userID, roomID, eventID); err == types.ErrRoomNotAccessible {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not in this room")
+		return
+	} else if err == types.ErrEventNotFound {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Event not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+}
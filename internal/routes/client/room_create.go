@@ -175,7 +175,7 @@ func (c *ClientRoutes) CreateRoom(w http.ResponseWriter, r *http.Request) {
 		defer c.backgroundWg.Done()
 
 		for uid, ev := range externalInvites {
-			_, respErr, err := c.prepareAndSendInviteForRemoteUser(backgroundCtx, roomID, uid, ev)
+			_, respErr, err := c.federator.PrepareAndSendInviteForRemoteUser(backgroundCtx, roomID, uid, ev)
 			if err != nil {
 				log.Err(err).Any("resp_error", respErr).Msg("Error sending federated invite to newly created room")
 				// TODO: tell the request user about this! (via their personal control room)
@@ -1 +1,84 @@
 package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3directoryroomroomalias
+func (c *ClientRoutes) GetRoomAlias(w http.ResponseWriter, r *http.Request) {
+	alias := util.RoomAliasFromRequestURLParam(r, "roomAlias")
+
+	roomID, servers, err := c.federator.ResolveRoomAlias(r.Context(), alias)
+	if err == types.ErrRoomNotAccessible {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room alias not found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, mautrix.RespAliasResolve{
+		RoomID:  roomID,
+		Servers: servers,
+	})
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3directoryroomroomalias
+func (c *ClientRoutes) PutRoomAlias(w http.ResponseWriter, r *http.Request) {
+	alias := util.RoomAliasFromRequestURLParam(r, "roomAlias")
+	if _, serverName, _ := strings.Cut(alias.String(), ":"); !strings.HasPrefix(alias.String(), "#") || serverName != c.config.ServerName {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Room alias must be on this server")
+		return
+	}
+
+	var req mautrix.ReqAliasCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	userID := middleware.GetRequestUser(r).UserID()
+
+	err := c.db.Rooms.SetRoomAlias(r.Context(), alias, req.RoomID, userID)
+	if err == types.ErrRoomAliasInUse {
+		util.ResponseErrorJSON(w, r, mautrix.MRoomInUse)
+		return
+	} else if err == types.ErrRoomAliasNotAllowed {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, err.Error())
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#delete_matrixclientv3directoryroomroomalias
+func (c *ClientRoutes) DeleteRoomAlias(w http.ResponseWriter, r *http.Request) {
+	alias := util.RoomAliasFromRequestURLParam(r, "roomAlias")
+
+	userID := middleware.GetRequestUser(r).UserID()
+
+	err := c.db.Rooms.DeleteRoomAlias(r.Context(), alias, userID)
+	if err == types.ErrRoomAliasNotFound {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, err.Error())
+		return
+	} else if err == types.ErrRoomAliasNotAllowed {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, err.Error())
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/federator"
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	defaultHierarchyLimit = 50
+	maxHierarchyLimit     = 100
+)
+
+// The hierarchy is walked again for each page, the token holds the number of
+// rooms already returned plus the options which must not change between pages.
+type hierarchyToken struct {
+	Offset        int  `json:"o"`
+	MaxDepth      int  `json:"d"`
+	SuggestedOnly bool `json:"s"`
+}
+
+func (t hierarchyToken) String() string {
+	b, _ := json.Marshal(t)
+	return util.Base64EncodeURLSafe(b)
+}
+
+func parseHierarchyToken(s string) (hierarchyToken, error) {
+	var token hierarchyToken
+	b, err := util.Base64DecodeURLSafe(s)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(b, &token)
+	return token, err
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidhierarchy
+func (c *ClientRoutes) GetRoomHierarchy(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	userID := middleware.GetRequestUser(r).UserID()
+
+	limit, err := util.IntFromRequestQuery(r, "limit", defaultHierarchyLimit)
+	if err != nil || limit < 1 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid limit")
+		return
+	}
+	maxDepth, err := util.IntFromRequestQuery(r, "max_depth", -1)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid max depth")
+		return
+	}
+
+	token := hierarchyToken{
+		MaxDepth:      maxDepth,
+		SuggestedOnly: r.URL.Query().Get("suggested_only") == "true",
+	}
+	if from := r.URL.Query().Get("from"); from != "" {
+		fromToken, err := parseHierarchyToken(from)
+		if err != nil {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid from token")
+			return
+		} else if fromToken.MaxDepth != token.MaxDepth || fromToken.SuggestedOnly != token.SuggestedOnly {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Options do not match from token")
+			return
+		}
+		token.Offset = fromToken.Offset
+	}
+
+	rooms, hasMore, err := c.federator.GetRoomHierarchyForUser(r.Context(), userID, roomID, federator.RoomHierarchyOptions{
+		MaxDepth:      token.MaxDepth,
+		SuggestedOnly: token.SuggestedOnly,
+		Offset:        token.Offset,
+		Limit:         min(limit, maxHierarchyLimit),
+	})
+	if err == types.ErrRoomNotAccessible {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You may not preview this room")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	resp := struct {
+		Rooms     []*fclient.RoomHierarchyRoom `json:"rooms"`
+		NextBatch string                       `json:"next_batch,omitempty"`
+	}{Rooms: rooms}
+	if hasMore {
+		token.Offset += len(rooms)
+		resp.NextBatch = token.String()
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
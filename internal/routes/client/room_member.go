@@ -13,6 +13,7 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 
@@ -20,9 +21,12 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
+	"github.com/tidwall/sjson"
 
 	"github.com/beeper/babbleserv/internal/databases/rooms"
 	"github.com/beeper/babbleserv/internal/middleware"
@@ -34,10 +38,14 @@ type reqMemberSelf struct {
 	Reason string `json:"reason,omitempty"`
 }
 
+type reqThirdPartySigned struct {
+	gomatrixserverlib.MemberThirdPartyInviteSigned `json:",inline"`
+	Sender                                         id.UserID `json:"sender"`
+}
+
 type reqMemberJoin struct {
-	reqMemberSelf `json:",inline"`
-	// TODO: support third party join rules
-	// ThirdPartySigned struct{} `json:"third_party_signed"`
+	reqMemberSelf    `json:",inline"`
+	ThirdPartySigned *reqThirdPartySigned `json:"third_party_signed,omitempty"`
 }
 
 type reqMemberOther struct {
@@ -45,6 +53,15 @@ type reqMemberOther struct {
 	UserID        id.UserID `json:"user_id"`
 }
 
+type reqMemberInvite struct {
+	reqMemberOther `json:",inline"`
+	// Third party invites
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+	Medium        string `json:"medium"`
+	Address       string `json:"address"`
+}
+
 func makeMembershipContent(membership event.Membership, reason string) map[string]any {
 	content := map[string]any{
 		"membership": membership,
@@ -78,16 +95,29 @@ func (c *ClientRoutes) GetJoinedRooms(w http.ResponseWriter, r *http.Request) {
 func (c *ClientRoutes) SendRoomInvite(w http.ResponseWriter, r *http.Request) {
 	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
 
-	var req reqMemberOther
+	var req reqMemberInvite
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
 		return
 	}
 
+	if req.UserID == "" && req.Medium != "" {
+		c.sendRoomThirdPartyInvite(w, r, roomID, req)
+		return
+	}
+	c.sendRoomInviteForUser(w, r, roomID, req.UserID, req.Reason)
+}
+
+func (c *ClientRoutes) sendRoomInviteForUser(
+	w http.ResponseWriter,
+	r *http.Request,
+	roomID id.RoomID,
+	otherUserID id.UserID,
+	reason string,
+) {
 	userID := middleware.GetRequestUser(r).UserID()
-	otherUserID := req.UserID
 	sKey := otherUserID.String()
-	content := makeMembershipContent(event.MembershipInvite, req.Reason)
+	content := makeMembershipContent(event.MembershipInvite, reason)
 	partialEv := types.NewPartialEvent(roomID, event.StateMember, &sKey, userID, content)
 
 	if otherUserID.Homeserver() == c.config.ServerName {
@@ -98,7 +128,7 @@ func (c *ClientRoutes) SendRoomInvite(w http.ResponseWriter, r *http.Request) {
 		// We're inviting a remote user, we need the users HS to sign the event
 		// before we send it.
 		// https://spec.matrix.org/v1.11/server-server-api/#inviting-to-a-room
-		_, respErr, err := c.prepareAndSendInviteForRemoteUser(r.Context(), roomID, otherUserID, partialEv)
+		_, respErr, err := c.federator.PrepareAndSendInviteForRemoteUser(r.Context(), roomID, otherUserID, partialEv)
 		if err != nil {
 			if respErr != nil {
 				util.ResponseErrorMessageJSON(w, r, *respErr, err.Error())
@@ -111,6 +141,59 @@ func (c *ClientRoutes) SendRoomInvite(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Invite a third party identifier, if the identity server knows the Matrix ID
+// it's bound to we invite that user directly, otherwise we store the invite on
+// the identity server and send a m.room.third_party_invite event. This is then
+// exchanged for an invite once the identity server calls /3pid/onbind.
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3roomsroomidinvite-1
+func (c *ClientRoutes) sendRoomThirdPartyInvite(
+	w http.ResponseWriter,
+	r *http.Request,
+	roomID id.RoomID,
+	req reqMemberInvite,
+) {
+	baseURL, found := c.config.IdentityServers[req.IDServer]
+	if !found {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Identity server is not trusted")
+		return
+	}
+
+	otherUserID, err := c.identity.LookupThreePID(r.Context(), baseURL, req.IDAccessToken, req.Medium, req.Address)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if otherUserID != "" {
+		c.sendRoomInviteForUser(w, r, roomID, otherUserID, req.Reason)
+		return
+	}
+
+	userID := middleware.GetRequestUser(r).UserID()
+	storeResp, err := c.identity.StoreInvite(r.Context(), baseURL, req.IDAccessToken, util.StoreInviteRequest{
+		Address: req.Address,
+		Medium:  req.Medium,
+		RoomID:  roomID,
+		Sender:  userID,
+	})
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// https://spec.matrix.org/v1.11/client-server-api/#mroomthird_party_invite
+	content := map[string]any{
+		"display_name": storeResp.DisplayName,
+		"public_keys":  storeResp.PublicKeys,
+	}
+	if len(storeResp.PublicKeys) > 0 {
+		content["public_key"] = storeResp.PublicKeys[0].PublicKey
+		content["key_validity_url"] = storeResp.PublicKeys[0].KeyValidityURL
+	}
+	partialEv := types.NewPartialEvent(roomID, types.StateThirdPartyInvite, &storeResp.Token, userID, content)
+	c.sendLocalEventHandleResults(w, r, roomID, partialEv, func(ev *types.Event) any {
+		return util.EmptyJSON
+	})
+}
+
 // https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3joinroomidoralias
 func (c *ClientRoutes) SendRoomJoinAlias(w http.ResponseWriter, r *http.Request) {
 	util.ResponseErrorJSON(w, r, util.MNotImplemented)
@@ -120,25 +203,55 @@ func (c *ClientRoutes) SendRoomJoinAlias(w http.ResponseWriter, r *http.Request)
 func (c *ClientRoutes) SendRoomJoin(w http.ResponseWriter, r *http.Request) {
 	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
 
-	var req reqMemberSelf
+	var req reqMemberJoin
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
 		return
 	}
 
+	userID := middleware.GetRequestUser(r).UserID()
+
+	// Joining via a third party invite, exchange it for a real invite first
+	// which the join is then authorised against.
+	if signed := req.ThirdPartySigned; signed != nil {
+		if id.UserID(signed.MXID) != userID {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Third party invite is for a different user")
+			return
+		}
+		if err := c.federator.ExchangeThirdPartyInvite(
+			r.Context(), roomID, signed.Sender, signed.MemberThirdPartyInviteSigned,
+		); err != nil {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, err.Error())
+			return
+		}
+	}
+
 	serverInRoom, err := c.db.Rooms.IsServerInRoom(r.Context(), c.config.ServerName, roomID)
 	if err != nil {
 		util.ResponseErrorUnknownJSON(w, r, err)
 		return
 	}
 
-	userID := middleware.GetRequestUser(r).UserID()
-
 	if serverInRoom {
 		// The easy path - we're already in the room, so just send the join. We
 		// re-check the server in room within the send local transaction.
 		sKey := userID.String()
 		content := makeMembershipContent(event.MembershipJoin, req.Reason)
+
+		// If the room is restricted, check the allow conditions and pick a local
+		// user to authorise the join.
+		if authoriser, err := c.db.Rooms.GetRestrictedJoinAuthoriser(r.Context(), roomID, userID); err == types.ErrJoinNotAuthorised ||
+			err == types.ErrUnableToAuthoriseJoin ||
+			err == types.ErrUnableToGrantJoin {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, err.Error())
+			return
+		} else if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		} else if authoriser != "" {
+			content["join_authorised_via_users_server"] = authoriser
+		}
+
 		ev := types.NewPartialEvent(roomID, event.StateMember, &sKey, userID, content)
 		c.sendLocalEventHandleResults(w, r, roomID, ev, func(ev *types.Event) any {
 			return util.EmptyJSON
@@ -178,7 +291,9 @@ func (c *ClientRoutes) SendRoomJoin(w http.ResponseWriter, r *http.Request) {
 			Logger().
 			WithContext(context.Background())
 
-		sendJoinResp, err := c.fclient.SendJoin(
+		// Request a partial state join (members omitted), for large rooms this
+		// is substantially faster, the full state is fetched in the background.
+		sendJoinResp, err := c.fclient.SendJoinPartialState(
 			backgroundCtx,
 			spec.ServerName(c.config.ServerName),
 			spec.ServerName(otherServer),
@@ -220,7 +335,24 @@ func (c *ClientRoutes) SendRoomJoin(w http.ResponseWriter, r *http.Request) {
 			allEvs = append(allEvs, remoteEv)
 			seenIDs[remoteEv.ID] = struct{}{}
 		}
-		// Finally, add our join event we just sent to the server
+		// Finally, add our join event we just sent to the server. For restricted
+		// joins the remote server returns the event with its signature added.
+		if len(sendJoinResp.Event) > 0 {
+			signedEv := &types.Event{RoomVersion: roomVersion}
+			if err := json.Unmarshal(sendJoinResp.Event, signedEv); err != nil {
+				util.ResponseErrorUnknownJSON(w, r, err)
+				return
+			}
+			if refHash, err := util.GetEventReferenceHash(signedEv); err != nil {
+				util.ResponseErrorUnknownJSON(w, r, err)
+				return
+			} else if refHash != ev.ID {
+				util.ResponseErrorUnknownJSON(w, r, errors.New("send_join returned a different join event"))
+				return
+			}
+			signedEv.ID = ev.ID
+			ev = signedEv
+		}
 		allEvs = append(allEvs, ev)
 
 		// TODO: check for and fill any missing auth events here
@@ -228,15 +360,21 @@ func (c *ClientRoutes) SendRoomJoin(w http.ResponseWriter, r *http.Request) {
 
 		util.SortEventList(allEvs)
 
-		results, err := c.db.Rooms.SendFederatedEvents(
-			backgroundCtx, roomID, allEvs,
-			rooms.SendFederatedEventsOptions{
-				// Skip the prev state check as we are including the full state in our ev list (which
-				// will itself be checked). This allows for events to be included that we don't have
-				// the prev events for - ie to bootstrap the start of a room from our perspective.
-				SkipPrevStateCheck: true,
-			},
-		)
+		options := rooms.SendFederatedEventsOptions{
+			// Skip the prev state check as we are including the full state in our ev list (which
+			// will itself be checked). This allows for events to be included that we don't have
+			// the prev events for - ie to bootstrap the start of a room from our perspective.
+			SkipPrevStateCheck: true,
+		}
+		if sendJoinResp.MembersOmitted {
+			options.PartialState = &rooms.PartialStateRoom{
+				RoomID:      roomID,
+				JoinEventID: ev.ID,
+				Servers:     sendJoinResp.ServersInRoom,
+			}
+		}
+
+		results, err := c.db.Rooms.SendFederatedEvents(backgroundCtx, roomID, allEvs, options)
 		if err != nil {
 			util.ResponseErrorUnknownJSON(w, r, err)
 			return
@@ -252,11 +390,141 @@ func (c *ClientRoutes) SendRoomJoin(w http.ResponseWriter, r *http.Request) {
 
 // https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3knockroomidoralias
 func (c *ClientRoutes) SendRoomKnockAlias(w http.ResponseWriter, r *http.Request) {
-	util.ResponseErrorJSON(w, r, util.MNotImplemented)
-	// Is local server in room?
-	// If use: is the requesting user in the room? (we must not)
-	// If yes: send knock
-	// If no: do the knock dance!
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	if !strings.HasPrefix(roomID.String(), "!") {
+		util.ResponseErrorMessageJSON(w, r, util.MNotImplemented, "Knocking by room alias is not supported")
+		return
+	}
+
+	var req reqMemberSelf
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	serverInRoom, err := c.db.Rooms.IsServerInRoom(r.Context(), c.config.ServerName, roomID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	userID := middleware.GetRequestUser(r).UserID()
+	roomIDResp := struct {
+		RoomID id.RoomID `json:"room_id"`
+	}{roomID}
+
+	if serverInRoom {
+		// The easy path - we're in the room so just send the knock, the auth
+		// rules will reject it if the room version or join rules don't allow.
+		sKey := userID.String()
+		content := makeMembershipContent(event.MembershipKnock, req.Reason)
+		ev := types.NewPartialEvent(roomID, event.StateMember, &sKey, userID, content)
+		c.sendLocalEventHandleResults(w, r, roomID, ev, func(ev *types.Event) any {
+			return roomIDResp
+		})
+		return
+	}
+
+	// We're not in the room, do the knock dance via one of the provided servers
+	// or the server from the room ID.
+	// https://spec.matrix.org/v1.11/server-server-api/#knocking-upon-a-room
+	viaServers := r.URL.Query()["via"]
+	if len(viaServers) == 0 {
+		viaServers = r.URL.Query()["server_name"]
+	}
+	if len(viaServers) == 0 {
+		roomIDBits := strings.Split(roomID.String(), ":")
+		viaServers = []string{roomIDBits[len(roomIDBits)-1]}
+	}
+
+	supportedVersions := make([]gomatrixserverlib.RoomVersion, 0)
+	for roomVersion := range gomatrixserverlib.StableRoomVersions() {
+		if util.RoomVersionSupportsKnocking(string(roomVersion)) {
+			supportedVersions = append(supportedVersions, roomVersion)
+		}
+	}
+
+	var otherServer string
+	var makeKnockResp fclient.RespMakeKnock
+	for _, otherServer = range viaServers {
+		makeKnockResp, err = c.fclient.MakeKnock(
+			r.Context(),
+			spec.ServerName(c.config.ServerName),
+			spec.ServerName(otherServer),
+			roomID.String(),
+			userID.String(),
+			supportedVersions,
+		)
+		if err == nil {
+			break
+		}
+		hlog.FromRequest(r).Warn().
+			Err(err).
+			Str("server_name", otherServer).
+			Msg("Failed to make knock via server")
+	}
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	roomVersion := string(makeKnockResp.RoomVersion)
+	if !util.RoomVersionSupportsKnocking(roomVersion) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Room version does not support knocking")
+		return
+	}
+
+	ev := types.EventFromProtoEvent(makeKnockResp.KnockEvent)
+	if ev.Type != event.StateMember || ev.StateKey == nil || *ev.StateKey != userID.String() ||
+		ev.Sender != userID || ev.Membership() != event.MembershipKnock {
+		util.ResponseErrorUnknownJSON(w, r, errors.New("invalid make_knock event from remote server"))
+		return
+	}
+	if req.Reason != "" {
+		if ev.Content, err = sjson.SetBytes(ev.Content, "reason", req.Reason); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+	}
+	if err := c.prepareEventFromOtherHomeserver(ev, roomVersion); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// Switch to a background context here - if the client drops the request
+	// we should still send/store the knock so the state on the remote HS
+	// and local don't end up diverged.
+	backgroundCtx := hlog.FromRequest(r).With().
+		Str("background_task", "SendFederatedKnock").
+		Logger().
+		WithContext(context.Background())
+
+	sendKnockResp, err := c.fclient.SendKnock(
+		backgroundCtx,
+		spec.ServerName(c.config.ServerName),
+		spec.ServerName(otherServer),
+		ev.PDU(),
+	)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// Store the stripped room state in unsigned so it can be returned to the user
+	// in the knock section of sync.
+	knockRoomState, err := util.StrippedStatesToValues(sendKnockResp.KnockRoomState)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+	ev.Unsigned = map[string]any{"knock_room_state": knockRoomState}
+
+	if err := c.db.Rooms.SendFederatedOutlierMembershipEvent(backgroundCtx, ev); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, roomIDResp)
 }
 
 // https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3roomsroomidleave
@@ -269,6 +537,8 @@ func (c *ClientRoutes) SendRoomLeave(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID := middleware.GetRequestUser(r).UserID()
+
 	serverInRoom, err := c.db.Rooms.IsServerInRoom(r.Context(), c.config.ServerName, roomID)
 	if err != nil {
 		util.ResponseErrorUnknownJSON(w, r, err)
@@ -279,7 +549,6 @@ func (c *ClientRoutes) SendRoomLeave(w http.ResponseWriter, r *http.Request) {
 		// The easy path - we're (the server) in the room, we can just send the
 		// leave. Note that this might also mean the server is no longer in the
 		// room once sent.
-		userID := middleware.GetRequestUser(r).UserID()
 		sKey := userID.String()
 		content := makeMembershipContent(event.MembershipLeave, req.Reason)
 		ev := types.NewPartialEvent(roomID, event.StateMember, &sKey, userID, content)
@@ -291,8 +560,81 @@ func (c *ClientRoutes) SendRoomLeave(w http.ResponseWriter, r *http.Request) {
 		// rejecting an invite over federation:
 		// https://spec.matrix.org/v1.11/server-server-api/#leaving-rooms-rejecting-invites
 
-		// TODO: make_leave, send_leave
-		// TODO: persist locally? Yes, SendFederatedOutlierMembershipEvent
+		outlierMemberships, err := c.db.Rooms.GetUserOutlierMemberships(r.Context(), userID)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+		membership, found := outlierMemberships[roomID]
+		if !found {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "You are not invited to or knocking on this room")
+			return
+		}
+		outlierEv, err := c.db.Rooms.GetEvent(r.Context(), membership.EventID)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		} else if outlierEv == nil {
+			util.ResponseErrorUnknownJSON(w, r, types.ErrEventNotFound)
+			return
+		}
+		// Leave via the server that sent us the invite, the only server we know
+		// is in the room. For knocks (sent by us) fall back to the room ID server.
+		otherServer := outlierEv.Sender.Homeserver()
+		if otherServer == c.config.ServerName {
+			roomIDBits := strings.Split(roomID.String(), ":")
+			otherServer = roomIDBits[len(roomIDBits)-1]
+		}
+
+		makeLeaveResp, err := c.fclient.MakeLeave(
+			r.Context(),
+			spec.ServerName(c.config.ServerName),
+			spec.ServerName(otherServer),
+			roomID.String(),
+			userID.String(),
+		)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+		roomVersion := string(makeLeaveResp.RoomVersion)
+
+		ev := types.EventFromProtoEvent(makeLeaveResp.LeaveEvent)
+		if ev.Type != event.StateMember || ev.StateKey == nil || *ev.StateKey != userID.String() ||
+			ev.Sender != userID || ev.Membership() != event.MembershipLeave {
+			util.ResponseErrorUnknownJSON(w, r, errors.New("invalid make_leave event from remote server"))
+			return
+		}
+		if err := c.prepareEventFromOtherHomeserver(ev, roomVersion); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+
+		// Switch to a background context here - if the client drops the request
+		// we should still send/store the leave so the state on the remote HS
+		// and local don't end up diverged.
+		backgroundCtx := hlog.FromRequest(r).With().
+			Str("background_task", "SendFederatedLeave").
+			Logger().
+			WithContext(context.Background())
+
+		if err := c.fclient.SendLeave(
+			backgroundCtx,
+			spec.ServerName(c.config.ServerName),
+			spec.ServerName(otherServer),
+			ev.PDU(),
+		); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+
+		// Store the leave as an outlier too, which clears the outlier invite
+		if err := c.db.Rooms.SendFederatedOutlierMembershipEvent(backgroundCtx, ev); err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+
+		util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
 	}
 }
 
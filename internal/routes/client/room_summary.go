@@ -0,0 +1,59 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Authentication is optional here, guests and logged out users may preview
+// rooms that are public or world readable.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/3266
+func (c *ClientRoutes) GetRoomSummary(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+
+	var userID id.UserID
+	if user := middleware.GetRequestUser(r); user != nil {
+		userID = user.UserID()
+	}
+
+	via := r.URL.Query()["via"]
+	if len(via) == 0 {
+		via = r.URL.Query()["server_name"]
+	}
+
+	if strings.HasPrefix(roomID.String(), "#") {
+		aliasRoomID, aliasServers, err := c.federator.ResolveRoomAlias(r.Context(), id.RoomAlias(roomID))
+		if err == types.ErrRoomNotAccessible {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room alias not found")
+			return
+		} else if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+		roomID = aliasRoomID
+		if len(via) == 0 {
+			via = aliasServers
+		}
+	} else if !strings.HasPrefix(roomID.String(), "!") {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid room ID or alias")
+		return
+	}
+
+	summary, err := c.federator.GetRoomSummaryForUser(r.Context(), userID, roomID, via)
+	if err == types.ErrRoomNotAccessible {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room not found or not previewable")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, summary)
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type reqUpgradeRoom struct {
+	NewVersion string `json:"new_version"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3roomsroomidupgrade
+func (c *ClientRoutes) UpgradeRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+
+	var req reqUpgradeRoom
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if _, err := gomatrixserverlib.GetRoomVersion(gomatrixserverlib.RoomVersion(req.NewVersion)); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MUnsupportedRoomVersion)
+		return
+	}
+
+	userID := middleware.GetRequestUser(r).UserID()
+
+	// Check the user is allowed to send the tombstone before we start, this
+	// also checks the user & server are in the room.
+	sKey := ""
+	_, evErr, err := c.db.Rooms.PrepareLocalEvents(r.Context(), []*types.PartialEvent{
+		types.NewPartialEvent(roomID, event.StateTombstone, &sKey, userID, map[string]any{
+			"body":             "This room has been replaced",
+			"replacement_room": roomID,
+		}),
+	})
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if evErr != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, evErr.Error())
+		return
+	}
+
+	upgrade, err := c.db.Rooms.StartRoomUpgrade(r.Context(), roomID, userID, req.NewVersion)
+	if err == types.ErrRoomUpgradeInProgress || err == types.ErrRoomAlreadyUpgraded {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// Run the upgrade now, if this fails part way through the room upgrader
+	// worker will pick it up and complete it.
+	if err := c.db.Rooms.RunRoomUpgrade(r.Context(), upgrade); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct {
+		ReplacementRoom id.RoomID `json:"replacement_room"`
+	}{upgrade.NewRoomID})
+}
@@ -0,0 +1,436 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	defaultSearchLimit = 10
+	maxSearchLimit     = 100
+	// Rank ordering ranks this many of the most recent matches in each room
+	searchRankCandidates = 100
+
+	defaultSearchContextLimit = 5
+	maxSearchContextLimit     = 50
+
+	searchOrderRank   = "rank"
+	searchOrderRecent = "recent"
+)
+
+var searchAllowedKeys = []string{"content.body", "content.name", "content.topic"}
+
+type searchFilter struct {
+	Limit      int         `json:"limit"`
+	Rooms      []id.RoomID `json:"rooms"`
+	NotRooms   []id.RoomID `json:"not_rooms"`
+	Senders    []id.UserID `json:"senders"`
+	NotSenders []id.UserID `json:"not_senders"`
+	Types      []string    `json:"types"`
+	NotTypes   []string    `json:"not_types"`
+}
+
+func matchesEventType(patterns []string, evType string) bool {
+	for _, pattern := range patterns {
+		if pattern == evType || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(evType, pattern[:len(pattern)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f searchFilter) matches(ev *types.Event) bool {
+	if len(f.Senders) > 0 && !slices.Contains(f.Senders, ev.Sender) {
+		return false
+	} else if slices.Contains(f.NotSenders, ev.Sender) {
+		return false
+	} else if len(f.Types) > 0 && !matchesEventType(f.Types, ev.Type.Type) {
+		return false
+	} else if matchesEventType(f.NotTypes, ev.Type.Type) {
+		return false
+	}
+	return true
+}
+
+type reqSearchEventContext struct {
+	BeforeLimit    *int `json:"before_limit"`
+	AfterLimit     *int `json:"after_limit"`
+	IncludeProfile bool `json:"include_profile"`
+}
+
+type reqSearchRoomEvents struct {
+	SearchTerm   string                 `json:"search_term"`
+	Keys         []string               `json:"keys"`
+	Filter       searchFilter           `json:"filter"`
+	OrderBy      string                 `json:"order_by"`
+	EventContext *reqSearchEventContext `json:"event_context"`
+	IncludeState bool                   `json:"include_state"`
+	Groups       *struct {
+		GroupBy []struct {
+			Key string `json:"key"`
+		} `json:"group_by"`
+	} `json:"groups"`
+}
+
+type reqSearch struct {
+	SearchCategories struct {
+		RoomEvents *reqSearchRoomEvents `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type respSearchProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type respSearchEventContext struct {
+	EventsBefore []types.ClientEvent             `json:"events_before"`
+	EventsAfter  []types.ClientEvent             `json:"events_after"`
+	ProfileInfo  map[id.UserID]respSearchProfile `json:"profile_info,omitempty"`
+}
+
+type respSearchResult struct {
+	Rank    float64                 `json:"rank"`
+	Result  types.ClientEvent       `json:"result"`
+	Context *respSearchEventContext `json:"context,omitempty"`
+}
+
+type respSearchGroup struct {
+	Order   int          `json:"order"`
+	Results []id.EventID `json:"results"`
+}
+
+type respSearchRoomEvents struct {
+	Count      int                                    `json:"count"`
+	Highlights []string                               `json:"highlights"`
+	NextBatch  string                                 `json:"next_batch,omitempty"`
+	Results    []respSearchResult                     `json:"results"`
+	State      map[id.RoomID][]types.ClientEvent      `json:"state,omitempty"`
+	Groups     map[string]map[string]*respSearchGroup `json:"groups,omitempty"`
+}
+
+// Recent ordering paginates by version, rank ordering re-ranks the same
+// candidates for each page and paginates by offset.
+type searchToken struct {
+	Version []byte `json:"v,omitempty"`
+	Offset  int    `json:"o,omitempty"`
+}
+
+func (t searchToken) String() string {
+	b, _ := json.Marshal(t)
+	return util.Base64EncodeURLSafe(b)
+}
+
+func parseSearchToken(s string) (searchToken, error) {
+	var token searchToken
+	b, err := util.Base64DecodeURLSafe(s)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(b, &token)
+	return token, err
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3search
+func (c *ClientRoutes) Search(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	var req reqSearch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	searchReq := req.SearchCategories.RoomEvents
+	if searchReq == nil {
+		util.ResponseJSON(w, r, http.StatusOK, map[string]any{"search_categories": struct{}{}})
+		return
+	}
+
+	for _, key := range searchReq.Keys {
+		if !slices.Contains(searchAllowedKeys, key) {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid search key: "+key)
+			return
+		}
+	}
+	orderBy := searchReq.OrderBy
+	if orderBy == "" {
+		orderBy = searchOrderRank
+	} else if orderBy != searchOrderRank && orderBy != searchOrderRecent {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid order_by")
+		return
+	}
+
+	var token searchToken
+	if nextBatch := r.URL.Query().Get("next_batch"); nextBatch != "" {
+		var err error
+		if token, err = parseSearchToken(nextBatch); err != nil {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid next_batch token")
+			return
+		}
+	}
+
+	limit := searchReq.Filter.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	limit = min(limit, maxSearchLimit)
+
+	// Search the rooms the user is joined to, narrowed by the filter
+	memberships, err := c.db.Rooms.GetUserMemberships(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+	roomIDs := make([]id.RoomID, 0, len(memberships))
+	for roomID, membership := range memberships {
+		if membership.Membership != event.MembershipJoin {
+			continue
+		} else if len(searchReq.Filter.Rooms) > 0 && !slices.Contains(searchReq.Filter.Rooms, roomID) {
+			continue
+		} else if slices.Contains(searchReq.Filter.NotRooms, roomID) {
+			continue
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+
+	terms := util.TokenizeSearchText(searchReq.SearchTerm)
+	options := rooms.SearchOptions{
+		Terms:  terms,
+		Keys:   searchReq.Keys,
+		Limit:  limit,
+		Filter: searchReq.Filter.matches,
+	}
+	if orderBy == searchOrderRank {
+		options.Limit = searchRankCandidates
+	} else if token.Version != nil {
+		if options.BeforeVersion, err = types.ValueToVersionstamp(token.Version); err != nil {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid next_batch token")
+			return
+		}
+	}
+
+	results, err := c.db.Rooms.SearchRoomEvents(r.Context(), roomIDs, options)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// Rooms that hit the limit may have older matches we didn't scan, a page
+	// of recent results must not go past the oldest result in any such room.
+	var cutoff tuple.Versionstamp
+	roomCounts := make(map[id.RoomID]int, len(roomIDs))
+	for _, result := range results {
+		roomCounts[result.Event.RoomID]++
+		if roomCounts[result.Event.RoomID] == options.Limit && bytes.Compare(result.Version.Bytes(), cutoff.Bytes()) > 0 {
+			cutoff = result.Version
+		}
+	}
+
+	results, err = c.filterVisibleSearchResults(r, userID, results)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	resp := respSearchRoomEvents{
+		Count:      len(results),
+		Highlights: terms,
+		Results:    make([]respSearchResult, 0, limit),
+	}
+
+	var page []rooms.SearchResult
+	if orderBy == searchOrderRank {
+		slices.SortStableFunc(results, func(a, b rooms.SearchResult) int {
+			if a.Rank > b.Rank {
+				return -1
+			} else if a.Rank < b.Rank {
+				return 1
+			}
+			return 0
+		})
+		start := min(token.Offset, len(results))
+		end := min(start+limit, len(results))
+		page = results[start:end]
+		if end < len(results) {
+			resp.NextBatch = searchToken{Offset: end}.String()
+		}
+	} else {
+		for _, result := range results {
+			if len(page) >= limit || bytes.Compare(result.Version.Bytes(), cutoff.Bytes()) < 0 {
+				break
+			}
+			page = append(page, result)
+		}
+		if len(page) < len(results) || cutoff != types.ZeroVersionstamp {
+			nextVersion := cutoff
+			if len(page) > 0 {
+				nextVersion = page[len(page)-1].Version
+			}
+			resp.NextBatch = searchToken{Version: types.ValueForVersionstamp(nextVersion)}.String()
+		}
+	}
+
+	for _, result := range page {
+		searchResult := respSearchResult{
+			Rank:   result.Rank,
+			Result: result.Event.ClientEvent(),
+		}
+		if searchReq.EventContext != nil {
+			if searchResult.Context, err = c.getSearchResultContext(r, userID, result.Event, searchReq.EventContext); err != nil {
+				util.ResponseErrorUnknownJSON(w, r, err)
+				return
+			}
+		}
+		resp.Results = append(resp.Results, searchResult)
+	}
+
+	if searchReq.Groups != nil {
+		resp.Groups = make(map[string]map[string]*respSearchGroup)
+		for _, groupBy := range searchReq.Groups.GroupBy {
+			var getGroupValue func(ev *types.Event) string
+			switch groupBy.Key {
+			case "room_id":
+				getGroupValue = func(ev *types.Event) string { return ev.RoomID.String() }
+			case "sender":
+				getGroupValue = func(ev *types.Event) string { return ev.Sender.String() }
+			default:
+				util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid group_by key: "+groupBy.Key)
+				return
+			}
+			groups := make(map[string]*respSearchGroup)
+			for _, result := range page {
+				value := getGroupValue(result.Event)
+				group, found := groups[value]
+				if !found {
+					group = &respSearchGroup{Order: len(groups) + 1}
+					groups[value] = group
+				}
+				group.Results = append(group.Results, result.Event.ID)
+			}
+			resp.Groups[groupBy.Key] = groups
+		}
+	}
+
+	if searchReq.IncludeState {
+		resp.State = make(map[id.RoomID][]types.ClientEvent)
+		for _, result := range page {
+			roomID := result.Event.RoomID
+			if _, found := resp.State[roomID]; found {
+				continue
+			}
+			stateEvs, err := c.db.Rooms.GetCurrentRoomStateEvents(r.Context(), roomID)
+			if err != nil {
+				util.ResponseErrorUnknownJSON(w, r, err)
+				return
+			}
+			resp.State[roomID] = util.EventsToClientEvents(stateEvs)
+		}
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, map[string]any{
+		"search_categories": map[string]any{
+			"room_events": resp,
+		},
+	})
+}
+
+func (c *ClientRoutes) filterVisibleSearchResults(
+	r *http.Request,
+	userID id.UserID,
+	results []rooms.SearchResult,
+) ([]rooms.SearchResult, error) {
+	evs := make([]*types.Event, 0, len(results))
+	for _, result := range results {
+		evs = append(evs, result.Event)
+	}
+	visibleEvs, err := c.db.Rooms.FilterEventsForUser(r.Context(), userID, evs)
+	if err != nil {
+		return nil, err
+	}
+	visible := make(map[id.EventID]struct{}, len(visibleEvs))
+	for _, ev := range visibleEvs {
+		visible[ev.ID] = struct{}{}
+	}
+	return slices.DeleteFunc(results, func(result rooms.SearchResult) bool {
+		_, found := visible[result.Event.ID]
+		return !found
+	}), nil
+}
+
+func (c *ClientRoutes) getSearchResultContext(
+	r *http.Request,
+	userID id.UserID,
+	ev *types.Event,
+	req *reqSearchEventContext,
+) (*respSearchEventContext, error) {
+	beforeLimit, afterLimit := defaultSearchContextLimit, defaultSearchContextLimit
+	if req.BeforeLimit != nil {
+		beforeLimit = max(min(*req.BeforeLimit, maxSearchContextLimit), 0)
+	}
+	if req.AfterLimit != nil {
+		afterLimit = max(min(*req.AfterLimit, maxSearchContextLimit), 0)
+	}
+
+	before, after, err := c.db.Rooms.GetRoomEventContext(r.Context(), ev.RoomID, ev.ID, beforeLimit, afterLimit)
+	if err != nil {
+		return nil, err
+	}
+	if before, err = c.db.Rooms.FilterEventsForUser(r.Context(), userID, before); err != nil {
+		return nil, err
+	}
+	if after, err = c.db.Rooms.FilterEventsForUser(r.Context(), userID, after); err != nil {
+		return nil, err
+	}
+
+	evContext := &respSearchEventContext{
+		EventsBefore: util.EventsToClientEvents(before),
+		EventsAfter:  util.EventsToClientEvents(after),
+	}
+	if !req.IncludeProfile {
+		return evContext, nil
+	}
+
+	// Profiles are the senders' member events at the result event
+	senders := []id.UserID{ev.Sender}
+	for _, contextEv := range slices.Concat(before, after) {
+		if !slices.Contains(senders, contextEv.Sender) {
+			senders = append(senders, contextEv.Sender)
+		}
+	}
+	stateMap, err := c.db.Rooms.GetRoomSpecificRoomMemberStateMapAtEvent(r.Context(), ev.RoomID, senders, ev.ID)
+	if err != nil {
+		return nil, err
+	}
+	evContext.ProfileInfo = make(map[id.UserID]respSearchProfile, len(stateMap))
+	for stateTup, memberEvID := range stateMap {
+		if stateTup.Type != event.StateMember {
+			continue
+		}
+		memberEv, err := c.db.Rooms.GetEvent(r.Context(), memberEvID)
+		if err != nil {
+			return nil, err
+		} else if memberEv == nil {
+			continue
+		}
+		evContext.ProfileInfo[id.UserID(stateTup.StateKey)] = respSearchProfile{
+			DisplayName: gjson.GetBytes(memberEv.Content, "displayname").String(),
+			AvatarURL:   gjson.GetBytes(memberEv.Content, "avatar_url").String(),
+		}
+	}
+	return evContext, nil
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"net/http"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidtimestamp_to_event
+func (c *ClientRoutes) GetTimestampToEvent(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	userID := middleware.GetRequestUser(r).UserID()
+
+	ts, forward, err := util.TimestampToEventQueryFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	}
+
+	resp, err := c.federator.GetRoomEventForTimestamp(r.Context(), roomID, ts, forward)
+	if err == types.ErrEventNotFound {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "No event found")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// Check the user may see the event, or if it's a remote event we don't have
+	// that they're in the room.
+	ev, err := c.db.Rooms.GetEvent(r.Context(), resp.EventID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+	var visible bool
+	if ev != nil {
+		visible, err = c.db.Rooms.IsEventVisibleToUser(r.Context(), userID, ev)
+	} else {
+		visible, err = c.db.Rooms.IsUserInRoom(r.Context(), userID, roomID)
+	}
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if !visible {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "No event found")
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+const (
+	defaultUserDirectoryLimit = 10
+	maxUserDirectoryLimit     = 100
+)
+
+type reqUserDirectorySearch struct {
+	SearchTerm string `json:"search_term"`
+	Limit      int    `json:"limit"`
+}
+
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3user_directorysearch
+func (c *ClientRoutes) SearchUserDirectory(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	var req reqUserDirectorySearch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultUserDirectoryLimit
+	}
+
+	entries, limited, err := c.db.Rooms.SearchUserDirectory(r.Context(), userID, req.SearchTerm, min(limit, maxUserDirectoryLimit))
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+	if entries == nil {
+		entries = []*types.UserDirectoryEntry{}
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct {
+		Limited bool                        `json:"limited"`
+		Results []*types.UserDirectoryEntry `json:"results"`
+	}{
+		Limited: limited,
+		Results: entries,
+	})
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -16,11 +17,29 @@ import (
 // https://spec.matrix.org/v1.10/client-server-api/#get_matrixclientv3profileuserid
 // https://spec.matrix.org/v1.10/client-server-api/#get_matrixclientv3profileuseridavatar_url
 // https://spec.matrix.org/v1.10/client-server-api/#get_matrixclientv3profileuseriddisplayname
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4133
 func (c *ClientRoutes) GetProfile(w http.ResponseWriter, r *http.Request) {
 	userID := id.UserID(chi.URLParam(r, "userID"))
 
-	profile, err := c.db.Rooms.GetUserProfile(r.Context(), userID)
-	if err != nil {
+	var profile *types.UserProfile
+	var err error
+	if userID.Homeserver() == c.config.ServerName {
+		profile, err = c.db.Rooms.GetUserProfile(r.Context(), userID)
+	} else if userID.Homeserver() == "" {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid user ID")
+		return
+	} else if middleware.GetRequestUser(r) == nil {
+		// Remote lookups make federation requests on our behalf, only
+		// allow them for our users.
+		util.ResponseErrorJSON(w, r, mautrix.MMissingToken)
+		return
+	} else {
+		profile, err = c.federator.GetRemoteUserProfile(r.Context(), userID)
+	}
+	if errors.Is(err, types.ErrProfileTooLarge) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Remote profile too large")
+		return
+	} else if err != nil {
 		util.ResponseErrorUnknownJSON(w, r, err)
 		return
 	} else if profile == nil {
@@ -28,28 +47,23 @@ func (c *ClientRoutes) GetProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var resp any = profile
-
 	key := chi.URLParam(r, "key")
-	if key == "displayname" {
-		resp = map[string]string{
-			"displayname": profile.DisplayName,
-		}
-	} else if key == "avatar_url" {
-		resp = map[string]string{
-			"avatar_url": profile.AvatarURL,
-		}
-	} else if key != "" {
-		resp = map[string]any{
-			key: profile.Custom[key],
-		}
+	if key == "" {
+		util.ResponseJSON(w, r, http.StatusOK, profile)
+		return
 	}
 
-	util.ResponseJSON(w, r, http.StatusOK, resp)
+	value, found := profile.Get(key)
+	if !found {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Profile field not set")
+		return
+	}
+	util.ResponseJSON(w, r, http.StatusOK, map[string]any{key: value})
 }
 
 // https://spec.matrix.org/v1.10/client-server-api/#put_matrixclientv3profileuseridavatar_url
 // https://spec.matrix.org/v1.10/client-server-api/#put_matrixclientv3profileuseriddisplayname
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4133
 func (c *ClientRoutes) PutProfile(w http.ResponseWriter, r *http.Request) {
 	var req map[string]any
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -66,17 +80,62 @@ func (c *ClientRoutes) PutProfile(w http.ResponseWriter, r *http.Request) {
 
 	key := chi.URLParam(r, "key")
 	value, found := req[key]
-	if !found {
+	if !found || value == nil {
 		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing value")
 		return
 	}
 
+	if err := types.ValidateUserProfileField(key, value); err != nil {
+		if errors.Is(err, types.ErrProfileKeyTooLarge) {
+			util.ResponseErrorJSON(w, r, util.MKeyTooLarge)
+		} else {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MBadJSON, err.Error())
+		}
+		return
+	}
+
+	c.updateProfile(w, r, userID, key, value)
+}
+
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4133
+func (c *ClientRoutes) DeleteProfile(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+	userIDParam := chi.URLParam(r, "userID")
+	if userIDParam != userID.String() {
+		util.ResponseErrorJSON(w, r, mautrix.MInvalidParam)
+		return
+	}
+
+	c.updateProfile(w, r, userID, chi.URLParam(r, "key"), nil)
+}
+
+func (c *ClientRoutes) updateProfile(w http.ResponseWriter, r *http.Request, userID id.UserID, key string, value any) {
 	if err := c.db.Rooms.UpdateUserProfile(
 		r.Context(), userID, key, value,
-	); err != nil && err != types.ErrProfileNotChanged {
+	); err == types.ErrProfileTooLarge {
+		util.ResponseErrorJSON(w, r, util.MProfileTooLarge)
+		return
+	} else if err != nil && err != types.ErrProfileNotChanged {
 		util.ResponseErrorUnknownJSON(w, r, err)
 		return
 	}
 
 	util.ResponseJSON(w, r, http.StatusOK, struct{}{})
 }
+
+// Get the progress of sending updated member events to the user's rooms after
+// their last profile change.
+func (c *ClientRoutes) GetProfileUpdateStatus(w http.ResponseWriter, r *http.Request) {
+	userID := middleware.GetRequestUser(r).UserID()
+
+	update, err := c.db.Rooms.GetProfileUpdate(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if update == nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "No profile update found")
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, update)
+}
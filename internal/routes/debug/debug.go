@@ -9,6 +9,7 @@ import (
 
 	"github.com/beeper/babbleserv/internal/config"
 	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/media"
 	"github.com/beeper/babbleserv/internal/notifier"
 )
 
@@ -17,6 +18,7 @@ type DebugRoutes struct {
 	config   config.BabbleConfig
 	db       *databases.Databases
 	notifier *notifier.Notifier
+	media    *media.MediaRepo
 }
 
 func NewDebugRoutes(
@@ -24,6 +26,7 @@ func NewDebugRoutes(
 	logger zerolog.Logger,
 	db *databases.Databases,
 	notifier *notifier.Notifier,
+	media *media.MediaRepo,
 ) *DebugRoutes {
 	log := log.With().
 		Str("routes", "babbleserv").
@@ -34,6 +37,7 @@ func NewDebugRoutes(
 		config:   cfg,
 		db:       db,
 		notifier: notifier,
+		media:    media,
 	}
 }
 
@@ -48,7 +52,11 @@ func (b *DebugRoutes) AddDebugRoutes(rtr chi.Router) {
 
 	rtr.MethodFunc(http.MethodGet, "/debug/user/{userID}", b.DebugGetUser)
 	rtr.MethodFunc(http.MethodGet, "/debug/user/{userID}/sync", b.DebugSyncUser)
+	rtr.MethodFunc(http.MethodGet, "/debug/user/{userID}/profile_update", b.DebugGetUserProfileUpdate)
 
+	rtr.MethodFunc(http.MethodGet, "/debug/servers", b.DebugGetServers)
 	rtr.MethodFunc(http.MethodGet, "/debug/server/{serverName}", b.DebugGetServer)
+	rtr.MethodFunc(http.MethodDelete, "/debug/server/{serverName}/backoff", b.DebugResetServerBackoff)
 	rtr.MethodFunc(http.MethodGet, "/debug/server/{serverName}/sync", b.DebugSyncServer)
+	rtr.MethodFunc(http.MethodDelete, "/debug/server/{serverName}/media", b.DebugPurgeServerMedia)
 }
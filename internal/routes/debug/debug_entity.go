@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/types"
@@ -47,7 +48,82 @@ func (b *DebugRoutes) DebugGetServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	positions, err := b.db.Rooms.GetServerPositions(r.Context(), serverName)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	backoff, err := b.db.Rooms.GetServerBackoff(r.Context(), serverName)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct {
+		Memberships types.Memberships    `json:"memberships"`
+		Positions   types.VersionMap     `json:"positions"`
+		Backoff     *types.ServerBackoff `json:"backoff"`
+		IsDown      bool                 `json:"is_down"`
+	}{memberships, positions, backoff, backoff != nil && backoff.IsDown()})
+}
+
+// Lists all destination servers we are currently backing off
+func (b *DebugRoutes) DebugGetServers(w http.ResponseWriter, r *http.Request) {
+	backoffs, err := b.db.Rooms.GetServerBackoffs(r.Context())
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct {
+		Backoffs []*types.ServerBackoff `json:"backoffs"`
+	}{backoffs})
+}
+
+func (b *DebugRoutes) DebugResetServerBackoff(w http.ResponseWriter, r *http.Request) {
+	serverName := chi.URLParam(r, "serverName")
+
+	reset, err := b.db.Rooms.ResetServerBackoff(r.Context(), serverName)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct {
+		Reset bool `json:"reset"`
+	}{reset})
+}
+
+// Removes all cached media from a remote server
+func (b *DebugRoutes) DebugPurgeServerMedia(w http.ResponseWriter, r *http.Request) {
+	serverName := chi.URLParam(r, "serverName")
+	if serverName == b.config.ServerName {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Cannot purge local media")
+		return
+	}
+
+	purged, err := b.media.PurgeRemoteServerMedia(r.Context(), serverName)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct {
+		Purged int `json:"purged"`
+	}{purged})
+}
+
+func (b *DebugRoutes) DebugGetUserProfileUpdate(w http.ResponseWriter, r *http.Request) {
+	userID := id.UserID(chi.URLParam(r, "userID"))
+
+	update, err := b.db.Rooms.GetProfileUpdate(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
 	util.ResponseJSON(w, r, http.StatusOK, struct {
-		Memberships types.Memberships `json:"memberships"`
-	}{memberships})
+		ProfileUpdate *types.ProfileUpdate `json:"profile_update"`
+	}{update})
 }
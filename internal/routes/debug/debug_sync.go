@@ -37,10 +37,35 @@ func (b *DebugRoutes) DebugSyncUser(w http.ResponseWriter, r *http.Request) {
 	}
 	nextBatch := util.Base64EncodeURLSafe(types.ValueForVersionstamp(nextVersion))
 
+	roomIDs := make([]id.RoomID, 0, len(rooms))
+	for membershipTup := range rooms {
+		roomIDs = append(roomIDs, membershipTup.RoomID)
+	}
+	unreadNotifications, err := b.db.Rooms.GetUserNotificationCounts(r.Context(), userID, roomIDs)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	knockedRooms, err := b.db.Rooms.GetUserKnockedRooms(r.Context(), userID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+	type knockState struct {
+		Events []any `json:"events"`
+	}
+	knock := make(map[id.RoomID]map[string]knockState, len(knockedRooms))
+	for roomID, state := range knockedRooms {
+		knock[roomID] = map[string]knockState{"knock_state": {state}}
+	}
+
 	util.ResponseJSON(w, r, http.StatusOK, struct {
-		NextBatch string
-		Rooms     map[types.MembershipTup][]*types.Event
-	}{nextBatch, rooms})
+		NextBatch           string
+		Rooms               map[types.MembershipTup][]*types.Event
+		Knock               map[id.RoomID]map[string]knockState    `json:"knock"`
+		UnreadNotifications map[id.RoomID]types.NotificationCounts `json:"unread_notifications"`
+	}{nextBatch, rooms, knock, unreadNotifications})
 }
 
 func (b *DebugRoutes) DebugSyncServer(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,26 @@
+package federation
+
+import (
+	"net/http"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Check the requesting server is allowed by the room's server ACL, writing a
+// forbidden response if not. Returns whether the request should continue.
+// https://spec.matrix.org/v1.11/server-server-api/#server-access-control-lists-acls
+func (f *FederationRoutes) checkRequestServerACL(w http.ResponseWriter, r *http.Request, roomID id.RoomID) bool {
+	allowed, err := f.db.Rooms.IsServerAllowedByRoomACL(r.Context(), roomID, middleware.GetRequestServer(r))
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return false
+	} else if !allowed {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Server is denied by room ACL")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// An EDU handler processes a single inbound EDU of a given type from origin,
+// handlers are responsible for validating the content (ie that any users
+// referenced belong to the origin server).
+type EDUHandler func(ctx context.Context, origin string, edu *types.EDU) error
+
+var errEDUUserNotFromOrigin = errors.New("EDU user does not belong to origin server")
+
+// Register a handler for an EDU type, replacing any existing handler, this must
+// be called before the routes are added to the router.
+func (f *FederationRoutes) RegisterEDUHandler(eduType string, handler EDUHandler) {
+	f.eduHandlers[eduType] = handler
+}
+
+func (f *FederationRoutes) registerDefaultEDUHandlers() {
+	f.RegisterEDUHandler(types.EDUTypeTyping, f.handleTypingEDU)
+	f.RegisterEDUHandler(types.EDUTypeReceipt, f.handleReceiptEDU)
+	f.RegisterEDUHandler(types.EDUTypePresence, f.handlePresenceEDU)
+	f.RegisterEDUHandler(types.EDUTypeDeviceListUpdate, f.handleDeviceEDU)
+	f.RegisterEDUHandler(types.EDUTypeSigningKeyUpdate, f.handleDeviceEDU)
+	f.RegisterEDUHandler(types.EDUTypeDirectToDevice, f.handleDirectToDeviceEDU)
+}
+
+// Dispatch EDUs to their handlers, errors are logged and otherwise ignored as
+// the spec provides no way to return EDU results to the sending server.
+func (f *FederationRoutes) handleTransactionEDUs(ctx context.Context, origin string, edus []*types.EDU) {
+	log := zerolog.Ctx(ctx)
+
+	for _, edu := range edus {
+		handler, found := f.eduHandlers[edu.Type]
+		if !found {
+			log.Debug().
+				Str("edu_type", edu.Type).
+				Msg("Ignoring EDU with no registered handler")
+			continue
+		}
+		if err := handler(ctx, origin, edu); err != nil {
+			log.Warn().Err(err).
+				Str("edu_type", edu.Type).
+				Msg("Failed to handle EDU")
+		}
+	}
+}
+
+func checkUserFromOrigin(userID id.UserID, origin string) error {
+	if userID.Homeserver() != origin {
+		return fmt.Errorf("%w: %s", errEDUUserNotFromOrigin, userID)
+	}
+	return nil
+}
+
+// Check the origin server is in the room and not denied by the room ACL
+func (f *FederationRoutes) checkOriginInRoom(ctx context.Context, origin string, roomID id.RoomID) error {
+	if inRoom, err := f.db.Rooms.IsServerInRoom(ctx, origin, roomID); err != nil {
+		return err
+	} else if !inRoom {
+		return fmt.Errorf("origin server is not in room: %s", roomID)
+	}
+	if allowed, err := f.db.Rooms.IsServerAllowedByRoomACL(ctx, roomID, origin); err != nil {
+		return err
+	} else if !allowed {
+		return fmt.Errorf("%w: %s", types.ErrServerDeniedByACL, roomID)
+	}
+	return nil
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#typing-notifications
+func (f *FederationRoutes) handleTypingEDU(ctx context.Context, origin string, edu *types.EDU) error {
+	var content struct {
+		RoomID id.RoomID `json:"room_id"`
+		UserID id.UserID `json:"user_id"`
+		Typing bool      `json:"typing"`
+	}
+	if err := json.Unmarshal(edu.Content, &content); err != nil {
+		return err
+	} else if err := checkUserFromOrigin(content.UserID, origin); err != nil {
+		return err
+	} else if err := f.checkOriginInRoom(ctx, origin, content.RoomID); err != nil {
+		return err
+	}
+	// TODO: store typing state once we have typing notifications
+	zerolog.Ctx(ctx).Trace().
+		Stringer("room_id", content.RoomID).
+		Stringer("user_id", content.UserID).
+		Bool("typing", content.Typing).
+		Msg("Received typing EDU")
+	return nil
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#receipts
+func (f *FederationRoutes) handleReceiptEDU(ctx context.Context, origin string, edu *types.EDU) error {
+	var content map[id.RoomID]map[string]map[id.UserID]struct {
+		EventIDs []id.EventID   `json:"event_ids"`
+		Data     map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(edu.Content, &content); err != nil {
+		return err
+	}
+	for roomID, receiptTypes := range content {
+		if err := f.checkOriginInRoom(ctx, origin, roomID); err != nil {
+			return err
+		}
+		for _, userReceipts := range receiptTypes {
+			for userID := range userReceipts {
+				if err := checkUserFromOrigin(userID, origin); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// TODO: store receipts once we have receipts
+	return nil
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#presence
+func (f *FederationRoutes) handlePresenceEDU(ctx context.Context, origin string, edu *types.EDU) error {
+	var content struct {
+		Push []struct {
+			UserID id.UserID `json:"user_id"`
+		} `json:"push"`
+	}
+	if err := json.Unmarshal(edu.Content, &content); err != nil {
+		return err
+	}
+	for _, push := range content.Push {
+		if err := checkUserFromOrigin(push.UserID, origin); err != nil {
+			return err
+		}
+	}
+	// TODO: store presence once we have presence
+	return nil
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#device-management
+func (f *FederationRoutes) handleDeviceEDU(ctx context.Context, origin string, edu *types.EDU) error {
+	var content struct {
+		UserID id.UserID `json:"user_id"`
+	}
+	if err := json.Unmarshal(edu.Content, &content); err != nil {
+		return err
+	} else if err := checkUserFromOrigin(content.UserID, origin); err != nil {
+		return err
+	}
+	// TODO: invalidate cached remote device lists once we have devices
+	return nil
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#send-to-device-messaging
+func (f *FederationRoutes) handleDirectToDeviceEDU(ctx context.Context, origin string, edu *types.EDU) error {
+	var content struct {
+		Sender    id.UserID                                `json:"sender"`
+		Type      string                                   `json:"type"`
+		MessageID string                                   `json:"message_id"`
+		Messages  map[id.UserID]map[string]json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(edu.Content, &content); err != nil {
+		return err
+	} else if err := checkUserFromOrigin(content.Sender, origin); err != nil {
+		return err
+	}
+	for userID := range content.Messages {
+		if userID.Homeserver() != f.config.ServerName {
+			return fmt.Errorf("to-device message for non-local user: %s", userID)
+		}
+	}
+	// TODO: deliver to device inboxes once we have devices
+	return nil
+}
@@ -7,10 +7,47 @@ import (
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 
+	"github.com/beeper/babbleserv/internal/middleware"
 	"github.com/beeper/babbleserv/internal/types"
 	"github.com/beeper/babbleserv/internal/util"
 )
 
+// Get an event in a room the requesting server may see, responding with not found
+// if the event does not exist or is not visible to the server.
+// https://spec.matrix.org/v1.11/server-server-api/#restricting-server-access
+func (f *FederationRoutes) getVisibleRoomEvent(
+	w http.ResponseWriter,
+	r *http.Request,
+	roomID id.RoomID,
+	eventID id.EventID,
+) *types.Event {
+	ev, err := f.db.Rooms.GetEvent(r.Context(), eventID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return nil
+	} else if ev == nil || ev.RoomID != roomID {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Event not found")
+		return nil
+	}
+
+	if !f.checkRequestServerCanSeeEvent(w, r, ev) {
+		return nil
+	}
+	return ev
+}
+
+func (f *FederationRoutes) checkRequestServerCanSeeEvent(w http.ResponseWriter, r *http.Request, ev *types.Event) bool {
+	serverName := middleware.GetRequestServer(r)
+	if visible, err := f.db.Rooms.IsEventVisibleToServer(r.Context(), serverName, ev); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return false
+	} else if !visible {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Event not found")
+		return false
+	}
+	return true
+}
+
 // https://spec.matrix.org/v1.10/server-server-api/#get_matrixfederationv1eventeventid
 func (f *FederationRoutes) GetEvent(w http.ResponseWriter, r *http.Request) {
 	eventID := chi.URLParam(r, "eventID")
@@ -21,14 +58,23 @@ func (f *FederationRoutes) GetEvent(w http.ResponseWriter, r *http.Request) {
 	} else if ev == nil {
 		util.ResponseErrorJSON(w, r, mautrix.MNotFound)
 		return
+	} else if !f.checkRequestServerACL(w, r, ev.RoomID) {
+		return
+	} else if !f.checkRequestServerCanSeeEvent(w, r, ev) {
+		return
 	}
 	util.ResponseJSON(w, r, http.StatusOK, ev)
 }
 
 // https://spec.matrix.org/v1.10/server-server-api/#get_matrixfederationv1event_authroomideventid
 func (f *FederationRoutes) GetEventAuth(w http.ResponseWriter, r *http.Request) {
-	// roomID := chi.URLParam(r, "roomID") // don't actually need it!
+	roomID := chi.URLParam(r, "roomID")
 	eventID := chi.URLParam(r, "eventID")
+	if !f.checkRequestServerACL(w, r, id.RoomID(roomID)) {
+		return
+	} else if ev := f.getVisibleRoomEvent(w, r, id.RoomID(roomID), id.EventID(eventID)); ev == nil {
+		return
+	}
 	authChain, err := f.db.Rooms.GetEventAuthChain(r.Context(), id.EventID(eventID))
 	if err == types.ErrEventNotFound {
 		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Event not found")
@@ -49,6 +95,10 @@ func (f *FederationRoutes) GetState(w http.ResponseWriter, r *http.Request) {
 	if eventID == "" {
 		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing event ID")
 		return
+	} else if !f.checkRequestServerACL(w, r, id.RoomID(roomID)) {
+		return
+	} else if ev := f.getVisibleRoomEvent(w, r, id.RoomID(roomID), id.EventID(eventID)); ev == nil {
+		return
 	}
 	state, err := f.db.Rooms.GetRoomStateWithAuthChainAtEvent(r.Context(), id.RoomID(roomID), id.EventID(eventID))
 	if err == types.ErrEventNotFound {
@@ -71,6 +121,10 @@ func (f *FederationRoutes) GetStateIDs(w http.ResponseWriter, r *http.Request) {
 	if eventID == "" {
 		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing event ID")
 		return
+	} else if !f.checkRequestServerACL(w, r, id.RoomID(roomID)) {
+		return
+	} else if ev := f.getVisibleRoomEvent(w, r, id.RoomID(roomID), id.EventID(eventID)); ev == nil {
+		return
 	}
 	stateIDs, err := f.db.Rooms.GetRoomStateWithAuthChainIDsAtEvent(r.Context(), id.RoomID(roomID), id.EventID(eventID))
 	if err == types.ErrEventNotFound {
@@ -6,20 +6,27 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
 
 	"github.com/beeper/babbleserv/internal/config"
 	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/federator"
+	"github.com/beeper/babbleserv/internal/media"
 	"github.com/beeper/babbleserv/internal/middleware"
 	"github.com/beeper/babbleserv/internal/util"
 )
 
 type FederationRoutes struct {
-	log      zerolog.Logger
-	db       *databases.Databases
-	config   config.BabbleConfig
-	fclient  fclient.FederationClient
-	keyStore *util.KeyStore
+	log       zerolog.Logger
+	db        *databases.Databases
+	config    config.BabbleConfig
+	fclient   fclient.FederationClient
+	keyStore  *util.KeyStore
+	federator *federator.Federator
+	media     *media.MediaRepo
+
+	eduHandlers map[string]EDUHandler
 }
 
 func NewFederationRoutes(
@@ -28,18 +35,26 @@ func NewFederationRoutes(
 	db *databases.Databases,
 	fclient fclient.FederationClient,
 	keyStore *util.KeyStore,
+	federator *federator.Federator,
+	media *media.MediaRepo,
 ) *FederationRoutes {
 	log := log.With().
 		Str("routes", "federation").
 		Logger()
 
-	return &FederationRoutes{
-		log:      log,
-		db:       db,
-		config:   cfg,
-		fclient:  fclient,
-		keyStore: keyStore,
+	f := &FederationRoutes{
+		log:       log,
+		db:        db,
+		config:    cfg,
+		fclient:   fclient,
+		keyStore:  keyStore,
+		federator: federator,
+		media:     media,
+
+		eduHandlers: make(map[string]EDUHandler),
 	}
+	f.registerDefaultEDUHandlers()
+	return f
 }
 
 func (f *FederationRoutes) AddKeyRoutes(rtr chi.Router) {
@@ -51,23 +66,42 @@ func (f *FederationRoutes) AddKeyRoutes(rtr chi.Router) {
 func (f *FederationRoutes) AddFederationRoutes(rtr chi.Router) {
 	rtr.MethodFunc(http.MethodGet, "/v1/version", f.GetVersion)
 
-	requireServerAuth := middleware.NewServerAuthMiddleware(f.config.ServerName, f.keyStore)
+	requireServerAuth := f.withResetServerBackoff(
+		middleware.NewServerAuthMiddleware(f.config.ServerName, f.keyStore),
+	)
 
-	rtr.MethodFunc(http.MethodPut, "/v1/send/{tnxID}", requireServerAuth(f.SendTransaction))
+	rtr.MethodFunc(http.MethodPut, "/v1/send/{txnID}", requireServerAuth(f.SendTransaction))
 
 	rtr.MethodFunc(http.MethodGet, "/v1/event/{eventID}", requireServerAuth(f.GetEvent))
 	rtr.MethodFunc(http.MethodGet, "/v1/event_auth/{roomID}/{eventID}", requireServerAuth(f.GetEventAuth))
 
 	rtr.MethodFunc(http.MethodGet, "/v1/state/{roomID}", requireServerAuth(f.GetState))
 	rtr.MethodFunc(http.MethodGet, "/v1/state_ids/{roomID}", requireServerAuth(f.GetStateIDs))
+	rtr.MethodFunc(http.MethodGet, "/v1/timestamp_to_event/{roomID}", requireServerAuth(f.GetTimestampToEvent))
+
+	rtr.MethodFunc(http.MethodGet, "/v1/hierarchy/{roomID}", requireServerAuth(f.GetRoomHierarchy))
+
+	rtr.MethodFunc(http.MethodPut, "/v1/peek/{roomID}/{peekID}", requireServerAuth(f.PeekRoom))
+	rtr.MethodFunc(http.MethodDelete, "/v1/peek/{roomID}/{peekID}", requireServerAuth(f.UnpeekRoom))
 
 	rtr.MethodFunc(http.MethodGet, "/v1/query/profile", requireServerAuth(f.QueryProfile))
 
 	rtr.MethodFunc(http.MethodGet, "/v1/user/devices/{userID}", requireServerAuth(f.GetUserDevices))
 
+	rtr.MethodFunc(http.MethodGet, "/v1/media/download/{mediaID}", requireServerAuth(f.DownloadMedia))
+	rtr.MethodFunc(http.MethodGet, "/v1/media/thumbnail/{mediaID}", requireServerAuth(f.GetMediaThumbnail))
+
 	rtr.MethodFunc(http.MethodPut, "/v2/invite/{roomID}/{eventID}", requireServerAuth(f.SignInvite))
 	rtr.MethodFunc(http.MethodGet, "/v1/make_join/{roomID}/{userID}", requireServerAuth(f.MakeJoin))
-	rtr.MethodFunc(http.MethodPut, "/v2/send_join/{roomID}/{userID}", requireServerAuth(f.SendJoin))
+	rtr.MethodFunc(http.MethodPut, "/v2/send_join/{roomID}/{eventID}", requireServerAuth(f.SendJoin))
+	rtr.MethodFunc(http.MethodGet, "/v1/make_leave/{roomID}/{userID}", requireServerAuth(f.MakeLeave))
+	rtr.MethodFunc(http.MethodPut, "/v2/send_leave/{roomID}/{eventID}", requireServerAuth(f.SendLeave))
+	rtr.MethodFunc(http.MethodGet, "/v1/make_knock/{roomID}/{userID}", requireServerAuth(f.MakeKnock))
+	rtr.MethodFunc(http.MethodPut, "/v1/send_knock/{roomID}/{eventID}", requireServerAuth(f.SendKnock))
+
+	// Identity servers call onbind directly so it cannot require server auth
+	rtr.MethodFunc(http.MethodPut, "/v1/3pid/onbind", f.OnBindThirdPartyInvites)
+	rtr.MethodFunc(http.MethodPut, "/v1/exchange_third_party_invite/{roomID}", requireServerAuth(f.ExchangeThirdPartyInvite))
 }
 
 func (f *FederationRoutes) GetVersion(w http.ResponseWriter, r *http.Request) {
@@ -75,3 +109,23 @@ func (f *FederationRoutes) GetVersion(w http.ResponseWriter, r *http.Request) {
 		"name": "Babbleserv",
 	})
 }
+
+// Wraps the server auth middleware to reset any backoff we have for the
+// requesting server, a successful authenticated request means it's back up.
+func (f *FederationRoutes) withResetServerBackoff(
+	requireServerAuth func(http.HandlerFunc) http.HandlerFunc,
+) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return requireServerAuth(func(w http.ResponseWriter, r *http.Request) {
+			serverName := middleware.GetRequestServer(r)
+			if reset, err := f.db.Rooms.ResetServerBackoff(r.Context(), serverName); err != nil {
+				hlog.FromRequest(r).Err(err).Msg("Failed to reset server backoff")
+			} else if reset {
+				hlog.FromRequest(r).Info().
+					Str("server", serverName).
+					Msg("Reset server backoff after inbound request")
+			}
+			next(w, r)
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package federation
+
+import (
+	"net/http"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1hierarchyroomid
+func (f *FederationRoutes) GetRoomHierarchy(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	if !f.checkRequestServerACL(w, r, roomID) {
+		return
+	}
+	suggestedOnly := r.URL.Query().Get("suggested_only") == "true"
+
+	resp, err := f.federator.GetRoomHierarchyForServer(r.Context(), middleware.GetRequestServer(r), roomID, suggestedOnly)
+	if err == types.ErrRoomNotAccessible {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room not found or not accessible")
+		return
+	} else if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,67 @@
+package federation
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Federation media endpoints only serve our own media, remote servers must
+// never use us to proxy media from elsewhere.
+
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1mediadownloadmediaid
+func (f *FederationRoutes) DownloadMedia(w http.ResponseWriter, r *http.Request) {
+	mediaID := chi.URLParam(r, "mediaID")
+	if !types.IsValidMediaID(mediaID) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Media not found")
+		return
+	}
+
+	maxStall, err := util.MediaStallTimeoutFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid timeout_ms")
+		return
+	}
+
+	media, content, err := f.media.GetMedia(r.Context(), f.config.ServerName, mediaID, maxStall)
+	if err != nil {
+		util.ResponseMediaErrorJSON(w, r, err)
+		return
+	}
+	defer content.Close()
+
+	util.ResponseFederationMedia(w, r, media.ContentType, media.FileName, content)
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1mediathumbnailmediaid
+func (f *FederationRoutes) GetMediaThumbnail(w http.ResponseWriter, r *http.Request) {
+	mediaID := chi.URLParam(r, "mediaID")
+	if !types.IsValidMediaID(mediaID) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Media not found")
+		return
+	}
+
+	width, height, method, err := util.ThumbnailParamsFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	}
+	maxStall, err := util.MediaStallTimeoutFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid timeout_ms")
+		return
+	}
+
+	thumbnail, content, err := f.media.GetThumbnail(r.Context(), f.config.ServerName, mediaID, width, height, method, maxStall)
+	if err != nil {
+		util.ResponseMediaErrorJSON(w, r, err)
+		return
+	}
+	defer content.Close()
+
+	util.ResponseFederationMedia(w, r, thumbnail.ContentType, "", content)
+}
@@ -0,0 +1,110 @@
+package federation
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// How long a peek lasts before the peeking server must renew it
+const peekRenewalInterval = time.Hour
+
+// Start or renew a peek on a world readable room.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2444
+func (f *FederationRoutes) PeekRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	peekID := chi.URLParam(r, "peekID")
+	if !f.checkRequestServerACL(w, r, roomID) {
+		return
+	}
+
+	if inRoom, err := f.db.Rooms.IsServerInRoom(r.Context(), f.config.ServerName, roomID); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if !inRoom {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room not found")
+		return
+	}
+
+	room, err := f.db.Rooms.GetRoom(r.Context(), roomID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if room == nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room not found")
+		return
+	} else if room.HistoryVisibility != string(event.HistoryVisibilityWorldReadable) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Room is not world readable")
+		return
+	}
+
+	if versions := r.URL.Query()["ver"]; len(versions) > 0 && !slices.Contains(versions, room.Version) {
+		util.ResponseErrorJSON(w, r, mautrix.MIncompatibleRoomVersion)
+		return
+	}
+
+	extremIDs, err := f.db.Rooms.GetRoomCurrentExtremEventIDs(r.Context(), roomID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if len(extremIDs) == 0 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room not found")
+		return
+	}
+	latestEv, err := f.db.Rooms.GetEvent(r.Context(), extremIDs[0])
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if latestEv == nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room not found")
+		return
+	}
+
+	state, err := f.db.Rooms.GetRoomStateWithAuthChainAtEvent(r.Context(), roomID, latestEv.ID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	serverName := middleware.GetRequestServer(r)
+	if _, err := f.db.Rooms.StartRoomPeek(r.Context(), roomID, serverName, peekID, peekRenewalInterval); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct {
+		RenewalInterval int64          `json:"renewal_interval"`
+		RoomVersion     string         `json:"room_version"`
+		State           []*types.Event `json:"state"`
+		AuthChain       []*types.Event `json:"auth_chain"`
+		LatestEvent     *types.Event   `json:"latest_event"`
+	}{
+		RenewalInterval: peekRenewalInterval.Milliseconds(),
+		RoomVersion:     room.Version,
+		State:           state.StateEvents,
+		AuthChain:       state.AuthChain,
+		LatestEvent:     latestEv,
+	})
+}
+
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2444
+func (f *FederationRoutes) UnpeekRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	peekID := chi.URLParam(r, "peekID")
+
+	serverName := middleware.GetRequestServer(r)
+	if err := f.db.Rooms.DeleteRoomPeek(r.Context(), roomID, serverName, peekID); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, struct{}{})
+}
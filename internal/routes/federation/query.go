@@ -12,6 +12,10 @@ import (
 // https://spec.matrix.org/v1.10/server-server-api/#get_matrixfederationv1queryprofile
 func (f *FederationRoutes) QueryProfile(w http.ResponseWriter, r *http.Request) {
 	userID := id.UserID(r.URL.Query().Get("user_id"))
+	if userID.Homeserver() != f.config.ServerName {
+		util.ResponseErrorJSON(w, r, mautrix.MNotFound)
+		return
+	}
 
 	profile, err := f.db.Rooms.GetUserProfile(r.Context(), userID)
 	if err != nil {
@@ -22,19 +26,17 @@ func (f *FederationRoutes) QueryProfile(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var resp any = profile
-
 	key := r.URL.Query().Get("field")
-	if key == "displayname" {
-		resp = map[string]string{
-			"displayname": profile.DisplayName,
-		}
-	} else if key == "avatar_url" {
-		resp = map[string]string{
-			"avatar_url": profile.AvatarURL,
-		}
+	if key == "" {
+		util.ResponseJSON(w, r, http.StatusOK, profile)
+		return
 	}
 
-	util.ResponseJSON(w, r, http.StatusOK, resp)
-	return
+	// Any profile field may be requested, including MSC4133 custom fields
+	value, found := profile.Get(key)
+	if !found {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Profile field not set")
+		return
+	}
+	util.ResponseJSON(w, r, http.StatusOK, map[string]any{key: value})
 }
@@ -3,14 +3,33 @@ package federation
 import (
 	"encoding/json"
 	"net/http"
+	"slices"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/middleware"
 	"github.com/beeper/babbleserv/internal/types"
 	"github.com/beeper/babbleserv/internal/util"
 )
 
+type makeMembershipResponse struct {
+	Event       *types.Event `json:"event"`
+	RoomVersion string       `json:"room_version"`
+}
+
+type sendJoinResponse struct {
+	Origin         string         `json:"origin"`
+	State          []*types.Event `json:"state"`
+	AuthChain      []*types.Event `json:"auth_chain"`
+	Event          *types.Event   `json:"event,omitempty"`
+	MembersOmitted bool           `json:"members_omitted,omitempty"`
+	ServersInRoom  []string       `json:"servers_in_room,omitempty"`
+}
+
 type inviteRequest struct {
 	Event       *types.Event   `json:"event"`
 	InviteState []*types.Event `json:"invite_room_state"`
@@ -28,6 +47,10 @@ func (f *FederationRoutes) SignInvite(w http.ResponseWriter, r *http.Request) {
 	req.Event.RoomVersion = req.RoomVersion
 	req.Event.ID = util.EventIDFromRequestURLParam(r, "eventID")
 
+	if !f.checkRequestServerACL(w, r, req.Event.RoomID) {
+		return
+	}
+
 	// Verify the event ID and signature
 	verifyErr, err := util.VerifyEvent(r.Context(), req.Event, middleware.GetRequestServer(r), f.keyStore)
 	if err != nil {
@@ -61,10 +84,272 @@ func (f *FederationRoutes) SignInvite(w http.ResponseWriter, r *http.Request) {
 	}{req.Event})
 }
 
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1make_joinroomiduserid
 func (f *FederationRoutes) MakeJoin(w http.ResponseWriter, r *http.Request) {
-	util.ResponseErrorJSON(w, r, util.MNotImplemented)
+	roomVersions := r.URL.Query()["ver"]
+	if len(roomVersions) == 0 {
+		// Servers that don't specify versions only support v1
+		roomVersions = []string{"1"}
+	}
+	f.makeMembershipEvent(w, r, event.MembershipJoin, roomVersions)
 }
 
+// https://spec.matrix.org/v1.11/server-server-api/#put_matrixfederationv2send_joinroomideventid
 func (f *FederationRoutes) SendJoin(w http.ResponseWriter, r *http.Request) {
-	util.ResponseErrorJSON(w, r, util.MNotImplemented)
+	ev := f.sendMembershipEvent(w, r, event.MembershipJoin)
+	if ev == nil {
+		return
+	}
+
+	// State is returned as it was prior to the join
+	state, err := f.db.Rooms.GetRoomStateWithAuthChainBeforeEvent(r.Context(), ev.RoomVersion, ev)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	// Partial state joins (MSC3706): omit member events other than the joining
+	// user, the remote server will fetch the full state later.
+	omitMembers := r.URL.Query().Get("omit_members") == "true"
+
+	resp := sendJoinResponse{
+		Origin:         f.config.ServerName,
+		Event:          signedJoinEvent(ev, f.config.ServerName),
+		State:          make([]*types.Event, 0, len(state.StateEvents)),
+		AuthChain:      state.AuthChain,
+		MembersOmitted: omitMembers,
+	}
+
+	for _, stateEv := range state.StateEvents {
+		if omitMembers && stateEv.Type == event.StateMember && *stateEv.StateKey != ev.Sender.String() {
+			continue
+		}
+		resp.State = append(resp.State, stateEv)
+	}
+
+	if omitMembers {
+		resp.ServersInRoom, err = f.db.Rooms.GetCurrentRoomServers(r.Context(), ev.RoomID)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return
+		}
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, resp)
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1make_leaveroomiduserid
+func (f *FederationRoutes) MakeLeave(w http.ResponseWriter, r *http.Request) {
+	f.makeMembershipEvent(w, r, event.MembershipLeave, nil)
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#put_matrixfederationv2send_leaveroomideventid
+func (f *FederationRoutes) SendLeave(w http.ResponseWriter, r *http.Request) {
+	if ev := f.sendMembershipEvent(w, r, event.MembershipLeave); ev != nil {
+		util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+	}
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1make_knockroomiduserid
+func (f *FederationRoutes) MakeKnock(w http.ResponseWriter, r *http.Request) {
+	roomVersions := r.URL.Query()["ver"]
+	if len(roomVersions) == 0 {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing supported room versions")
+		return
+	}
+	f.makeMembershipEvent(w, r, event.MembershipKnock, roomVersions)
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#put_matrixfederationv1send_knockroomideventid
+func (f *FederationRoutes) SendKnock(w http.ResponseWriter, r *http.Request) {
+	ev := f.sendMembershipEvent(w, r, event.MembershipKnock)
+	if ev == nil {
+		return
+	}
+
+	knockStateEvs, err := f.db.Rooms.GetCurrentRoomInviteStateEvents(r.Context(), ev.RoomID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, fclient.RespSendKnock{
+		KnockRoomState: util.EventsToStrippedStates(knockStateEvs),
+	})
+}
+
+// Build a membership event template for a user on the requesting server, the
+// event is authorized against the current room state but not stored. The remote
+// server will fill in the origin, timestamp, hashes and signatures. If room versions
+// are provided the room's version must be one of them.
+func (f *FederationRoutes) makeMembershipEvent(
+	w http.ResponseWriter,
+	r *http.Request,
+	membership event.Membership,
+	roomVersions []string,
+) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	userID := id.UserID(chi.URLParam(r, "userID"))
+
+	if userID.Homeserver() != middleware.GetRequestServer(r) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "User does not belong to requesting server")
+		return
+	} else if !f.checkRequestServerACL(w, r, roomID) {
+		return
+	}
+
+	if inRoom, err := f.db.Rooms.IsServerInRoom(r.Context(), f.config.ServerName, roomID); err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if !inRoom {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room not found")
+		return
+	}
+
+	room, err := f.db.Rooms.GetRoom(r.Context(), roomID)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if roomVersions != nil && !slices.Contains(roomVersions, room.Version) {
+		util.ResponseErrorMessageJSON(
+			w, r,
+			mautrix.MIncompatibleRoomVersion,
+			"Your homeserver does not support the features required to join this room",
+		)
+		return
+	} else if membership == event.MembershipKnock && !util.RoomVersionSupportsKnocking(room.Version) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MIncompatibleRoomVersion, "Room version does not support knocking")
+		return
+	}
+
+	sKey := userID.String()
+	content := map[string]any{"membership": membership}
+
+	if membership == event.MembershipJoin {
+		// If the room is restricted we act as the authorising server, checking
+		// the allow conditions and picking a local user with invite power.
+		authoriser, err := f.db.Rooms.GetRestrictedJoinAuthoriser(r.Context(), roomID, userID)
+		if err != nil {
+			responseRestrictedJoinError(w, r, err)
+			return
+		} else if authoriser != "" {
+			content["join_authorised_via_users_server"] = authoriser
+		}
+	}
+
+	partialEv := types.NewPartialEvent(roomID, event.StateMember, &sKey, userID, content)
+
+	evs, evErr, err := f.db.Rooms.PrepareLocalEvents(r.Context(), []*types.PartialEvent{partialEv})
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if evErr != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, evErr.Error())
+		return
+	}
+
+	ev := evs[0]
+	ev.Hashes = nil
+	ev.Signatures = nil
+
+	util.ResponseJSON(w, r, http.StatusOK, makeMembershipResponse{ev, ev.RoomVersion})
+}
+
+// Receive a signed membership event for a user on the requesting server and
+// send it into the room. Returns nil if a response has already been written.
+func (f *FederationRoutes) sendMembershipEvent(
+	w http.ResponseWriter,
+	r *http.Request,
+	membership event.Membership,
+) *types.Event {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	origin := middleware.GetRequestServer(r)
+
+	var ev types.Event
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return nil
+	}
+	ev.ID = util.EventIDFromRequestURLParam(r, "eventID")
+
+	if ev.RoomID != roomID ||
+		ev.Type != event.StateMember ||
+		ev.StateKey == nil ||
+		*ev.StateKey != ev.Sender.String() ||
+		ev.Membership() != membership {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid membership event")
+		return nil
+	} else if ev.Sender.Homeserver() != origin {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "User does not belong to requesting server")
+		return nil
+	}
+
+	// If the join was authorised by one of our users (restricted rooms) check
+	// the conditions still hold and add our signature to the event.
+	if authoriser := ev.JoinAuthorisedViaUsersServer(); membership == event.MembershipJoin &&
+		authoriser != "" && authoriser.Homeserver() == f.config.ServerName {
+		if _, err := f.db.Rooms.GetRestrictedJoinAuthoriser(r.Context(), roomID, ev.Sender); err != nil {
+			responseRestrictedJoinError(w, r, err)
+			return nil
+		}
+		room, err := f.db.Rooms.GetRoom(r.Context(), roomID)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return nil
+		} else if room == nil {
+			util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room not found")
+			return nil
+		}
+		ev.RoomVersion = room.Version
+		keyID, key := f.config.MustGetActiveSigningKey()
+		signature, err := util.GetEventSignature(&ev, key)
+		if err != nil {
+			util.ResponseErrorUnknownJSON(w, r, err)
+			return nil
+		}
+		if ev.Signatures == nil {
+			ev.Signatures = make(map[string]map[string]string, 2)
+		}
+		ev.Signatures[f.config.ServerName] = map[string]string{
+			keyID: signature,
+		}
+	}
+
+	// The federator handles the ACL check, verification and fetching any missing
+	// prev/auth events before sending the event into the room.
+	results, err := f.federator.ProcessPDUs(r.Context(), origin, []*types.Event{&ev})
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return nil
+	} else if evErr, found := results[ev.ID]; !found {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Room not found")
+		return nil
+	} else if evErr != nil && evErr != types.ErrAlreadyExists {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, evErr.Error())
+		return nil
+	}
+
+	return &ev
+}
+
+func responseRestrictedJoinError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case types.ErrJoinNotAuthorised:
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, err.Error())
+	case types.ErrUnableToAuthoriseJoin:
+		util.ResponseErrorMessageJSON(w, r, util.MUnableToAuthoriseJoin, err.Error())
+	case types.ErrUnableToGrantJoin:
+		util.ResponseErrorMessageJSON(w, r, util.MUnableToGrantJoin, err.Error())
+	default:
+		util.ResponseErrorUnknownJSON(w, r, err)
+	}
+}
+
+// Restricted joins authorised by this server return the join event including
+// our signature, otherwise the event is omitted.
+func signedJoinEvent(ev *types.Event, serverName string) *types.Event {
+	if authoriser := ev.JoinAuthorisedViaUsersServer(); authoriser != "" && authoriser.Homeserver() == serverName {
+		return ev
+	}
+	return nil
 }
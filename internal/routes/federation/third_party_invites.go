@@ -0,0 +1,115 @@
+package federation
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/rs/zerolog/hlog"
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/middleware"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+type reqOnBindInvite struct {
+	Address string                                         `json:"address"`
+	Medium  string                                         `json:"medium"`
+	MXID    id.UserID                                      `json:"mxid"`
+	RoomID  id.RoomID                                      `json:"room_id"`
+	Sender  id.UserID                                      `json:"sender"`
+	Signed  gomatrixserverlib.MemberThirdPartyInviteSigned `json:"signed"`
+}
+
+type reqOnBind struct {
+	Address string            `json:"address"`
+	Medium  string            `json:"medium"`
+	MXID    id.UserID         `json:"mxid"`
+	Invites []reqOnBindInvite `json:"invites"`
+}
+
+// Called by identity servers (not authenticated) once a 3pid with pending
+// invites is bound to one of our users.
+// https://spec.matrix.org/v1.11/server-server-api/#put_matrixfederationv13pidonbind
+func (f *FederationRoutes) OnBindThirdPartyInvites(w http.ResponseWriter, r *http.Request) {
+	var req reqOnBind
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	} else if req.MXID.Homeserver() != f.config.ServerName {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "User does not belong to this server")
+		return
+	}
+
+	log := hlog.FromRequest(r)
+
+	for _, invite := range req.Invites {
+		if invite.MXID != req.MXID || id.UserID(invite.Signed.MXID) != req.MXID {
+			log.Warn().
+				Str("room_id", invite.RoomID.String()).
+				Str("mxid", invite.Signed.MXID).
+				Msg("Skipping third party invite for a different user")
+			continue
+		}
+		if err := f.federator.ExchangeThirdPartyInvite(r.Context(), invite.RoomID, invite.Sender, invite.Signed); err != nil {
+			log.Err(err).
+				Str("room_id", invite.RoomID.String()).
+				Str("sender", invite.Sender.String()).
+				Msg("Failed to exchange third party invite")
+		}
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
+
+// https://spec.matrix.org/v1.11/server-server-api/#put_matrixfederationv1exchange_third_party_inviteroomid
+func (f *FederationRoutes) ExchangeThirdPartyInvite(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+
+	var ev types.PartialEvent
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+		util.ResponseErrorJSON(w, r, mautrix.MNotJSON)
+		return
+	}
+
+	var signed gomatrixserverlib.MemberThirdPartyInviteSigned
+	if signedRaw := gjson.GetBytes(ev.Content, "third_party_invite.signed"); !signedRaw.IsObject() {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Missing third party invite")
+		return
+	} else if err := json.Unmarshal([]byte(signedRaw.Raw), &signed); err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid third party invite")
+		return
+	}
+
+	if ev.RoomID != roomID ||
+		ev.Type != event.StateMember ||
+		ev.StateKey == nil ||
+		*ev.StateKey != signed.MXID ||
+		gjson.GetBytes(ev.Content, "membership").String() != string(event.MembershipInvite) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, "Invalid membership event")
+		return
+	} else if ev.Sender.Homeserver() != f.config.ServerName {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Sender does not belong to this server")
+		return
+	} else if id.UserID(signed.MXID).Homeserver() != middleware.GetRequestServer(r) {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, "Invitee does not belong to requesting server")
+		return
+	} else if !f.checkRequestServerACL(w, r, roomID) {
+		return
+	}
+
+	_, evErr, err := f.federator.SendThirdPartyInvite(r.Context(), roomID, ev.Sender, signed)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if evErr != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MForbidden, evErr.Error())
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, util.EmptyJSON)
+}
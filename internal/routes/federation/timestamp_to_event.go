@@ -0,0 +1,43 @@
+package federation
+
+import (
+	"net/http"
+	"time"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/federator"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Only looks at our local history, we don't ask other servers on behalf of a
+// remote server.
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1timestamp_to_eventroomid
+func (f *FederationRoutes) GetTimestampToEvent(w http.ResponseWriter, r *http.Request) {
+	roomID := util.RoomIDFromRequestURLParam(r, "roomID")
+	if !f.checkRequestServerACL(w, r, roomID) {
+		return
+	}
+
+	ts, forward, err := util.TimestampToEventQueryFromRequest(r)
+	if err != nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+		return
+	}
+
+	ev, err := f.db.Rooms.GetRoomEventForTime(r.Context(), roomID, time.UnixMilli(ts), forward)
+	if err != nil {
+		util.ResponseErrorUnknownJSON(w, r, err)
+		return
+	} else if ev == nil {
+		util.ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "No event found")
+		return
+	} else if !f.checkRequestServerCanSeeEvent(w, r, ev) {
+		return
+	}
+
+	util.ResponseJSON(w, r, http.StatusOK, federator.TimestampToEventResponse{
+		EventID:        ev.ID,
+		OriginServerTS: ev.Timestamp,
+	})
+}
@@ -15,6 +15,8 @@ import (
 
 	"github.com/beeper/babbleserv/internal/config"
 	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/federator"
+	"github.com/beeper/babbleserv/internal/media"
 	"github.com/beeper/babbleserv/internal/middleware"
 	"github.com/beeper/babbleserv/internal/notifier"
 	"github.com/beeper/babbleserv/internal/routes/client"
@@ -47,6 +49,8 @@ func NewRoutes(
 	notifier *notifier.Notifier,
 	fclient fclient.FederationClient,
 	keyStore *util.KeyStore,
+	federator *federator.Federator,
+	mediaRepo *media.MediaRepo,
 ) *Routes {
 	log := logger.With().
 		Str("component", "routes").
@@ -56,9 +60,9 @@ func NewRoutes(
 		log:    log,
 		config: cfg,
 
-		babbleserv: debug.NewDebugRoutes(cfg, logger, databases, notifier),
-		client:     client.NewClientRoutes(cfg, logger, databases, fclient, keyStore),
-		federation: federation.NewFederationRoutes(cfg, logger, databases, fclient, keyStore),
+		babbleserv: debug.NewDebugRoutes(cfg, logger, databases, notifier, mediaRepo),
+		client:     client.NewClientRoutes(cfg, logger, databases, fclient, keyStore, federator, mediaRepo),
+		federation: federation.NewFederationRoutes(cfg, logger, databases, fclient, keyStore, federator, mediaRepo),
 
 		servers: make([]*Server, 0),
 	}
@@ -92,6 +96,7 @@ func (r *Routes) MakeHandler(groups []string) http.Handler {
 			rtr.Route("/_babbleserv", r.babbleserv.AddDebugRoutes)
 		case "client":
 			rtr.Route("/_matrix/client", r.client.AddClientRoutes)
+			rtr.Route("/_matrix/media", r.client.AddMediaRoutes)
 		case "federation":
 			rtr.Route("/_matrix/key", r.federation.AddKeyRoutes)
 			rtr.Route("/_matrix/federation", r.federation.AddFederationRoutes)
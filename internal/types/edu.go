@@ -0,0 +1,50 @@
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// EDU types we know about, see:
+// https://spec.matrix.org/v1.11/server-server-api/#edus
+const (
+	EDUTypeTyping           = "m.typing"
+	EDUTypeReceipt          = "m.receipt"
+	EDUTypePresence         = "m.presence"
+	EDUTypeDeviceListUpdate = "m.device_list_update"
+	EDUTypeSigningKeyUpdate = "m.signing_key_update"
+	EDUTypeDirectToDevice   = "m.direct_to_device"
+)
+
+// Spec limit on the number of EDUs in a single federation transaction
+const MaxTransactionEDUs = 100
+
+type EDU struct {
+	Type    string          `json:"edu_type" msgpack:"typ"`
+	Content json.RawMessage `json:"content" msgpack:"con"`
+}
+
+func NewEDUFromBytes(b []byte) (*EDU, error) {
+	var edu EDU
+	if err := msgpack.Unmarshal(b, &edu); err != nil {
+		return nil, err
+	}
+	return &edu, nil
+}
+
+func MustNewEDUFromBytes(b []byte) *EDU {
+	edu, err := NewEDUFromBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	return edu
+}
+
+func (e *EDU) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(e); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
@@ -7,3 +7,40 @@ var ErrAlreadyExists = errors.New("event already exists")
 var ErrEventRedacted = errors.New("event has been redacted")
 
 var ErrProfileNotChanged = errors.New("profile is unchanged")
+var ErrProfileTooLarge = errors.New("profile is too large")
+var ErrProfileKeyTooLarge = errors.New("profile key is too large")
+var ErrProfileFieldInvalid = errors.New("invalid profile field")
+
+var ErrServerDeniedByACL = errors.New("server is denied by room ACL")
+
+var ErrJoinNotAuthorised = errors.New("user does not meet the room's restricted join conditions")
+var ErrUnableToAuthoriseJoin = errors.New("unable to check membership of rooms allowed to join")
+var ErrUnableToGrantJoin = errors.New("no local user is able to authorise the join")
+
+var ErrThirdPartyInviteNotFound = errors.New("no matching third party invite in room")
+
+var ErrRoomUpgradeInProgress = errors.New("room is already being upgraded")
+var ErrRoomAlreadyUpgraded = errors.New("room has already been upgraded")
+
+var ErrRoomNotAccessible = errors.New("room is not accessible")
+
+var ErrRoomAliasInUse = errors.New("room alias already exists")
+var ErrRoomAliasNotFound = errors.New("room alias not found")
+var ErrRoomAliasNotAllowed = errors.New("user is not allowed to change the room's aliases")
+
+var ErrPushRuleNotFound = errors.New("push rule not found")
+var ErrPushRuleInvalid = errors.New("invalid push rule")
+var ErrPusherInvalid = errors.New("invalid pusher")
+
+var ErrIPRangeDenied = errors.New("address is in a denied IP range")
+
+var ErrMediaNotFound = errors.New("media not found")
+var ErrMediaTooLarge = errors.New("media is too large")
+var ErrMediaQuotaExceeded = errors.New("media storage quota exceeded")
+var ErrMediaTooManyPending = errors.New("too many pending media uploads")
+var ErrMediaNotOwner = errors.New("media was created by another user")
+var ErrMediaAlreadyUploaded = errors.New("media has already been uploaded")
+var ErrMediaNotYetUploaded = errors.New("media has not been uploaded yet")
+var ErrMediaNotThumbnailable = errors.New("cannot generate thumbnail for media")
+var ErrMediaContentNotStored = errors.New("media content is not in storage")
+var ErrMediaThumbnailMethodUnavailable = errors.New("no thumbnail sizes available for method")
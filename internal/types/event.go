@@ -11,6 +11,10 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
+// mautrix doesn't define the third party invite state event type, we use the
+// guessed class so it matches types parsed from events.
+var StateThirdPartyInvite = event.NewEventType("m.room.third_party_invite")
+
 type PartialEvent struct {
 	RoomID   id.RoomID       `msgpack:"rid" json:"room_id"`
 	Sender   id.UserID       `msgpack:"sdr" json:"sender"`
@@ -250,6 +254,18 @@ func (ev *Event) Membership() event.Membership {
 	return event.Membership(gjson.GetBytes(ev.Content, "membership").String())
 }
 
+// Returns the user authorising a restricted room join, if any
+// https://spec.matrix.org/v1.11/client-server-api/#restricted-rooms
+func (ev *PartialEvent) JoinAuthorisedViaUsersServer() id.UserID {
+	return id.UserID(gjson.GetBytes(ev.Content, "join_authorised_via_users_server").String())
+}
+
+// Returns the token of the third party invite this member event claims, if any
+// https://spec.matrix.org/v1.11/client-server-api/#mroommember
+func (ev *PartialEvent) ThirdPartyInviteToken() string {
+	return gjson.GetBytes(ev.Content, "third_party_invite.signed.token").String()
+}
+
 func (ev *Event) RelatesTo() (id.EventID, event.RelationType) {
 	relatesTo := gjson.GetBytes(ev.Content, "m\\.relates_to")
 	if !relatesTo.Exists() {
@@ -291,3 +307,18 @@ func (ev *Event) GetRedactedEvent() (*Event, error) {
 
 	return &redacted, err
 }
+
+// Whether a redaction event may redact another event, either the redaction is
+// by the original sender or they have the redact power level. Power levels may
+// be nil if the room has none at the redaction.
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3roomsroomidredacteventidtxnid
+func (ev *Event) CanRedact(redacted *Event, powerLevels *event.PowerLevelsEventContent) bool {
+	if ev.RoomID != redacted.RoomID {
+		return false
+	} else if ev.Sender == redacted.Sender {
+		return true
+	} else if powerLevels == nil {
+		return false
+	}
+	return powerLevels.GetUserLevel(ev.Sender) >= powerLevels.Redact()
+}
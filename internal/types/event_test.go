@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/tidwall/gjson"
 	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/babbleserv/internal/types"
@@ -60,3 +61,30 @@ func TestEventSerializationWithPrevState(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotNil(t, ev.PrevState)
 }
+
+func makeEventFrom(roomID id.RoomID, sender id.UserID) *types.Event {
+	return &types.Event{PartialEvent: types.PartialEvent{RoomID: roomID, Sender: sender}}
+}
+
+func TestEventCanRedact(t *testing.T) {
+	redacted := makeEventFrom("!room:example.com", "@alice:example.com")
+	powerLevels := &event.PowerLevelsEventContent{
+		Users: map[id.UserID]int{"@mod:example.com": 50},
+	}
+
+	// Original sender can always redact
+	redaction := makeEventFrom("!room:example.com", "@alice:example.com")
+	assert.True(t, redaction.CanRedact(redacted, nil))
+
+	// Others need the redact power level, which defaults to 50
+	redaction = makeEventFrom("!room:example.com", "@mod:example.com")
+	assert.True(t, redaction.CanRedact(redacted, powerLevels))
+	assert.False(t, redaction.CanRedact(redacted, nil))
+
+	redaction = makeEventFrom("!room:example.com", "@bob:example.com")
+	assert.False(t, redaction.CanRedact(redacted, powerLevels))
+
+	// Redactions can't apply across rooms
+	redaction = makeEventFrom("!other:example.com", "@alice:example.com")
+	assert.False(t, redaction.CanRedact(redacted, powerLevels))
+}
@@ -0,0 +1,84 @@
+package types
+
+import (
+	"bytes"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/event"
+)
+
+// Pure history visibility rules, the rooms database looks up the history
+// visibility and membership changes these are evaluated against.
+// https://spec.matrix.org/v1.11/client-server-api/#history-visibility
+
+type HistoryVisibilityChange struct {
+	Version    tuple.Versionstamp
+	Visibility event.HistoryVisibility
+}
+
+func compareVersions(a, b tuple.Versionstamp) int {
+	return bytes.Compare(a.Bytes(), b.Bytes())
+}
+
+// Returns the history visibility at (inclusive) a version given the changes in
+// a room ordered by version, rooms without any default to shared.
+func HistoryVisibilityAtVersion(changes []HistoryVisibilityChange, version tuple.Versionstamp) event.HistoryVisibility {
+	visibility := event.HistoryVisibilityShared
+	for _, change := range changes {
+		if compareVersions(change.Version, version) > 0 {
+			break
+		}
+		if change.Visibility != "" {
+			visibility = change.Visibility
+		}
+	}
+	return visibility
+}
+
+// Returns the membership at (inclusive) a version given a user's membership
+// changes in a room ordered by version, leave if they had none.
+func MembershipAtVersion(changes MembershipChanges, version tuple.Versionstamp) event.Membership {
+	membership := event.MembershipLeave
+	for _, change := range changes {
+		if compareVersions(change.Version, version) > 0 {
+			break
+		}
+		membership = change.Membership
+	}
+	return membership
+}
+
+// Returns whether a user was joined at any point at or after a version given
+// their membership changes in a room ordered by version.
+func JoinedSinceVersion(changes MembershipChanges, version tuple.Versionstamp) bool {
+	if MembershipAtVersion(changes, version) == event.MembershipJoin {
+		return true
+	}
+	for _, change := range changes {
+		if compareVersions(change.Version, version) > 0 && change.Membership == event.MembershipJoin {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether an event is visible to a user given the history visibility
+// and the user's membership at the event, and whether they were joined at any
+// point since for shared visibility.
+func IsEventVisibleToMember(
+	visibility event.HistoryVisibility,
+	membership event.Membership,
+	joinedSince bool,
+) bool {
+	switch {
+	case visibility == event.HistoryVisibilityWorldReadable:
+		return true
+	case membership == event.MembershipJoin:
+		return true
+	case visibility == event.HistoryVisibilityInvited && membership == event.MembershipInvite:
+		return true
+	case visibility == event.HistoryVisibilityShared:
+		return joinedSince
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func makeVersion(n uint16) tuple.Versionstamp {
+	return tuple.Versionstamp{UserVersion: n}
+}
+
+func makeMembershipChanges(memberships ...event.Membership) types.MembershipChanges {
+	changes := make(types.MembershipChanges, 0, len(memberships))
+	for i, membership := range memberships {
+		changes = append(changes, types.MembershipTupWithVersion{
+			MembershipTup: types.MembershipTup{Membership: membership},
+			// Changes at versions 10, 20, 30...
+			Version: makeVersion(uint16(i+1) * 10),
+		})
+	}
+	return changes
+}
+
+func TestHistoryVisibilityAtVersion(t *testing.T) {
+	changes := []types.HistoryVisibilityChange{
+		{Version: makeVersion(10), Visibility: event.HistoryVisibilityJoined},
+		{Version: makeVersion(20), Visibility: event.HistoryVisibilityWorldReadable},
+	}
+	assert.Equal(t, event.HistoryVisibilityShared, types.HistoryVisibilityAtVersion(changes, makeVersion(5)))
+	assert.Equal(t, event.HistoryVisibilityJoined, types.HistoryVisibilityAtVersion(changes, makeVersion(10)))
+	assert.Equal(t, event.HistoryVisibilityJoined, types.HistoryVisibilityAtVersion(changes, makeVersion(15)))
+	assert.Equal(t, event.HistoryVisibilityWorldReadable, types.HistoryVisibilityAtVersion(changes, makeVersion(25)))
+	assert.Equal(t, event.HistoryVisibilityShared, types.HistoryVisibilityAtVersion(nil, makeVersion(25)))
+}
+
+func TestMembershipAtVersion(t *testing.T) {
+	// Invited at 10, joined at 20, left at 30
+	changes := makeMembershipChanges(event.MembershipInvite, event.MembershipJoin, event.MembershipLeave)
+
+	assert.Equal(t, event.MembershipLeave, types.MembershipAtVersion(changes, makeVersion(5)))
+	assert.Equal(t, event.MembershipInvite, types.MembershipAtVersion(changes, makeVersion(15)))
+	assert.Equal(t, event.MembershipJoin, types.MembershipAtVersion(changes, makeVersion(25)))
+	assert.Equal(t, event.MembershipLeave, types.MembershipAtVersion(changes, makeVersion(35)))
+
+	assert.True(t, types.JoinedSinceVersion(changes, makeVersion(5)))
+	assert.True(t, types.JoinedSinceVersion(changes, makeVersion(25)))
+	assert.False(t, types.JoinedSinceVersion(changes, makeVersion(35)))
+}
+
+func TestIsEventVisibleToMember(t *testing.T) {
+	// A user who joined and then left can still see shared history from before
+	// they left, but not after.
+	changes := makeMembershipChanges(event.MembershipJoin, event.MembershipLeave)
+	isVisible := func(visibility event.HistoryVisibility, version uint16) bool {
+		return types.IsEventVisibleToMember(
+			visibility,
+			types.MembershipAtVersion(changes, makeVersion(version)),
+			types.JoinedSinceVersion(changes, makeVersion(version)),
+		)
+	}
+
+	assert.True(t, isVisible(event.HistoryVisibilityShared, 5))
+	assert.True(t, isVisible(event.HistoryVisibilityShared, 15))
+	assert.False(t, isVisible(event.HistoryVisibilityShared, 25))
+
+	assert.False(t, isVisible(event.HistoryVisibilityJoined, 5))
+	assert.True(t, isVisible(event.HistoryVisibilityJoined, 15))
+	assert.False(t, isVisible(event.HistoryVisibilityJoined, 25))
+
+	assert.True(t, isVisible(event.HistoryVisibilityWorldReadable, 25))
+
+	// Invited users can see invited visibility history but not joined
+	assert.True(t, types.IsEventVisibleToMember(event.HistoryVisibilityInvited, event.MembershipInvite, false))
+	assert.False(t, types.IsEventVisibleToMember(event.HistoryVisibilityJoined, event.MembershipInvite, false))
+}
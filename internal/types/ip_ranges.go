@@ -0,0 +1,59 @@
+package types
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Filters outbound connections by IP address, ie to stop user supplied URLs
+// reaching internal services. Addresses in an allowed range are always
+// allowed, otherwise any in a denied range are denied.
+type IPRangeFilter struct {
+	allow, deny []netip.Prefix
+}
+
+func NewIPRangeFilter(allow, deny []string) (*IPRangeFilter, error) {
+	f := &IPRangeFilter{
+		allow: make([]netip.Prefix, 0, len(allow)),
+		deny:  make([]netip.Prefix, 0, len(deny)),
+	}
+	for _, cidr := range allow {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed IP range %s: %w", cidr, err)
+		}
+		f.allow = append(f.allow, prefix)
+	}
+	for _, cidr := range deny {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied IP range %s: %w", cidr, err)
+		}
+		f.deny = append(f.deny, prefix)
+	}
+	return f, nil
+}
+
+func MustNewIPRangeFilter(allow, deny []string) *IPRangeFilter {
+	f, err := NewIPRangeFilter(allow, deny)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (f *IPRangeFilter) IsAllowed(addr netip.Addr) bool {
+	// IPv4 mapped IPv6 addresses are checked as IPv4
+	addr = addr.Unmap()
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	for _, prefix := range f.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
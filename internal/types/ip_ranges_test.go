@@ -0,0 +1,36 @@
+package types_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestIPRangeFilter(t *testing.T) {
+	f, err := types.NewIPRangeFilter(
+		[]string{"10.1.2.3/32"},
+		[]string{"10.0.0.0/8", "127.0.0.0/8", "::1/128", "fe80::/10"},
+	)
+	require.NoError(t, err)
+
+	isAllowed := func(addr string) bool {
+		return f.IsAllowed(netip.MustParseAddr(addr))
+	}
+	assert.True(t, isAllowed("1.1.1.1"))
+	assert.True(t, isAllowed("2001:db8::1"))
+	assert.False(t, isAllowed("10.0.0.1"))
+	assert.False(t, isAllowed("127.0.0.1"))
+	assert.False(t, isAllowed("::1"))
+	assert.False(t, isAllowed("fe80::1"))
+	// IPv4 mapped addresses are checked as IPv4
+	assert.False(t, isAllowed("::ffff:127.0.0.1"))
+	// Allowed ranges take precedence over denied ones
+	assert.True(t, isAllowed("10.1.2.3"))
+
+	_, err = types.NewIPRangeFilter(nil, []string{"not a range"})
+	assert.Error(t, err)
+}
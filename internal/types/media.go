@@ -0,0 +1,116 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	ThumbnailMethodCrop  = "crop"
+	ThumbnailMethodScale = "scale"
+)
+
+// Media metadata, the content itself is kept in media storage addressed by its
+// SHA256 hash so identical uploads share a single stored file.
+// https://spec.matrix.org/v1.11/client-server-api/#content-repository
+type Media struct {
+	ServerName  string    `msgpack:"srv"`
+	MediaID     string    `msgpack:"mid"`
+	UserID      id.UserID `msgpack:"uid,omitempty"`
+	ContentType string    `msgpack:"cty"`
+	FileName    string    `msgpack:"fnm,omitempty"`
+	Size        int64     `msgpack:"sze"`
+	SHA256      string    `msgpack:"sha"`
+	CreatedTS   int64     `msgpack:"cts"`
+
+	// Media created via /create without content yet, expires if the content is
+	// not uploaded in time.
+	PendingExpiresTS int64 `msgpack:"pet,omitempty"`
+
+	// Cached remote media are expired by least recent access
+	LastAccessTS int64 `msgpack:"lat,omitempty"`
+}
+
+func NewMediaFromBytes(b []byte) (*Media, error) {
+	var m Media
+	if err := msgpack.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *Media) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(m); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+func (m *Media) ContentURI() id.ContentURI {
+	return id.ContentURI{Homeserver: m.ServerName, FileID: m.MediaID}
+}
+
+func (m *Media) IsPending() bool {
+	return m.SHA256 == ""
+}
+
+func (m *Media) IsPendingExpired() bool {
+	return m.IsPending() && time.Now().UnixMilli() > m.PendingExpiresTS
+}
+
+func (m *Media) StorageKey() string {
+	return MediaStorageKey(m.SHA256)
+}
+
+// A thumbnail generated from media content, thumbnails belong to the content
+// hash rather than the media ID so deduplicated media share thumbnails too.
+type MediaThumbnail struct {
+	SHA256      string `msgpack:"sha"`
+	Width       int    `msgpack:"wid"`
+	Height      int    `msgpack:"hei"`
+	Method      string `msgpack:"mtd"`
+	ContentType string `msgpack:"cty"`
+	Size        int64  `msgpack:"sze"`
+}
+
+func NewMediaThumbnailFromBytes(b []byte) (*MediaThumbnail, error) {
+	var t MediaThumbnail
+	if err := msgpack.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t *MediaThumbnail) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(t); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+func (t *MediaThumbnail) StorageKey() string {
+	return fmt.Sprintf("thumbnails/%s/%s/%dx%d-%s", t.SHA256[:2], t.SHA256, t.Width, t.Height, t.Method)
+}
+
+// Storage key for media content by its (hex) SHA256 hash, sharded by the first
+// byte to avoid huge directories with the filesystem storage.
+func MediaStorageKey(sha256 string) string {
+	return fmt.Sprintf("content/%s/%s", sha256[:2], sha256)
+}
+
+// Media IDs are used in URLs and storage, limit them to a safe character set
+// https://spec.matrix.org/v1.11/client-server-api/#security-considerations-5
+func IsValidMediaID(mediaID string) bool {
+	if mediaID == "" || len(mediaID) > 255 {
+		return false
+	}
+	return strings.IndexFunc(mediaID, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-')
+	}) == -1
+}
@@ -0,0 +1,60 @@
+package types
+
+import (
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+// Unread notification counts for a user in a room, reset by read receipts
+// https://spec.matrix.org/v1.11/client-server-api/#receiving-notifications
+type NotificationCounts struct {
+	NotificationCount int64 `json:"notification_count"`
+	HighlightCount    int64 `json:"highlight_count"`
+}
+
+// A notification stored for a user by the push evaluator
+type UserNotification struct {
+	Version   tuple.Versionstamp
+	RoomID    id.RoomID
+	EventID   id.EventID
+	Highlight bool
+	Actions   pushrules.PushActionArray
+	// Set once the user's read receipt in the room passes the notification
+	Read bool
+}
+
+// A page of a user's notifications, built from log entries scanned most recent
+// first. The page is full once it has limit notifications or maxScan entries
+// have been scanned, with NextVersion set to the last scanned entry's version
+// to continue from.
+type NotificationsPage struct {
+	Notifications []*UserNotification
+	NextVersion   tuple.Versionstamp
+
+	limit, maxScan, scanned int
+	onlyHighlight           bool
+}
+
+func NewNotificationsPage(limit, maxScan int, onlyHighlight bool) *NotificationsPage {
+	return &NotificationsPage{
+		Notifications: make([]*UserNotification, 0, limit),
+		limit:         limit,
+		maxScan:       maxScan,
+		onlyHighlight: onlyHighlight,
+	}
+}
+
+// Add a scanned notification to the page, skipping it if only highlights are
+// wanted and it isn't one. Returns false once the page is full.
+func (p *NotificationsPage) Add(notification *UserNotification) bool {
+	p.scanned++
+	if !p.onlyHighlight || notification.Highlight {
+		p.Notifications = append(p.Notifications, notification)
+	}
+	if len(p.Notifications) >= p.limit || p.scanned >= p.maxScan {
+		p.NextVersion = notification.Version
+		return false
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Notifications as scanned from the log, most recent first, every third one
+// a highlight.
+func makeTestNotifications(n int) []*types.UserNotification {
+	notifications := make([]*types.UserNotification, 0, n)
+	for i := n; i > 0; i-- {
+		notifications = append(notifications, &types.UserNotification{
+			Version:   tuple.Versionstamp{UserVersion: uint16(i)},
+			Highlight: i%3 == 0,
+		})
+	}
+	return notifications
+}
+
+func fillNotificationsPage(page *types.NotificationsPage, notifications []*types.UserNotification) {
+	for _, notification := range notifications {
+		if !page.Add(notification) {
+			break
+		}
+	}
+}
+
+func TestNotificationsPage(t *testing.T) {
+	notifications := makeTestNotifications(10)
+
+	// Full page continues from the last notification
+	page := types.NewNotificationsPage(4, 1000, false)
+	fillNotificationsPage(page, notifications)
+	assert.Equal(t, notifications[:4], page.Notifications)
+	assert.Equal(t, notifications[3].Version, page.NextVersion)
+
+	// Partial page is the end
+	page = types.NewNotificationsPage(20, 1000, false)
+	fillNotificationsPage(page, notifications)
+	assert.Equal(t, notifications, page.Notifications)
+	assert.Equal(t, types.ZeroVersionstamp, page.NextVersion)
+}
+
+func TestNotificationsPageOnlyHighlight(t *testing.T) {
+	notifications := makeTestNotifications(10)
+
+	// Only highlights (9, 6, 3) are included, continuing from the last one
+	page := types.NewNotificationsPage(2, 1000, true)
+	fillNotificationsPage(page, notifications)
+	assert.Equal(t, []*types.UserNotification{notifications[1], notifications[4]}, page.Notifications)
+	assert.Equal(t, notifications[4].Version, page.NextVersion)
+
+	page = types.NewNotificationsPage(20, 1000, true)
+	fillNotificationsPage(page, notifications)
+	assert.Len(t, page.Notifications, 3)
+	assert.Equal(t, types.ZeroVersionstamp, page.NextVersion)
+
+	// Hitting the scan limit continues from the last scanned notification,
+	// even though it isn't included.
+	page = types.NewNotificationsPage(20, 4, true)
+	fillNotificationsPage(page, notifications)
+	assert.Equal(t, []*types.UserNotification{notifications[1]}, page.Notifications)
+	assert.Equal(t, notifications[3].Version, page.NextVersion)
+}
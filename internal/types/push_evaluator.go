@@ -0,0 +1,269 @@
+package types
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+// Push rule conditions match against the "flattened" event, where nested keys
+// are joined with dots and dots within keys escaped, see:
+// https://spec.matrix.org/v1.11/client-server-api/#conditions-1
+type PushEvent struct {
+	Event *Event
+
+	flattened map[string]any
+	// Events with m.mentions disable the legacy mention rules
+	hasMentions bool
+}
+
+func NewPushEvent(ev *Event) (*PushEvent, error) {
+	b, err := json.Marshal(ev.ClientEvent())
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	pushEv := &PushEvent{
+		Event:       ev,
+		flattened:   make(map[string]any),
+		hasMentions: gjson.GetBytes(ev.Content, `m\.mentions`).Exists(),
+	}
+	flattenPushEventValue(pushEv.flattened, "", raw)
+	return pushEv, nil
+}
+
+var pushEventKeyEscaper = strings.NewReplacer(`\`, `\\`, `.`, `\.`)
+
+func flattenPushEventValue(flattened map[string]any, prefix string, value map[string]any) {
+	for key, v := range value {
+		key = prefix + pushEventKeyEscaper.Replace(key)
+		switch typed := v.(type) {
+		case map[string]any:
+			flattenPushEventValue(flattened, key+".", typed)
+		default:
+			flattened[key] = typed
+		}
+	}
+}
+
+func (pe *PushEvent) body() (string, bool) {
+	body, ok := pe.flattened["content.body"].(string)
+	return body, ok
+}
+
+// Room context for evaluating push rules for one user
+type PushRuleRoom struct {
+	// Number of joined members
+	MemberCount int
+	// The user's display name in the room
+	DisplayName string
+	// Power level of the event sender and the notifications power levels
+	SenderPowerLevel        int
+	NotificationPowerLevels map[string]int
+}
+
+// Find the actions for an event from the highest priority matching rule,
+// returns nil if no rule matches.
+func EvaluatePushRules(rs *pushrules.PushRuleset, pe *PushEvent, room *PushRuleRoom) pushrules.PushActionArray {
+	for _, rule := range rs.Override {
+		if matchPushRule(rule, pe, room) {
+			return rule.Actions
+		}
+	}
+	for _, rule := range rs.Content {
+		if matchPushRule(rule, pe, room) {
+			return rule.Actions
+		}
+	}
+	if rule, found := rs.Room.Map[pe.Event.RoomID.String()]; found && rule.Enabled {
+		return rule.Actions
+	}
+	if rule, found := rs.Sender.Map[pe.Event.Sender.String()]; found && rule.Enabled {
+		return rule.Actions
+	}
+	for _, rule := range rs.Underride {
+		if matchPushRule(rule, pe, room) {
+			return rule.Actions
+		}
+	}
+	return nil
+}
+
+// Whether actions notify and highlight. Unlike PushActionArray.Should this
+// doesn't assume tweak values are valid.
+func PushActionsNotifyHighlight(actions pushrules.PushActionArray) (notify, highlight bool) {
+	for _, action := range actions {
+		switch action.Action {
+		case pushrules.ActionNotify, pushrules.ActionCoalesce:
+			notify = true
+		case pushrules.ActionSetTweak:
+			if action.Tweak == pushrules.TweakHighlight {
+				value, ok := action.Value.(bool)
+				highlight = !ok || value
+			}
+		}
+	}
+	return notify, notify && highlight
+}
+
+func matchPushRule(rule *pushrules.PushRule, pe *PushEvent, room *PushRuleRoom) bool {
+	if !rule.Enabled {
+		return false
+	}
+	switch rule.RuleID {
+	case ".m.rule.contains_display_name", ".m.rule.contains_user_name", ".m.rule.roomnotif":
+		if pe.hasMentions {
+			return false
+		}
+	}
+
+	if rule.Type == pushrules.ContentRule {
+		body, ok := pe.body()
+		return ok && rule.Pattern != "" && pushGlobRegexp(rule.Pattern, true).MatchString(body)
+	}
+	for _, cond := range rule.Conditions {
+		if !matchPushCondition(cond, pe, room) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchPushCondition(cond *pushrules.PushCondition, pe *PushEvent, room *PushRuleRoom) bool {
+	switch cond.Kind {
+	case pushrules.KindEventMatch:
+		value, ok := pe.flattened[cond.Key].(string)
+		if !ok {
+			return false
+		}
+		// Body matches are against words rather than the whole value
+		return pushGlobRegexp(cond.Pattern, cond.Key == "content.body").MatchString(value)
+	case pushrules.KindEventPropertyIs:
+		value, found := pe.flattened[cond.Key]
+		return found && pushValueEquals(value, cond.Value)
+	case pushrules.KindEventPropertyContains:
+		values, ok := pe.flattened[cond.Key].([]any)
+		if !ok {
+			return false
+		}
+		for _, value := range values {
+			if pushValueEquals(value, cond.Value) {
+				return true
+			}
+		}
+		return false
+	case pushrules.KindContainsDisplayName:
+		body, ok := pe.body()
+		if !ok || room.DisplayName == "" {
+			return false
+		}
+		return pushWordRegexp(regexp.QuoteMeta(room.DisplayName)).MatchString(body)
+	case pushrules.KindRoomMemberCount:
+		return matchPushMemberCount(cond.MemberCountCondition, room.MemberCount)
+	case PushCondSenderNotificationPermission:
+		level, found := room.NotificationPowerLevels[cond.Key]
+		if !found {
+			level = 50
+		}
+		return room.SenderPowerLevel >= level
+	}
+	// Spec: unknown conditions never match
+	return false
+}
+
+func matchPushMemberCount(condition string, count int) bool {
+	group := pushrules.MemberCountFilterRegex.FindStringSubmatch(condition)
+	if len(group) != 3 {
+		return false
+	}
+	wanted, err := strconv.Atoi(group[2])
+	if err != nil {
+		return false
+	}
+	switch group[1] {
+	case "", "==":
+		return count == wanted
+	case "<":
+		return count < wanted
+	case ">":
+		return count > wanted
+	case "<=":
+		return count <= wanted
+	case ">=":
+		return count >= wanted
+	}
+	return false
+}
+
+// Spec: only strings, integers, booleans and null are compared, JSON numbers
+// are always float64 so compare numbers via that.
+func pushValueEquals(a, b any) bool {
+	switch typed := b.(type) {
+	case int:
+		b = float64(typed)
+	case int64:
+		b = float64(typed)
+	}
+	switch a.(type) {
+	case string, float64, bool, nil:
+		return a == b
+	}
+	return false
+}
+
+// Maximum compiled push rule regexps cached, patterns come from user push rules
+// and display names so the cache is reset when full rather than growing.
+const maxPushRegexpCacheSize = 10000
+
+var (
+	pushRegexpCacheLock sync.Mutex
+	pushRegexpCache     = make(map[string]*regexp.Regexp)
+)
+
+func cachedPushRegexp(expr string) *regexp.Regexp {
+	pushRegexpCacheLock.Lock()
+	defer pushRegexpCacheLock.Unlock()
+
+	if re, found := pushRegexpCache[expr]; found {
+		return re
+	}
+	re := regexp.MustCompile(expr)
+	if len(pushRegexpCache) >= maxPushRegexpCacheSize {
+		clear(pushRegexpCache)
+	}
+	pushRegexpCache[expr] = re
+	return re
+}
+
+// Compile a push rule glob, matching case insensitively against either the
+// entire value or any words in it.
+func pushGlobRegexp(glob string, words bool) *regexp.Regexp {
+	var b strings.Builder
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*?")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if words {
+		return pushWordRegexp(b.String())
+	}
+	return cachedPushRegexp("(?is)^" + b.String() + "$")
+}
+
+func pushWordRegexp(pattern string) *regexp.Regexp {
+	return cachedPushRegexp(`(?is)(^|\W)` + pattern + `(\W|$)`)
+}
@@ -0,0 +1,285 @@
+package types
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+// Push rules decide which events notify a user, each user has a ruleset that
+// starts with the spec default rules, see:
+// https://spec.matrix.org/v1.11/client-server-api/#push-rules
+
+const PushCondSenderNotificationPermission pushrules.PushCondKind = "sender_notification_permission"
+
+const pushRuleMaster = ".m.rule.master"
+
+func pushActionsNotify(sound string, highlight bool) pushrules.PushActionArray {
+	actions := pushrules.PushActionArray{{Action: pushrules.ActionNotify}}
+	if sound != "" {
+		actions = append(actions, &pushrules.PushAction{
+			Action: pushrules.ActionSetTweak,
+			Tweak:  pushrules.TweakSound,
+			Value:  sound,
+		})
+	}
+	if highlight {
+		actions = append(actions, &pushrules.PushAction{
+			Action: pushrules.ActionSetTweak,
+			Tweak:  pushrules.TweakHighlight,
+		})
+	}
+	return actions
+}
+
+func pushCondEventMatch(key, pattern string) *pushrules.PushCondition {
+	return &pushrules.PushCondition{Kind: pushrules.KindEventMatch, Key: key, Pattern: pattern}
+}
+
+func pushCondEventPropertyIs(key string, value any) *pushrules.PushCondition {
+	return &pushrules.PushCondition{Kind: pushrules.KindEventPropertyIs, Key: key, Value: value}
+}
+
+func defaultPushRule(ruleID string, actions pushrules.PushActionArray, conditions ...*pushrules.PushCondition) *pushrules.PushRule {
+	if actions == nil {
+		actions = pushrules.PushActionArray{}
+	}
+	if conditions == nil {
+		conditions = []*pushrules.PushCondition{}
+	}
+	return &pushrules.PushRule{
+		RuleID:     ruleID,
+		Actions:    actions,
+		Default:    true,
+		Enabled:    true,
+		Conditions: conditions,
+	}
+}
+
+// The spec default ruleset for a user
+// https://spec.matrix.org/v1.11/client-server-api/#predefined-rules
+func NewDefaultPushRuleset(userID id.UserID) *pushrules.PushRuleset {
+	master := defaultPushRule(pushRuleMaster, nil)
+	master.Enabled = false
+
+	override := pushrules.PushRuleArray{
+		master,
+		defaultPushRule(".m.rule.suppress_notices", nil,
+			pushCondEventMatch("content.msgtype", "m.notice"),
+		),
+		defaultPushRule(".m.rule.invite_for_me", pushActionsNotify("default", false),
+			pushCondEventMatch("type", event.StateMember.Type),
+			pushCondEventMatch("content.membership", string(event.MembershipInvite)),
+			pushCondEventMatch("state_key", userID.String()),
+		),
+		defaultPushRule(".m.rule.member_event", nil,
+			pushCondEventMatch("type", event.StateMember.Type),
+		),
+		defaultPushRule(".m.rule.is_user_mention", pushActionsNotify("default", true),
+			&pushrules.PushCondition{
+				Kind:  pushrules.KindEventPropertyContains,
+				Key:   `content.m\.mentions.user_ids`,
+				Value: userID.String(),
+			},
+		),
+		defaultPushRule(".m.rule.contains_display_name", pushActionsNotify("default", true),
+			&pushrules.PushCondition{Kind: pushrules.KindContainsDisplayName},
+		),
+		defaultPushRule(".m.rule.is_room_mention", pushActionsNotify("", true),
+			pushCondEventPropertyIs(`content.m\.mentions.room`, true),
+			&pushrules.PushCondition{Kind: PushCondSenderNotificationPermission, Key: "room"},
+		),
+		defaultPushRule(".m.rule.roomnotif", pushActionsNotify("", true),
+			&pushrules.PushCondition{Kind: PushCondSenderNotificationPermission, Key: "room"},
+			pushCondEventMatch("content.body", "@room"),
+		),
+		defaultPushRule(".m.rule.tombstone", pushActionsNotify("", true),
+			pushCondEventMatch("type", event.StateTombstone.Type),
+			pushCondEventMatch("state_key", ""),
+		),
+		defaultPushRule(".m.rule.reaction", nil,
+			pushCondEventMatch("type", event.EventReaction.Type),
+		),
+		defaultPushRule(".m.rule.room.server_acl", nil,
+			pushCondEventMatch("type", event.StateServerACL.Type),
+			pushCondEventMatch("state_key", ""),
+		),
+		defaultPushRule(".m.rule.suppress_edits", nil,
+			pushCondEventPropertyIs(`content.m\.relates_to.rel_type`, string(event.RelReplace)),
+		),
+	}
+
+	localpart, _, _ := userID.Parse()
+	content := pushrules.PushRuleArray{{
+		RuleID:  ".m.rule.contains_user_name",
+		Actions: pushActionsNotify("default", true),
+		Default: true,
+		Enabled: true,
+		Pattern: localpart,
+	}}
+
+	underride := pushrules.PushRuleArray{
+		defaultPushRule(".m.rule.call", pushActionsNotify("ring", false),
+			pushCondEventMatch("type", event.CallInvite.Type),
+		),
+		defaultPushRule(".m.rule.encrypted_room_one_to_one", pushActionsNotify("default", false),
+			&pushrules.PushCondition{Kind: pushrules.KindRoomMemberCount, MemberCountCondition: "2"},
+			pushCondEventMatch("type", event.EventEncrypted.Type),
+		),
+		defaultPushRule(".m.rule.room_one_to_one", pushActionsNotify("default", false),
+			&pushrules.PushCondition{Kind: pushrules.KindRoomMemberCount, MemberCountCondition: "2"},
+			pushCondEventMatch("type", event.EventMessage.Type),
+		),
+		defaultPushRule(".m.rule.message", pushActionsNotify("", false),
+			pushCondEventMatch("type", event.EventMessage.Type),
+		),
+		defaultPushRule(".m.rule.encrypted", pushActionsNotify("", false),
+			pushCondEventMatch("type", event.EventEncrypted.Type),
+		),
+	}
+
+	return &pushrules.PushRuleset{
+		Override:  override.SetType(pushrules.OverrideRule),
+		Content:   content.SetType(pushrules.ContentRule),
+		Room:      pushrules.PushRuleArray{}.SetTypeAndMap(pushrules.RoomRule),
+		Sender:    pushrules.PushRuleArray{}.SetTypeAndMap(pushrules.SenderRule),
+		Underride: underride.SetType(pushrules.UnderrideRule),
+	}
+}
+
+func pushRuleArray(rs *pushrules.PushRuleset, kind pushrules.PushRuleType) (*pushrules.PushRuleArray, error) {
+	switch kind {
+	case pushrules.OverrideRule:
+		return &rs.Override, nil
+	case pushrules.ContentRule:
+		return &rs.Content, nil
+	case pushrules.UnderrideRule:
+		return &rs.Underride, nil
+	}
+	return nil, fmt.Errorf("%w: unknown kind %s", ErrPushRuleInvalid, kind)
+}
+
+func pushRuleMap(rs *pushrules.PushRuleset, kind pushrules.PushRuleType) (*pushrules.PushRuleMap, bool) {
+	var ruleMap *pushrules.PushRuleMap
+	switch kind {
+	case pushrules.RoomRule:
+		ruleMap = &rs.Room
+	case pushrules.SenderRule:
+		ruleMap = &rs.Sender
+	default:
+		return nil, false
+	}
+	if ruleMap.Map == nil {
+		ruleMap.Map = make(map[string]*pushrules.PushRule)
+		ruleMap.Type = kind
+	}
+	return ruleMap, true
+}
+
+func GetPushRule(rs *pushrules.PushRuleset, kind pushrules.PushRuleType, ruleID string) (*pushrules.PushRule, error) {
+	if ruleMap, ok := pushRuleMap(rs, kind); ok {
+		if rule, found := ruleMap.Map[ruleID]; found {
+			return rule, nil
+		}
+		return nil, ErrPushRuleNotFound
+	}
+
+	rules, err := pushRuleArray(rs, kind)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range *rules {
+		if rule.RuleID == ruleID {
+			return rule, nil
+		}
+	}
+	return nil, ErrPushRuleNotFound
+}
+
+// Add or replace a user defined push rule. User defined rules always come
+// before the default rules of the same kind (except the master rule), before
+// and after may be the ID of another user defined rule to position relative to.
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixclientv3pushrulesscopekindruleid
+func SetPushRule(rs *pushrules.PushRuleset, kind pushrules.PushRuleType, rule *pushrules.PushRule, before, after string) error {
+	if strings.HasPrefix(rule.RuleID, ".") {
+		return fmt.Errorf("%w: rule IDs starting with . are reserved", ErrPushRuleInvalid)
+	} else if rule.Actions == nil {
+		return fmt.Errorf("%w: missing actions", ErrPushRuleInvalid)
+	}
+	rule.Type = kind
+	rule.Default = false
+	rule.Enabled = true
+
+	if ruleMap, ok := pushRuleMap(rs, kind); ok {
+		rule.Conditions = nil
+		rule.Pattern = ""
+		ruleMap.Map[rule.RuleID] = rule
+		return nil
+	}
+
+	rules, err := pushRuleArray(rs, kind)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case pushrules.ContentRule:
+		if rule.Pattern == "" {
+			return fmt.Errorf("%w: missing pattern", ErrPushRuleInvalid)
+		}
+		rule.Conditions = nil
+	default:
+		if rule.Conditions == nil {
+			rule.Conditions = []*pushrules.PushCondition{}
+		}
+		rule.Pattern = ""
+	}
+
+	// Remove any existing rule with the same ID, keeping the position if
+	// not being moved.
+	index := slices.IndexFunc(*rules, func(r *pushrules.PushRule) bool { return r.RuleID == rule.RuleID })
+	if index != -1 {
+		*rules = slices.Delete(*rules, index, index+1)
+	}
+
+	if before != "" || after != "" {
+		relativeID := cmp.Or(before, after)
+		index = slices.IndexFunc(*rules, func(r *pushrules.PushRule) bool { return r.RuleID == relativeID && !r.Default })
+		if index == -1 {
+			return fmt.Errorf("%w: %s", ErrPushRuleNotFound, relativeID)
+		} else if before == "" {
+			index++
+		}
+	} else if index == -1 {
+		// New rules go at the start of the user defined rules
+		index = 0
+		if len(*rules) > 0 && (*rules)[0].RuleID == pushRuleMaster {
+			index = 1
+		}
+	}
+
+	*rules = slices.Insert(*rules, index, rule)
+	return nil
+}
+
+// Delete a user defined push rule, the default rules cannot be deleted.
+func DeletePushRule(rs *pushrules.PushRuleset, kind pushrules.PushRuleType, ruleID string) error {
+	rule, err := GetPushRule(rs, kind, ruleID)
+	if err != nil {
+		return err
+	} else if rule.Default {
+		return fmt.Errorf("%w: cannot delete default rules", ErrPushRuleInvalid)
+	}
+
+	if ruleMap, ok := pushRuleMap(rs, kind); ok {
+		delete(ruleMap.Map, ruleID)
+		return nil
+	}
+	rules, _ := pushRuleArray(rs, kind)
+	*rules = slices.DeleteFunc(*rules, func(r *pushrules.PushRule) bool { return r.RuleID == ruleID })
+	return nil
+}
@@ -0,0 +1,189 @@
+package types_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+const pushTestUserID = id.UserID("@alice:babbleserv.test")
+
+func makePushEvent(t *testing.T, evType event.Type, stateKey *string, content map[string]any) *types.PushEvent {
+	ev := &types.Event{
+		PartialEvent: *types.NewPartialEvent("!room:babbleserv.test", evType, stateKey, "@bob:babbleserv.test", content),
+		ID:           "$event",
+	}
+	pushEv, err := types.NewPushEvent(ev)
+	require.NoError(t, err)
+	return pushEv
+}
+
+func evaluateDefaultPushRules(pushEv *types.PushEvent, room *types.PushRuleRoom) (bool, bool) {
+	rs := types.NewDefaultPushRuleset(pushTestUserID)
+	return types.PushActionsNotifyHighlight(types.EvaluatePushRules(rs, pushEv, room))
+}
+
+func TestEvaluateDefaultPushRules(t *testing.T) {
+	room := &types.PushRuleRoom{MemberCount: 3, DisplayName: "Alice Smith"}
+
+	// Plain message notifies without highlight
+	notify, highlight := evaluateDefaultPushRules(makePushEvent(t, event.EventMessage, nil, map[string]any{
+		"msgtype": "m.text",
+		"body":    "hello",
+	}), room)
+	assert.True(t, notify)
+	assert.False(t, highlight)
+
+	// Notices are suppressed
+	notify, _ = evaluateDefaultPushRules(makePushEvent(t, event.EventMessage, nil, map[string]any{
+		"msgtype": "m.notice",
+		"body":    "hello",
+	}), room)
+	assert.False(t, notify)
+
+	// Display name and user name mentions highlight, case insensitively
+	notify, highlight = evaluateDefaultPushRules(makePushEvent(t, event.EventMessage, nil, map[string]any{
+		"msgtype": "m.text",
+		"body":    "hey alice smith!",
+	}), room)
+	assert.True(t, notify)
+	assert.True(t, highlight)
+
+	notify, highlight = evaluateDefaultPushRules(makePushEvent(t, event.EventMessage, nil, map[string]any{
+		"msgtype": "m.text",
+		"body":    "ALICE: look",
+	}), room)
+	assert.True(t, notify)
+	assert.True(t, highlight)
+
+	// But not within other words
+	_, highlight = evaluateDefaultPushRules(makePushEvent(t, event.EventMessage, nil, map[string]any{
+		"msgtype": "m.text",
+		"body":    "malice",
+	}), room)
+	assert.False(t, highlight)
+
+	// Intentional mentions highlight and disable the legacy rules
+	_, highlight = evaluateDefaultPushRules(makePushEvent(t, event.EventMessage, nil, map[string]any{
+		"msgtype":    "m.text",
+		"body":       "hello",
+		"m.mentions": map[string]any{"user_ids": []any{pushTestUserID.String()}},
+	}), room)
+	assert.True(t, highlight)
+
+	_, highlight = evaluateDefaultPushRules(makePushEvent(t, event.EventMessage, nil, map[string]any{
+		"msgtype":    "m.text",
+		"body":       "alice",
+		"m.mentions": map[string]any{},
+	}), room)
+	assert.False(t, highlight)
+
+	// Edits are suppressed
+	notify, _ = evaluateDefaultPushRules(makePushEvent(t, event.EventMessage, nil, map[string]any{
+		"msgtype":      "m.text",
+		"body":         "* hello",
+		"m.relates_to": map[string]any{"rel_type": "m.replace", "event_id": "$other"},
+	}), room)
+	assert.False(t, notify)
+
+	// Invites for the user notify
+	stateKey := pushTestUserID.String()
+	notify, _ = evaluateDefaultPushRules(makePushEvent(t, event.StateMember, &stateKey, map[string]any{
+		"membership": "invite",
+	}), room)
+	assert.True(t, notify)
+}
+
+func TestEvaluatePushRulesRoomMention(t *testing.T) {
+	pushEv := makePushEvent(t, event.EventMessage, nil, map[string]any{
+		"msgtype":    "m.text",
+		"body":       "everyone look",
+		"m.mentions": map[string]any{"room": true},
+	})
+
+	// sender_notification_permission defaults to a power level of 50
+	_, highlight := evaluateDefaultPushRules(pushEv, &types.PushRuleRoom{MemberCount: 3, SenderPowerLevel: 0})
+	assert.False(t, highlight)
+	_, highlight = evaluateDefaultPushRules(pushEv, &types.PushRuleRoom{MemberCount: 3, SenderPowerLevel: 50})
+	assert.True(t, highlight)
+	_, highlight = evaluateDefaultPushRules(pushEv, &types.PushRuleRoom{
+		MemberCount:             3,
+		SenderPowerLevel:        50,
+		NotificationPowerLevels: map[string]int{"room": 100},
+	})
+	assert.False(t, highlight)
+}
+
+func TestEvaluatePushRulesOneToOne(t *testing.T) {
+	rs := types.NewDefaultPushRuleset(pushTestUserID)
+	pushEv := makePushEvent(t, event.EventMessage, nil, map[string]any{"msgtype": "m.text", "body": "hi"})
+
+	actions := types.EvaluatePushRules(rs, pushEv, &types.PushRuleRoom{MemberCount: 2})
+	assert.True(t, actions.Should().PlaySound)
+
+	actions = types.EvaluatePushRules(rs, pushEv, &types.PushRuleRoom{MemberCount: 3})
+	assert.False(t, actions.Should().PlaySound)
+}
+
+func TestSetAndDeletePushRule(t *testing.T) {
+	rs := types.NewDefaultPushRuleset(pushTestUserID)
+	dontNotify := pushrules.PushActionArray{}
+
+	// User override rules come after master but before other defaults
+	err := types.SetPushRule(rs, pushrules.OverrideRule, &pushrules.PushRule{
+		RuleID:  "mute_bob",
+		Actions: dontNotify,
+		Conditions: []*pushrules.PushCondition{
+			{Kind: pushrules.KindEventMatch, Key: "sender", Pattern: "@bob:*"},
+		},
+	}, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, ".m.rule.master", rs.Override[0].RuleID)
+	assert.Equal(t, "mute_bob", rs.Override[1].RuleID)
+
+	err = types.SetPushRule(rs, pushrules.OverrideRule, &pushrules.PushRule{
+		RuleID:  "second",
+		Actions: dontNotify,
+	}, "", "mute_bob")
+	require.NoError(t, err)
+	assert.Equal(t, "second", rs.Override[2].RuleID)
+
+	pushEv := makePushEvent(t, event.EventMessage, nil, map[string]any{"msgtype": "m.text", "body": "alice"})
+	notify, _ := types.PushActionsNotifyHighlight(types.EvaluatePushRules(rs, pushEv, &types.PushRuleRoom{}))
+	assert.False(t, notify)
+
+	// Rules survive JSON storage
+	b, err := json.Marshal(rs)
+	require.NoError(t, err)
+	var stored pushrules.PushRuleset
+	require.NoError(t, json.Unmarshal(b, &stored))
+	rule, err := types.GetPushRule(&stored, pushrules.OverrideRule, "mute_bob")
+	require.NoError(t, err)
+	assert.False(t, rule.Default)
+
+	assert.ErrorIs(t, types.SetPushRule(rs, pushrules.OverrideRule, &pushrules.PushRule{
+		RuleID: ".m.rule.mine", Actions: dontNotify,
+	}, "", ""), types.ErrPushRuleInvalid)
+	assert.ErrorIs(t, types.SetPushRule(rs, pushrules.OverrideRule, &pushrules.PushRule{
+		RuleID: "third", Actions: dontNotify,
+	}, ".m.rule.message", ""), types.ErrPushRuleNotFound)
+
+	require.NoError(t, types.DeletePushRule(rs, pushrules.OverrideRule, "mute_bob"))
+	assert.ErrorIs(t, types.DeletePushRule(rs, pushrules.OverrideRule, "mute_bob"), types.ErrPushRuleNotFound)
+	assert.ErrorIs(t, types.DeletePushRule(rs, pushrules.OverrideRule, ".m.rule.master"), types.ErrPushRuleInvalid)
+
+	// Room rules are keyed by room ID
+	require.NoError(t, types.SetPushRule(rs, pushrules.RoomRule, &pushrules.PushRule{
+		RuleID: "!room:babbleserv.test", Actions: dontNotify,
+	}, "", ""))
+	pushEv = makePushEvent(t, event.EventMessage, nil, map[string]any{"msgtype": "m.text", "body": "hi"})
+	notify, _ = types.PushActionsNotifyHighlight(types.EvaluatePushRules(rs, pushEv, &types.PushRuleRoom{}))
+	assert.False(t, notify)
+}
@@ -0,0 +1,264 @@
+package types
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+const (
+	PusherKindHTTP = "http"
+
+	PusherFormatEventIDOnly = "event_id_only"
+
+	PushGatewayNotifyPath = "/_matrix/push/v1/notify"
+
+	maxPusherAppIDLength   = 64
+	maxPusherPushKeyLength = 512
+)
+
+// Pushers are uniquely identified by the user, app ID and pushkey
+type PusherKey struct {
+	UserID  id.UserID `json:"user_id" msgpack:"uid"`
+	AppID   string    `json:"app_id" msgpack:"aid"`
+	PushKey string    `json:"pushkey" msgpack:"pky"`
+}
+
+func (pk PusherKey) String() string {
+	return fmt.Sprintf("%s|%s|%s", pk.UserID, pk.AppID, pk.PushKey)
+}
+
+// A pusher sends a user's notifications to an HTTP push gateway
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3pushers
+type Pusher struct {
+	PushKey           string         `json:"pushkey" msgpack:"pky"`
+	Kind              string         `json:"kind" msgpack:"knd"`
+	AppID             string         `json:"app_id" msgpack:"aid"`
+	AppDisplayName    string         `json:"app_display_name" msgpack:"adn"`
+	DeviceDisplayName string         `json:"device_display_name" msgpack:"ddn"`
+	ProfileTag        string         `json:"profile_tag,omitempty" msgpack:"ptg,omitempty"`
+	Lang              string         `json:"lang" msgpack:"lng"`
+	Data              map[string]any `json:"data" msgpack:"dat"`
+
+	// Internal fields not returned to clients
+	UserID    id.UserID `json:"-" msgpack:"uid"`
+	PushKeyTS int64     `json:"-" msgpack:"pts"`
+}
+
+func NewPusherFromBytes(b []byte) (*Pusher, error) {
+	var p Pusher
+	if err := msgpack.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Pusher) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(p); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+func (p *Pusher) Key() PusherKey {
+	return PusherKey{UserID: p.UserID, AppID: p.AppID, PushKey: p.PushKey}
+}
+
+func (p *Pusher) URL() string {
+	url, _ := p.Data["url"].(string)
+	return url
+}
+
+func (p *Pusher) Format() string {
+	format, _ := p.Data["format"].(string)
+	return format
+}
+
+// Validate a pusher from a client, returns an ErrPusherInvalid error if it's
+// invalid. The gateway URL host must only resolve to addresses the gateway IP
+// filter allows, if set. Other errors are from resolving the host.
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixclientv3pushersset
+func ValidatePusher(ctx context.Context, p *Pusher, gatewayIPs *IPRangeFilter) error {
+	switch {
+	case p.AppID == "" || len(p.AppID) > maxPusherAppIDLength:
+		return fmt.Errorf("%w: app_id must be between 1 and %d bytes", ErrPusherInvalid, maxPusherAppIDLength)
+	case p.PushKey == "" || len(p.PushKey) > maxPusherPushKeyLength:
+		return fmt.Errorf("%w: pushkey must be between 1 and %d bytes", ErrPusherInvalid, maxPusherPushKeyLength)
+	case p.Kind != PusherKindHTTP:
+		return fmt.Errorf("%w: unsupported kind: %s", ErrPusherInvalid, p.Kind)
+	case p.Format() != "" && p.Format() != PusherFormatEventIDOnly:
+		return fmt.Errorf("%w: unsupported format: %s", ErrPusherInvalid, p.Format())
+	}
+
+	pushURL, err := url.Parse(p.URL())
+	if err != nil || pushURL.Host == "" || (pushURL.Scheme != "http" && pushURL.Scheme != "https") {
+		return fmt.Errorf("%w: data.url must be an absolute HTTP URL", ErrPusherInvalid)
+	} else if pushURL.Path != PushGatewayNotifyPath {
+		return fmt.Errorf("%w: data.url path must be %s", ErrPusherInvalid, PushGatewayNotifyPath)
+	} else if gatewayIPs == nil {
+		return nil
+	}
+
+	// The push sender also checks addresses when connecting, this gives the
+	// client an error up front.
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(pushURL.Hostname()); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", pushURL.Hostname()); err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return fmt.Errorf("%w: data.url host not found", ErrPusherInvalid)
+		}
+		return err
+	}
+	for _, addr := range addrs {
+		if !gatewayIPs.IsAllowed(addr) {
+			return fmt.Errorf("%w: data.url host is not allowed", ErrPusherInvalid)
+		}
+	}
+	return nil
+}
+
+// Pusher backoff tracks failed requests to a pusher's gateway, cleared once we
+// successfully send a notification.
+type PusherBackoff struct {
+	PusherKey
+
+	Failures      int    `json:"failures" msgpack:"fai"`
+	LastError     string `json:"last_error" msgpack:"err"`
+	LastFailureTS int64  `json:"last_failure_ts" msgpack:"lft"`
+	RetryAfterTS  int64  `json:"retry_after_ts" msgpack:"rat"`
+}
+
+func NewPusherBackoffFromBytes(b []byte) (*PusherBackoff, error) {
+	var pb PusherBackoff
+	if err := msgpack.Unmarshal(b, &pb); err != nil {
+		return nil, err
+	}
+	return &pb, nil
+}
+
+func (pb *PusherBackoff) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(pb); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+func (pb *PusherBackoff) RetryAfter() time.Time {
+	return time.UnixMilli(pb.RetryAfterTS)
+}
+
+func (pb *PusherBackoff) IsBackingOff() bool {
+	return time.Now().Before(pb.RetryAfter())
+}
+
+// Push gateway notification request body
+// https://spec.matrix.org/v1.11/push-gateway-api/#post_matrixpushv1notify
+type PushGatewayNotification struct {
+	EventID           id.EventID      `json:"event_id,omitempty"`
+	RoomID            id.RoomID       `json:"room_id,omitempty"`
+	Type              string          `json:"type,omitempty"`
+	Sender            id.UserID       `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+	Priority          string          `json:"prio,omitempty"`
+	Content           json.RawMessage `json:"content,omitempty"`
+
+	Counts  PushGatewayCounts    `json:"counts"`
+	Devices []*PushGatewayDevice `json:"devices"`
+}
+
+type PushGatewayCounts struct {
+	Unread int64 `json:"unread"`
+}
+
+type PushGatewayDevice struct {
+	AppID     string         `json:"app_id"`
+	PushKey   string         `json:"pushkey"`
+	PushKeyTS int64          `json:"pushkey_ts,omitempty"`
+	Data      map[string]any `json:"data,omitempty"`
+	Tweaks    map[string]any `json:"tweaks,omitempty"`
+}
+
+// Build the push gateway notification for an event sent to a pusher, with the
+// event_id_only format only the IDs and counts are included.
+func NewPushGatewayNotification(
+	pusher *Pusher,
+	ev *Event,
+	actions pushrules.PushActionArray,
+	roomName, senderDisplayName string,
+	unread int64,
+) *PushGatewayNotification {
+	// Data is passed through to the gateway, minus the URL
+	data := make(map[string]any, len(pusher.Data))
+	for key, value := range pusher.Data {
+		if key != "url" {
+			data[key] = value
+		}
+	}
+
+	notification := &PushGatewayNotification{
+		EventID:  ev.ID,
+		RoomID:   ev.RoomID,
+		Priority: "low",
+		Counts:   PushGatewayCounts{Unread: unread},
+		Devices: []*PushGatewayDevice{{
+			AppID:     pusher.AppID,
+			PushKey:   pusher.PushKey,
+			PushKeyTS: pusher.PushKeyTS,
+			Data:      data,
+			Tweaks:    PushActionTweaks(actions),
+		}},
+	}
+
+	_, highlight := PushActionsNotifyHighlight(actions)
+	if highlight || ev.Type == event.EventMessage || ev.Type == event.EventEncrypted ||
+		(ev.Type == event.StateMember && ev.Membership() == event.MembershipInvite) {
+		notification.Priority = "high"
+	}
+
+	if pusher.Format() == PusherFormatEventIDOnly {
+		return notification
+	}
+
+	notification.Type = ev.Type.Type
+	notification.Sender = ev.Sender
+	notification.SenderDisplayName = senderDisplayName
+	notification.RoomName = roomName
+	notification.Content = json.RawMessage(ev.Content)
+	if ev.StateKey != nil && *ev.StateKey == pusher.UserID.String() {
+		notification.UserIsTarget = true
+	}
+	return notification
+}
+
+// Get the tweaks set by push rule actions, a highlight tweak without a value
+// means true.
+func PushActionTweaks(actions pushrules.PushActionArray) map[string]any {
+	tweaks := make(map[string]any)
+	for _, action := range actions {
+		if action.Action != pushrules.ActionSetTweak {
+			continue
+		}
+		if action.Tweak == pushrules.TweakHighlight && action.Value == nil {
+			tweaks[string(action.Tweak)] = true
+		} else {
+			tweaks[string(action.Tweak)] = action.Value
+		}
+	}
+	return tweaks
+}
@@ -20,10 +20,20 @@ type Room struct {
 
 	CanonicalAlias string `json:"canonical_alias" msgpack:"cas"`
 
+	JoinRule          string      `json:"join_rule" msgpack:"jrl"`
+	AllowedRoomIDs    []id.RoomID `json:"allowed_room_ids,omitempty" msgpack:"ari"`
+	HistoryVisibility string      `json:"history_visibility" msgpack:"hvs"`
+	GuestAccess       string      `json:"guest_access" msgpack:"gac"`
+	Encryption        string      `json:"encryption,omitempty" msgpack:"enc"`
+
 	MemberCount int `json:"members" msgpack:"mem"`
 
 	Public    bool `json:"is_public" msgpack:"pub"`
 	Federated bool `json:"is_federated" msgpack:"fed"`
+
+	// Joined over federation without the full member list, see the rooms
+	// database partial state resync.
+	PartialState bool `json:"partial_state" msgpack:"pst"`
 }
 
 func NewRoomFromBytes(b []byte) (*Room, error) {
@@ -0,0 +1,50 @@
+package types
+
+import (
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/id"
+)
+
+// A remote server peeking a world readable room we're in (MSC2444), peeks
+// expire unless renewed by the peeking server.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/2444
+type RoomPeek struct {
+	RoomID     id.RoomID `msgpack:"rid"`
+	ServerName string    `msgpack:"srv"`
+	PeekID     string    `msgpack:"pid"`
+	ExpiresAt  int64     `msgpack:"exp"`
+	// Latest event version when the peek started, only events after this are
+	// sent to the peeking server.
+	FromVersion []byte `msgpack:"frm"`
+}
+
+func MustNewRoomPeekFromBytes(b []byte) *RoomPeek {
+	var peek RoomPeek
+	if err := msgpack.Unmarshal(b, &peek); err != nil {
+		panic(err)
+	}
+	return &peek
+}
+
+func (p *RoomPeek) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(p); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+// Renew the peek for another interval from now
+func (p *RoomPeek) Renew(now time.Time, renewalInterval time.Duration) {
+	p.ExpiresAt = now.Add(renewalInterval).UnixMilli()
+}
+
+func (p *RoomPeek) IsExpiredAt(now time.Time) bool {
+	return now.UnixMilli() >= p.ExpiresAt
+}
+
+func (p *RoomPeek) IsExpired() bool {
+	return p.IsExpiredAt(time.Now())
+}
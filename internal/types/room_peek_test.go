@@ -0,0 +1,28 @@
+package types_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestRoomPeekExpiry(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	peek := &types.RoomPeek{RoomID: "!room:example.com", ServerName: "example.org", PeekID: "peek"}
+	peek.Renew(now, time.Hour)
+
+	assert.False(t, peek.IsExpiredAt(now))
+	assert.False(t, peek.IsExpiredAt(now.Add(time.Hour-time.Millisecond)))
+	assert.True(t, peek.IsExpiredAt(now.Add(time.Hour)))
+
+	// Renewing extends from the renewal time
+	peek.Renew(now.Add(time.Hour), time.Hour)
+	assert.False(t, peek.IsExpiredAt(now.Add(time.Hour)))
+	assert.True(t, peek.IsExpiredAt(now.Add(2*time.Hour)))
+
+	roundTripped := types.MustNewRoomPeekFromBytes(peek.ToMsgpack())
+	assert.Equal(t, peek, roundTripped)
+}
@@ -0,0 +1,58 @@
+package types
+
+import (
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Server backoff tracks failed federation transactions to a destination server,
+// cleared once we successfully send to or receive a request from the server.
+type ServerBackoff struct {
+	ServerName string `json:"server_name" msgpack:"snm"`
+
+	Failures      int    `json:"failures" msgpack:"fai"`
+	LastError     string `json:"last_error" msgpack:"err"`
+	LastFailureTS int64  `json:"last_failure_ts" msgpack:"lft"`
+	RetryAfterTS  int64  `json:"retry_after_ts" msgpack:"rat"`
+
+	// Set once the server has failed enough times that we consider it down and
+	// fast-fail any other outbound requests until the retry time passes.
+	Down bool `json:"down" msgpack:"dwn"`
+}
+
+func NewServerBackoffFromBytes(b []byte) (*ServerBackoff, error) {
+	var sb ServerBackoff
+	if err := msgpack.Unmarshal(b, &sb); err != nil {
+		return nil, err
+	}
+	return &sb, nil
+}
+
+func MustNewServerBackoffFromBytes(b []byte) *ServerBackoff {
+	sb, err := NewServerBackoffFromBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	return sb
+}
+
+func (sb *ServerBackoff) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(sb); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+func (sb *ServerBackoff) RetryAfter() time.Time {
+	return time.UnixMilli(sb.RetryAfterTS)
+}
+
+func (sb *ServerBackoff) IsBackingOff() bool {
+	return time.Now().Before(sb.RetryAfter())
+}
+
+func (sb *ServerBackoff) IsDown() bool {
+	return sb.Down && sb.IsBackingOff()
+}
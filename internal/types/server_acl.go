@@ -0,0 +1,114 @@
+package types
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Server ACLs restrict which servers may participate in a room, see:
+// https://spec.matrix.org/v1.11/client-server-api/#server-access-control-lists-acls-for-rooms
+type ServerACL struct {
+	Allow           []string `json:"allow"`
+	Deny            []string `json:"deny"`
+	AllowIPLiterals bool     `json:"allow_ip_literals"`
+
+	allowRegexps []*regexp.Regexp
+	denyRegexps  []*regexp.Regexp
+}
+
+// Parse ACL content leniently, room admins can send any content so malformed
+// fields must not break federation for the room.
+func NewServerACLFromContent(content []byte) (*ServerACL, error) {
+	if !gjson.ValidBytes(content) {
+		return nil, errors.New("invalid server ACL content")
+	}
+	parsed := gjson.ParseBytes(content)
+
+	// Spec: defaults to true if missing or not a boolean
+	allowIPLiterals := parsed.Get("allow_ip_literals")
+	acl := &ServerACL{
+		AllowIPLiterals: allowIPLiterals.Type != gjson.False,
+	}
+
+	// Spec: entries that are not strings are ignored, as are non-array lists
+	for _, entry := range stringEntries(parsed.Get("allow")) {
+		acl.Allow = append(acl.Allow, entry)
+		acl.allowRegexps = append(acl.allowRegexps, globToRegexp(entry))
+	}
+	for _, entry := range stringEntries(parsed.Get("deny")) {
+		acl.Deny = append(acl.Deny, entry)
+		acl.denyRegexps = append(acl.denyRegexps, globToRegexp(entry))
+	}
+	return acl, nil
+}
+
+func stringEntries(list gjson.Result) []string {
+	if !list.IsArray() {
+		return nil
+	}
+	entries := make([]string, 0)
+	for _, entry := range list.Array() {
+		if entry.Type == gjson.String {
+			entries = append(entries, entry.Str)
+		}
+	}
+	return entries
+}
+
+func (acl *ServerACL) IsServerAllowed(serverName string) bool {
+	host := serverNameHost(serverName)
+
+	if !acl.AllowIPLiterals && isIPLiteral(host) {
+		return false
+	}
+	for _, re := range acl.denyRegexps {
+		if re.MatchString(host) {
+			return false
+		}
+	}
+	for _, re := range acl.allowRegexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func globToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?i)^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// ACLs are matched against the server name without any port
+func serverNameHost(serverName string) string {
+	if strings.HasPrefix(serverName, "[") {
+		if end := strings.Index(serverName, "]"); end != -1 {
+			return serverName[:end+1]
+		}
+		return serverName
+	}
+	if idx := strings.LastIndex(serverName, ":"); idx != -1 {
+		return serverName[:idx]
+	}
+	return serverName
+}
+
+func isIPLiteral(host string) bool {
+	return strings.HasPrefix(host, "[") || net.ParseIP(host) != nil
+}
@@ -0,0 +1,84 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestServerACL(t *testing.T) {
+	acl, err := types.NewServerACLFromContent([]byte(`{
+		"allow": ["*", 123],
+		"deny": ["evil.com", "*.evil.com", "bad?.org", null]
+	}`))
+	require.NoError(t, err)
+
+	assert.True(t, acl.AllowIPLiterals)
+	assert.Equal(t, []string{"*"}, acl.Allow)
+	assert.Equal(t, []string{"evil.com", "*.evil.com", "bad?.org"}, acl.Deny)
+
+	for serverName, allowed := range map[string]bool{
+		"matrix.org":          true,
+		"beeper.com:8448":     true,
+		"evil.com":            false,
+		"evil.com:8448":       false,
+		"EVIL.com":            false,
+		"sub.evil.com":        false,
+		"notevil.com":         true,
+		"bad1.org":            false,
+		"bad12.org":           true,
+		"1.2.3.4":             true,
+		"[1234:5678::abcd]":   true,
+		"[1234:5678::abcd]:1": true,
+	} {
+		assert.Equal(t, allowed, acl.IsServerAllowed(serverName), serverName)
+	}
+}
+
+func TestServerACLIPLiterals(t *testing.T) {
+	acl, err := types.NewServerACLFromContent([]byte(`{
+		"allow": ["*"],
+		"allow_ip_literals": false
+	}`))
+	require.NoError(t, err)
+
+	assert.True(t, acl.IsServerAllowed("matrix.org"))
+	assert.False(t, acl.IsServerAllowed("1.2.3.4"))
+	assert.False(t, acl.IsServerAllowed("1.2.3.4:8448"))
+	assert.False(t, acl.IsServerAllowed("[1234:5678::abcd]"))
+	assert.False(t, acl.IsServerAllowed("[1234:5678::abcd]:8448"))
+}
+
+func TestServerACLEmpty(t *testing.T) {
+	// No allow entries means no servers are allowed
+	acl, err := types.NewServerACLFromContent([]byte(`{}`))
+	require.NoError(t, err)
+	assert.False(t, acl.IsServerAllowed("matrix.org"))
+
+	acl, err = types.NewServerACLFromContent([]byte(`{"allow": ["matrix.org"]}`))
+	require.NoError(t, err)
+	assert.True(t, acl.IsServerAllowed("matrix.org"))
+	assert.False(t, acl.IsServerAllowed("beeper.com"))
+}
+
+func TestServerACLMalformed(t *testing.T) {
+	// Malformed fields are ignored rather than failing to parse
+	acl, err := types.NewServerACLFromContent([]byte(`{
+		"allow": ["*"],
+		"deny": "evil.com",
+		"allow_ip_literals": "no"
+	}`))
+	require.NoError(t, err)
+	assert.True(t, acl.AllowIPLiterals)
+	assert.Empty(t, acl.Deny)
+	assert.True(t, acl.IsServerAllowed("evil.com"))
+	assert.True(t, acl.IsServerAllowed("1.2.3.4"))
+
+	acl, err = types.NewServerACLFromContent([]byte(`{"allow": {"matrix.org": true}, "allow_ip_literals": 0}`))
+	require.NoError(t, err)
+	assert.True(t, acl.AllowIPLiterals)
+	assert.False(t, acl.IsServerAllowed("matrix.org"))
+}
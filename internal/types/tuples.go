@@ -56,6 +56,17 @@ type StateTupWithID struct {
 
 type StateMap map[StateTup]id.EventID
 
+// Returns the users that have no member event in the state map
+func (s StateMap) MissingMembers(userIDs []id.UserID) []id.UserID {
+	missing := make([]id.UserID, 0)
+	for _, userID := range userIDs {
+		if _, found := s[StateTup{Type: event.StateMember, StateKey: userID.String()}]; !found {
+			missing = append(missing, userID)
+		}
+	}
+	return missing
+}
+
 func ValueForStateTupWithID(tup StateTupWithID) []byte {
 	return tuple.Tuple{tup.EventID.String(), tup.Type.String(), tup.StateKey}.Pack()
 }
@@ -0,0 +1,27 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestStateMapMissingMembers(t *testing.T) {
+	stateMap := types.StateMap{
+		{Type: event.StateCreate, StateKey: ""}:                   "$create",
+		{Type: event.StateMember, StateKey: "@alice:example.com"}: "$alice",
+		// Not a member event, doesn't count
+		{Type: event.StatePowerLevels, StateKey: "@bob:example.com"}: "$bogus",
+	}
+
+	assert.Empty(t, stateMap.MissingMembers([]id.UserID{"@alice:example.com"}))
+	assert.Equal(t,
+		[]id.UserID{"@bob:example.com"},
+		stateMap.MissingMembers([]id.UserID{"@alice:example.com", "@bob:example.com"}),
+	)
+	assert.Empty(t, stateMap.MissingMembers(nil))
+}
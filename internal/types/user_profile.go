@@ -1,12 +1,47 @@
 package types
 
-import "github.com/vmihailenco/msgpack/v5"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MSC4133 extended profiles: as well as the display name and avatar URL users
+// may set arbitrary namespaced profile fields, with a limit on total size.
+// https://github.com/matrix-org/matrix-spec-proposals/pull/4133
+const (
+	MaxUserProfileSize      = 64 * 1024
+	MaxUserProfileKeyLength = 255
+
+	UserProfileKeyDisplayName = "displayname"
+	UserProfileKeyAvatarURL   = "avatar_url"
+	UserProfileKeyTimezone    = "m.tz"
+)
 
 type UserProfile struct {
-	DisplayName string `json:"displayname" msgpack:"dn"`
-	AvatarURL   string `json:"avatar_url" msgpack:"au"`
+	DisplayName string `json:"displayname,omitempty" msgpack:"dn"`
+	AvatarURL   string `json:"avatar_url,omitempty" msgpack:"au"`
 
-	Custom map[string]any `json:"-" msgpack:"cu"` // MSC4133 placeholder
+	// Extended (MSC4133) profile fields
+	Custom map[string]any `json:"-" msgpack:"cu"`
+}
+
+// Create a profile from a profile JSON object, ie a federation profile query
+// response. Invalid fields are ignored.
+func NewUserProfileFromMap(fields map[string]any) *UserProfile {
+	profile := &UserProfile{}
+	for key, value := range fields {
+		if ValidateUserProfileField(key, value) == nil {
+			profile.Set(key, value)
+		}
+	}
+	return profile
 }
 
 func NewUserProfileFromBytes(b []byte) (*UserProfile, error) {
@@ -33,16 +68,195 @@ func (p *UserProfile) ToMsgpack() []byte {
 	}
 }
 
-func (p *UserProfile) ToMembershipContent() map[string]any {
-	content := make(map[string]any, 2)
+// Check a profile field key & value are valid. Custom keys must be namespaced
+// (ie us.cloke.pronouns) and the m. namespace is reserved for known fields.
+func ValidateUserProfileField(key string, value any) error {
+	if len(key) > MaxUserProfileKeyLength {
+		return ErrProfileKeyTooLarge
+	}
+
+	switch key {
+	case UserProfileKeyDisplayName, UserProfileKeyAvatarURL, UserProfileKeyTimezone:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%w: %s must be a string", ErrProfileFieldInvalid, key)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(key, "m.") {
+		return fmt.Errorf("%w: unknown field %s", ErrProfileFieldInvalid, key)
+	} else if !strings.Contains(strings.Trim(key, "."), ".") {
+		return fmt.Errorf("%w: custom field %s must be namespaced", ErrProfileFieldInvalid, key)
+	}
+	return nil
+}
+
+func (p *UserProfile) Get(key string) (any, bool) {
+	switch key {
+	case UserProfileKeyDisplayName:
+		return p.DisplayName, p.DisplayName != ""
+	case UserProfileKeyAvatarURL:
+		return p.AvatarURL, p.AvatarURL != ""
+	}
+	value, found := p.Custom[key]
+	return value, found
+}
+
+// Set a profile field, returning whether the value changed. Values are
+// expected to be validated with ValidateUserProfileField.
+func (p *UserProfile) Set(key string, value any) bool {
+	switch key {
+	case UserProfileKeyDisplayName:
+		changed := p.DisplayName != value.(string)
+		p.DisplayName = value.(string)
+		return changed
+	case UserProfileKeyAvatarURL:
+		changed := p.AvatarURL != value.(string)
+		p.AvatarURL = value.(string)
+		return changed
+	}
+
+	if existing, found := p.Custom[key]; found {
+		a, _ := json.Marshal(existing)
+		b, _ := json.Marshal(value)
+		if bytes.Equal(a, b) {
+			return false
+		}
+	}
+	if p.Custom == nil {
+		p.Custom = make(map[string]any, 1)
+	}
+	p.Custom[key] = value
+	return true
+}
+
+// Remove a profile field, returning whether it was set
+func (p *UserProfile) Delete(key string) bool {
+	switch key {
+	case UserProfileKeyDisplayName:
+		return p.Set(key, "")
+	case UserProfileKeyAvatarURL:
+		return p.Set(key, "")
+	}
+	_, found := p.Custom[key]
+	delete(p.Custom, key)
+	return found
+}
+
+// All set profile fields as a JSON object
+func (p *UserProfile) ToMap() map[string]any {
+	fields := make(map[string]any, len(p.Custom)+2)
 	for k, v := range p.Custom {
-		content[k] = v
+		fields[k] = v
+	}
+	if p.DisplayName != "" {
+		fields[UserProfileKeyDisplayName] = p.DisplayName
+	}
+	if p.AvatarURL != "" {
+		fields[UserProfileKeyAvatarURL] = p.AvatarURL
+	}
+	return fields
+}
+
+func (p *UserProfile) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.ToMap())
+}
+
+// Size of the profile when encoded as JSON, which is limited to
+// MaxUserProfileSize.
+func (p *UserProfile) Size() int {
+	b, err := p.MarshalJSON()
+	if err != nil {
+		panic(err)
 	}
+	return len(b)
+}
+
+// Cached profile of a remote user, fetched over federation
+type RemoteUserProfile struct {
+	Profile   *UserProfile `msgpack:"pro"`
+	FetchedAt int64        `msgpack:"fat"`
+}
+
+func (p *RemoteUserProfile) FetchedBefore(t time.Time) bool {
+	return p.FetchedAt < t.UnixMilli()
+}
+
+// Member events only carry the display name and avatar URL, extended fields
+// are fetched via the profile APIs.
+func (p *UserProfile) ToMembershipContent() map[string]any {
+	content := make(map[string]any, 2)
 	if p.DisplayName != "" {
-		content["displayname"] = p.DisplayName
+		content[UserProfileKeyDisplayName] = p.DisplayName
 	}
 	if p.AvatarURL != "" {
-		content["avatar_url"] = p.AvatarURL
+		content[UserProfileKeyAvatarURL] = p.AvatarURL
 	}
 	return content
 }
+
+// User directory entries hold the profile used to search for a user, for
+// local users this is their global profile and for remote users the profile
+// from their latest member event.
+type UserDirectoryEntry struct {
+	UserID      id.UserID `json:"user_id" msgpack:"uid"`
+	DisplayName string    `json:"display_name,omitempty" msgpack:"dn"`
+	AvatarURL   string    `json:"avatar_url,omitempty" msgpack:"au"`
+
+	// Search terms from the user ID and display name
+	Terms []string `json:"-" msgpack:"trm"`
+}
+
+func NewUserDirectoryEntryFromBytes(b []byte) (*UserDirectoryEntry, error) {
+	var e UserDirectoryEntry
+	if err := msgpack.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func MustNewUserDirectoryEntryFromBytes(b []byte) *UserDirectoryEntry {
+	e, err := NewUserDirectoryEntryFromBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func (e *UserDirectoryEntry) ToMsgpack() []byte {
+	if bytes, err := msgpack.Marshal(e); err != nil {
+		panic(err)
+	} else {
+		return bytes
+	}
+}
+
+// Returns whether a user is visible to a searcher in the user directory, they
+// must share a joined room or the user must be joined to a public room. The
+// searcher can always see themselves.
+// https://spec.matrix.org/v1.11/client-server-api/#user-directory
+func IsUserVisibleInDirectory(
+	searcherID id.UserID,
+	searcherMemberships Memberships,
+	userID id.UserID,
+	userMemberships Memberships,
+	isPublicRoom func(id.RoomID) (bool, error),
+) (bool, error) {
+	if userID == searcherID {
+		return true, nil
+	}
+	for roomID, membership := range userMemberships {
+		if membership.Membership != event.MembershipJoin {
+			continue
+		}
+		if searcherMemberships[roomID].Membership == event.MembershipJoin {
+			return true, nil
+		}
+		if public, err := isPublicRoom(roomID); err != nil {
+			return false, err
+		} else if public {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,121 @@
+package types_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestValidateUserProfileField(t *testing.T) {
+	assert.NoError(t, types.ValidateUserProfileField("displayname", "Nick"))
+	assert.NoError(t, types.ValidateUserProfileField("m.tz", "Europe/London"))
+	assert.NoError(t, types.ValidateUserProfileField("us.cloke.pronouns", []any{"they/them"}))
+
+	assert.ErrorIs(t, types.ValidateUserProfileField("displayname", 1), types.ErrProfileFieldInvalid)
+	assert.ErrorIs(t, types.ValidateUserProfileField("m.tz", true), types.ErrProfileFieldInvalid)
+	assert.ErrorIs(t, types.ValidateUserProfileField("m.unknown", "x"), types.ErrProfileFieldInvalid)
+	assert.ErrorIs(t, types.ValidateUserProfileField("pronouns", "x"), types.ErrProfileFieldInvalid)
+	assert.ErrorIs(t, types.ValidateUserProfileField("a."+strings.Repeat("b", 255), "x"), types.ErrProfileKeyTooLarge)
+}
+
+func TestUserProfileSetDelete(t *testing.T) {
+	profile := &types.UserProfile{}
+
+	assert.True(t, profile.Set("displayname", "Nick"))
+	assert.False(t, profile.Set("displayname", "Nick"))
+	assert.True(t, profile.Set("m.tz", "Europe/London"))
+	assert.False(t, profile.Set("m.tz", "Europe/London"))
+
+	value, found := profile.Get("m.tz")
+	assert.True(t, found)
+	assert.Equal(t, "Europe/London", value)
+
+	assert.True(t, profile.Delete("m.tz"))
+	assert.False(t, profile.Delete("m.tz"))
+	assert.True(t, profile.Delete("displayname"))
+
+	_, found = profile.Get("displayname")
+	assert.False(t, found)
+}
+
+func TestUserProfileMarshalJSON(t *testing.T) {
+	profile := &types.UserProfile{}
+	profile.Set("displayname", "Nick")
+	profile.Set("us.cloke.pronouns", "he/him")
+
+	b, err := json.Marshal(profile)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"displayname":"Nick","us.cloke.pronouns":"he/him"}`, string(b))
+
+	// Only the display name & avatar go into member events
+	assert.Equal(t, map[string]any{"displayname": "Nick"}, profile.ToMembershipContent())
+}
+
+func TestIsUserVisibleInDirectory(t *testing.T) {
+	joined := func(roomIDs ...id.RoomID) types.Memberships {
+		memberships := make(types.Memberships, len(roomIDs))
+		for _, roomID := range roomIDs {
+			memberships[roomID] = types.MembershipTup{RoomID: roomID, Membership: event.MembershipJoin}
+		}
+		return memberships
+	}
+	publicRooms := map[id.RoomID]bool{"!public:example.com": true}
+	isPublicRoom := func(roomID id.RoomID) (bool, error) {
+		return publicRooms[roomID], nil
+	}
+	searcherID := id.UserID("@alice:example.com")
+	searcherMemberships := joined("!shared:example.com")
+	isVisible := func(userID id.UserID, memberships types.Memberships) bool {
+		visible, err := types.IsUserVisibleInDirectory(searcherID, searcherMemberships, userID, memberships, isPublicRoom)
+		require.NoError(t, err)
+		return visible
+	}
+
+	assert.True(t, isVisible(searcherID, nil))
+	assert.True(t, isVisible("@bob:example.com", joined("!shared:example.com")))
+	assert.True(t, isVisible("@bob:example.com", joined("!private:example.com", "!public:example.com")))
+	assert.False(t, isVisible("@bob:example.com", joined("!private:example.com")))
+	assert.False(t, isVisible("@bob:example.com", nil))
+
+	// Users who have left or are only invited to a shared room aren't visible
+	left := types.Memberships{
+		"!shared:example.com": {RoomID: "!shared:example.com", Membership: event.MembershipLeave},
+		"!public:example.com": {RoomID: "!public:example.com", Membership: event.MembershipInvite},
+	}
+	assert.False(t, isVisible("@bob:example.com", left))
+
+	// Nor are users sharing a room the searcher has left
+	searcherMemberships = types.Memberships{
+		"!shared:example.com": {RoomID: "!shared:example.com", Membership: event.MembershipLeave},
+	}
+	assert.False(t, isVisible("@bob:example.com", joined("!shared:example.com")))
+}
+
+func TestRemoteUserProfileFetchedBefore(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	remote := &types.RemoteUserProfile{Profile: &types.UserProfile{}, FetchedAt: now.UnixMilli()}
+	assert.False(t, remote.FetchedBefore(now))
+	assert.True(t, remote.FetchedBefore(now.Add(time.Millisecond)))
+	assert.False(t, remote.FetchedBefore(now.Add(-time.Hour)))
+}
+
+func TestRemoteUserProfileSizeLimit(t *testing.T) {
+	// Remote profiles drop invalid fields but may still exceed the size limit
+	profile := types.NewUserProfileFromMap(map[string]any{
+		"displayname": "Bob",
+		"m.tz":        "Europe/London",
+		"com.example": strings.Repeat("x", types.MaxUserProfileSize),
+		"m.unknown":   "dropped",
+	})
+	_, found := profile.Get("m.unknown")
+	assert.False(t, found)
+	assert.Greater(t, profile.Size(), types.MaxUserProfileSize)
+}
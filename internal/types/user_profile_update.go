@@ -0,0 +1,77 @@
+package types
+
+import (
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"maunium.net/go/mautrix/id"
+)
+
+// A job sending updated member events to every room a user is joined to after
+// they change their profile, run in batches of rooms.
+type ProfileUpdate struct {
+	UserID id.UserID `json:"user_id" msgpack:"uid"`
+	// Unique per profile change, used to detect the job being replaced
+	JobID string `json:"job_id" msgpack:"jid"`
+	// The last room processed, the job pages through the user's memberships
+	// after this rather than storing them.
+	Cursor id.RoomID `json:"-" msgpack:"cur"`
+
+	TotalRooms     int `json:"total_rooms" msgpack:"tot"`
+	ProcessedRooms int `json:"processed_rooms" msgpack:"pro"`
+	UpdatedRooms   int `json:"updated_rooms" msgpack:"upd"`
+	SkippedRooms   int `json:"skipped_rooms" msgpack:"skp"`
+	FailedRooms    int `json:"failed_rooms" msgpack:"fld"`
+
+	StartedAt   int64 `json:"started_at" msgpack:"sta"`
+	CompletedAt int64 `json:"completed_at,omitempty" msgpack:"cpa"`
+	Complete    bool  `json:"complete" msgpack:"cmp"`
+}
+
+func NewProfileUpdate(userID id.UserID, jobID string, totalRooms int, now time.Time) *ProfileUpdate {
+	update := &ProfileUpdate{
+		UserID:     userID,
+		JobID:      jobID,
+		TotalRooms: totalRooms,
+		StartedAt:  now.UnixMilli(),
+	}
+	if totalRooms == 0 {
+		update.markComplete(now)
+	}
+	return update
+}
+
+func NewProfileUpdateFromBytes(b []byte) (*ProfileUpdate, error) {
+	var update ProfileUpdate
+	if err := msgpack.Unmarshal(b, &update); err != nil {
+		return nil, err
+	}
+	return &update, nil
+}
+
+func (u *ProfileUpdate) ToMsgpack() []byte {
+	if b, err := msgpack.Marshal(u); err != nil {
+		panic(err)
+	} else {
+		return b
+	}
+}
+
+// Record the results of a batch of rooms and the cursor to continue from, an
+// empty cursor means there are no more rooms and completes the job.
+func (u *ProfileUpdate) CompleteBatch(cursor id.RoomID, updated, skipped, failed int, now time.Time) {
+	// Rooms joined since the job started are included, so cap the progress
+	u.ProcessedRooms = min(u.ProcessedRooms+updated+skipped+failed, u.TotalRooms)
+	u.UpdatedRooms += updated
+	u.SkippedRooms += skipped
+	u.FailedRooms += failed
+	u.Cursor = cursor
+	if cursor == "" {
+		u.markComplete(now)
+	}
+}
+
+func (u *ProfileUpdate) markComplete(now time.Time) {
+	u.Complete = true
+	u.CompletedAt = now.UnixMilli()
+}
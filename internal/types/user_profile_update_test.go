@@ -0,0 +1,49 @@
+package types_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func TestProfileUpdateBatches(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	update := types.NewProfileUpdate("@alice:example.com", "job", 3, now)
+	assert.False(t, update.Complete)
+	assert.Equal(t, 3, update.TotalRooms)
+
+	update.CompleteBatch("!b:example.com", 1, 1, 0, now)
+	assert.False(t, update.Complete)
+	assert.Equal(t, 2, update.ProcessedRooms)
+	assert.Equal(t, "!b:example.com", update.Cursor.String())
+
+	update.CompleteBatch("", 0, 0, 1, now.Add(time.Second))
+	assert.True(t, update.Complete)
+	assert.Equal(t, now.Add(time.Second).UnixMilli(), update.CompletedAt)
+	assert.Equal(t, 3, update.ProcessedRooms)
+	assert.Equal(t, 1, update.UpdatedRooms)
+	assert.Equal(t, 1, update.SkippedRooms)
+	assert.Equal(t, 1, update.FailedRooms)
+	assert.Empty(t, update.Cursor)
+}
+
+func TestProfileUpdateCapsProcessedRooms(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	update := types.NewProfileUpdate("@alice:example.com", "job", 1, now)
+
+	// A room joined after the job started is processed too
+	update.CompleteBatch("", 2, 0, 0, now)
+	assert.True(t, update.Complete)
+	assert.Equal(t, 1, update.ProcessedRooms)
+	assert.Equal(t, 2, update.UpdatedRooms)
+}
+
+func TestProfileUpdateNoRooms(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+	update := types.NewProfileUpdate("@alice:example.com", "job", 0, now)
+	assert.True(t, update.Complete)
+	assert.Equal(t, now.UnixMilli(), update.CompletedAt)
+}
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Returns the exponential backoff duration after a number of consecutive
+// failures, capped at max and with +/-20% jitter applied so that many callers
+// backing off at once don't all retry in lockstep.
+func GetBackoffDuration(failures int, initial, max time.Duration) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+
+	backoff := initial
+	for i := 1; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+
+	jitter := 0.8 + rand.Float64()*0.4
+	return time.Duration(float64(backoff) * jitter)
+}
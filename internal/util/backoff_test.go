@@ -0,0 +1,29 @@
+package util_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func TestGetBackoffDuration(t *testing.T) {
+	initial := time.Second * 10
+	max := time.Hour
+
+	assert.Equal(t, time.Duration(0), util.GetBackoffDuration(0, initial, max))
+
+	for failures, expected := range map[int]time.Duration{
+		1:  initial,
+		2:  initial * 2,
+		3:  initial * 4,
+		10: max,
+		99: max,
+	} {
+		backoff := util.GetBackoffDuration(failures, initial, max)
+		assert.GreaterOrEqual(t, backoff, time.Duration(float64(expected)*0.8), failures)
+		assert.LessOrEqual(t, backoff, time.Duration(float64(expected)*1.2), failures)
+	}
+}
@@ -91,3 +91,146 @@ func DoWriteTransaction[T any](
 		return res.(T), nil
 	}
 }
+
+// Time to version keys ("ttv", unix_nanos) -> versionstamp
+//
+
+func KeyForTimeToVersion(t time.Time) fdb.Key {
+	return tuple.Tuple{timeToVersionPrefix, t.UnixNano()}.Pack()
+}
+
+func KeyToTimeToVersion(key fdb.Key) time.Time {
+	tup, _ := tuple.Unpack(key)
+	return time.Unix(0, tup[1].(int64))
+}
+
+// Lookup the version of the last write at or before a time, or if forward the
+// first write at or after it. Returns types.ZeroVersionstamp if there is none.
+func TxnLookupVersionForTime(txn fdb.ReadTransaction, t time.Time, forward bool) (tuple.Versionstamp, error) {
+	prefix := tuple.Tuple{timeToVersionPrefix}.Pack()
+	var keyRange fdb.KeyRange
+	if forward {
+		keyRange = fdb.KeyRange{
+			Begin: KeyForTimeToVersion(t),
+			End:   fdb.Key(append(prefix, 0xff)),
+		}
+	} else {
+		keyRange = fdb.KeyRange{
+			Begin: fdb.Key(append(prefix, 0x00)),
+			End:   fdb.Key(append(KeyForTimeToVersion(t), 0x00)),
+		}
+	}
+
+	kvs, err := txn.GetRange(keyRange, fdb.RangeOptions{
+		Limit:   1,
+		Reverse: !forward,
+	}).GetSliceWithError()
+	if err != nil {
+		return types.ZeroVersionstamp, err
+	} else if len(kvs) == 0 {
+		return types.ZeroVersionstamp, nil
+	}
+	return types.ValueToVersionstamp(kvs[0].Value)
+}
+
+const (
+	timeToVersionPositionPrefix = "ttvp"
+	timeToVersionPruneBatchSize = 1000
+)
+
+// Returns which of the (ordered) times to prune, keeping only the first time in
+// each granularity bucket. The last bucket is that of the last time already
+// scanned, or -1 if none, and is returned updated for the next batch.
+func TimeToVersionPruneMask(times []time.Time, lastBucket int64, granularity time.Duration) ([]bool, int64) {
+	prune := make([]bool, len(times))
+	for i, t := range times {
+		bucket := t.UnixNano() / int64(granularity)
+		if bucket == lastBucket {
+			prune[i] = true
+		} else {
+			lastBucket = bucket
+		}
+	}
+	return prune, lastBucket
+}
+
+// Prune time to version keys written before a time down to one per granularity
+// (the first), this keeps the index small while still being able to map older
+// times to versions, less precisely. The position pruned up to is stored per
+// granularity so repeated calls only scan new keys. The after batch function,
+// if set, is called after each batch, ie to refresh a lock. Returns the number
+// of keys removed.
+func PruneTimeToVersion(
+	ctx context.Context,
+	db fdb.Database,
+	before time.Time,
+	granularity time.Duration,
+	afterBatch func(),
+) (int, error) {
+	positionKey := fdb.Key(tuple.Tuple{timeToVersionPositionPrefix, int64(granularity)}.Pack())
+	prefix := tuple.Tuple{timeToVersionPrefix}.Pack()
+
+	type batchResult struct {
+		cleared int
+		done    bool
+	}
+
+	var total int
+	for {
+		res, err := DoWriteTransaction(ctx, db, func(txn fdb.Transaction) (batchResult, error) {
+			begin := fdb.Key(append(prefix, 0x00))
+			lastBucket := int64(-1)
+			if b := txn.Get(positionKey).MustGet(); b != nil {
+				position, err := tuple.Unpack(b)
+				if err != nil {
+					return batchResult{}, err
+				}
+				lastNanos := position[0].(int64)
+				begin = fdb.Key(append(tuple.Tuple{timeToVersionPrefix, lastNanos}.Pack(), 0x00))
+				lastBucket = lastNanos / int64(granularity)
+			}
+
+			kvs, err := txn.GetRange(fdb.KeyRange{
+				Begin: begin,
+				End:   KeyForTimeToVersion(before),
+			}, fdb.RangeOptions{
+				Limit: timeToVersionPruneBatchSize,
+			}).GetSliceWithError()
+			if err != nil {
+				return batchResult{}, err
+			} else if len(kvs) == 0 {
+				return batchResult{done: true}, nil
+			}
+
+			times := make([]time.Time, 0, len(kvs))
+			for _, kv := range kvs {
+				times = append(times, KeyToTimeToVersion(kv.Key))
+			}
+			prune, _ := TimeToVersionPruneMask(times, lastBucket, granularity)
+
+			var res batchResult
+			for i, kv := range kvs {
+				if prune[i] {
+					txn.Clear(kv.Key)
+					res.cleared++
+				}
+			}
+
+			lastNanos := KeyToTimeToVersion(kvs[len(kvs)-1].Key).UnixNano()
+			txn.Set(positionKey, tuple.Tuple{lastNanos}.Pack())
+
+			res.done = len(kvs) < timeToVersionPruneBatchSize
+			return res, nil
+		})
+		if err != nil {
+			return total, err
+		}
+		total += res.cleared
+		if res.done {
+			return total, nil
+		}
+		if afterBatch != nil {
+			afterBatch()
+		}
+	}
+}
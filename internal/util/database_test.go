@@ -0,0 +1,36 @@
+package util_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func TestTimeToVersionPruneMask(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	times := []time.Time{
+		start,
+		start.Add(time.Millisecond * 100),
+		start.Add(time.Millisecond * 900),
+		start.Add(time.Second),
+		start.Add(time.Second * 30),
+		start.Add(time.Minute),
+		start.Add(time.Minute + time.Millisecond),
+	}
+
+	// Keep the first key per second
+	prune, lastBucket := util.TimeToVersionPruneMask(times, -1, time.Second)
+	assert.Equal(t, []bool{false, true, true, false, false, false, true}, prune)
+	assert.Equal(t, start.Add(time.Minute).Unix(), lastBucket)
+
+	// The next batch continues from the last bucket
+	prune, _ = util.TimeToVersionPruneMask([]time.Time{start.Add(time.Minute + time.Millisecond*500)}, lastBucket, time.Second)
+	assert.Equal(t, []bool{true}, prune)
+
+	// A coarser tier keeps the first key per minute, start is 20s into a minute
+	prune, _ = util.TimeToVersionPruneMask(times, -1, time.Minute)
+	assert.Equal(t, []bool{false, true, true, true, true, false, true}, prune)
+}
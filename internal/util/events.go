@@ -44,6 +44,28 @@ func EventsToPDUs(evs []*types.Event) []gomatrixserverlib.PDU {
 	return pdus
 }
 
+func EventsToStrippedStates(evs []*types.Event) []gomatrixserverlib.InviteStrippedState {
+	stripped := make([]gomatrixserverlib.InviteStrippedState, 0, len(evs))
+	for _, ev := range evs {
+		stripped = append(stripped, gomatrixserverlib.NewInviteStrippedState(ev.PDU()))
+	}
+	return stripped
+}
+
+// Convert stripped state events into plain JSON values that can be stored in an
+// event's unsigned data.
+func StrippedStatesToValues(stripped []gomatrixserverlib.InviteStrippedState) ([]any, error) {
+	b, err := json.Marshal(stripped)
+	if err != nil {
+		return nil, err
+	}
+	var values []any
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
 func EventsToJSONs(evs []*types.Event) []json.RawMessage {
 	jsons := make([]json.RawMessage, 0, len(evs))
 	for _, ev := range evs {
@@ -221,3 +243,20 @@ func HashAndSignEvent(ev *types.Event, serverName, keyID string, key ed25519.Pri
 
 	return nil
 }
+
+// Knocking was introduced in room version 7, earlier versions (and any versions
+// unknown to us) do not support it.
+// https://spec.matrix.org/v1.11/rooms/v7/
+func RoomVersionSupportsKnocking(roomVersion string) bool {
+	if _, err := gomatrixserverlib.GetRoomVersion(gomatrixserverlib.RoomVersion(roomVersion)); err != nil {
+		return false
+	}
+	return !slices.Contains([]gomatrixserverlib.RoomVersion{
+		gomatrixserverlib.RoomVersionV1,
+		gomatrixserverlib.RoomVersionV2,
+		gomatrixserverlib.RoomVersionV3,
+		gomatrixserverlib.RoomVersionV4,
+		gomatrixserverlib.RoomVersionV5,
+		gomatrixserverlib.RoomVersionV6,
+	}, gomatrixserverlib.RoomVersion(roomVersion))
+}
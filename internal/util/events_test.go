@@ -143,3 +143,39 @@ func TestVerifyEventJSON(t *testing.T) {
 	err = util.VerifyJSON(b, "matrix.org", "ed25519:a_RXGa", pubKey)
 	require.NoError(t, err)
 }
+
+func TestRoomVersionSupportsKnocking(t *testing.T) {
+	assert.False(t, util.RoomVersionSupportsKnocking("1"))
+	assert.False(t, util.RoomVersionSupportsKnocking("6"))
+	assert.True(t, util.RoomVersionSupportsKnocking("7"))
+	assert.True(t, util.RoomVersionSupportsKnocking("10"))
+	assert.False(t, util.RoomVersionSupportsKnocking("not-a-version"))
+}
+
+func TestStrippedStatesToValues(t *testing.T) {
+	stateKey := "@a:domain"
+	ev := &types.Event{
+		PartialEvent: types.PartialEvent{
+			RoomID:   id.RoomID("!x:domain"),
+			Sender:   id.UserID("@a:domain"),
+			Type:     event.StateMember,
+			StateKey: &stateKey,
+			Content:  []byte(`{"membership":"knock"}`),
+		},
+		ID:           "abc",
+		PrevEventIDs: []id.EventID{},
+		AuthEventIDs: []id.EventID{},
+		RoomVersion:  "10",
+		Origin:       "domain",
+	}
+
+	values, err := util.StrippedStatesToValues(util.EventsToStrippedStates([]*types.Event{ev}))
+	require.NoError(t, err)
+	require.Len(t, values, 1)
+	assert.Equal(t, map[string]any{
+		"type":      "m.room.member",
+		"state_key": "@a:domain",
+		"sender":    "@a:domain",
+		"content":   map[string]any{"membership": "knock"},
+	}, values[0])
+}
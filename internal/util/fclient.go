@@ -0,0 +1,221 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/rs/zerolog"
+)
+
+var ErrServerDown = errors.New("server is down")
+
+type serverDownChecker interface {
+	IsServerDown(ctx context.Context, serverName string) (bool, error)
+}
+
+// Federation client wrapper that fast-fails requests to servers we consider
+// down (see RoomsDatabase.RecordServerFailure) rather than waiting on them to
+// time out. Transactions are not wrapped as the federation sender manages its
+// own backoff.
+type BackoffFederationClient struct {
+	fclient.FederationClient
+	checker serverDownChecker
+}
+
+func NewBackoffFederationClient(
+	fclient fclient.FederationClient,
+	checker serverDownChecker,
+) *BackoffFederationClient {
+	return &BackoffFederationClient{fclient, checker}
+}
+
+func (c *BackoffFederationClient) checkServer(ctx context.Context, s spec.ServerName) error {
+	if down, err := c.checker.IsServerDown(ctx, string(s)); err != nil {
+		// Don't block requests if we can't check, just log and carry on
+		zerolog.Ctx(ctx).Err(err).
+			Str("server", string(s)).
+			Msg("Failed to check if server is down")
+	} else if down {
+		return fmt.Errorf("%w: %s", ErrServerDown, s)
+	}
+	return nil
+}
+
+func (c *BackoffFederationClient) GetServerKeys(
+	ctx context.Context,
+	s spec.ServerName,
+) (gomatrixserverlib.ServerKeys, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return gomatrixserverlib.ServerKeys{}, err
+	}
+	return c.FederationClient.GetServerKeys(ctx, s)
+}
+
+func (c *BackoffFederationClient) LookupServerKeys(
+	ctx context.Context,
+	s spec.ServerName,
+	keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+) ([]gomatrixserverlib.ServerKeys, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return nil, err
+	}
+	return c.FederationClient.LookupServerKeys(ctx, s, keyRequests)
+}
+
+func (c *BackoffFederationClient) MakeJoin(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	roomID, userID string,
+) (fclient.RespMakeJoin, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return fclient.RespMakeJoin{}, err
+	}
+	return c.FederationClient.MakeJoin(ctx, origin, s, roomID, userID)
+}
+
+func (c *BackoffFederationClient) MakeLeave(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	roomID, userID string,
+) (fclient.RespMakeLeave, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return fclient.RespMakeLeave{}, err
+	}
+	return c.FederationClient.MakeLeave(ctx, origin, s, roomID, userID)
+}
+
+func (c *BackoffFederationClient) SendLeave(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	event gomatrixserverlib.PDU,
+) error {
+	if err := c.checkServer(ctx, s); err != nil {
+		return err
+	}
+	return c.FederationClient.SendLeave(ctx, origin, s, event)
+}
+
+func (c *BackoffFederationClient) MakeKnock(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	roomID, userID string,
+	roomVersions []gomatrixserverlib.RoomVersion,
+) (fclient.RespMakeKnock, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return fclient.RespMakeKnock{}, err
+	}
+	return c.FederationClient.MakeKnock(ctx, origin, s, roomID, userID, roomVersions)
+}
+
+func (c *BackoffFederationClient) SendKnock(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	event gomatrixserverlib.PDU,
+) (fclient.RespSendKnock, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return fclient.RespSendKnock{}, err
+	}
+	return c.FederationClient.SendKnock(ctx, origin, s, event)
+}
+
+func (c *BackoffFederationClient) SendInviteV2(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	request fclient.InviteV2Request,
+) (fclient.RespInviteV2, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return fclient.RespInviteV2{}, err
+	}
+	return c.FederationClient.SendInviteV2(ctx, origin, s, request)
+}
+
+func (c *BackoffFederationClient) ExchangeThirdPartyInvite(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	proto gomatrixserverlib.ProtoEvent,
+) error {
+	if err := c.checkServer(ctx, s); err != nil {
+		return err
+	}
+	return c.FederationClient.ExchangeThirdPartyInvite(ctx, origin, s, proto)
+}
+
+func (c *BackoffFederationClient) GetEvent(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return gomatrixserverlib.Transaction{}, err
+	}
+	return c.FederationClient.GetEvent(ctx, origin, s, eventID)
+}
+
+func (c *BackoffFederationClient) LookupState(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	roomID, eventID string,
+	roomVersion gomatrixserverlib.RoomVersion,
+) (fclient.RespState, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return fclient.RespState{}, err
+	}
+	return c.FederationClient.LookupState(ctx, origin, s, roomID, eventID, roomVersion)
+}
+
+func (c *BackoffFederationClient) LookupProfile(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	userID string,
+	field string,
+) (fclient.RespProfile, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return fclient.RespProfile{}, err
+	}
+	return c.FederationClient.LookupProfile(ctx, origin, s, userID, field)
+}
+
+func (c *BackoffFederationClient) LookupRoomAlias(
+	ctx context.Context,
+	origin, s spec.ServerName,
+	roomAlias string,
+) (fclient.RespDirectory, error) {
+	if err := c.checkServer(ctx, s); err != nil {
+		return fclient.RespDirectory{}, err
+	}
+	return c.FederationClient.LookupRoomAlias(ctx, origin, s, roomAlias)
+}
+
+func (c *BackoffFederationClient) RoomHierarchy(
+	ctx context.Context,
+	origin, dst spec.ServerName,
+	roomID string,
+	suggestedOnly bool,
+) (fclient.RoomHierarchyResponse, error) {
+	if err := c.checkServer(ctx, dst); err != nil {
+		return fclient.RoomHierarchyResponse{}, err
+	}
+	return c.FederationClient.RoomHierarchy(ctx, origin, dst, roomID, suggestedOnly)
+}
+
+// Federation clients able to make raw HTTP requests, for endpoints that don't
+// return JSON (ie media downloads).
+type HTTPFederationClient interface {
+	DoHTTPRequest(ctx context.Context, req *http.Request) (*http.Response, error)
+}
+
+func (c *BackoffFederationClient) DoHTTPRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if err := c.checkServer(ctx, spec.ServerName(req.URL.Host)); err != nil {
+		return nil, err
+	}
+	httpClient, ok := c.FederationClient.(HTTPFederationClient)
+	if !ok {
+		return nil, errors.New("federation client does not support raw HTTP requests")
+	}
+	return httpClient.DoHTTPRequest(ctx, req)
+}
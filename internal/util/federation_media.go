@@ -0,0 +1,123 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// Federation media responses are multipart, the first part is a JSON metadata
+// object (currently empty) and the second either the media content or a
+// Location header pointing at it.
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1mediadownloadmediaid
+
+func ResponseFederationMedia(
+	w http.ResponseWriter,
+	r *http.Request,
+	contentType, fileName string,
+	content io.Reader,
+) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusOK)
+
+	err := func() error {
+		metadataHeader := make(textproto.MIMEHeader)
+		metadataHeader.Set("Content-Type", "application/json")
+		metadata, err := mw.CreatePart(metadataHeader)
+		if err != nil {
+			return err
+		} else if _, err := metadata.Write([]byte("{}")); err != nil {
+			return err
+		}
+
+		contentHeader := make(textproto.MIMEHeader)
+		contentHeader.Set("Content-Type", contentType)
+		contentHeader.Set("Content-Disposition", MediaContentDisposition(contentType, fileName))
+		part, err := mw.CreatePart(contentHeader)
+		if err != nil {
+			return err
+		} else if _, err := io.Copy(part, content); err != nil {
+			return err
+		}
+		return mw.Close()
+	}()
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to write federation media response")
+	}
+}
+
+type FederationMedia struct {
+	ContentType string
+	FileName    string
+	// Set when the server redirects to the content rather than including it
+	Location string
+	Content  io.Reader
+}
+
+// Read a multipart federation media response, the content is read from the
+// response body so it must not be closed until the content has been read.
+func ReadFederationMediaResponse(res *http.Response) (*FederationMedia, error) {
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	} else if mediaType != "multipart/mixed" || params["boundary"] == "" {
+		return nil, fmt.Errorf("unexpected federation media content type: %s", mediaType)
+	}
+
+	mr := multipart.NewReader(res.Body, params["boundary"])
+
+	// Metadata must be JSON but we don't currently use any of it
+	metadata, err := mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	var metadataContent map[string]any
+	if err := json.NewDecoder(io.LimitReader(metadata, 64*1024)).Decode(&metadataContent); err != nil {
+		return nil, fmt.Errorf("invalid federation media metadata: %w", err)
+	}
+
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	media := &FederationMedia{
+		ContentType: part.Header.Get("Content-Type"),
+		FileName:    MediaFileNameFromContentDisposition(part.Header.Get("Content-Disposition")),
+		Location:    part.Header.Get("Location"),
+		Content:     part,
+	}
+	if media.Location == "" && media.ContentType == "" {
+		return nil, errors.New("federation media part has no content type or location")
+	}
+	return media, nil
+}
+
+func MediaFileNameFromContentDisposition(contentDisposition string) string {
+	if contentDisposition == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(contentDisposition)
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// Read a Matrix error code from a non 200 response body, if present
+func ErrorCodeFromResponse(res *http.Response) string {
+	var resp struct {
+		Code string `json:"errcode"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&resp); err != nil {
+		return ""
+	}
+	return resp.Code
+}
@@ -0,0 +1,84 @@
+package util_test
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func TestFederationMediaRoundTrip(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/federation/v1/media/download/abc", nil)
+	rec := httptest.NewRecorder()
+	util.ResponseFederationMedia(rec, req, "image/png", "cat.png", strings.NewReader("not really a png"))
+
+	res := rec.Result()
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	media, err := util.ReadFederationMediaResponse(res)
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", media.ContentType)
+	assert.Equal(t, "cat.png", media.FileName)
+	assert.Empty(t, media.Location)
+
+	content, err := io.ReadAll(media.Content)
+	require.NoError(t, err)
+	assert.Equal(t, "not really a png", string(content))
+}
+
+func TestReadFederationMediaLocation(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	metadataHeader := make(textproto.MIMEHeader)
+	metadataHeader.Set("Content-Type", "application/json")
+	metadata, err := mw.CreatePart(metadataHeader)
+	require.NoError(t, err)
+	_, err = metadata.Write([]byte(`{"unknown":true}`))
+	require.NoError(t, err)
+
+	locationHeader := make(textproto.MIMEHeader)
+	locationHeader.Set("Location", "https://cdn.example.com/abc")
+	_, err = mw.CreatePart(locationHeader)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"multipart/mixed; boundary=" + mw.Boundary()}},
+		Body:       io.NopCloser(&buf),
+	}
+	media, err := util.ReadFederationMediaResponse(res)
+	require.NoError(t, err)
+	assert.Equal(t, "https://cdn.example.com/abc", media.Location)
+
+	// Not multipart at all
+	res = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"image/png"}},
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	_, err = util.ReadFederationMediaResponse(res)
+	assert.Error(t, err)
+}
+
+func TestErrorCodeFromResponse(t *testing.T) {
+	res := &http.Response{Body: io.NopCloser(strings.NewReader(`{"errcode":"M_NOT_FOUND","error":"Media not found"}`))}
+	assert.Equal(t, "M_NOT_FOUND", util.ErrorCodeFromResponse(res))
+
+	res = &http.Response{Body: io.NopCloser(strings.NewReader("<html>404</html>"))}
+	assert.Equal(t, "", util.ErrorCodeFromResponse(res))
+
+	assert.Equal(t, "cat.png", util.MediaFileNameFromContentDisposition(`attachment; filename="cat.png"`))
+	assert.Equal(t, "", util.MediaFileNameFromContentDisposition("inline"))
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"maunium.net/go/mautrix/id"
+)
+
+const identityPathPrefix = "/_matrix/identity/v2"
+
+// Minimal client for the identity server endpoints needed to send third party
+// invites, requests are authenticated with the inviting user's id_access_token.
+// https://spec.matrix.org/v1.11/identity-service-api/
+type IdentityClient struct {
+	client    *http.Client
+	userAgent string
+}
+
+func NewIdentityClient(userAgent string) *IdentityClient {
+	return &IdentityClient{
+		client:    &http.Client{Timeout: 30 * time.Second},
+		userAgent: userAgent,
+	}
+}
+
+type StoreInviteRequest struct {
+	Address           string    `json:"address"`
+	Medium            string    `json:"medium"`
+	RoomID            id.RoomID `json:"room_id"`
+	Sender            id.UserID `json:"sender"`
+	SenderDisplayName string    `json:"sender_display_name,omitempty"`
+	RoomName          string    `json:"room_name,omitempty"`
+	RoomAvatarURL     string    `json:"room_avatar_url,omitempty"`
+	RoomJoinRules     string    `json:"room_join_rules,omitempty"`
+}
+
+type StoreInviteResponse struct {
+	Token       string                        `json:"token"`
+	DisplayName string                        `json:"display_name"`
+	PublicKeys  []gomatrixserverlib.PublicKey `json:"public_keys"`
+}
+
+func (ic *IdentityClient) do(
+	ctx context.Context,
+	method, baseURL, path, accessToken string,
+	body, resp any,
+) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(baseURL, "/")+identityPathPrefix+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", ic.userAgent)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := ic.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("identity server returned status %d for %s", res.StatusCode, path)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// Lookup the Matrix ID bound to a third party identifier, returns an empty user
+// ID if there is no binding.
+// https://spec.matrix.org/v1.11/identity-service-api/#post_matrixidentityv2lookup
+func (ic *IdentityClient) LookupThreePID(
+	ctx context.Context,
+	baseURL, accessToken, medium, address string,
+) (id.UserID, error) {
+	var hashDetails struct {
+		Algorithms []string `json:"algorithms"`
+		Pepper     string   `json:"lookup_pepper"`
+	}
+	if err := ic.do(ctx, http.MethodGet, baseURL, "/hash_details", accessToken, nil, &hashDetails); err != nil {
+		return "", err
+	}
+
+	var algorithm, lookup string
+	if slices.Contains(hashDetails.Algorithms, "sha256") {
+		algorithm = "sha256"
+		hash := sha256.Sum256([]byte(address + " " + medium + " " + hashDetails.Pepper))
+		lookup = base64.RawURLEncoding.EncodeToString(hash[:])
+	} else if slices.Contains(hashDetails.Algorithms, "none") {
+		algorithm = "none"
+		lookup = address + " " + medium
+	} else {
+		return "", fmt.Errorf("identity server supports no known lookup algorithms: %v", hashDetails.Algorithms)
+	}
+
+	var lookupResp struct {
+		Mappings map[string]id.UserID `json:"mappings"`
+	}
+	if err := ic.do(ctx, http.MethodPost, baseURL, "/lookup", accessToken, map[string]any{
+		"addresses": []string{lookup},
+		"algorithm": algorithm,
+		"pepper":    hashDetails.Pepper,
+	}, &lookupResp); err != nil {
+		return "", err
+	}
+	return lookupResp.Mappings[lookup], nil
+}
+
+// Store a pending invite for a third party identifier that is not yet bound,
+// the identity server will call /3pid/onbind on the users server once it is.
+// https://spec.matrix.org/v1.11/identity-service-api/#post_matrixidentityv2store-invite
+func (ic *IdentityClient) StoreInvite(
+	ctx context.Context,
+	baseURL, accessToken string,
+	req StoreInviteRequest,
+) (StoreInviteResponse, error) {
+	var resp StoreInviteResponse
+	err := ic.do(ctx, http.MethodPost, baseURL, "/store-invite", accessToken, req, &resp)
+	return resp, err
+}
@@ -0,0 +1,101 @@
+package util_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Stand-in identity server with a single bound email address
+func newTestIdentityServer(t *testing.T) *httptest.Server {
+	const pepper = "matrixrocks"
+	hash := sha256.Sum256([]byte("alice@example.com email " + pepper))
+	boundHash := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_matrix/identity/v2/hash_details", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(map[string]any{
+			"algorithms":    []string{"none", "sha256"},
+			"lookup_pepper": pepper,
+		})
+	})
+	mux.HandleFunc("POST /_matrix/identity/v2/lookup", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Addresses []string `json:"addresses"`
+			Algorithm string   `json:"algorithm"`
+			Pepper    string   `json:"pepper"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "sha256", req.Algorithm)
+		assert.Equal(t, pepper, req.Pepper)
+
+		mappings := make(map[string]string)
+		for _, address := range req.Addresses {
+			if address == boundHash {
+				mappings[address] = "@alice:example.com"
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"mappings": mappings})
+	})
+	mux.HandleFunc("POST /_matrix/identity/v2/store-invite", func(w http.ResponseWriter, r *http.Request) {
+		var req util.StoreInviteRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "bob@example.com", req.Address)
+		assert.Equal(t, id.RoomID("!room:babbleserv"), req.RoomID)
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":        "invitetoken",
+			"display_name": "b...@e...",
+			"public_keys": []map[string]string{{
+				"public_key":       "c2VjcmV0",
+				"key_validity_url": "https://identity.example.com/_matrix/identity/v2/pubkey/isvalid",
+			}},
+		})
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestIdentityClientLookupThreePID(t *testing.T) {
+	server := newTestIdentityServer(t)
+	defer server.Close()
+
+	ic := util.NewIdentityClient("test")
+
+	userID, err := ic.LookupThreePID(context.Background(), server.URL, "token", "email", "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@alice:example.com"), userID)
+
+	userID, err = ic.LookupThreePID(context.Background(), server.URL, "token", "email", "bob@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID(""), userID)
+}
+
+func TestIdentityClientStoreInvite(t *testing.T) {
+	server := newTestIdentityServer(t)
+	defer server.Close()
+
+	ic := util.NewIdentityClient("test")
+
+	resp, err := ic.StoreInvite(context.Background(), server.URL, "token", util.StoreInviteRequest{
+		Address: "bob@example.com",
+		Medium:  "email",
+		RoomID:  id.RoomID("!room:babbleserv"),
+		Sender:  id.UserID("@alice:babbleserv"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "invitetoken", resp.Token)
+	assert.Equal(t, "b...@e...", resp.DisplayName)
+	require.Len(t, resp.PublicKeys, 1)
+	assert.Equal(t, []byte("secret"), []byte(resp.PublicKeys[0].PublicKey))
+}
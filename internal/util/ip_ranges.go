@@ -0,0 +1,44 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Returns a dialer that refuses to connect to addresses the filter denies. The
+// address is checked after DNS resolution, so hostnames resolving to a denied
+// address are also refused.
+func NewIPRangeFilteredDialer(filter *types.IPRangeFilter) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			} else if !filter.IsAllowed(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", types.ErrIPRangeDenied, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+}
+
+// Returns an HTTP transport that only connects to addresses the filter allows,
+// or the default transport if the filter is nil. Proxies are not used as they
+// would bypass the filter.
+func NewIPRangeFilteredTransport(filter *types.IPRangeFilter) http.RoundTripper {
+	if filter == nil {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = NewIPRangeFilteredDialer(filter).DialContext
+	return transport
+}
@@ -0,0 +1,268 @@
+package util
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Media storage holds media content by key, metadata lives in the database.
+// Get returns types.ErrMediaNotFound for missing keys.
+type MediaStorage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Filesystem media storage
+//
+
+type FileMediaStorage struct {
+	basePath string
+}
+
+func NewFileMediaStorage(basePath string) (*FileMediaStorage, error) {
+	if err := os.MkdirAll(basePath, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMediaStorage{basePath}, nil
+}
+
+func (s *FileMediaStorage) path(key string) string {
+	return filepath.Join(s.basePath, filepath.FromSlash(key))
+}
+
+func (s *FileMediaStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename so readers never see partial files
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *FileMediaStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, types.ErrMediaNotFound
+	}
+	return f, err
+}
+
+func (s *FileMediaStorage) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// S3 compatible media storage, requests are signed with AWS signature V4.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+//
+
+type S3MediaStorageOptions struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Use path style (endpoint/bucket/key) rather than virtual host style
+	// (bucket.endpoint/key) URLs, required by most self hosted S3 servers.
+	PathStyle bool
+}
+
+type S3MediaStorage struct {
+	client  *http.Client
+	options S3MediaStorageOptions
+	baseURL *url.URL
+}
+
+func NewS3MediaStorage(options S3MediaStorageOptions) (*S3MediaStorage, error) {
+	baseURL, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, err
+	} else if baseURL.Scheme == "" || baseURL.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %s", options.Endpoint)
+	}
+	if options.PathStyle {
+		baseURL.Path = "/" + options.Bucket
+	} else {
+		baseURL.Host = options.Bucket + "." + baseURL.Host
+		baseURL.Path = ""
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+
+	return &S3MediaStorage{
+		client:  &http.Client{Timeout: 5 * time.Minute},
+		options: options,
+		baseURL: baseURL,
+	}, nil
+}
+
+func (s *S3MediaStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3MediaStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *S3MediaStorage) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if errors.Is(err, types.ErrMediaNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *S3MediaStorage) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	reqURL := *s.baseURL
+	reqURL.Path += "/" + key
+	reqURL.RawPath = s3EscapePath(reqURL.Path)
+	return http.NewRequestWithContext(ctx, method, reqURL.String(), body)
+}
+
+func (s *S3MediaStorage) do(req *http.Request) (*http.Response, error) {
+	SignS3Request(req, s.options.Region, s.options.AccessKeyID, s.options.SecretAccessKey, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, types.ErrMediaNotFound
+	} else if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("S3 returned status %d: %s", res.StatusCode, body)
+	}
+	return res, nil
+}
+
+const s3PayloadUnsigned = "UNSIGNED-PAYLOAD"
+
+// Sign a request to S3 with AWS signature V4, the payload is left unsigned so
+// media can be streamed rather than hashed up front.
+func SignS3Request(req *http.Request, region, accessKeyID, secretAccessKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3PayloadUnsigned)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + s3PayloadUnsigned,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		s3PayloadUnsigned,
+	}, "\n")
+
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Escape a path as S3 expects in canonical requests: each segment URI encoded
+// with only unreserved characters left as is.
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		var b strings.Builder
+		for _, c := range []byte(segment) {
+			if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+				c == '-' || c == '_' || c == '.' || c == '~' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,114 @@
+package util_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Stand-in S3 server storing objects in memory, checking requests are signed
+func newTestS3Server(t *testing.T, bucket string) *httptest.Server {
+	var lock sync.Mutex
+	objects := make(map[string][]byte)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") ||
+			!strings.Contains(auth, "/test-region/s3/aws4_request") ||
+			r.Header.Get("X-Amz-Date") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		key, found := strings.CutPrefix(r.URL.Path, "/"+bucket+"/")
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch r.Method {
+		case http.MethodPut:
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(b)), r.ContentLength)
+			objects[key] = b
+		case http.MethodGet:
+			b, found := objects[key]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(b)
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func testMediaStorage(t *testing.T, storage util.MediaStorage) {
+	ctx := context.Background()
+	key := types.MediaStorageKey("abcdef0123")
+
+	_, err := storage.Get(ctx, key)
+	assert.ErrorIs(t, err, types.ErrMediaNotFound)
+
+	content := "hello media"
+	require.NoError(t, storage.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain"))
+
+	r, err := storage.Get(ctx, key)
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, string(b))
+
+	require.NoError(t, storage.Delete(ctx, key))
+	_, err = storage.Get(ctx, key)
+	assert.ErrorIs(t, err, types.ErrMediaNotFound)
+
+	// Deleting missing content is not an error
+	assert.NoError(t, storage.Delete(ctx, key))
+}
+
+func TestFileMediaStorage(t *testing.T) {
+	storage, err := util.NewFileMediaStorage(t.TempDir())
+	require.NoError(t, err)
+	testMediaStorage(t, storage)
+}
+
+func TestS3MediaStorage(t *testing.T) {
+	server := newTestS3Server(t, "media")
+	defer server.Close()
+
+	storage, err := util.NewS3MediaStorage(util.S3MediaStorageOptions{
+		Endpoint:        server.URL,
+		Region:          "test-region",
+		Bucket:          "media",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	})
+	require.NoError(t, err)
+	testMediaStorage(t, storage)
+}
+
+func TestMediaContentDisposition(t *testing.T) {
+	assert.Equal(t, `inline; filename=cat.png`, util.MediaContentDisposition("image/png", "cat.png"))
+	assert.Equal(t, `attachment; filename=page.html`, util.MediaContentDisposition("text/html", "page.html"))
+	assert.Equal(t, `attachment`, util.MediaContentDisposition("image/svg+xml", ""))
+	assert.Equal(t, `inline; filename="my cat.jpg"`, util.MediaContentDisposition("image/jpeg; charset=binary", "my cat.jpg"))
+}
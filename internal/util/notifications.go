@@ -0,0 +1,36 @@
+package util
+
+import (
+	"errors"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+var errInvalidNotificationsToken = errors.New("invalid notifications token")
+
+// Pagination tokens for the notifications endpoint are the version to continue
+// before.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv3notifications
+func EncodeNotificationsToken(version tuple.Versionstamp) string {
+	return Base64EncodeURLSafe(types.ValueForVersionstamp(version))
+}
+
+func DecodeNotificationsToken(token string) (tuple.Versionstamp, error) {
+	b, err := Base64DecodeURLSafe(token)
+	if err != nil {
+		return types.ZeroVersionstamp, err
+	}
+	tup, err := tuple.Unpack(b)
+	if err != nil {
+		return types.ZeroVersionstamp, err
+	} else if len(tup) != 1 {
+		return types.ZeroVersionstamp, errInvalidNotificationsToken
+	}
+	version, ok := tup[0].(tuple.Versionstamp)
+	if !ok || version == types.ZeroVersionstamp {
+		return types.ZeroVersionstamp, errInvalidNotificationsToken
+	}
+	return version, nil
+}
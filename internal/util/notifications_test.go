@@ -0,0 +1,34 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func TestNotificationsToken(t *testing.T) {
+	version := tuple.Versionstamp{
+		TransactionVersion: [10]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 2},
+		UserVersion:        3,
+	}
+	token := util.EncodeNotificationsToken(version)
+	decoded, err := util.DecodeNotificationsToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, version, decoded)
+
+	// Tokens must be a single non-zero version
+	for _, token := range []string{
+		"not base64!",
+		util.Base64EncodeURLSafe([]byte("garbage")),
+		util.Base64EncodeURLSafe(tuple.Tuple{"version"}.Pack()),
+		util.Base64EncodeURLSafe(tuple.Tuple{version, version}.Pack()),
+		util.EncodeNotificationsToken(tuple.Versionstamp{}),
+	} {
+		_, err := util.DecodeNotificationsToken(token)
+		assert.Error(t, err, token)
+	}
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+// Minimal client for sending notifications to push gateways, the gateway URL
+// comes from each pusher's data so connections are restricted to addresses the
+// gateway IP filter allows, if set.
+// https://spec.matrix.org/v1.11/push-gateway-api/
+type PushGatewayClient struct {
+	client    *http.Client
+	userAgent string
+}
+
+func NewPushGatewayClient(userAgent string, gatewayIPs *types.IPRangeFilter) *PushGatewayClient {
+	return &PushGatewayClient{
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: NewIPRangeFilteredTransport(gatewayIPs),
+		},
+		userAgent: userAgent,
+	}
+}
+
+// Send a notification to a push gateway, returning any pushkeys the gateway
+// rejected which should no longer be used.
+// https://spec.matrix.org/v1.11/push-gateway-api/#post_matrixpushv1notify
+func (pc *PushGatewayClient) Notify(
+	ctx context.Context,
+	url string,
+	notification *types.PushGatewayNotification,
+) ([]string, error) {
+	var reqBody bytes.Buffer
+	if err := json.NewEncoder(&reqBody).Encode(map[string]any{
+		"notification": notification,
+	}); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", pc.userAgent)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := pc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("push gateway returned status %d", res.StatusCode)
+	}
+
+	var resp struct {
+		Rejected []string `json:"rejected"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp.Rejected, nil
+}
@@ -0,0 +1,165 @@
+package util_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/pushrules"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Stand-in push gateway that records notifications and rejects one pushkey
+func newTestPushGateway(t *testing.T, notifications *[]map[string]any) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+types.PushGatewayNotifyPath, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Notification map[string]any `json:"notification"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		*notifications = append(*notifications, req.Notification)
+
+		rejected := []string{}
+		for _, device := range req.Notification["devices"].([]any) {
+			if pushKey := device.(map[string]any)["pushkey"].(string); pushKey == "expired" {
+				rejected = append(rejected, pushKey)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"rejected": rejected})
+	})
+	return httptest.NewServer(mux)
+}
+
+func makeTestPusherAndEvent(url, pushKey, format string) (*types.Pusher, *types.Event) {
+	pusher := &types.Pusher{
+		UserID:    "@alice:babbleserv",
+		Kind:      types.PusherKindHTTP,
+		AppID:     "com.example.app",
+		PushKey:   pushKey,
+		PushKeyTS: 1700000000,
+		Data:      map[string]any{"url": url, "format": format, "custom": "value"},
+	}
+	ev := &types.Event{
+		PartialEvent: *types.NewPartialEvent("!room:babbleserv", event.EventMessage, nil, "@bob:babbleserv", map[string]any{
+			"msgtype": "m.text",
+			"body":    "hello",
+		}),
+		ID: "$event",
+	}
+	return pusher, ev
+}
+
+func TestPushGatewayClientNotify(t *testing.T) {
+	var notifications []map[string]any
+	server := newTestPushGateway(t, &notifications)
+	defer server.Close()
+
+	pc := util.NewPushGatewayClient("test", nil)
+	url := server.URL + types.PushGatewayNotifyPath
+	actions := pushrules.PushActionArray{
+		{Action: pushrules.ActionNotify},
+		{Action: pushrules.ActionSetTweak, Tweak: pushrules.TweakSound, Value: "default"},
+		{Action: pushrules.ActionSetTweak, Tweak: pushrules.TweakHighlight},
+	}
+
+	// Full format includes the event
+	pusher, ev := makeTestPusherAndEvent(url, "token", "")
+	require.NoError(t, types.ValidatePusher(context.Background(), pusher, nil))
+	rejected, err := pc.Notify(context.Background(), pusher.URL(),
+		types.NewPushGatewayNotification(pusher, ev, actions, "Room", "Bob", 3))
+	require.NoError(t, err)
+	assert.Empty(t, rejected)
+
+	require.Len(t, notifications, 1)
+	notification := notifications[0]
+	assert.Equal(t, "$event", notification["event_id"])
+	assert.Equal(t, "m.room.message", notification["type"])
+	assert.Equal(t, "Room", notification["room_name"])
+	assert.Equal(t, "Bob", notification["sender_display_name"])
+	assert.Equal(t, "high", notification["prio"])
+	assert.Equal(t, "hello", notification["content"].(map[string]any)["body"])
+	assert.Equal(t, float64(3), notification["counts"].(map[string]any)["unread"])
+
+	device := notification["devices"].([]any)[0].(map[string]any)
+	assert.Equal(t, "token", device["pushkey"])
+	assert.Equal(t, float64(1700000000), device["pushkey_ts"])
+	assert.Equal(t, map[string]any{"format": "", "custom": "value"}, device["data"])
+	assert.Equal(t, map[string]any{"sound": "default", "highlight": true}, device["tweaks"])
+
+	// Event ID only format excludes event details
+	pusher, ev = makeTestPusherAndEvent(url, "token", types.PusherFormatEventIDOnly)
+	_, err = pc.Notify(context.Background(), pusher.URL(),
+		types.NewPushGatewayNotification(pusher, ev, actions, "Room", "Bob", 3))
+	require.NoError(t, err)
+
+	require.Len(t, notifications, 2)
+	notification = notifications[1]
+	assert.Equal(t, "$event", notification["event_id"])
+	assert.Equal(t, "!room:babbleserv", notification["room_id"])
+	assert.NotContains(t, notification, "type")
+	assert.NotContains(t, notification, "sender")
+	assert.NotContains(t, notification, "content")
+	assert.NotContains(t, notification, "room_name")
+
+	// Rejected pushkeys are returned
+	pusher, ev = makeTestPusherAndEvent(url, "expired", "")
+	rejected, err = pc.Notify(context.Background(), pusher.URL(),
+		types.NewPushGatewayNotification(pusher, ev, actions, "", "", 0))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"expired"}, rejected)
+
+	// Gateway errors fail the request
+	_, err = pc.Notify(context.Background(), server.URL+"/_matrix/push/v1/missing",
+		types.NewPushGatewayNotification(pusher, ev, actions, "", "", 0))
+	assert.Error(t, err)
+}
+
+func TestValidatePusher(t *testing.T) {
+	ctx := context.Background()
+	pusher, _ := makeTestPusherAndEvent("http://localhost:5000"+types.PushGatewayNotifyPath, "token", "")
+	assert.NoError(t, types.ValidatePusher(ctx, pusher, nil))
+
+	pusher.Data["format"] = "full"
+	assert.ErrorIs(t, types.ValidatePusher(ctx, pusher, nil), types.ErrPusherInvalid)
+
+	pusher, _ = makeTestPusherAndEvent("https://push.example.com/notify", "token", "")
+	assert.ErrorIs(t, types.ValidatePusher(ctx, pusher, nil), types.ErrPusherInvalid)
+
+	pusher, _ = makeTestPusherAndEvent("/_matrix/push/v1/notify", "token", "")
+	assert.ErrorIs(t, types.ValidatePusher(ctx, pusher, nil), types.ErrPusherInvalid)
+
+	pusher, _ = makeTestPusherAndEvent("http://localhost"+types.PushGatewayNotifyPath, "", "")
+	assert.ErrorIs(t, types.ValidatePusher(ctx, pusher, nil), types.ErrPusherInvalid)
+}
+
+func TestPushGatewayIPRanges(t *testing.T) {
+	var notifications []map[string]any
+	server := newTestPushGateway(t, &notifications)
+	defer server.Close()
+
+	ctx := context.Background()
+	url := server.URL + types.PushGatewayNotifyPath
+	pusher, ev := makeTestPusherAndEvent(url, "token", "")
+	notification := types.NewPushGatewayNotification(pusher, ev, nil, "", "", 0)
+
+	// Loopback gateways are denied
+	denyLoopback := types.MustNewIPRangeFilter(nil, []string{"127.0.0.0/8", "::1/128"})
+	assert.ErrorIs(t, types.ValidatePusher(ctx, pusher, denyLoopback), types.ErrPusherInvalid)
+	_, err := util.NewPushGatewayClient("test", denyLoopback).Notify(ctx, pusher.URL(), notification)
+	assert.ErrorIs(t, err, types.ErrIPRangeDenied)
+	assert.Empty(t, notifications)
+
+	// Unless explicitly allowed
+	allowLoopback := types.MustNewIPRangeFilter([]string{"127.0.0.1/32"}, []string{"127.0.0.0/8", "::1/128"})
+	assert.NoError(t, types.ValidatePusher(ctx, pusher, allowLoopback))
+	_, err = util.NewPushGatewayClient("test", allowLoopback).Notify(ctx, pusher.URL(), notification)
+	assert.NoError(t, err)
+	assert.Len(t, notifications, 1)
+}
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"github.com/go-chi/chi/v5"
@@ -48,6 +49,16 @@ func EventIDFromRequestURLParam(r *http.Request, field string) id.EventID {
 	}
 }
 
+func RoomAliasFromRequestURLParam(r *http.Request, field string) id.RoomAlias {
+	p := chi.URLParam(r, field)
+
+	if parsed, err := url.PathUnescape(p); err != nil {
+		return id.RoomAlias("")
+	} else {
+		return id.RoomAlias(parsed)
+	}
+}
+
 func IntFromRequestQuery(r *http.Request, field string, def int) (int, error) {
 	str := r.URL.Query().Get(field)
 	if str == "" {
@@ -56,6 +67,38 @@ func IntFromRequestQuery(r *http.Request, field string, def int) (int, error) {
 	return strconv.Atoi(str)
 }
 
+const (
+	defaultMediaStallTimeout = 20 * time.Second
+	maxMediaStallTimeout     = 60 * time.Second
+)
+
+// How long to wait for media that has not been uploaded yet
+func MediaStallTimeoutFromRequest(r *http.Request) (time.Duration, error) {
+	timeoutMS, err := IntFromRequestQuery(r, "timeout_ms", int(defaultMediaStallTimeout.Milliseconds()))
+	if err != nil || timeoutMS < 0 {
+		return 0, errors.New("invalid timeout_ms")
+	}
+	return min(time.Duration(timeoutMS)*time.Millisecond, maxMediaStallTimeout), nil
+}
+
+func ThumbnailParamsFromRequest(r *http.Request) (int, int, string, error) {
+	width, err := IntFromRequestQuery(r, "width", 0)
+	if err != nil || width < 1 {
+		return 0, 0, "", errors.New("invalid width")
+	}
+	height, err := IntFromRequestQuery(r, "height", 0)
+	if err != nil || height < 1 {
+		return 0, 0, "", errors.New("invalid height")
+	}
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		method = types.ThumbnailMethodScale
+	} else if method != types.ThumbnailMethodScale && method != types.ThumbnailMethodCrop {
+		return 0, 0, "", errors.New("invalid method")
+	}
+	return width, height, method, nil
+}
+
 func VersionMapFromRequestQuery(r *http.Request, field types.VersionKey) (types.VersionMap, error) {
 	parts := strings.Split(r.URL.Query().Get(string(field)), ".")
 	versions := make(types.VersionMap, 3) // we currently have 3 known versions (above)
@@ -165,3 +208,20 @@ func VerifyFederatonRequest(
 
 	return string(origin), nil
 }
+
+// Parse the timestamp (unix millis) and direction query of timestamp_to_event
+// requests, returning whether the direction is forwards.
+func TimestampToEventQueryFromRequest(r *http.Request) (int64, bool, error) {
+	ts, err := strconv.ParseInt(r.URL.Query().Get("ts"), 10, 64)
+	if err != nil {
+		return 0, false, errors.New("invalid ts")
+	}
+	switch r.URL.Query().Get("dir") {
+	case "f":
+		return ts, true, nil
+	case "b":
+		return ts, false, nil
+	default:
+		return 0, false, errors.New("invalid dir")
+	}
+}
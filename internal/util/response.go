@@ -2,12 +2,18 @@ package util
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
 
 	"github.com/matrix-org/gomatrix"
 	"github.com/rs/zerolog/hlog"
 	"maunium.net/go/mautrix"
+
+	"github.com/beeper/babbleserv/internal/types"
 )
 
 var (
@@ -23,6 +29,24 @@ var (
 	MUnauthorized = mautrix.RespError{
 		ErrCode: "M_UNAUTHORIZED",
 	}
+	MUnableToAuthoriseJoin = mautrix.RespError{
+		ErrCode: "M_UNABLE_TO_AUTHORISE_JOIN",
+	}
+	MUnableToGrantJoin = mautrix.RespError{
+		ErrCode: "M_UNABLE_TO_GRANT_JOIN",
+	}
+	MProfileTooLarge = mautrix.RespError{
+		ErrCode: "M_PROFILE_TOO_LARGE",
+	}
+	MKeyTooLarge = mautrix.RespError{
+		ErrCode: "M_KEY_TOO_LARGE",
+	}
+	MCannotOverwriteMedia = mautrix.RespError{
+		ErrCode: "M_CANNOT_OVERWRITE_MEDIA",
+	}
+	MNotYetUploaded = mautrix.RespError{
+		ErrCode: "M_NOT_YET_UPLOADED",
+	}
 )
 
 type errorMeta struct {
@@ -31,8 +55,15 @@ type errorMeta struct {
 }
 
 var errorToMeta = map[string]errorMeta{
-	mautrix.MNotJSON.ErrCode:      {400, "Request body is not valid JSON"},
-	mautrix.MInvalidParam.ErrCode: {400, ""},
+	mautrix.MNotJSON.ErrCode:                 {400, "Request body is not valid JSON"},
+	mautrix.MInvalidParam.ErrCode:            {400, ""},
+	mautrix.MBadJSON.ErrCode:                 {400, ""},
+	mautrix.MIncompatibleRoomVersion.ErrCode: {400, "Room version not supported"},
+	mautrix.MUnsupportedRoomVersion.ErrCode:  {400, "Room version not supported"},
+	MUnableToAuthoriseJoin.ErrCode:           {400, "Unable to authorise join"},
+	MUnableToGrantJoin.ErrCode:               {400, "Unable to grant join"},
+	MProfileTooLarge.ErrCode:                 {400, "Profile is too large"},
+	MKeyTooLarge.ErrCode:                     {400, "Profile key is too large"},
 
 	mautrix.MMissingToken.ErrCode: {401, ""},
 	mautrix.MUnknownToken.ErrCode: {401, ""},
@@ -42,7 +73,14 @@ var errorToMeta = map[string]errorMeta{
 	mautrix.MNotFound.ErrCode: {404, "Nothing found here"},
 	MMethodNotAllowed.ErrCode: {405, "Wrong HTTP method"},
 
-	MUnknown.ErrCode: {500, "An unknown error occurred"},
+	MCannotOverwriteMedia.ErrCode:  {409, "Media has already been uploaded"},
+	mautrix.MRoomInUse.ErrCode:     {409, "Room alias already exists"},
+	mautrix.MTooLarge.ErrCode:      {413, "Request is too large"},
+	mautrix.MLimitExceeded.ErrCode: {429, "Too many requests"},
+
+	MUnknown.ErrCode:        {500, "An unknown error occurred"},
+	MNotImplemented.ErrCode: {501, "Not implemented"},
+	MNotYetUploaded.ErrCode: {504, "Media has not been uploaded yet"},
 }
 
 var EmptyJSON struct{}
@@ -67,6 +105,28 @@ func ResponseErrorUnknownJSON(w http.ResponseWriter, r *http.Request, err error)
 	ResponseErrorJSON(w, r, MUnknown)
 }
 
+// Respond with the Matrix error for a media error
+func ResponseMediaErrorJSON(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, types.ErrMediaNotFound):
+		ResponseErrorMessageJSON(w, r, mautrix.MNotFound, "Media not found")
+	case errors.Is(err, types.ErrMediaTooLarge):
+		ResponseErrorMessageJSON(w, r, mautrix.MTooLarge, "Media is too large")
+	case errors.Is(err, types.ErrMediaQuotaExceeded), errors.Is(err, types.ErrMediaNotOwner):
+		ResponseErrorMessageJSON(w, r, mautrix.MForbidden, err.Error())
+	case errors.Is(err, types.ErrMediaTooManyPending):
+		ResponseErrorMessageJSON(w, r, mautrix.MLimitExceeded, err.Error())
+	case errors.Is(err, types.ErrMediaAlreadyUploaded):
+		ResponseErrorJSON(w, r, MCannotOverwriteMedia)
+	case errors.Is(err, types.ErrMediaNotYetUploaded):
+		ResponseErrorJSON(w, r, MNotYetUploaded)
+	case errors.Is(err, types.ErrMediaNotThumbnailable), errors.Is(err, types.ErrMediaThumbnailMethodUnavailable):
+		ResponseErrorMessageJSON(w, r, mautrix.MInvalidParam, err.Error())
+	default:
+		ResponseErrorUnknownJSON(w, r, err)
+	}
+}
+
 func ResponseErrorJSON(w http.ResponseWriter, r *http.Request, error mautrix.RespError) {
 	ResponseErrorMessageJSON(w, r, error, "")
 }
@@ -103,6 +163,53 @@ func ResponseRawJSON(w http.ResponseWriter, r *http.Request, statusCode int, dat
 	w.Write(data)
 }
 
+// Media types safe to display inline, anything else is served as an attachment
+// https://spec.matrix.org/v1.11/client-server-api/#serving-inline-content
+var inlineMediaTypes = map[string]struct{}{
+	"text/css": {}, "text/plain": {}, "text/csv": {},
+	"application/json": {}, "application/ld+json": {},
+	"image/jpeg": {}, "image/gif": {}, "image/png": {}, "image/apng": {}, "image/webp": {}, "image/avif": {},
+	"video/mp4": {}, "video/webm": {}, "video/ogg": {}, "video/quicktime": {},
+	"audio/mp4": {}, "audio/webm": {}, "audio/aac": {}, "audio/mpeg": {}, "audio/ogg": {},
+	"audio/wave": {}, "audio/wav": {}, "audio/x-wav": {}, "audio/x-pn-wav": {}, "audio/flac": {}, "audio/x-flac": {},
+}
+
+func MediaContentDisposition(contentType, fileName string) string {
+	disposition := "attachment"
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if _, found := inlineMediaTypes[mediaType]; found {
+			disposition = "inline"
+		}
+	}
+	if fileName == "" {
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": fileName})
+}
+
+// Stream media content with headers to stop browsers executing it
+// https://spec.matrix.org/v1.11/client-server-api/#security-considerations-5
+func ResponseMedia(
+	w http.ResponseWriter,
+	r *http.Request,
+	contentType, fileName string,
+	size int64,
+	content io.Reader,
+) {
+	addCORSHeaders(w)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", MediaContentDisposition(contentType, fileName))
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; script-src 'none'; plugin-types application/pdf; style-src 'unsafe-inline'; media-src 'self'; object-src 'self';")
+	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := io.Copy(w, content); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to write media response")
+	}
+}
+
 func addCORSHeaders(w http.ResponseWriter) {
 	// Recommended CORS headers can be found in https://spec.matrix.org/v1.3/client-server-api/#web-browser-clients
 	w.Header().Set("Access-Control-Allow-Origin", "*")
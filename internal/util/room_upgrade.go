@@ -0,0 +1,81 @@
+package util
+
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Build the create event content for the replacement room of an upgrade, the
+// room type and federation flag are kept from the old room.
+func RoomUpgradeCreateContent(
+	oldCreateContent map[string]any,
+	sender id.UserID,
+	newVersion string,
+	oldRoomID id.RoomID,
+	lastEventID id.EventID,
+) map[string]any {
+	createContent := map[string]any{
+		"creator":      sender,
+		"room_version": newVersion,
+		"predecessor": map[string]any{
+			"room_id":  oldRoomID,
+			"event_id": lastEventID,
+		},
+	}
+	for _, key := range []string{"type", "m.federate"} {
+		if value, found := oldCreateContent[key]; found {
+			createContent[key] = value
+		}
+	}
+	return createContent
+}
+
+// The upgrading user may not have the power to send all the state copied to
+// the new room, returns power levels content with them raised to the highest
+// level needed for state events, or nil if they already have it.
+func RoomUpgradeRaisedPowerLevels(powerLevelsContent map[string]any, sender id.UserID) (map[string]any, error) {
+	var powerLevels event.PowerLevelsEventContent
+	plBytes, _ := json.Marshal(powerLevelsContent)
+	if err := json.Unmarshal(plBytes, &powerLevels); err != nil {
+		return nil, err
+	}
+	neededLevel := powerLevels.StateDefault()
+	for _, level := range powerLevels.Events {
+		neededLevel = max(neededLevel, level)
+	}
+	if powerLevels.GetUserLevel(sender) >= neededLevel {
+		return nil, nil
+	}
+
+	raisedContent := make(map[string]any, len(powerLevelsContent))
+	for key, value := range powerLevelsContent {
+		raisedContent[key] = value
+	}
+	users := make(map[string]any)
+	if existingUsers, ok := powerLevelsContent["users"].(map[string]any); ok {
+		for userID, level := range existingUsers {
+			users[userID] = level
+		}
+	}
+	users[sender.String()] = neededLevel
+	raisedContent["users"] = users
+	return raisedContent, nil
+}
+
+// Restrict the old room of an upgrade so only moderators (or users above the
+// default level) can talk or invite.
+func RoomUpgradeRestrictedPowerLevels(powerLevelsContent map[string]any) map[string]any {
+	plBytes, _ := json.Marshal(powerLevelsContent)
+	restrictedLevel := max(50, int(gjson.GetBytes(plBytes, "users_default").Int())+1)
+
+	restrictedContent := make(map[string]any, len(powerLevelsContent)+2)
+	for key, value := range powerLevelsContent {
+		restrictedContent[key] = value
+	}
+	restrictedContent["events_default"] = restrictedLevel
+	restrictedContent["invite"] = restrictedLevel
+	return restrictedContent
+}
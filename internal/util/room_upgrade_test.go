@@ -0,0 +1,63 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func TestRoomUpgradeCreateContent(t *testing.T) {
+	content := util.RoomUpgradeCreateContent(
+		map[string]any{"type": "m.space", "m.federate": false, "creator": "@old:example.com"},
+		"@alice:example.com",
+		"11",
+		"!old:example.com",
+		"$last",
+	)
+	assert.Equal(t, map[string]any{
+		"creator":      id.UserID("@alice:example.com"),
+		"room_version": "11",
+		"predecessor": map[string]any{
+			"room_id":  id.RoomID("!old:example.com"),
+			"event_id": id.EventID("$last"),
+		},
+		"type":       "m.space",
+		"m.federate": false,
+	}, content)
+}
+
+func TestRoomUpgradeRaisedPowerLevels(t *testing.T) {
+	content := map[string]any{
+		"users":         map[string]any{"@alice:example.com": 50, "@bob:example.com": 100},
+		"state_default": 50,
+		"events":        map[string]any{"m.room.tombstone": 100},
+	}
+
+	raised, err := util.RoomUpgradeRaisedPowerLevels(content, "@alice:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"@alice:example.com": 100,
+		"@bob:example.com":   100,
+	}, raised["users"])
+	// The original content is untouched, it's restored after copying state
+	assert.Equal(t, 50, content["users"].(map[string]any)["@alice:example.com"])
+
+	// Already at the highest level
+	raised, err = util.RoomUpgradeRaisedPowerLevels(content, "@bob:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, raised)
+}
+
+func TestRoomUpgradeRestrictedPowerLevels(t *testing.T) {
+	restricted := util.RoomUpgradeRestrictedPowerLevels(map[string]any{"users_default": 0})
+	assert.Equal(t, 50, restricted["events_default"])
+	assert.Equal(t, 50, restricted["invite"])
+
+	restricted = util.RoomUpgradeRestrictedPowerLevels(map[string]any{"users_default": 60})
+	assert.Equal(t, 61, restricted["events_default"])
+	assert.Equal(t, 61, restricted["invite"])
+}
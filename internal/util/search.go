@@ -0,0 +1,31 @@
+package util
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Terms longer than this are ignored, they're unlikely to be searched for and
+// would bloat the index keys.
+const maxSearchTermLength = 64
+
+// Split text into unique lowercase search terms on anything that isn't a
+// letter or number, preserving the order terms first appear.
+func TokenizeSearchText(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	seen := make(map[string]struct{}, len(fields))
+	terms := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if len(field) > maxSearchTermLength {
+			continue
+		} else if _, found := seen[field]; found {
+			continue
+		}
+		seen[field] = struct{}{}
+		terms = append(terms, field)
+	}
+	return terms
+}
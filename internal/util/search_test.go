@@ -0,0 +1,22 @@
+package util_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+func TestTokenizeSearchText(t *testing.T) {
+	assert.Equal(t, []string{}, util.TokenizeSearchText(""))
+	assert.Equal(t, []string{}, util.TokenizeSearchText("  !?  "))
+	assert.Equal(
+		t,
+		[]string{"hello", "world", "it", "s", "2024"},
+		util.TokenizeSearchText("Hello, World! It's hello 2024..."),
+	)
+	assert.Equal(t, []string{"héllo", "日本語"}, util.TokenizeSearchText("HÉLLO 日本語"))
+	assert.Equal(t, []string{"short"}, util.TokenizeSearchText("short "+strings.Repeat("a", 65)))
+}
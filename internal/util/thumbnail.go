@@ -0,0 +1,182 @@
+package util
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"mime"
+
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+const thumbnailJPEGQuality = 80
+
+var thumbnailableContentTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/gif":  {},
+}
+
+func IsThumbnailableContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	_, found := thumbnailableContentTypes[mediaType]
+	return found
+}
+
+type Thumbnail struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// Generate a thumbnail no larger than width x height. The scale method fits
+// the whole image within the bounds, crop fills the bounds exactly, cropping
+// the center of the image. Images are never upscaled. Images over maxPixels
+// are rejected before decoding to avoid decompression bombs.
+// https://spec.matrix.org/v1.11/client-server-api/#thumbnails
+func GenerateThumbnail(src []byte, width, height int, method string, maxPixels int64) (*Thumbnail, error) {
+	if width < 1 || height < 1 {
+		return nil, types.ErrMediaNotThumbnailable
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, types.ErrMediaNotThumbnailable
+	} else if cfg.Width < 1 || cfg.Height < 1 || int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return nil, types.ErrMediaNotThumbnailable
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, types.ErrMediaNotThumbnailable
+	}
+
+	var thumb *image.RGBA
+	switch method {
+	case types.ThumbnailMethodCrop:
+		thumb = cropImage(img, width, height)
+	case types.ThumbnailMethodScale:
+		thumb = scaleImage(img, width, height)
+	default:
+		return nil, types.ErrMediaNotThumbnailable
+	}
+
+	var buf bytes.Buffer
+	res := &Thumbnail{Width: thumb.Rect.Dx(), Height: thumb.Rect.Dy()}
+	// Keep transparency for formats that may have it
+	if format == "jpeg" {
+		res.ContentType = "image/jpeg"
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		res.ContentType = "image/png"
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Data = buf.Bytes()
+	return res, nil
+}
+
+func scaleImage(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	scale := math.Min(1, math.Min(
+		float64(width)/float64(bounds.Dx()),
+		float64(height)/float64(bounds.Dy()),
+	))
+	return resizeImage(img, bounds,
+		max(1, int(math.Round(float64(bounds.Dx())*scale))),
+		max(1, int(math.Round(float64(bounds.Dy())*scale))),
+	)
+}
+
+func cropImage(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	scale := math.Min(1, math.Max(
+		float64(width)/float64(bounds.Dx()),
+		float64(height)/float64(bounds.Dy()),
+	))
+	width = min(width, bounds.Dx())
+	height = min(height, bounds.Dy())
+
+	// Take the largest centered region of the source matching the output
+	cropWidth := min(bounds.Dx(), int(math.Round(float64(width)/scale)))
+	cropHeight := min(bounds.Dy(), int(math.Round(float64(height)/scale)))
+	x0 := bounds.Min.X + (bounds.Dx()-cropWidth)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-cropHeight)/2
+
+	return resizeImage(img, image.Rect(x0, y0, x0+cropWidth, y0+cropHeight), width, height)
+}
+
+// Box filter weights mapping each destination pixel to the source pixels it
+// covers, including partial coverage at the edges.
+type boxContrib struct {
+	start   int
+	weights []float64
+}
+
+func boxContribs(srcLen, dstLen int) []boxContrib {
+	scale := float64(srcLen) / float64(dstLen)
+	contribs := make([]boxContrib, dstLen)
+	for i := range contribs {
+		lo := float64(i) * scale
+		hi := lo + scale
+		start := int(lo)
+		end := min(srcLen, int(math.Ceil(hi)))
+		weights := make([]float64, 0, end-start)
+		for j := start; j < end; j++ {
+			weights = append(weights, (math.Min(hi, float64(j+1))-math.Max(lo, float64(j)))/scale)
+		}
+		contribs[i] = boxContrib{start, weights}
+	}
+	return contribs
+}
+
+// Resize a region of an image by area averaging, done in premultiplied alpha
+// so transparent pixels don't bleed color into their neighbours.
+func resizeImage(img image.Image, rect image.Rectangle, width, height int) *image.RGBA {
+	src := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(src, src.Rect, img, rect.Min, draw.Src)
+
+	// Horizontal pass into an intermediate buffer of width x source height
+	xContribs := boxContribs(rect.Dx(), width)
+	tmp := make([]float64, width*rect.Dy()*4)
+	for y := 0; y < rect.Dy(); y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, c := range xContribs {
+			out := tmp[(y*width+x)*4:]
+			for i, w := range c.weights {
+				px := row[(c.start+i)*4:]
+				for ch := 0; ch < 4; ch++ {
+					out[ch] += float64(px[ch]) * w
+				}
+			}
+		}
+	}
+
+	// Vertical pass into the destination
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	yContribs := boxContribs(rect.Dy(), height)
+	for y, c := range yContribs {
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			var sum [4]float64
+			for i, w := range c.weights {
+				px := tmp[((c.start+i)*width+x)*4:]
+				for ch := 0; ch < 4; ch++ {
+					sum[ch] += px[ch] * w
+				}
+			}
+			for ch := 0; ch < 4; ch++ {
+				row[x*4+ch] = uint8(math.Min(255, math.Round(sum[ch])))
+			}
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,103 @@
+package util_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+)
+
+// Left half red, right half blue
+func makeTestImage(t *testing.T, width, height int, format string) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if format == "png" {
+		require.NoError(t, png.Encode(&buf, img))
+	} else {
+		require.NoError(t, jpeg.Encode(&buf, img, nil))
+	}
+	return buf.Bytes()
+}
+
+func decodeTestThumbnail(t *testing.T, thumb *util.Thumbnail) image.Image {
+	img, _, err := image.Decode(bytes.NewReader(thumb.Data))
+	require.NoError(t, err)
+	assert.Equal(t, thumb.Width, img.Bounds().Dx())
+	assert.Equal(t, thumb.Height, img.Bounds().Dy())
+	return img
+}
+
+func TestGenerateThumbnailScale(t *testing.T) {
+	src := makeTestImage(t, 400, 200, "png")
+
+	thumb, err := util.GenerateThumbnail(src, 100, 100, types.ThumbnailMethodScale, 1_000_000)
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", thumb.ContentType)
+	assert.Equal(t, 100, thumb.Width)
+	assert.Equal(t, 50, thumb.Height)
+
+	img := decodeTestThumbnail(t, thumb)
+	r, _, b, _ := img.At(10, 25).RGBA()
+	assert.Equal(t, uint32(0xffff), r)
+	assert.Equal(t, uint32(0), b)
+	r, _, b, _ = img.At(90, 25).RGBA()
+	assert.Equal(t, uint32(0), r)
+	assert.Equal(t, uint32(0xffff), b)
+
+	// Images are never upscaled
+	thumb, err = util.GenerateThumbnail(src, 800, 800, types.ThumbnailMethodScale, 1_000_000)
+	require.NoError(t, err)
+	assert.Equal(t, 400, thumb.Width)
+	assert.Equal(t, 200, thumb.Height)
+}
+
+func TestGenerateThumbnailCrop(t *testing.T) {
+	src := makeTestImage(t, 400, 200, "jpeg")
+
+	thumb, err := util.GenerateThumbnail(src, 50, 50, types.ThumbnailMethodCrop, 1_000_000)
+	require.NoError(t, err)
+	assert.Equal(t, "image/jpeg", thumb.ContentType)
+	assert.Equal(t, 50, thumb.Width)
+	assert.Equal(t, 50, thumb.Height)
+	decodeTestThumbnail(t, thumb)
+
+	// Source smaller than requested in one dimension, crop without upscaling
+	thumb, err = util.GenerateThumbnail(src, 300, 300, types.ThumbnailMethodCrop, 1_000_000)
+	require.NoError(t, err)
+	assert.Equal(t, 300, thumb.Width)
+	assert.Equal(t, 200, thumb.Height)
+	decodeTestThumbnail(t, thumb)
+}
+
+func TestGenerateThumbnailErrors(t *testing.T) {
+	src := makeTestImage(t, 400, 200, "png")
+
+	_, err := util.GenerateThumbnail(src, 100, 100, types.ThumbnailMethodScale, 1000)
+	assert.ErrorIs(t, err, types.ErrMediaNotThumbnailable)
+
+	_, err = util.GenerateThumbnail([]byte("not an image"), 100, 100, types.ThumbnailMethodScale, 1_000_000)
+	assert.ErrorIs(t, err, types.ErrMediaNotThumbnailable)
+
+	_, err = util.GenerateThumbnail(src, 100, 100, "stretch", 1_000_000)
+	assert.ErrorIs(t, err, types.ErrMediaNotThumbnailable)
+
+	assert.True(t, util.IsThumbnailableContentType("image/png"))
+	assert.False(t, util.IsThumbnailableContentType("image/svg+xml"))
+}
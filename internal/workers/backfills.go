@@ -0,0 +1,112 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	backfillLockNamePrefix = "BackfillLock:"
+	backfillLockRefresh    = time.Second * 5
+	backfillLockTimeout    = time.Second * 30
+	backfillBatchSize      = 100
+	backfillRetryInterval  = time.Minute
+)
+
+// The backfiller runs each of the rooms database backfills to completion, only
+// one process runs each backfill at a time and the others wait for it to finish.
+type Backfiller struct {
+	log    zerolog.Logger
+	config config.BabbleConfig
+	db     *databases.Databases
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewBackfiller(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+) *Backfiller {
+	log := logger.With().
+		Str("worker", "Backfiller").
+		Logger()
+
+	return &Backfiller{
+		log:    log,
+		config: cfg,
+		db:     db,
+	}
+}
+
+func (b *Backfiller) Start() {
+	b.ctx, b.cancel = context.WithCancel(b.log.WithContext(context.Background()))
+	b.log.Info().Msg("Starting backfiller...")
+	b.wg.Add(1)
+	go b.backfillLoop()
+}
+
+func (b *Backfiller) Stop() {
+	b.cancel()
+	b.wg.Wait()
+	b.log.Info().Msg("Backfiller stopped")
+}
+
+func (b *Backfiller) backfillLoop() {
+	defer b.wg.Done()
+
+	for _, name := range b.db.Rooms.GetBackfillNames() {
+		for {
+			done, err := b.runBackfill(name)
+			if err != nil {
+				b.log.Err(err).Str("backfill", name).Msg("Failed to run backfill")
+			} else if done {
+				break
+			}
+
+			// Either failed or another process holds the lock, try again later
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-time.After(backfillRetryInterval):
+			}
+		}
+	}
+}
+
+func (b *Backfiller) runBackfill(name string) (bool, error) {
+	log := b.log.With().Str("backfill", name).Logger()
+
+	var done bool
+	var backfillErr error
+	if err := lock.WithLockIfAvailable(b.ctx, b.db.Rooms, backfillLockNamePrefix+name, lock.LockOptions{
+		RefreshInterval: backfillLockRefresh,
+		Timeout:         backfillLockTimeout,
+	}, func(lock lock.Lock) {
+		defer lock.Release()
+		var batches int
+		for b.ctx.Err() == nil {
+			done, backfillErr = b.db.Rooms.RunBackfillBatch(b.ctx, name, backfillBatchSize)
+			if backfillErr != nil || done {
+				break
+			}
+			batches++
+			lock.Refresh()
+		}
+		if done && batches > 0 {
+			log.Info().Int("batches", batches).Msg("Completed backfill")
+		}
+	}); err != nil {
+		return false, err
+	}
+	return done, backfillErr
+}
@@ -57,8 +57,8 @@ func NewEventsIterator(
 func (ei *EventsIterator) Start() {
 	ei.ctx, ei.cancel = context.WithCancel(ei.log.WithContext(context.Background()))
 
+	ei.wg.Add(1)
 	go func() {
-		ei.wg.Add(1)
 		defer ei.wg.Done()
 		lock.WithLock(ei.ctx, ei.db.Rooms, eventsIteratorLockName, lock.LockOptions{
 			RefreshInterval: eventsIteratorLockRefresh,
@@ -161,6 +161,12 @@ func (ei *EventsIterator) notifyFederationSenders(tups []types.EventIDTupWithVer
 		if err != nil {
 			return err
 		}
+		// Servers peeking the room receive events as if they were in it
+		peekingServers, err := ei.db.Rooms.GetRoomPeekingServers(ei.ctx, roomID)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, peekingServers...)
 		for _, server := range servers {
 			if server != ei.config.ServerName {
 				// We only care about non-local servers
@@ -0,0 +1,362 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/federator"
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	inboxRoomLockNamePrefix = "FederationInboxRoomLock:"
+	inboxRoomLockRefresh    = time.Second * 5
+	inboxRoomLockTimeout    = time.Second * 30
+	inboxRoomBatchSize      = 50
+	inboxPollInterval       = time.Second * 30
+
+	// Events failing with unexpected errors are retried with backoff and given
+	// up on (recorded in the failed inbox) after max attempts.
+	inboxMaxAttempts  = 5
+	inboxRetryInitial = time.Second * 10
+	inboxRetryMax     = time.Minute * 10
+
+	inboxPruneLockName  = "FederationInboxPruneLock"
+	inboxPruneInterval  = time.Minute * 10
+	inboxPruneBatchSize = 1000
+)
+
+// The federation inbox processes PDUs durably queued by the send transaction
+// route (when async transactions are enabled), each room is processed in order
+// under a lock. It also prunes stored transaction responses.
+type FederationInbox struct {
+	log       zerolog.Logger
+	config    config.BabbleConfig
+	db        *databases.Databases
+	notifier  *notifier.Notifier
+	federator *federator.Federator
+
+	// Internal maps + lock of rooms being processed in this process and rooms
+	// backing off after a failure
+	lock        sync.Mutex
+	activeRooms map[id.RoomID]struct{}
+	retryRooms  map[id.RoomID]time.Time
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewFederationInbox(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+	notif *notifier.Notifier,
+	federator *federator.Federator,
+) *FederationInbox {
+	log := logger.With().
+		Str("worker", "FederationInbox").
+		Logger()
+
+	return &FederationInbox{
+		log:         log,
+		config:      cfg,
+		db:          db,
+		notifier:    notif,
+		federator:   federator,
+		activeRooms: make(map[id.RoomID]struct{}),
+		retryRooms:  make(map[id.RoomID]time.Time),
+	}
+}
+
+func (fi *FederationInbox) Start() {
+	fi.ctx, fi.cancel = context.WithCancel(fi.log.WithContext(context.Background()))
+	fi.log.Info().Msg("Starting federation inbox...")
+	fi.wg.Add(2)
+	go fi.handleRoomsLoop()
+	go fi.pruneTransactionsLoop()
+}
+
+func (fi *FederationInbox) Stop() {
+	fi.cancel()
+	fi.wg.Wait()
+	fi.log.Info().Msg("Federation inbox stopped")
+}
+
+func (fi *FederationInbox) handleRoomsLoop() {
+	defer fi.wg.Done()
+
+	roomsCh := make(chan any, 1000)
+	fi.notifier.Subscribe(roomsCh, notifier.Subscription{AllRooms: true})
+	defer fi.notifier.Unsubscribe(roomsCh)
+
+	// Cold start case: handle anything waiting right away
+	fi.handleInboxRooms()
+
+	for {
+		select {
+		case <-fi.ctx.Done():
+			return
+		case change := <-roomsCh:
+			// Drain any other pending changes and wake only the changed rooms
+			roomIDs := map[id.RoomID]struct{}{change.(id.RoomID): {}}
+			for len(roomsCh) > 0 {
+				roomIDs[(<-roomsCh).(id.RoomID)] = struct{}{}
+			}
+			for roomID := range roomIDs {
+				fi.startRoom(roomID)
+			}
+		case <-time.After(inboxPollInterval):
+			fi.handleInboxRooms()
+		}
+	}
+}
+
+func (fi *FederationInbox) handleInboxRooms() {
+	roomIDs, err := fi.db.Rooms.GetInboxRoomIDs(fi.ctx)
+	if err != nil {
+		fi.log.Err(err).Msg("Failed to get inbox rooms")
+		return
+	}
+
+	for _, roomID := range roomIDs {
+		fi.startRoom(roomID)
+	}
+}
+
+// Start processing a room unless it's already being processed or is backing
+// off after a failure.
+func (fi *FederationInbox) startRoom(roomID id.RoomID) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	if _, found := fi.activeRooms[roomID]; found {
+		return
+	}
+	if retryAt, found := fi.retryRooms[roomID]; found {
+		if time.Now().Before(retryAt) {
+			return
+		}
+		delete(fi.retryRooms, roomID)
+	}
+
+	fi.activeRooms[roomID] = struct{}{}
+	fi.wg.Add(1)
+	go fi.maybeProcessRoom(roomID)
+}
+
+func (fi *FederationInbox) maybeProcessRoom(roomID id.RoomID) {
+	defer fi.wg.Done()
+	defer func() {
+		fi.lock.Lock()
+		delete(fi.activeRooms, roomID)
+		fi.lock.Unlock()
+	}()
+
+	log := fi.log.With().Stringer("room_id", roomID).Logger()
+	ctx := log.WithContext(fi.ctx)
+
+	// Room changes are notified for all events, skip rooms with nothing waiting
+	// before taking the lock.
+	if isInboxRoom, err := fi.db.Rooms.IsInboxRoom(ctx, roomID); err != nil {
+		log.Err(err).Msg("Failed to check inbox room")
+		return
+	} else if !isInboxRoom {
+		return
+	}
+
+	if err := lock.WithLockIfAvailable(ctx, fi.db.Rooms, inboxRoomLockNamePrefix+roomID.String(), lock.LockOptions{
+		RefreshInterval: inboxRoomLockRefresh,
+		Timeout:         inboxRoomLockTimeout,
+	}, func(lock lock.Lock) {
+		defer lock.Release()
+		for fi.processRoomBatch(ctx, roomID, lock) {
+		}
+	}); err != nil {
+		log.Err(err).Msg("Error acquiring inbox room lock")
+	}
+}
+
+// Process the next batch of inbox events for a room, returning true if there
+// may be more to process.
+func (fi *FederationInbox) processRoomBatch(ctx context.Context, roomID id.RoomID, lock lock.Lock) bool {
+	log := zerolog.Ctx(ctx)
+	lock.Refresh()
+
+	inboxEvs, err := fi.db.Rooms.GetRoomInboxEvents(ctx, roomID, inboxRoomBatchSize)
+	if err != nil {
+		log.Err(err).Msg("Failed to get room inbox events")
+		return false
+	} else if len(inboxEvs) == 0 {
+		return false
+	}
+
+	res := processInboxBatch(inboxEvs, inboxMaxAttempts, func(group []rooms.InboxEvent) error {
+		return fi.processEvents(ctx, group)
+	})
+
+	if len(res.processed) > 0 {
+		lastVersion := res.processed[len(res.processed)-1].Version
+		if err := fi.db.Rooms.ClearRoomInboxEvents(ctx, roomID, lastVersion, res.failed, lock.TxnRefresh); err != nil {
+			log.Err(err).Msg("Failed to clear room inbox events")
+			return false
+		}
+		for _, failedEv := range res.failed {
+			log.Warn().
+				Str("origin", failedEv.Origin).
+				Stringer("event_id", failedEv.Event.ID).
+				Int("attempts", failedEv.Attempts+1).
+				Str("error", failedEv.Error).
+				Msg("Giving up on inbox event after repeated failures")
+		}
+	}
+
+	if len(res.retry) > 0 {
+		if err := fi.db.Rooms.RetryRoomInboxEvents(ctx, roomID, res.retry, lock.TxnRefresh); err != nil {
+			log.Err(err).Msg("Failed to update room inbox event attempts")
+		}
+		backoff := util.GetBackoffDuration(inboxEventsAttempts(res.retry)+1, inboxRetryInitial, inboxRetryMax)
+		fi.lock.Lock()
+		fi.retryRooms[roomID] = time.Now().Add(backoff)
+		fi.lock.Unlock()
+		log.Warn().
+			Err(res.retryErr).
+			Dur("backoff", backoff).
+			Msg("Failed to process inbox events, will retry")
+		return false
+	}
+
+	return len(inboxEvs) == inboxRoomBatchSize
+}
+
+type inboxBatchResult struct {
+	// Leading events processed or given up on, to be cleared from the inbox
+	processed []rooms.InboxEvent
+	failed    []rooms.FailedInboxEvent
+	// Events that failed unexpectedly and should be retried later, nothing
+	// after them is processed to keep the room in order.
+	retry    []rooms.InboxEvent
+	retryErr error
+}
+
+// Process inbox events in order, grouping consecutive events from the same
+// origin as verification & missing event fetches are done per origin. A group
+// failing with an unexpected error stops the batch unless it has reached max
+// attempts, in which case it is given up on.
+func processInboxBatch(
+	inboxEvs []rooms.InboxEvent,
+	maxAttempts int,
+	process func([]rooms.InboxEvent) error,
+) inboxBatchResult {
+	var res inboxBatchResult
+
+	for start := 0; start < len(inboxEvs); {
+		end := start + 1
+		for end < len(inboxEvs) && inboxEvs[end].Origin == inboxEvs[start].Origin {
+			end++
+		}
+		group := inboxEvs[start:end]
+
+		if err := process(group); err != nil {
+			if inboxEventsAttempts(group)+1 < maxAttempts {
+				res.retry = group
+				res.retryErr = err
+				return res
+			}
+			for _, inboxEv := range group {
+				res.failed = append(res.failed, rooms.FailedInboxEvent{
+					InboxEvent: inboxEv,
+					Error:      err.Error(),
+				})
+			}
+		}
+
+		res.processed = inboxEvs[:end]
+		start = end
+	}
+
+	return res
+}
+
+func inboxEventsAttempts(inboxEvs []rooms.InboxEvent) int {
+	var attempts int
+	for _, inboxEv := range inboxEvs {
+		attempts = max(attempts, inboxEv.Attempts)
+	}
+	return attempts
+}
+
+// Process a group of inbox events from the same origin, any returned error is
+// unexpected (rejected events are expected and only logged).
+func (fi *FederationInbox) processEvents(ctx context.Context, inboxEvs []rooms.InboxEvent) error {
+	origin := inboxEvs[0].Origin
+	log := zerolog.Ctx(ctx).With().Str("origin", origin).Logger()
+
+	evs := make([]*types.Event, 0, len(inboxEvs))
+	for _, inboxEv := range inboxEvs {
+		evs = append(evs, inboxEv.Event)
+	}
+
+	results, err := fi.federator.ProcessPDUs(log.WithContext(ctx), origin, evs)
+	if err != nil {
+		return err
+	}
+
+	var rejected int
+	for evID, err := range results {
+		if err != nil {
+			rejected++
+			log.Debug().Err(err).Stringer("event_id", evID).Msg("Rejected inbox event")
+		}
+	}
+	log.Debug().
+		Int("events", len(evs)).
+		Int("rejected", rejected).
+		Msg("Processed inbox events")
+	return nil
+}
+
+func (fi *FederationInbox) pruneTransactionsLoop() {
+	defer fi.wg.Done()
+
+	for {
+		select {
+		case <-fi.ctx.Done():
+			return
+		case <-time.After(inboxPruneInterval):
+		}
+
+		if err := lock.WithLockIfAvailable(fi.ctx, fi.db.Rooms, inboxPruneLockName, lock.LockOptions{
+			RefreshInterval: inboxRoomLockRefresh,
+			Timeout:         inboxRoomLockTimeout,
+		}, func(lock lock.Lock) {
+			defer lock.Release()
+			before := time.Now().Add(-fi.config.Federation.TransactionRetention)
+			for {
+				lock.Refresh()
+				pruned, err := fi.db.Rooms.PruneServerTransactions(fi.ctx, before, inboxPruneBatchSize)
+				if err != nil {
+					fi.log.Err(err).Msg("Failed to prune server transactions")
+					return
+				} else if pruned > 0 {
+					fi.log.Debug().Int("pruned", pruned).Msg("Pruned server transactions")
+				}
+				if pruned < inboxPruneBatchSize {
+					return
+				}
+			}
+		}); err != nil {
+			fi.log.Err(err).Msg("Error acquiring inbox prune lock")
+		}
+	}
+}
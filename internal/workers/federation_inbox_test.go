@@ -0,0 +1,92 @@
+package workers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/types"
+)
+
+func makeInboxEvents(origins ...string) []rooms.InboxEvent {
+	inboxEvs := make([]rooms.InboxEvent, 0, len(origins))
+	for i, origin := range origins {
+		inboxEvs = append(inboxEvs, rooms.InboxEvent{
+			Origin: origin,
+			Event:  &types.Event{ID: id.EventID(string(rune('a' + i)))},
+		})
+	}
+	return inboxEvs
+}
+
+func TestProcessInboxBatchGroupsByOrigin(t *testing.T) {
+	inboxEvs := makeInboxEvents("a.com", "a.com", "b.com", "a.com")
+
+	var groups [][]rooms.InboxEvent
+	res := processInboxBatch(inboxEvs, 5, func(group []rooms.InboxEvent) error {
+		groups = append(groups, group)
+		return nil
+	})
+
+	assert.Len(t, groups, 3)
+	assert.Len(t, groups[0], 2)
+	assert.Equal(t, inboxEvs, res.processed)
+	assert.Empty(t, res.failed)
+	assert.Empty(t, res.retry)
+}
+
+func TestProcessInboxBatchRetry(t *testing.T) {
+	inboxEvs := makeInboxEvents("a.com", "b.com", "b.com", "c.com")
+	errFetch := errors.New("fetch timeout")
+
+	var calls int
+	res := processInboxBatch(inboxEvs, 5, func(group []rooms.InboxEvent) error {
+		calls++
+		if group[0].Origin == "b.com" {
+			return errFetch
+		}
+		return nil
+	})
+
+	// Processing stops at the failed group, only the events before it are
+	// cleared and nothing after it is processed.
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, inboxEvs[:1], res.processed)
+	assert.Equal(t, inboxEvs[1:3], res.retry)
+	assert.ErrorIs(t, res.retryErr, errFetch)
+	assert.Empty(t, res.failed)
+}
+
+func TestProcessInboxBatchGiveUp(t *testing.T) {
+	inboxEvs := makeInboxEvents("a.com", "b.com", "c.com")
+	inboxEvs[1].Attempts = 4
+
+	res := processInboxBatch(inboxEvs, 5, func(group []rooms.InboxEvent) error {
+		if group[0].Origin == "b.com" {
+			return errors.New("bad event")
+		}
+		return nil
+	})
+
+	// Max attempts reached, the event is given up on and the batch continues
+	assert.Equal(t, inboxEvs, res.processed)
+	assert.Empty(t, res.retry)
+	if assert.Len(t, res.failed, 1) {
+		assert.Equal(t, inboxEvs[1].Event.ID, res.failed[0].Event.ID)
+		assert.Equal(t, "bad event", res.failed[0].Error)
+	}
+}
+
+func TestProcessInboxBatchFirstGroupFails(t *testing.T) {
+	inboxEvs := makeInboxEvents("a.com", "b.com")
+
+	res := processInboxBatch(inboxEvs, 5, func(group []rooms.InboxEvent) error {
+		return errors.New("db error")
+	})
+
+	assert.Empty(t, res.processed)
+	assert.Equal(t, inboxEvs[:1], res.retry)
+}
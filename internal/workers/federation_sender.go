@@ -60,6 +60,7 @@ func (fs *FederationSender) Start() {
 	fs.ctx, fs.cancel = context.WithCancel(fs.log.WithContext(context.Background()))
 	fs.log.Info().Msg("Starting federation sender...")
 	go fs.handleServersLoop()
+	go fs.retryBackoffServersLoop()
 }
 
 func (fs *FederationSender) Stop() {
@@ -81,25 +82,55 @@ func (fs *FederationSender) handleServersLoop() {
 		case <-fs.ctx.Done():
 			return
 		case server := <-newServersCh:
-			serverName := server.(string)
-
-			// First check our in memory map of active senders, avoid the FDB lock
-			// entirely if we're already running this sender.
-			fs.lock.RLock()
-			ch, found := fs.serverSenders[serverName]
-			select {
-			// Wakeup the sender if needed
-			case ch <- struct{}{}:
-			default:
-			}
-			fs.lock.RUnlock()
+			fs.wakeServerSender(server.(string))
+		}
+	}
+}
 
-			if found {
-				fs.log.Trace().
-					Str("server", serverName).
-					Msg("We are already running this server sender")
-			} else {
-				go fs.maybeRunServerSender(serverName)
+func (fs *FederationSender) wakeServerSender(serverName string) {
+	// First check our in memory map of active senders, avoid the FDB lock
+	// entirely if we're already running this sender.
+	fs.lock.RLock()
+	ch, found := fs.serverSenders[serverName]
+	select {
+	// Wakeup the sender if needed
+	case ch <- struct{}{}:
+	default:
+	}
+	fs.lock.RUnlock()
+
+	if found {
+		fs.log.Trace().
+			Str("server", serverName).
+			Msg("We are already running this server sender")
+	} else {
+		go fs.maybeRunServerSender(serverName)
+	}
+}
+
+const serverBackoffRetryInterval = time.Minute
+
+// Server senders exit while a server is backing off, this loop periodically
+// wakes them back up once their retry time has passed.
+func (fs *FederationSender) retryBackoffServersLoop() {
+	fs.wg.Add(1)
+	defer fs.wg.Done()
+
+	for {
+		select {
+		case <-fs.ctx.Done():
+			return
+		case <-time.After(serverBackoffRetryInterval):
+		}
+
+		backoffs, err := fs.db.Rooms.GetServerBackoffs(fs.ctx)
+		if err != nil {
+			fs.log.Err(err).Msg("Failed to get server backoffs")
+			continue
+		}
+		for _, backoff := range backoffs {
+			if !backoff.IsBackingOff() {
+				fs.wakeServerSender(backoff.ServerName)
 			}
 		}
 	}
@@ -161,9 +192,22 @@ func (fs *FederationSender) sendEventsToServerLoop(
 	wakeCh chan struct{},
 ) {
 	var noSends int
+	var backingOff bool
 
 	trySend := func() {
-		if fs.sendEventsToServer(serverName, lock, log) {
+		backoff, err := fs.db.Rooms.GetServerBackoff(fs.ctx, serverName)
+		if err != nil {
+			log.Err(err).Msg("Failed to get server backoff")
+		} else if backoff != nil && backoff.IsBackingOff() {
+			log.Debug().
+				Int("failures", backoff.Failures).
+				Time("retry_after", backoff.RetryAfter()).
+				Msg("Server is backing off, stopping sender")
+			backingOff = true
+			return
+		}
+
+		if fs.sendEventsToServer(serverName, lock, log, backoff) {
 			noSends = 0
 		} else {
 			noSends++
@@ -173,6 +217,11 @@ func (fs *FederationSender) sendEventsToServerLoop(
 	trySend()
 
 	for {
+		if backingOff {
+			// Exit the sender, it will be woken up again by the retry loop
+			// once the backoff has expired.
+			return
+		}
 		select {
 		case <-fs.ctx.Done():
 			return
@@ -189,7 +238,12 @@ func (fs *FederationSender) sendEventsToServerLoop(
 	}
 }
 
-func (fs *FederationSender) sendEventsToServer(serverName string, lock lock.Lock, log zerolog.Logger) bool {
+func (fs *FederationSender) sendEventsToServer(
+	serverName string,
+	lock lock.Lock,
+	log zerolog.Logger,
+	backoff *types.ServerBackoff,
+) bool {
 	serverVersions, err := fs.db.Rooms.GetServerPositions(fs.ctx, serverName)
 	if err != nil {
 		log.Err(err).Msg("Failed to get current server positions")
@@ -217,19 +271,60 @@ func (fs *FederationSender) sendEventsToServer(serverName string, lock lock.Lock
 			return sent
 		}
 
-		if nextVersion == roomsVersion {
+		edus, edusVersion, err := fs.db.Rooms.GetServerEDUs(fs.ctx, serverName, types.MaxTransactionEDUs)
+		if err != nil {
+			log.Err(err).Msg("Failed to get queued EDUs for server")
+			return sent
+		}
+
+		if nextVersion == roomsVersion && len(edus) == 0 {
 			return sent
 		}
 		sent = true
 
 		allEvs := make([]*types.Event, 0, 50)
-		for _, evs := range events {
+		for memberTup, evs := range events {
+			// Don't send events to servers denied by the room's current ACL
+			// https://spec.matrix.org/v1.11/server-server-api/#server-access-control-lists-acls
+			if allowed, err := fs.db.Rooms.IsServerAllowedByRoomACL(fs.ctx, memberTup.RoomID, serverName); err != nil {
+				log.Err(err).Msg("Failed to check room server ACL")
+				return sent
+			} else if !allowed {
+				log.Debug().
+					Stringer("room_id", memberTup.RoomID).
+					Int("events", len(evs)).
+					Msg("Skipping room events for server denied by room ACL")
+				continue
+			}
 			allEvs = append(allEvs, evs...)
 		}
-		transactionID := util.Base64EncodeURLSafe(roomsVersion.Bytes())
+
+		if len(allEvs) == 0 && len(edus) == 0 {
+			// Everything in this batch was denied by room ACLs, advance positions
+			// without sending an empty transaction.
+			serverVersions[types.RoomsVersionKey] = nextVersion
+			err = fs.db.Rooms.UpdateServerPositions(fs.ctx, serverName, serverVersions, edusVersion, lock.TxnRefresh)
+			if err != nil {
+				log.Err(err).Msg("Failed to update current server positions")
+				return sent
+			}
+			continue
+		}
+		// Transaction ID is derived from the PDU and EDU positions so retries of
+		// the same transaction always have the same ID.
+		transactionID := util.Base64EncodeURLSafe(append(roomsVersion.Bytes(), edusVersion.Bytes()...))
+
+		txnEDUs := make([]gomatrixserverlib.EDU, 0, len(edus))
+		for _, edu := range edus {
+			txnEDUs = append(txnEDUs, gomatrixserverlib.EDU{
+				Type:    edu.Type,
+				Content: spec.RawJSON(edu.Content),
+			})
+		}
 
 		log.Info().
 			Int("pdus", len(allEvs)).
+			Int("edus", len(txnEDUs)).
 			Str("transaction_id", transactionID).
 			Msg("Sending transaction to server")
 
@@ -239,8 +334,18 @@ func (fs *FederationSender) sendEventsToServer(serverName string, lock lock.Lock
 			Destination:    spec.ServerName(serverName),
 			OriginServerTS: spec.Timestamp(time.Now().UnixMilli()),
 			PDUs:           util.EventsToJSONs(allEvs),
+			EDUs:           txnEDUs,
 		}); err != nil {
 			log.Err(err).Msg("Failed to send transaction")
+			if backoff, err := fs.db.Rooms.RecordServerFailure(fs.ctx, serverName, err); err != nil {
+				log.Err(err).Msg("Failed to record server failure")
+			} else {
+				log.Warn().
+					Int("failures", backoff.Failures).
+					Bool("down", backoff.Down).
+					Time("retry_after", backoff.RetryAfter()).
+					Msg("Backing off server after failed transaction")
+			}
 			return sent
 		} else {
 			var success, error int
@@ -260,11 +365,18 @@ func (fs *FederationSender) sendEventsToServer(serverName string, lock lock.Lock
 				Int("error", error).
 				Str("transaction_id", transactionID).
 				Msg("Sent transaction to server")
+
+			if backoff != nil {
+				if _, err := fs.db.Rooms.ResetServerBackoff(fs.ctx, serverName); err != nil {
+					log.Err(err).Msg("Failed to reset server backoff")
+				}
+				backoff = nil
+			}
 		}
 
 		serverVersions[types.RoomsVersionKey] = nextVersion
 
-		err = fs.db.Rooms.UpdateServerPositions(fs.ctx, serverName, serverVersions, lock.TxnRefresh)
+		err = fs.db.Rooms.UpdateServerPositions(fs.ctx, serverName, serverVersions, edusVersion, lock.TxnRefresh)
 		if err != nil {
 			log.Err(err).Msg("Failed to update current server positions")
 			return sent
@@ -0,0 +1,153 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/databases/rooms"
+	"github.com/beeper/babbleserv/internal/federator"
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	partialStateRoomLockNamePrefix = "PartialStateRoomLock:"
+	partialStateRoomLockRefresh    = time.Second * 30
+	// Fetching the full state of a large room can take a while, so a long
+	// timeout, the lock is released as soon as the resync completes or fails.
+	partialStateRoomLockTimeout = time.Minute * 10
+	partialStatePollInterval    = time.Minute
+)
+
+// The partial state resyncer fetches the full state for rooms joined with
+// partial state (members omitted), see rooms.PartialStateRoom. Failed resyncs
+// are retried on the next poll.
+type PartialStateResyncer struct {
+	log       zerolog.Logger
+	config    config.BabbleConfig
+	db        *databases.Databases
+	notifier  *notifier.Notifier
+	federator *federator.Federator
+
+	// Internal map + lock of rooms being resynced in this process
+	lock        sync.Mutex
+	activeRooms map[id.RoomID]struct{}
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPartialStateResyncer(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+	notif *notifier.Notifier,
+	federator *federator.Federator,
+) *PartialStateResyncer {
+	log := logger.With().
+		Str("worker", "PartialStateResyncer").
+		Logger()
+
+	return &PartialStateResyncer{
+		log:         log,
+		config:      cfg,
+		db:          db,
+		notifier:    notif,
+		federator:   federator,
+		activeRooms: make(map[id.RoomID]struct{}),
+	}
+}
+
+func (pr *PartialStateResyncer) Start() {
+	pr.ctx, pr.cancel = context.WithCancel(pr.log.WithContext(context.Background()))
+	pr.log.Info().Msg("Starting partial state resyncer...")
+	pr.wg.Add(1)
+	go pr.resyncRoomsLoop()
+}
+
+func (pr *PartialStateResyncer) Stop() {
+	pr.cancel()
+	pr.wg.Wait()
+	pr.log.Info().Msg("Partial state resyncer stopped")
+}
+
+func (pr *PartialStateResyncer) resyncRoomsLoop() {
+	defer pr.wg.Done()
+
+	roomsCh := make(chan any, 1000)
+	pr.notifier.Subscribe(roomsCh, notifier.Subscription{AllRooms: true})
+	defer pr.notifier.Unsubscribe(roomsCh)
+
+	// Cold start case: resync anything waiting right away
+	pr.resyncRooms()
+
+	for {
+		select {
+		case <-pr.ctx.Done():
+			return
+		case <-roomsCh:
+			// Drain any other pending changes, we check all partial state rooms at once
+			for len(roomsCh) > 0 {
+				<-roomsCh
+			}
+			pr.resyncRooms()
+		case <-time.After(partialStatePollInterval):
+			pr.resyncRooms()
+		}
+	}
+}
+
+func (pr *PartialStateResyncer) resyncRooms() {
+	partialStateRooms, err := pr.db.Rooms.GetPartialStateRooms(pr.ctx)
+	if err != nil {
+		pr.log.Err(err).Msg("Failed to get partial state rooms")
+		return
+	}
+
+	for _, partialStateRoom := range partialStateRooms {
+		pr.lock.Lock()
+		_, found := pr.activeRooms[partialStateRoom.RoomID]
+		if !found {
+			pr.activeRooms[partialStateRoom.RoomID] = struct{}{}
+		}
+		pr.lock.Unlock()
+
+		if !found {
+			pr.wg.Add(1)
+			go pr.maybeResyncRoom(partialStateRoom)
+		}
+	}
+}
+
+func (pr *PartialStateResyncer) maybeResyncRoom(partialStateRoom rooms.PartialStateRoom) {
+	roomID := partialStateRoom.RoomID
+
+	defer pr.wg.Done()
+	defer func() {
+		pr.lock.Lock()
+		delete(pr.activeRooms, roomID)
+		pr.lock.Unlock()
+	}()
+
+	log := pr.log.With().Stringer("room_id", roomID).Logger()
+	ctx := log.WithContext(pr.ctx)
+
+	if err := lock.WithLockIfAvailable(ctx, pr.db.Rooms, partialStateRoomLockNamePrefix+roomID.String(), lock.LockOptions{
+		RefreshInterval: partialStateRoomLockRefresh,
+		Timeout:         partialStateRoomLockTimeout,
+	}, func(lock lock.Lock) {
+		defer lock.Release()
+		if err := pr.federator.ResyncPartialStateRoom(ctx, partialStateRoom, lock.Refresh); err != nil {
+			log.Err(err).Msg("Failed to resync partial state room")
+		}
+	}); err != nil {
+		log.Err(err).Msg("Error acquiring partial state room lock")
+	}
+}
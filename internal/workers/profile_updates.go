@@ -0,0 +1,135 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	profileUpdatesPollInterval = time.Minute
+	// Maximum pending jobs resumed per poll
+	profileUpdatesPollLimit = 1000
+
+	remoteProfilesPruneLockName    = "RemoteProfilesPruneLock"
+	remoteProfilesPruneLockRefresh = time.Second * 30
+	remoteProfilesPruneLockTimeout = time.Minute * 5
+	remoteProfilesPruneInterval    = time.Hour
+	remoteProfilesPruneBatchSize   = 1000
+	// Cached remote profiles are refreshed after an hour but kept for longer as
+	// a fallback if the remote server is unavailable.
+	remoteProfilesRetention = time.Hour * 24 * 7
+)
+
+// The profile updater resumes profile update jobs (sending updated member
+// events to each of a user's rooms) that were interrupted part way, ie by a
+// crash or restart. It also prunes old cached remote user profiles.
+type ProfileUpdater struct {
+	log    zerolog.Logger
+	config config.BabbleConfig
+	db     *databases.Databases
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewProfileUpdater(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+) *ProfileUpdater {
+	log := logger.With().
+		Str("worker", "ProfileUpdater").
+		Logger()
+
+	return &ProfileUpdater{
+		log:    log,
+		config: cfg,
+		db:     db,
+	}
+}
+
+func (pu *ProfileUpdater) Start() {
+	pu.ctx, pu.cancel = context.WithCancel(pu.log.WithContext(context.Background()))
+	pu.log.Info().Msg("Starting profile updater...")
+	pu.wg.Add(2)
+	go pu.resumeUpdatesLoop()
+	go pu.pruneRemoteProfilesLoop()
+}
+
+func (pu *ProfileUpdater) Stop() {
+	pu.cancel()
+	pu.wg.Wait()
+	pu.log.Info().Msg("Profile updater stopped")
+}
+
+func (pu *ProfileUpdater) resumeUpdatesLoop() {
+	defer pu.wg.Done()
+
+	for {
+		select {
+		case <-pu.ctx.Done():
+			return
+		case <-time.After(profileUpdatesPollInterval):
+		}
+
+		userIDs, err := pu.db.Rooms.GetPendingProfileUpdateUserIDs(pu.ctx, profileUpdatesPollLimit)
+		if err != nil {
+			pu.log.Err(err).Msg("Failed to get pending profile updates")
+			continue
+		}
+
+		for _, userID := range userIDs {
+			log := pu.log.With().Stringer("user_id", userID).Logger()
+			if err := pu.db.Rooms.RunProfileUpdate(log.WithContext(pu.ctx), userID); err != nil {
+				log.Err(err).Msg("Failed to resume profile update")
+			}
+		}
+	}
+}
+
+func (pu *ProfileUpdater) pruneRemoteProfilesLoop() {
+	defer pu.wg.Done()
+
+	for {
+		select {
+		case <-pu.ctx.Done():
+			return
+		case <-time.After(remoteProfilesPruneInterval):
+		}
+
+		if err := lock.WithLockIfAvailable(pu.ctx, pu.db.Rooms, remoteProfilesPruneLockName, lock.LockOptions{
+			RefreshInterval: remoteProfilesPruneLockRefresh,
+			Timeout:         remoteProfilesPruneLockTimeout,
+		}, func(lock lock.Lock) {
+			defer lock.Release()
+			before := time.Now().Add(-remoteProfilesRetention)
+			var total int
+			var cursor fdb.Key
+			for pu.ctx.Err() == nil {
+				pruned, nextCursor, err := pu.db.Rooms.PruneRemoteUserProfiles(pu.ctx, before, cursor, remoteProfilesPruneBatchSize)
+				if err != nil {
+					pu.log.Err(err).Msg("Failed to prune remote user profiles")
+					return
+				}
+				total += pruned
+				if nextCursor == nil {
+					break
+				}
+				cursor = nextCursor
+				lock.Refresh()
+			}
+			pu.log.Debug().Int("pruned", total).Msg("Pruned remote user profiles")
+		}); err != nil {
+			pu.log.Err(err).Msg("Error acquiring remote profiles prune lock")
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	pushEvaluatorLockName    = "PushEvaluatorLock"
+	pushEvaluatorLockRefresh = time.Second * 5
+	pushEvaluatorLockTimeout = time.Second * 10
+	pushEvaluatorBatchSize   = 50
+
+	notificationsPruneLockName    = "NotificationsPruneLock"
+	notificationsPruneLockRefresh = time.Second * 30
+	notificationsPruneLockTimeout = time.Minute
+	notificationsPruneInterval    = time.Minute * 10
+	notificationsPruneBatchSize   = 1000
+)
+
+// The push evaluator is a singleton background worker that, like the events
+// iterator, iterates over all events and evaluates the push rules of local
+// users in each event's room, storing notifications and unread counts. It also
+// prunes notifications older than the configured retention.
+type PushEvaluator struct {
+	log      zerolog.Logger
+	config   config.BabbleConfig
+	db       *databases.Databases
+	notifier *notifier.Notifier
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPushEvaluator(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+	notif *notifier.Notifier,
+) *PushEvaluator {
+	log := logger.With().
+		Str("worker", "PushEvaluator").
+		Logger()
+
+	return &PushEvaluator{
+		log:      log,
+		config:   cfg,
+		db:       db,
+		notifier: notif,
+	}
+}
+
+func (pe *PushEvaluator) Start() {
+	pe.ctx, pe.cancel = context.WithCancel(pe.log.WithContext(context.Background()))
+
+	pe.wg.Add(1)
+	go func() {
+		defer pe.wg.Done()
+		lock.WithLock(pe.ctx, pe.db.Rooms, pushEvaluatorLockName, lock.LockOptions{
+			RefreshInterval: pushEvaluatorLockRefresh,
+			Timeout:         pushEvaluatorLockTimeout,
+		}, pe.evaluateNewEventsLoop)
+	}()
+
+	pe.wg.Add(1)
+	go pe.pruneNotificationsLoop()
+}
+
+func (pe *PushEvaluator) Stop() {
+	pe.cancel()
+	pe.wg.Wait()
+	pe.log.Info().Msg("Push evaluator stopped")
+}
+
+func (pe *PushEvaluator) evaluateNewEventsLoop(lock lock.Lock) {
+	newEventsCh := make(chan any, 1)
+	pe.notifier.Subscribe(newEventsCh, notifier.Subscription{AllEvents: true})
+	defer pe.notifier.Unsubscribe(newEventsCh)
+
+	// Cold start case: evaluate anything waiting right away
+	pe.evaluateNewEvents(lock)
+
+	for {
+		select {
+		case <-pe.ctx.Done():
+			lock.Release()
+			return
+		case <-newEventsCh:
+			pe.evaluateNewEvents(lock)
+		case <-time.After(pushEvaluatorLockRefresh):
+			lock.Refresh()
+		}
+	}
+}
+
+func (pe *PushEvaluator) evaluateNewEvents(lock lock.Lock) {
+	currentVersion, err := pe.db.Rooms.GetPushEvaluatorPosition(pe.ctx)
+	if err != nil {
+		pe.log.Err(err).Msg("Failed to get current position")
+		return
+	}
+
+	for {
+		lock.Refresh()
+
+		newEventIDTups, err := pe.db.Rooms.EventsIteratorPaginateEvents(pe.ctx, currentVersion, pushEvaluatorBatchSize)
+		if err != nil {
+			pe.log.Err(err).Msg("Failed to paginate new events")
+			return
+		} else if len(newEventIDTups) == 0 {
+			return
+		}
+
+		pe.log.Debug().
+			Int("events", len(newEventIDTups)).
+			Any("fromVersion", currentVersion).
+			Msg("Evaluating new events batch")
+
+		// Evaluate and update the position in one transaction, refreshing the lock
+		// as part of it to ensure the write is safe.
+		evaluated, err := pe.db.Rooms.EvaluateEventsForPush(pe.ctx, newEventIDTups, lock.TxnRefresh)
+		if err != nil {
+			pe.log.Err(err).Msg("Failed to evaluate events")
+			return
+		}
+
+		// Large rooms may stop the batch early, continue from the last event
+		// evaluated.
+		currentVersion = newEventIDTups[evaluated-1].Version
+		currentVersion.UserVersion += 1
+
+		if evaluated == len(newEventIDTups) && len(newEventIDTups) < pushEvaluatorBatchSize {
+			return
+		}
+	}
+}
+
+func (pe *PushEvaluator) pruneNotificationsLoop() {
+	defer pe.wg.Done()
+
+	for {
+		select {
+		case <-pe.ctx.Done():
+			return
+		case <-time.After(notificationsPruneInterval):
+		}
+
+		if err := lock.WithLockIfAvailable(pe.ctx, pe.db.Rooms, notificationsPruneLockName, lock.LockOptions{
+			RefreshInterval: notificationsPruneLockRefresh,
+			Timeout:         notificationsPruneLockTimeout,
+		}, func(lock lock.Lock) {
+			defer lock.Release()
+			before := time.Now().Add(-pe.config.Push.NotificationRetention)
+			for {
+				lock.Refresh()
+				pruned, err := pe.db.Rooms.PruneUserNotifications(pe.ctx, before, notificationsPruneBatchSize)
+				if err != nil {
+					pe.log.Err(err).Msg("Failed to prune notifications")
+					return
+				} else if pruned > 0 {
+					pe.log.Debug().Int("pruned", pruned).Msg("Pruned notifications")
+				}
+				if pruned < notificationsPruneBatchSize {
+					return
+				}
+			}
+		}); err != nil {
+			pe.log.Err(err).Msg("Error acquiring notifications prune lock")
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package workers
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+// The push sender sends notifications stored by the push evaluator to each
+// pusher's push gateway, with one sender per pusher across all processes.
+type PushSender struct {
+	log      zerolog.Logger
+	config   config.BabbleConfig
+	db       *databases.Databases
+	notifier *notifier.Notifier
+	gateway  *util.PushGatewayClient
+
+	// Internal map + lock of active senders we have running in this process
+	lock          sync.RWMutex
+	pusherSenders map[types.PusherKey]chan struct{}
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPushSender(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+	notif *notifier.Notifier,
+) *PushSender {
+	log := logger.With().
+		Str("worker", "PushSender").
+		Logger()
+
+	gatewayIPs := types.MustNewIPRangeFilter(cfg.Push.GatewayIPRanges.Allow, cfg.Push.GatewayIPRanges.Deny)
+
+	return &PushSender{
+		log:           log,
+		config:        cfg,
+		db:            db,
+		notifier:      notif,
+		gateway:       util.NewPushGatewayClient(cfg.UserAgent, gatewayIPs),
+		pusherSenders: make(map[types.PusherKey]chan struct{}),
+	}
+}
+
+func (ps *PushSender) Start() {
+	ps.ctx, ps.cancel = context.WithCancel(ps.log.WithContext(context.Background()))
+	ps.log.Info().Msg("Starting push sender...")
+	ps.wg.Add(1)
+	go ps.handlePushersLoop()
+	ps.wg.Add(1)
+	go ps.retryBackoffPushersLoop()
+}
+
+func (ps *PushSender) Stop() {
+	ps.cancel()
+	ps.wg.Wait()
+	ps.log.Info().Msg("Push sender stopped")
+}
+
+func (ps *PushSender) handlePushersLoop() {
+	defer ps.wg.Done()
+
+	newPushersCh := make(chan any, 1000)
+	ps.notifier.Subscribe(newPushersCh, notifier.Subscription{AllPushers: true})
+	defer ps.notifier.Unsubscribe(newPushersCh)
+
+	for {
+		select {
+		case <-ps.ctx.Done():
+			return
+		case pusher := <-newPushersCh:
+			ps.wakePusherSender(pusher.(types.PusherKey))
+		}
+	}
+}
+
+func (ps *PushSender) wakePusherSender(key types.PusherKey) {
+	// First check our in memory map of active senders, avoid the FDB lock
+	// entirely if we're already running this sender.
+	ps.lock.RLock()
+	ch, found := ps.pusherSenders[key]
+	select {
+	// Wakeup the sender if needed
+	case ch <- struct{}{}:
+	default:
+	}
+	ps.lock.RUnlock()
+
+	if found {
+		ps.log.Trace().
+			Stringer("pusher", key).
+			Msg("We are already running this pusher sender")
+	} else {
+		ps.wg.Add(1)
+		go ps.maybeRunPusherSender(key)
+	}
+}
+
+const pusherBackoffRetryInterval = time.Second * 10
+
+// Pusher senders exit while a pusher is backing off, this loop periodically
+// wakes them back up once their retry time has passed.
+func (ps *PushSender) retryBackoffPushersLoop() {
+	defer ps.wg.Done()
+
+	for {
+		select {
+		case <-ps.ctx.Done():
+			return
+		case <-time.After(pusherBackoffRetryInterval):
+		}
+
+		backoffs, err := ps.db.Rooms.GetPusherBackoffs(ps.ctx)
+		if err != nil {
+			ps.log.Err(err).Msg("Failed to get pusher backoffs")
+			continue
+		}
+		for _, backoff := range backoffs {
+			if !backoff.IsBackingOff() {
+				ps.wakePusherSender(backoff.PusherKey)
+			}
+		}
+	}
+}
+
+const (
+	pusherSenderLockNamePrefix = "PushSenderLock:"
+	pusherSenderLockRefresh    = time.Second * 30
+	pusherSenderLockTimeout    = time.Second * 60
+	pusherSenderBatchSize      = 20
+)
+
+func (ps *PushSender) maybeRunPusherSender(key types.PusherKey) {
+	defer ps.wg.Done()
+
+	lockName := pusherSenderLockNamePrefix + key.String()
+	var hadLock bool
+
+	if err := lock.WithLockIfAvailable(ps.ctx, ps.db.Rooms, lockName, lock.LockOptions{
+		RefreshInterval: pusherSenderLockRefresh,
+		Timeout:         pusherSenderLockTimeout,
+	}, func(lock lock.Lock) {
+		hadLock = true
+
+		log := ps.log.With().
+			Stringer("user_id", key.UserID).
+			Str("app_id", key.AppID).
+			Logger()
+
+		wakeCh := make(chan struct{}, 1)
+
+		// Store internal flag that we're running this sender
+		ps.lock.Lock()
+		ps.pusherSenders[key] = wakeCh
+		ps.lock.Unlock()
+
+		log.Info().Msg("Starting pusher sender")
+		ps.sendNotificationsToPusherLoop(key, lock, log, wakeCh)
+
+		// Remove the internal flag on sender
+		ps.lock.Lock()
+		delete(ps.pusherSenders, key)
+		ps.lock.Unlock()
+
+		lock.Release()
+		log.Info().Msg("Pusher sender stopped without error")
+	}); err != nil {
+		ps.log.Err(err).Msg("Error starting pusher sender")
+		return
+	} else if !hadLock {
+		ps.log.Trace().
+			Stringer("pusher", key).
+			Msg("Someone else is already running this pusher sender")
+	}
+}
+
+func (ps *PushSender) sendNotificationsToPusherLoop(
+	key types.PusherKey,
+	lock lock.Lock,
+	log zerolog.Logger,
+	wakeCh chan struct{},
+) {
+	var noSends int
+	var stop bool
+
+	trySend := func() {
+		backoff, err := ps.db.Rooms.GetPusherBackoff(ps.ctx, key)
+		if err != nil {
+			log.Err(err).Msg("Failed to get pusher backoff")
+		} else if backoff != nil && backoff.IsBackingOff() {
+			log.Debug().
+				Int("failures", backoff.Failures).
+				Time("retry_after", backoff.RetryAfter()).
+				Msg("Pusher is backing off, stopping sender")
+			stop = true
+			return
+		}
+
+		sent, deleted := ps.sendNotificationsToPusher(key, lock, log, backoff)
+		if deleted {
+			stop = true
+		} else if sent {
+			noSends = 0
+		} else {
+			noSends++
+		}
+	}
+
+	trySend()
+
+	for {
+		if stop {
+			// Exit the sender, if backing off it will be woken up again by the
+			// retry loop once the backoff has expired.
+			return
+		}
+		select {
+		case <-ps.ctx.Done():
+			return
+		case <-wakeCh:
+			trySend()
+		case <-time.After(pusherSenderLockRefresh):
+			trySend()
+		}
+		if noSends >= 10 {
+			// After 10 refreshes without sends, exit the pusher sender. If new
+			// notifications come in for this pusher we'll start again.
+			return
+		}
+	}
+}
+
+// Send any pending notifications to a pusher, returns whether anything was sent
+// and whether the pusher no longer exists.
+func (ps *PushSender) sendNotificationsToPusher(
+	key types.PusherKey,
+	lock lock.Lock,
+	log zerolog.Logger,
+	backoff *types.PusherBackoff,
+) (bool, bool) {
+	var sent bool
+
+	for {
+		lock.Refresh()
+
+		pending, err := ps.db.Rooms.GetPusherNotifications(ps.ctx, key, pusherSenderBatchSize)
+		if err != nil {
+			log.Err(err).Msg("Failed to get pusher notifications")
+			return sent, false
+		} else if pending == nil {
+			log.Debug().Msg("Pusher has been deleted")
+			return sent, true
+		}
+
+		for _, notification := range pending.Notifications {
+			rejected, err := ps.gateway.Notify(ps.ctx, pending.Pusher.URL(), notification.Notification)
+			if err != nil {
+				log.Err(err).
+					Stringer("event_id", notification.Notification.EventID).
+					Msg("Failed to send notification to push gateway")
+				backoff, err := ps.db.Rooms.RecordPusherFailure(ps.ctx, key, err)
+				if err != nil {
+					log.Err(err).Msg("Failed to record pusher failure")
+					return sent, false
+				}
+				log.Warn().
+					Int("failures", backoff.Failures).
+					Time("retry_after", backoff.RetryAfter()).
+					Msg("Backing off pusher after failed notification")
+
+				if backoff.Failures < ps.config.Push.Backoff.DropAfterFailures {
+					return sent, false
+				}
+				// Give up on this notification so one the gateway can't handle
+				// doesn't block every notification after it.
+				log.Warn().
+					Stringer("event_id", notification.Notification.EventID).
+					Msg("Dropping notification after too many failures")
+				position := notification.Version
+				position.UserVersion += 1
+				if err := ps.db.Rooms.UpdatePusherPosition(ps.ctx, key, position, lock.TxnRefresh); err != nil {
+					log.Err(err).Msg("Failed to update pusher position")
+				}
+				return sent, false
+			} else {
+				sent = true
+				if slices.Contains(rejected, key.PushKey) {
+					log.Info().Msg("Push gateway rejected pushkey, deleting pusher")
+					if err := ps.db.Rooms.DeleteUserPusher(ps.ctx, key); err != nil {
+						log.Err(err).Msg("Failed to delete rejected pusher")
+						return sent, false
+					}
+					return sent, true
+				}
+				if backoff != nil {
+					if _, err := ps.db.Rooms.ResetPusherBackoff(ps.ctx, key); err != nil {
+						log.Err(err).Msg("Failed to reset pusher backoff")
+					}
+					backoff = nil
+				}
+			}
+
+			position := notification.Version
+			position.UserVersion += 1
+			if err := ps.db.Rooms.UpdatePusherPosition(ps.ctx, key, position, lock.TxnRefresh); err != nil {
+				log.Err(err).Msg("Failed to update pusher position")
+				return sent, false
+			}
+		}
+
+		if len(pending.Notifications) == 0 && pending.NextVersion == pending.Position {
+			return sent, false
+		}
+
+		// Move past any notifications skipped as already read
+		if err := ps.db.Rooms.UpdatePusherPosition(ps.ctx, key, pending.NextVersion, lock.TxnRefresh); err != nil {
+			log.Err(err).Msg("Failed to update pusher position")
+			return sent, false
+		}
+	}
+}
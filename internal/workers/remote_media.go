@@ -0,0 +1,105 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/media"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	remoteMediaExpirerLockName    = "RemoteMediaExpirerLock"
+	remoteMediaExpirerLockRefresh = time.Second * 30
+	remoteMediaExpirerLockTimeout = time.Minute * 5
+	remoteMediaExpireInterval     = time.Minute * 10
+)
+
+// Evicts cached remote media older than the configured max age, or least
+// recently accessed media while the cache is over the configured max size.
+type RemoteMediaExpirer struct {
+	log    zerolog.Logger
+	config config.BabbleConfig
+	db     *databases.Databases
+	media  *media.MediaRepo
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewRemoteMediaExpirer(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+	media *media.MediaRepo,
+) *RemoteMediaExpirer {
+	log := logger.With().
+		Str("worker", "RemoteMediaExpirer").
+		Logger()
+
+	return &RemoteMediaExpirer{
+		log:    log,
+		config: cfg,
+		db:     db,
+		media:  media,
+	}
+}
+
+func (me *RemoteMediaExpirer) Start() {
+	me.ctx, me.cancel = context.WithCancel(me.log.WithContext(context.Background()))
+	me.log.Info().Msg("Starting remote media expirer...")
+	me.wg.Add(1)
+	go me.expireLoop()
+}
+
+func (me *RemoteMediaExpirer) Stop() {
+	me.cancel()
+	me.wg.Wait()
+	me.log.Info().Msg("Remote media expirer stopped")
+}
+
+func (me *RemoteMediaExpirer) expireLoop() {
+	defer me.wg.Done()
+
+	for {
+		select {
+		case <-me.ctx.Done():
+			return
+		case <-time.After(remoteMediaExpireInterval):
+		}
+
+		if err := lock.WithLockIfAvailable(me.ctx, me.db.Rooms, remoteMediaExpirerLockName, lock.LockOptions{
+			RefreshInterval: remoteMediaExpirerLockRefresh,
+			Timeout:         remoteMediaExpirerLockTimeout,
+		}, func(lock lock.Lock) {
+			defer lock.Release()
+			me.expire(lock)
+		}); err != nil {
+			me.log.Err(err).Msg("Error acquiring remote media expirer lock")
+		}
+	}
+}
+
+func (me *RemoteMediaExpirer) expire(lock lock.Lock) {
+	var total int
+	for me.ctx.Err() == nil {
+		evicted, err := me.media.ExpireRemoteMedia(me.ctx)
+		if err != nil {
+			me.log.Err(err).Msg("Failed to expire remote media")
+			return
+		} else if evicted == 0 {
+			break
+		}
+		total += evicted
+		lock.Refresh()
+	}
+	me.log.Debug().
+		Int("evicted", total).
+		Msg("Expired remote media")
+}
@@ -0,0 +1,106 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	roomPeekPrunerLockName    = "RoomPeekPrunerLock"
+	roomPeekPrunerLockRefresh = time.Second * 30
+	roomPeekPrunerLockTimeout = time.Minute * 5
+	roomPeekPruneInterval     = time.Minute * 10
+	roomPeekPruneBatchSize    = 1000
+)
+
+// Clears peeks remote servers have stopped renewing, expired peeks are
+// otherwise only cleared when the same server renews another peek on the room.
+type RoomPeekPruner struct {
+	log    zerolog.Logger
+	config config.BabbleConfig
+	db     *databases.Databases
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewRoomPeekPruner(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+) *RoomPeekPruner {
+	log := logger.With().
+		Str("worker", "RoomPeekPruner").
+		Logger()
+
+	return &RoomPeekPruner{
+		log:    log,
+		config: cfg,
+		db:     db,
+	}
+}
+
+func (pp *RoomPeekPruner) Start() {
+	pp.ctx, pp.cancel = context.WithCancel(pp.log.WithContext(context.Background()))
+	pp.log.Info().Msg("Starting room peek pruner...")
+	pp.wg.Add(1)
+	go pp.pruneLoop()
+}
+
+func (pp *RoomPeekPruner) Stop() {
+	pp.cancel()
+	pp.wg.Wait()
+	pp.log.Info().Msg("Room peek pruner stopped")
+}
+
+func (pp *RoomPeekPruner) pruneLoop() {
+	defer pp.wg.Done()
+
+	for {
+		select {
+		case <-pp.ctx.Done():
+			return
+		case <-time.After(roomPeekPruneInterval):
+		}
+
+		if err := lock.WithLockIfAvailable(pp.ctx, pp.db.Rooms, roomPeekPrunerLockName, lock.LockOptions{
+			RefreshInterval: roomPeekPrunerLockRefresh,
+			Timeout:         roomPeekPrunerLockTimeout,
+		}, func(lock lock.Lock) {
+			defer lock.Release()
+			pp.prune(lock)
+		}); err != nil {
+			pp.log.Err(err).Msg("Error acquiring room peek pruner lock")
+		}
+	}
+}
+
+func (pp *RoomPeekPruner) prune(lock lock.Lock) {
+	var total int
+	var cursor fdb.Key
+	for pp.ctx.Err() == nil {
+		pruned, nextCursor, err := pp.db.Rooms.PruneExpiredRoomPeeks(pp.ctx, cursor, roomPeekPruneBatchSize)
+		if err != nil {
+			pp.log.Err(err).Msg("Failed to prune expired room peeks")
+			return
+		}
+		total += pruned
+		if nextCursor == nil {
+			break
+		}
+		cursor = nextCursor
+		lock.Refresh()
+	}
+	pp.log.Debug().
+		Int("pruned", total).
+		Msg("Pruned expired room peeks")
+}
@@ -0,0 +1,80 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+)
+
+const roomUpgradesPollInterval = time.Minute
+
+// The room upgrader resumes room upgrades that were interrupted part way, ie
+// by a crash or restart while handling the upgrade request.
+type RoomUpgrader struct {
+	log    zerolog.Logger
+	config config.BabbleConfig
+	db     *databases.Databases
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewRoomUpgrader(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+) *RoomUpgrader {
+	log := logger.With().
+		Str("worker", "RoomUpgrader").
+		Logger()
+
+	return &RoomUpgrader{
+		log:    log,
+		config: cfg,
+		db:     db,
+	}
+}
+
+func (ru *RoomUpgrader) Start() {
+	ru.ctx, ru.cancel = context.WithCancel(ru.log.WithContext(context.Background()))
+	ru.log.Info().Msg("Starting room upgrader...")
+	ru.wg.Add(1)
+	go ru.resumeUpgradesLoop()
+}
+
+func (ru *RoomUpgrader) Stop() {
+	ru.cancel()
+	ru.wg.Wait()
+	ru.log.Info().Msg("Room upgrader stopped")
+}
+
+func (ru *RoomUpgrader) resumeUpgradesLoop() {
+	defer ru.wg.Done()
+
+	for {
+		select {
+		case <-ru.ctx.Done():
+			return
+		case <-time.After(roomUpgradesPollInterval):
+		}
+
+		upgrades, err := ru.db.Rooms.GetPendingRoomUpgrades(ru.ctx)
+		if err != nil {
+			ru.log.Err(err).Msg("Failed to get pending room upgrades")
+			continue
+		}
+
+		for _, upgrade := range upgrades {
+			log := ru.log.With().Stringer("room_id", upgrade.RoomID).Logger()
+			if err := ru.db.Rooms.RunRoomUpgrade(log.WithContext(ru.ctx), upgrade); err != nil {
+				log.Err(err).Msg("Failed to resume room upgrade")
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/notifier"
+	"github.com/beeper/babbleserv/internal/types"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	searchIndexerLockName    = "SearchIndexerLock"
+	searchIndexerLockRefresh = time.Second * 5
+	searchIndexerLockTimeout = time.Second * 10
+	searchIndexerBatchSize   = 50
+)
+
+// The search indexer is a singleton background worker that, like the events
+// iterator, iterates over all events and adds them to the full text search
+// index, removing redacted events from it.
+type SearchIndexer struct {
+	log      zerolog.Logger
+	config   config.BabbleConfig
+	db       *databases.Databases
+	notifier *notifier.Notifier
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewSearchIndexer(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+	notif *notifier.Notifier,
+) *SearchIndexer {
+	log := logger.With().
+		Str("worker", "SearchIndexer").
+		Logger()
+
+	return &SearchIndexer{
+		log:      log,
+		config:   cfg,
+		db:       db,
+		notifier: notif,
+	}
+}
+
+func (si *SearchIndexer) Start() {
+	si.ctx, si.cancel = context.WithCancel(si.log.WithContext(context.Background()))
+
+	si.wg.Add(1)
+	go func() {
+		defer si.wg.Done()
+		lock.WithLock(si.ctx, si.db.Rooms, searchIndexerLockName, lock.LockOptions{
+			RefreshInterval: searchIndexerLockRefresh,
+			Timeout:         searchIndexerLockTimeout,
+		}, si.indexNewEventsLoop)
+	}()
+}
+
+func (si *SearchIndexer) Stop() {
+	si.cancel()
+	si.wg.Wait()
+	si.log.Info().Msg("Search indexer stopped")
+}
+
+func (si *SearchIndexer) indexNewEventsLoop(lock lock.Lock) {
+	newEventsCh := make(chan any, 1)
+	si.notifier.Subscribe(newEventsCh, notifier.Subscription{AllEvents: true})
+	defer si.notifier.Unsubscribe(newEventsCh)
+
+	// Cold start case: index anything waiting right away
+	si.indexNewEvents(lock)
+
+	for {
+		select {
+		case <-si.ctx.Done():
+			lock.Release()
+			return
+		case <-newEventsCh:
+			si.indexNewEvents(lock)
+		case <-time.After(searchIndexerLockRefresh):
+			lock.Refresh()
+		}
+	}
+}
+
+func (si *SearchIndexer) indexNewEvents(lock lock.Lock) {
+	currentVersion, err := si.db.Rooms.GetSearchIndexerPosition(si.ctx)
+	if err != nil {
+		si.log.Err(err).Msg("Failed to get current position")
+		return
+	}
+
+	for {
+		lock.Refresh()
+
+		newEventIDTups, err := si.db.Rooms.EventsIteratorPaginateEvents(si.ctx, currentVersion, searchIndexerBatchSize)
+		if err != nil {
+			si.log.Err(err).Msg("Failed to paginate new events")
+			return
+		} else if len(newEventIDTups) == 0 {
+			return
+		}
+
+		si.log.Debug().
+			Int("events", len(newEventIDTups)).
+			Any("fromVersion", currentVersion).
+			Msg("Indexing new events batch")
+
+		// Index and update the position in one transaction, refreshing the lock
+		// as part of it to ensure the write is safe.
+		if err := si.db.Rooms.IndexEventsForSearch(si.ctx, newEventIDTups, lock.TxnRefresh); err != nil {
+			si.log.Err(err).Msg("Failed to index events batch, indexing events individually")
+			if !si.indexEventsIndividually(lock, newEventIDTups) {
+				return
+			}
+		}
+
+		currentVersion = newEventIDTups[len(newEventIDTups)-1].Version
+		currentVersion.UserVersion += 1
+
+		if len(newEventIDTups) < searchIndexerBatchSize {
+			return
+		}
+	}
+}
+
+// Index a batch that failed one event at a time, skipping any event that still
+// fails. Transient errors are already retried by the transaction, so an event
+// that fails on its own would otherwise block the indexer forever. Returns
+// false if indexing should stop.
+func (si *SearchIndexer) indexEventsIndividually(lock lock.Lock, tups []types.EventIDTupWithVersion) bool {
+	for _, tup := range tups {
+		if si.ctx.Err() != nil {
+			return false
+		}
+		err := si.db.Rooms.IndexEventsForSearch(si.ctx, []types.EventIDTupWithVersion{tup}, lock.TxnRefresh)
+		if err == nil {
+			continue
+		}
+		si.log.Err(err).
+			Str("event_id", tup.EventID.String()).
+			Msg("Failed to index event, skipping")
+		if err := si.db.Rooms.SkipEventForSearch(si.ctx, tup, lock.TxnRefresh); err != nil {
+			si.log.Err(err).Msg("Failed to skip event")
+			return false
+		}
+	}
+	return true
+}
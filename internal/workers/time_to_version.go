@@ -0,0 +1,109 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/beeper/babbleserv/internal/config"
+	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/util/lock"
+)
+
+const (
+	timeToVersionPrunerLockName    = "TimeToVersionPrunerLock"
+	timeToVersionPrunerLockRefresh = time.Second * 30
+	timeToVersionPrunerLockTimeout = time.Minute * 5
+	timeToVersionPruneInterval     = time.Minute * 10
+)
+
+// Every write transaction adds a time to version key (see util.DoWriteTransaction),
+// older keys are progressively pruned to a coarser granularity. Each tier keeps
+// one key per granularity for keys older than the age.
+var timeToVersionPruneTiers = []struct {
+	age, granularity time.Duration
+}{
+	{time.Hour, time.Second},
+	{time.Hour * 24, time.Minute},
+	{time.Hour * 24 * 30, time.Hour},
+}
+
+type TimeToVersionPruner struct {
+	log    zerolog.Logger
+	config config.BabbleConfig
+	db     *databases.Databases
+
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewTimeToVersionPruner(
+	logger zerolog.Logger,
+	cfg config.BabbleConfig,
+	db *databases.Databases,
+) *TimeToVersionPruner {
+	log := logger.With().
+		Str("worker", "TimeToVersionPruner").
+		Logger()
+
+	return &TimeToVersionPruner{
+		log:    log,
+		config: cfg,
+		db:     db,
+	}
+}
+
+func (tp *TimeToVersionPruner) Start() {
+	tp.ctx, tp.cancel = context.WithCancel(tp.log.WithContext(context.Background()))
+	tp.log.Info().Msg("Starting time to version pruner...")
+	tp.wg.Add(1)
+	go tp.pruneLoop()
+}
+
+func (tp *TimeToVersionPruner) Stop() {
+	tp.cancel()
+	tp.wg.Wait()
+	tp.log.Info().Msg("Time to version pruner stopped")
+}
+
+func (tp *TimeToVersionPruner) pruneLoop() {
+	defer tp.wg.Done()
+
+	for {
+		select {
+		case <-tp.ctx.Done():
+			return
+		case <-time.After(timeToVersionPruneInterval):
+		}
+
+		if err := lock.WithLockIfAvailable(tp.ctx, tp.db.Rooms, timeToVersionPrunerLockName, lock.LockOptions{
+			RefreshInterval: timeToVersionPrunerLockRefresh,
+			Timeout:         timeToVersionPrunerLockTimeout,
+		}, func(lock lock.Lock) {
+			defer lock.Release()
+			tp.prune(lock)
+		}); err != nil {
+			tp.log.Err(err).Msg("Error acquiring time to version pruner lock")
+		}
+	}
+}
+
+func (tp *TimeToVersionPruner) prune(lock lock.Lock) {
+	now := time.Now()
+	for _, tier := range timeToVersionPruneTiers {
+		cleared, err := tp.db.Rooms.PruneTimeToVersion(tp.ctx, now.Add(-tier.age), tier.granularity, lock.Refresh)
+		if err != nil {
+			tp.log.Err(err).
+				Str("granularity", tier.granularity.String()).
+				Msg("Failed to prune time to version keys")
+			return
+		}
+		tp.log.Debug().
+			Int("cleared", cleared).
+			Str("granularity", tier.granularity.String()).
+			Msg("Pruned time to version keys")
+	}
+}
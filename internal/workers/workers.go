@@ -6,6 +6,8 @@ import (
 
 	"github.com/beeper/babbleserv/internal/config"
 	"github.com/beeper/babbleserv/internal/databases"
+	"github.com/beeper/babbleserv/internal/federator"
+	"github.com/beeper/babbleserv/internal/media"
 	"github.com/beeper/babbleserv/internal/notifier"
 )
 
@@ -30,6 +32,8 @@ func NewWorkers(
 	db *databases.Databases,
 	notif *notifier.Notifier,
 	fclient fclient.FederationClient,
+	federator *federator.Federator,
+	media *media.MediaRepo,
 ) *Workers {
 	log := logger.With().
 		Str("component", "workers").
@@ -37,7 +41,18 @@ func NewWorkers(
 
 	workers := []Worker{
 		NewEventsIterator(log, cfg, db, notif),
+		NewSearchIndexer(log, cfg, db, notif),
+		NewPushEvaluator(log, cfg, db, notif),
+		NewPushSender(log, cfg, db, notif),
 		NewFederationSender(log, cfg, db, notif, fclient),
+		NewFederationInbox(log, cfg, db, notif, federator),
+		NewPartialStateResyncer(log, cfg, db, notif, federator),
+		NewRoomUpgrader(log, cfg, db),
+		NewProfileUpdater(log, cfg, db),
+		NewTimeToVersionPruner(log, cfg, db),
+		NewRemoteMediaExpirer(log, cfg, db, media),
+		NewRoomPeekPruner(log, cfg, db),
+		NewBackfiller(log, cfg, db),
 	}
 
 	return &Workers{